@@ -0,0 +1,42 @@
+package main
+
+import "time"
+
+// With ADAPTIVE_SYNC_MIN and ADAPTIVE_SYNC_MAX, the sync period follows the change rate: a cycle
+// that changed anything halves it (down to the minimum), a quiet one stretches it by half (up to
+// the maximum). Failed cycles leave it alone, as they say nothing about the change rate.
+
+type syncInterval struct {
+	current time.Duration
+}
+
+// newSyncInterval starts at period, within the adaptive bounds
+func newSyncInterval(period time.Duration) *syncInterval {
+	if cfg.SyncPeriodMax > 0 {
+		period = min(max(period, cfg.SyncPeriodMin), cfg.SyncPeriodMax)
+	}
+	return &syncInterval{current: period}
+}
+
+// adjust picks the period after a cycle, reporting whether it changed
+func (s *syncInterval) adjust(result SyncResult, ok bool) (time.Duration, bool) {
+	if cfg.SyncPeriodMax <= 0 || !ok {
+		return s.current, false
+	}
+
+	var next time.Duration
+	if result.Added+result.Changed+result.Deleted > 0 {
+		next = max(s.current/2, cfg.SyncPeriodMin)
+	} else {
+		next = min(s.current*3/2, cfg.SyncPeriodMax)
+	}
+	changed := next != s.current
+	s.current = next
+	return next, changed
+}
+
+// longestSyncPeriod is the longest the sync thread may go between cycles, which the watchdog and
+// /healthz judge stalls by
+func longestSyncPeriod() time.Duration {
+	return max(syncPeriod, cfg.SyncPeriodMax)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewSyncInterval(t *testing.T) {
+	useConfig(t, map[string]string{"ADAPTIVE_SYNC_MIN": "1m", "ADAPTIVE_SYNC_MAX": "10m"})
+	for period, want := range map[time.Duration]time.Duration{
+		30 * time.Second: time.Minute,
+		5 * time.Minute:  5 * time.Minute,
+		time.Hour:        10 * time.Minute,
+	} {
+		if got := newSyncInterval(period).current; got != want {
+			t.Errorf("newSyncInterval(%v) starts at %v, want %v", period, got, want)
+		}
+	}
+
+	useConfig(t, map[string]string{"ADAPTIVE_SYNC_MIN": "0s", "ADAPTIVE_SYNC_MAX": "0s"})
+	if got := newSyncInterval(time.Hour).current; got != time.Hour {
+		t.Errorf("newSyncInterval without adaptive sync starts at %v, want the period as is", got)
+	}
+}
+
+func TestSyncIntervalAdjust(t *testing.T) {
+	busy := SyncResult{Changed: 1}
+	for _, tt := range []struct {
+		name    string
+		current time.Duration
+		result  SyncResult
+		ok      bool
+		want    time.Duration
+		changed bool
+	}{
+		{"busy halves", 4 * time.Minute, busy, true, 2 * time.Minute, true},
+		{"busy stops at the minimum", 90 * time.Second, busy, true, time.Minute, true},
+		{"busy at the minimum", time.Minute, busy, true, time.Minute, false},
+		{"deletions count as changes", 4 * time.Minute, SyncResult{Deleted: 1}, true, 2 * time.Minute, true},
+		{"errors alone don't", 4 * time.Minute, SyncResult{Errors: 3}, true, 6 * time.Minute, true},
+		{"quiet stretches by half", 4 * time.Minute, SyncResult{}, true, 6 * time.Minute, true},
+		{"quiet stops at the maximum", 8 * time.Minute, SyncResult{}, true, 10 * time.Minute, true},
+		{"quiet at the maximum", 10 * time.Minute, SyncResult{}, true, 10 * time.Minute, false},
+		{"failed cycle", 4 * time.Minute, busy, false, 4 * time.Minute, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, map[string]string{"ADAPTIVE_SYNC_MIN": "1m", "ADAPTIVE_SYNC_MAX": "10m"})
+			interval := &syncInterval{current: tt.current}
+			got, changed := interval.adjust(tt.result, tt.ok)
+			if got != tt.want || changed != tt.changed {
+				t.Errorf("adjust = %v, %v, want %v, %v", got, changed, tt.want, tt.changed)
+			}
+			if interval.current != got {
+				t.Errorf("current = %v after adjust returned %v", interval.current, got)
+			}
+		})
+	}
+}
+
+func TestSyncIntervalFixed(t *testing.T) {
+	useConfig(t, map[string]string{"ADAPTIVE_SYNC_MIN": "0s", "ADAPTIVE_SYNC_MAX": "0s"})
+	interval := &syncInterval{current: 5 * time.Minute}
+	for _, result := range []SyncResult{{Added: 1}, {}} {
+		if got, changed := interval.adjust(result, true); got != 5*time.Minute || changed {
+			t.Errorf("adjust(%v) without adaptive sync = %v, %v, want the period unchanged", result, got, changed)
+		}
+	}
+}
+
+func TestLongestSyncPeriod(t *testing.T) {
+	useConfig(t, map[string]string{"ADAPTIVE_SYNC_MIN": "0s", "ADAPTIVE_SYNC_MAX": "0s"})
+	if got := longestSyncPeriod(); got != syncPeriod {
+		t.Errorf("longestSyncPeriod without adaptive sync = %v, want %v", got, syncPeriod)
+	}
+	useConfig(t, map[string]string{"ADAPTIVE_SYNC_MIN": "1m", "ADAPTIVE_SYNC_MAX": "30m"})
+	if got := longestSyncPeriod(); got != 30*time.Minute {
+		t.Errorf("longestSyncPeriod = %v, want ADAPTIVE_SYNC_MAX", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Sync records each pilot it adds, changes or deletes in a sorted set scored by time (unix
+// milliseconds), so "what changed in the last hour" can be answered after the fact. The log is
+// capped to AUDIT_LOG_MAX_ENTRIES entries and AUDIT_LOG_MAX_AGE.
+
+// PilotChange is one entry of the pilot audit log
+type PilotChange struct {
+	Event    string    `json:"event"` // added, changed, renamed or deleted
+	Username string    `json:"username"`
+	From     string    `json:"from,omitempty"` // the previous username of a renamed pilot
+	At       time.Time `json:"at"`
+}
+
+// recordPilotChanges appends a sync cycle's changes to the audit log and trims it
+func recordPilotChanges(ctx context.Context, rdb *redis.Client, changes []PilotChange) error {
+	if cfg.AuditLogMaxEntries == 0 || len(changes) == 0 {
+		return nil
+	}
+
+	members := make([]redis.Z, 0, len(changes))
+	for _, change := range changes {
+		// The timestamp (to the nanosecond) keeps repeated changes of a pilot distinct members
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		members = append(members, redis.Z{Score: float64(change.At.UnixMilli()), Member: data})
+	}
+
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, pilotChangesKey, members...)
+		if cfg.AuditLogMaxAge > 0 {
+			cutoff := time.Now().Add(-cfg.AuditLogMaxAge).UnixMilli()
+			pipe.ZRemRangeByScore(ctx, pilotChangesKey, "-inf", "("+strconv.FormatInt(cutoff, 10))
+		}
+		pipe.ZRemRangeByRank(ctx, pilotChangesKey, 0, int64(-cfg.AuditLogMaxEntries-1))
+		return nil
+	})
+	return err
+}
+
+// PilotChangesSince lists the audit log entries at or after since, oldest first
+func PilotChangesSince(ctx context.Context, rdb *redis.Client, since time.Time) ([]PilotChange, error) {
+	members, err := rdb.ZRangeByScore(ctx, pilotChangesKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(since.UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]PilotChange, 0, len(members))
+	for _, member := range members {
+		var change PilotChange
+		if err := json.Unmarshal([]byte(member), &change); err != nil {
+			return nil, fmt.Errorf("invalid audit log entry %q: %w", member, err)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// RunChanges writes the pilot changes since a time, one JSON object per line. The argument is
+// either a duration back from now or an RFC 3339 time. Usage: changes [1h|2006-01-02T15:04:05Z]
+func RunChanges(ctx context.Context, rdb *redis.Client, args []string, out io.Writer) error {
+	since := time.Now().Add(-time.Hour)
+	if len(args) > 1 {
+		return fmt.Errorf("usage: changes [duration|time]")
+	}
+	if len(args) == 1 {
+		if ago, err := time.ParseDuration(args[0]); err == nil {
+			since = time.Now().Add(-ago)
+		} else if since, err = time.Parse(time.RFC3339, args[0]); err != nil {
+			return fmt.Errorf("invalid time %q (expected a duration or RFC 3339)", args[0])
+		}
+	}
+
+	changes, err := PilotChangesSince(ctx, rdb, since)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	for _, change := range changes {
+		if err := enc.Encode(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncRecordsPilotChanges(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK}
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK}
+	pilot_hashes := map[string]pilotHash{}
+	start := time.Now()
+
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice, bob}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	alice.PersonalData = `{"name":"Alice Smith"}`
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	// Unchanged: nothing recorded
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("third cycle: %v", err)
+	}
+
+	changes, err := PilotChangesSince(ctx, rdb, start.Add(-time.Millisecond))
+	if err != nil {
+		t.Fatalf("PilotChangesSince: %v", err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, change.Event+" "+change.Username)
+		if change.At.Before(start.Add(-time.Millisecond)) {
+			t.Errorf("%s %s recorded at %v, before the sync", change.Event, change.Username, change.At)
+		}
+	}
+	// Each change is timed as it's written, so a cycle's changes have no set order
+	slices.Sort(got[:2])
+	slices.Sort(got[2:])
+	if want := []string{"added alice", "added bob", "changed alice", "deleted bob"}; !slices.Equal(got, want) {
+		t.Fatalf("changes = %v, want %v", got, want)
+	}
+}
+
+func TestPilotChangesTrimmed(t *testing.T) {
+	useConfig(t, map[string]string{"AUDIT_LOG_MAX_ENTRIES": "3", "AUDIT_LOG_MAX_AGE": "1h"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	now := time.Now()
+	var changes []PilotChange
+	for i, ago := range []time.Duration{2 * time.Hour, 50 * time.Minute, 40 * time.Minute, 30 * time.Minute, 20 * time.Minute} {
+		changes = append(changes, PilotChange{Event: "added", Username: string(rune('a' + i)), At: now.Add(-ago)})
+	}
+	if err := recordPilotChanges(ctx, rdb, changes); err != nil {
+		t.Fatalf("recordPilotChanges: %v", err)
+	}
+
+	// Too old, then too many: only the newest 3 are kept
+	kept, err := PilotChangesSince(ctx, rdb, time.Time{})
+	if err != nil {
+		t.Fatalf("PilotChangesSince: %v", err)
+	}
+	var usernames []string
+	for _, change := range kept {
+		usernames = append(usernames, change.Username)
+	}
+	if !slices.Equal(usernames, []string{"c", "d", "e"}) {
+		t.Fatalf("kept %v, want [c d e]", usernames)
+	}
+
+	useConfig(t, map[string]string{"AUDIT_LOG_MAX_ENTRIES": "0"})
+	if err := recordPilotChanges(ctx, rdb, []PilotChange{{Event: "added", Username: "f", At: now}}); err != nil {
+		t.Fatalf("recordPilotChanges: %v", err)
+	}
+	if len(fr.zset(0, pilotChangesKey)) != 3 {
+		t.Fatal("recorded a change with the audit log disabled")
+	}
+}
+
+func TestRunChanges(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	now := time.Now()
+	recordPilotChanges(ctx, rdb, []PilotChange{
+		{Event: "deleted", Username: "old", At: now.Add(-3 * time.Hour)},
+		{Event: "added", Username: "recent", At: now.Add(-30 * time.Minute)},
+	})
+
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"recent"}},
+		{[]string{"4h"}, []string{"old", "recent"}},
+		{[]string{now.Add(-4 * time.Hour).UTC().Format(time.RFC3339)}, []string{"old", "recent"}},
+		{[]string{"10m"}, nil},
+	} {
+		out := &strings.Builder{}
+		if err := RunChanges(ctx, rdb, tt.args, out); err != nil {
+			t.Fatalf("RunChanges %v: %v", tt.args, err)
+		}
+		var usernames []string
+		for line := range strings.Lines(out.String()) {
+			var change PilotChange
+			if err := json.Unmarshal([]byte(line), &change); err != nil {
+				t.Fatalf("RunChanges %v printed %q: %v", tt.args, line, err)
+			}
+			usernames = append(usernames, change.Username)
+		}
+		if !slices.Equal(usernames, tt.want) {
+			t.Errorf("RunChanges %v = %v, want %v", tt.args, usernames, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{{"yesterday"}, {"1h", "2h"}} {
+		if err := RunChanges(ctx, rdb, args, &strings.Builder{}); err == nil {
+			t.Errorf("RunChanges accepted %v", args)
+		}
+	}
+}
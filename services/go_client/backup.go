@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backups hold every cached pilot hash and embedding in one versioned JSON document. Pilots are
+// stored by username rather than key, so a backup restores under whatever KEY_SCHEME the
+// importing device uses; embeddings are stored decoded and re-encoded on import.
+
+const backupVersion = 1
+
+type Backup struct {
+	Version    int           `json:"version"`
+	ExportedAt time.Time     `json:"exported_at"`
+	Pilots     []BackupPilot `json:"pilots"`
+}
+
+type BackupPilot struct {
+	Username string            `json:"username"`
+	Fields   map[string]string `json:"fields"`
+	// When the fields with a TTL (the authenticated flag and its signature) expire, so restored
+	// ones don't outlive the originals
+	FieldExpires map[string]time.Time `json:"field_expires,omitempty"`
+	Embedding    []float64            `json:"embedding,omitempty"`
+}
+
+// RunExport snapshots all cached pilots into a backup file. Usage: export <file>
+func RunExport(ctx context.Context, rdb *redis.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: export <file>")
+	}
+
+	pilots, err := readBackupPilots(ctx, rdb)
+	if err != nil {
+		return err
+	}
+	backup := Backup{Version: backupVersion, ExportedAt: time.Now().UTC(), Pilots: pilots}
+
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+
+	// Write next to the destination and rename, so an interrupted export never leaves a torn file
+	tmp, err := os.CreateTemp(filepath.Dir(args[0]), ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), args[0]); err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d pilot(s) to %s\n", len(backup.Pilots), args[0])
+	return nil
+}
+
+// readBackupPilots reads every cached pilot of rdb, with its profile decrypted and its embedding
+// decoded
+func readBackupPilots(ctx context.Context, rdb *redis.Client) ([]BackupPilot, error) {
+	pilots := make([]BackupPilot, 0)
+	iter := rdb.Scan(ctx, 0, pilotKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		username, ok := usernameFromKey(iter.Val(), pilotKey)
+		if !ok {
+			continue
+		}
+		fields, err := rdb.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", iter.Val(), err)
+		}
+
+		// Backups hold plaintext, so they restore under whatever key the importing device uses
+		if err := openProfileField(fields); err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", iter.Val(), err)
+		}
+		pilot := BackupPilot{Username: username, Fields: fields}
+		if pilot.FieldExpires, err = fieldExpiries(ctx, rdb, iter.Val(), fields); err != nil {
+			return nil, fmt.Errorf("failed to read field TTLs of %s: %w", iter.Val(), err)
+		}
+		value, err := rdb.Get(ctx, embeddingKey(username)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to read embedding for %q: %w", username, err)
+		}
+		if err == nil {
+			if pilot.Embedding, err = decodeStoredEmbedding(value); err != nil {
+				return nil, fmt.Errorf("invalid stored embedding for %q: %w", username, err)
+			}
+		}
+		pilots = append(pilots, pilot)
+	}
+	return pilots, iter.Err()
+}
+
+// fieldExpiries looks up when the fields of a pilot hash with a TTL expire. Fields that expired
+// since they were read are removed from fields.
+func fieldExpiries(ctx context.Context, rdb *redis.Client, key string, fields map[string]string) (map[string]time.Time, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	names := slices.Sorted(maps.Keys(fields))
+	ttls, err := rdb.HPTTL(ctx, key, names...).Result()
+	if err != nil {
+		// Redis before 7.4 has no field TTLs to keep
+		if strings.HasPrefix(err.Error(), "ERR unknown command") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var expires map[string]time.Time
+	now := time.Now()
+	for i, ttl := range ttls {
+		switch {
+		case ttl == -2:
+			delete(fields, names[i])
+		case ttl >= 0:
+			if expires == nil {
+				expires = map[string]time.Time{}
+			}
+			expires[names[i]] = now.Add(time.Duration(ttl) * time.Millisecond).UTC()
+		}
+	}
+	return expires, nil
+}
+
+// RunImport restores the pilots of a backup file, replacing their cached state. Pilots that
+// aren't in the backup are left alone. Usage: import <file>
+func RunImport(ctx context.Context, rdb *redis.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import <file>")
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var backup Backup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return fmt.Errorf("invalid backup file: %w", err)
+	}
+	if backup.Version != backupVersion {
+		return fmt.Errorf("unsupported backup version %d (expected %d)", backup.Version, backupVersion)
+	}
+
+	for _, pilot := range backup.Pilots {
+		if !validUsername(pilot.Username) {
+			return fmt.Errorf("backup contains invalid username %q", pilot.Username)
+		}
+		if err := restoreBackupPilot(ctx, rdb, pilot); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Imported %d pilot(s) from %s (exported %s)\n", len(backup.Pilots), args[0], backup.ExportedAt.Format(time.RFC3339))
+	return nil
+}
+
+// restoreBackupPilot replaces the cached state of a pilot with pilot, keyed by the current
+// KEY_SCHEME and encrypted under the current ENCRYPTION_KEY. Fields with a TTL get what's left
+// of it, in the same transaction, and are left out once expired.
+func restoreBackupPilot(ctx context.Context, rdb *redis.Client, pilot BackupPilot) error {
+	fields := make(map[string]any, len(pilot.Fields))
+	ttls := map[string]time.Duration{}
+	for name, value := range pilot.Fields {
+		if expires, ok := pilot.FieldExpires[name]; ok {
+			ttl := time.Until(expires)
+			if ttl <= 0 {
+				continue
+			}
+			ttls[name] = ttl
+		}
+		fields[name] = value
+	}
+	if data, ok := pilot.Fields["personal_data"]; ok {
+		fields["personal_data"] = ProfileData(data)
+	}
+
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, pilotKey(pilot.Username), embeddingKey(pilot.Username))
+		if len(fields) != 0 {
+			pipe.HSet(ctx, pilotKey(pilot.Username), fields)
+		}
+		for name, ttl := range ttls {
+			pipe.HPExpire(ctx, pilotKey(pilot.Username), ttl, name)
+		}
+		if pilot.Embedding != nil {
+			value, err := encodeStoredEmbedding(pilot.Embedding)
+			if err != nil {
+				return err
+			}
+			pipe.Set(ctx, embeddingKey(pilot.Username), value, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore %q: %w", pilot.Username, err)
+	}
+	return nil
+}
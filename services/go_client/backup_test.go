@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "pilots.json")
+
+	// Exported from a flat, unencrypted cache...
+	useConfig(t, nil)
+	source := newFakeRedis(t)
+	src := source.client(0)
+	alice := PilotInfo{Username: "alice", FlightID: "1700000000000000000", PersonalData: `{"name":"Alice"}`, Embedding: []float64{0.25, -1, 3e-3}, Status: PilotStatusOK, Authenticated: true}
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusNoEmbedding}
+	for _, pilot := range []PilotInfo{alice, bob} {
+		if err := writePilotParts(ctx, src, pilot, true, true); err != nil {
+			t.Fatalf("seeding %s: %v", pilot.Username, err)
+		}
+	}
+	if err := RunExport(ctx, src, []string{file}); err != nil {
+		t.Fatalf("RunExport: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(file)); len(entries) != 1 {
+		t.Fatalf("export left %d files behind", len(entries))
+	}
+	exported := map[string]map[string]string{}
+	for _, username := range []string{"alice", "bob"} {
+		exported[username] = source.hash(0, pilotKey(username))
+	}
+
+	// ...into a cluster-keyed, encrypted one, where alice has stale state and carol isn't in the backup
+	useConfig(t, map[string]string{"KEY_SCHEME": "cluster", "ENCRYPTION_KEY": base64.StdEncoding.EncodeToString(make([]byte, 32)), "ENCRYPT_PROFILES": "true"})
+	target := newFakeRedis(t)
+	dst := target.client(0)
+	dst.HSet(ctx, pilotKey("alice"), "pilot_username", "alice", "stale", "true")
+	dst.HSet(ctx, pilotKey("carol"), "pilot_username", "carol")
+	if err := RunImport(ctx, dst, []string{file}); err != nil {
+		t.Fatalf("RunImport: %v", err)
+	}
+
+	for username, want := range exported {
+		fields := target.hash(0, pilotKey(username))
+		if strings.Contains(fields["personal_data"], "name") {
+			t.Errorf("%s's profile imported unencrypted", username)
+		}
+		if err := openProfileField(fields); err != nil {
+			t.Fatalf("decrypting %s's profile: %v", username, err)
+		}
+		if !reflect.DeepEqual(fields, want) {
+			t.Errorf("%s imported as %v, want %v", username, fields, want)
+		}
+	}
+	value, ok := target.get(0, embeddingKey("alice"))
+	if !ok {
+		t.Fatal("alice's embedding not imported")
+	}
+	if embedding, err := decodeStoredEmbedding(value); err != nil || !slices.Equal(embedding, alice.Embedding) {
+		t.Errorf("alice's embedding imported as %v (%v), want %v", embedding, err, alice.Embedding)
+	}
+	if target.exists(0, embeddingKey("bob")) {
+		t.Error("bob got an embedding")
+	}
+	if !target.exists(0, pilotKey("carol")) {
+		t.Error("import removed a pilot that isn't in the backup")
+	}
+}
+
+func TestImportRejectsBadBackups(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name, data, err string
+	}{
+		{"not JSON", "pilots", "invalid backup file"},
+		{"future version", `{"version": 2, "pilots": []}`, "unsupported backup version 2"},
+		{"invalid username", `{"version": 1, "pilots": [{"username": "../x", "fields": {}}]}`, `invalid username "../x"`},
+	} {
+		file := filepath.Join(dir, tt.name+".json")
+		os.WriteFile(file, []byte(tt.data), 0o600)
+		if err := RunImport(context.Background(), fr.client(0), []string{file}); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: RunImport = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	if keys := fr.keys(0); len(keys) != 0 {
+		t.Errorf("rejected backups wrote %v", keys)
+	}
+	if err := RunImport(context.Background(), fr.client(0), nil); err == nil {
+		t.Error("RunImport without a file succeeded")
+	}
+}
+
+func TestBackupKeepsFieldTTLs(t *testing.T) {
+	useConfig(t, map[string]string{"AUTH_TTL_LOW": "1m", "PILOT_SIGNING_KEY": base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))})
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "pilots.json")
+	source := newFakeRedis(t)
+	src := source.client(0)
+	if err := updatePilot(withAuthTTL(ctx, authTTL("")), src, "alice", []any{"pilot_username", "alice", "authenticated", AuthFlag(true)}); err != nil {
+		t.Fatalf("authenticating alice: %v", err)
+	}
+	if err := updatePilot(ctx, src, "bob", []any{"pilot_username", "bob", "authenticated", AuthFlag(false)}); err != nil {
+		t.Fatalf("seeding bob: %v", err)
+	}
+	// Halfway to expiring when exported
+	source.advance(30 * time.Second)
+	if err := RunExport(ctx, src, []string{file}); err != nil {
+		t.Fatalf("RunExport: %v", err)
+	}
+
+	target := newFakeRedis(t)
+	dst := target.client(0)
+	if err := RunImport(ctx, dst, []string{file}); err != nil {
+		t.Fatalf("RunImport: %v", err)
+	}
+	for _, field := range []string{"authenticated", "signature"} {
+		if ttl := target.fieldTTL(0, pilotKey("alice"), field); ttl <= 0 || ttl > 30*time.Second {
+			t.Errorf("alice's %s expires in %v after the import, want what was left of the TTL", field, ttl)
+		}
+	}
+	if !VerifyPilotSignature(cfg.SigningKey, target.hash(0, pilotKey("alice"))) {
+		t.Error("alice's imported signature doesn't verify")
+	}
+	if ttl := target.fieldTTL(0, pilotKey("bob"), "authenticated"); ttl != 0 {
+		t.Errorf("bob's authenticated expires in %v, want no TTL as exported", ttl)
+	}
+
+	// Restored after the flag would have expired, it isn't restored at all
+	expired := BackupPilot{
+		Username:     "carol",
+		Fields:       map[string]string{"pilot_username": "carol", "authenticated": "true"},
+		FieldExpires: map[string]time.Time{"authenticated": time.Now().Add(-time.Second)},
+	}
+	if err := restoreBackupPilot(ctx, dst, expired); err != nil {
+		t.Fatalf("restoreBackupPilot: %v", err)
+	}
+	if fields := target.hash(0, pilotKey("carol")); fields["pilot_username"] != "carol" || fields["authenticated"] != "" {
+		t.Errorf("carol restored as %v, want her expired flag left out", fields)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
+)
+
+// With BATCH_FETCH_COMMAND, GetPilots pulls every pilot's files with one command instead of a
+// cat per file. The command prints one record per file that exists:
+//
+//	@@ <username> <file name> <length>\n<length bytes of content>\n
+//
+// Lengths rather than delimiters keep embeddings from being mistaken for headers. A pilot with
+// no record for a file doesn't have it; pilots missing from the batch altogether (listed after
+// it ran, or a partial batch) are fetched one file at a time as usual.
+
+// fetchBatch holds the files of a batch fetch by username, then file name
+type fetchBatch map[string]map[string][]byte
+
+type fetchBatchKey struct{}
+
+func withFetchBatch(ctx context.Context, batch fetchBatch) context.Context {
+	return context.WithValue(ctx, fetchBatchKey{}, batch)
+}
+
+// batchedFiles returns the batched files of a pilot, if the context carries a batch including them
+func batchedFiles(ctx context.Context, username string) (map[string][]byte, bool) {
+	batch, _ := ctx.Value(fetchBatchKey{}).(fetchBatch)
+	files, ok := batch[username]
+	return files, ok
+}
+
+// decodedEmbedding is the outcome of decoding a batched embedding ahead of its pilot's fetch
+type decodedEmbedding struct {
+	embedding []float64
+	err       error
+}
+
+type predecodedEmbeddingsKey struct{}
+
+func withPredecodedEmbeddings(ctx context.Context, decoded map[string]decodedEmbedding) context.Context {
+	return context.WithValue(ctx, predecodedEmbeddingsKey{}, decoded)
+}
+
+// predecodedEmbedding returns the decoded embedding of a pilot, if the context carries one
+func predecodedEmbedding(ctx context.Context, username string) (decodedEmbedding, bool) {
+	decoded, _ := ctx.Value(predecodedEmbeddingsKey{}).(map[string]decodedEmbedding)
+	embedding, ok := decoded[username]
+	return embedding, ok
+}
+
+// predecodeEmbeddings decodes the batched embeddings of usernames on up to GOMAXPROCS workers.
+// Each raw embedding is dropped from the batch once decoded, so the decoded copies replace the
+// raw ones rather than adding to them; fetchEmbedding looks the decoded one up first.
+func predecodeEmbeddings(batch fetchBatch, usernames []string) map[string]decodedEmbedding {
+	decoded := make(map[string]decodedEmbedding, len(usernames))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	for range min(runtime.GOMAXPROCS(0), len(usernames)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for username := range jobs {
+				// The same precedence as catHomeFile: the first listed file that exists
+				for _, name := range cfg.EmbeddingFilenames {
+					if data, ok := batch[username][name]; ok {
+						embedding, err := DecodeEmbedding(string(data))
+						mu.Lock()
+						decoded[username] = decodedEmbedding{embedding, err}
+						mu.Unlock()
+						break
+					}
+				}
+			}
+		}()
+	}
+	for _, username := range usernames {
+		jobs <- username
+	}
+	close(jobs)
+	wg.Wait()
+
+	for username := range decoded {
+		for _, name := range cfg.EmbeddingFilenames {
+			delete(batch[username], name)
+		}
+	}
+	return decoded
+}
+
+// runBatchFetch runs BATCH_FETCH_COMMAND and parses its output
+func runBatchFetch(ctx context.Context, api_client client.SocketClient) (fetchBatch, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, cfg.BatchFetchCommand, stdout, stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run batch fetch command: %w", err)
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("batch fetch command failed: %s", stderrSummary(stderr.String()))
+	}
+	return parseFetchBatch(stdout)
+}
+
+// parseFetchBatch parses batch fetch output. Anything malformed fails the whole batch, since a
+// misread length would shift every record after it.
+func parseFetchBatch(r io.Reader) (fetchBatch, error) {
+	batch := fetchBatch{}
+	reader := bufio.NewReader(r)
+	for {
+		header, err := reader.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return batch, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("truncated batch record header %q", header)
+		}
+
+		fields := strings.Fields(strings.TrimSuffix(header, "\n"))
+		if len(fields) != 4 || fields[0] != "@@" {
+			return nil, fmt.Errorf("invalid batch record header %q", header)
+		}
+		username, name := fields[1], fields[2]
+		if !validUsername(username) || !validFilename(name) {
+			return nil, fmt.Errorf("invalid batch record header %q", header)
+		}
+		length, err := strconv.Atoi(fields[3])
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid batch record length in %q", header)
+		}
+
+		content := make([]byte, length+1)
+		if _, err := io.ReadFull(reader, content); err != nil || content[length] != '\n' {
+			return nil, fmt.Errorf("truncated batch record for %s/%s", username, name)
+		}
+
+		if batch[username] == nil {
+			batch[username] = map[string][]byte{}
+		}
+		batch[username][name] = content[:length]
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// decodeSequentially decodes a batch the way fetchEmbedding would one pilot at a time
+func decodeSequentially(batch fetchBatch, usernames []string) map[string]decodedEmbedding {
+	decoded := map[string]decodedEmbedding{}
+	for _, username := range usernames {
+		for _, name := range cfg.EmbeddingFilenames {
+			if data, ok := batch[username][name]; ok {
+				embedding, err := DecodeEmbedding(string(data))
+				decoded[username] = decodedEmbedding{embedding, err}
+				break
+			}
+		}
+	}
+	return decoded
+}
+
+// cloneBatch copies a batch deep enough for predecodeEmbeddings to delete from
+func cloneBatch(batch fetchBatch) fetchBatch {
+	clone := fetchBatch{}
+	for username, files := range batch {
+		clone[username] = maps.Clone(files)
+	}
+	return clone
+}
+
+func testBatch(pilots, dimensions int) (fetchBatch, []string) {
+	batch := fetchBatch{}
+	usernames := make([]string, 0, pilots)
+	for i := range pilots {
+		username := fmt.Sprintf("pilot%d", i)
+		usernames = append(usernames, username)
+		values := make([]float64, dimensions)
+		for j := range values {
+			values[j] = rand.Float64()
+		}
+		batch[username] = map[string][]byte{"user.profile": []byte("name: " + username)}
+		switch i % 5 {
+		case 0, 1:
+			batch[username]["user.embedding"] = []byte(testEmbedding(values...))
+		case 2:
+			// Only the fallback file, with cat's line ending
+			batch[username]["face.embedding"] = []byte(testEmbedding(values...) + "\r\n")
+		case 3:
+			batch[username]["user.embedding"] = []byte("not base64!")
+		case 4:
+			// No embedding at all
+		}
+	}
+	// Listed, but missing from the batch
+	usernames = append(usernames, "unbatched")
+	return batch, usernames
+}
+
+func TestPredecodeEmbeddingsMatchesSequential(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_FILENAMES": "user.embedding,face.embedding"})
+	batch, usernames := testBatch(50, 16)
+	// Precedence: with both files, the first listed wins
+	batch["pilot0"]["face.embedding"] = []byte(testEmbedding(9, 9))
+
+	want := decodeSequentially(batch, usernames)
+	got := predecodeEmbeddings(batch, usernames)
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d embeddings, want %d", len(got), len(want))
+	}
+	for username, want := range want {
+		got := got[username]
+		if !reflect.DeepEqual(got.embedding, want.embedding) {
+			t.Errorf("%s: embedding %v, want %v", username, got.embedding, want.embedding)
+		}
+		if fmt.Sprint(got.err) != fmt.Sprint(want.err) {
+			t.Errorf("%s: error %v, want %v", username, got.err, want.err)
+		}
+	}
+
+	// Decoded embeddings replace the raw ones, and nothing else is dropped
+	for username, files := range batch {
+		if _, ok := want[username]; ok && (files["user.embedding"] != nil || files["face.embedding"] != nil) {
+			t.Errorf("%s: raw embedding still in the batch", username)
+		}
+		if files["user.profile"] == nil {
+			t.Errorf("%s: profile dropped from the batch", username)
+		}
+	}
+}
+
+func BenchmarkPredecodeEmbeddings(b *testing.B) {
+	useConfig(b, nil)
+	batch, usernames := testBatch(500, 512)
+	for _, bench := range []struct {
+		name   string
+		decode func(fetchBatch, []string) map[string]decodedEmbedding
+	}{
+		{"sequential", decodeSequentially},
+		{"pool", predecodeEmbeddings},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				bench.decode(cloneBatch(batch), usernames)
+			}
+		})
+	}
+}
+
+func TestParseFetchBatch(t *testing.T) {
+	embedding := testEmbedding(1, 2)
+	valid := "@@ alice user.profile 12\nname: Alice\n\n" +
+		"@@ alice user.embedding " + fmt.Sprint(len(embedding)) + "\n" + embedding + "\n" +
+		// Content that looks like a header is just content
+		"@@ bob user.profile 21\n@@ bob user.profile 1\n" +
+		"@@ carol user.profile 0\n\n"
+	batch, err := parseFetchBatch(strings.NewReader(valid))
+	if err != nil {
+		t.Fatalf("parseFetchBatch: %v", err)
+	}
+	want := fetchBatch{
+		"alice": {"user.profile": []byte("name: Alice\n"), "user.embedding": []byte(embedding)},
+		"bob":   {"user.profile": []byte("@@ bob user.profile 1")},
+		"carol": {"user.profile": []byte{}},
+	}
+	if !reflect.DeepEqual(batch, want) {
+		t.Fatalf("batch = %q, want %q", batch, want)
+	}
+
+	if batch, err := parseFetchBatch(strings.NewReader("")); err != nil || len(batch) != 0 {
+		t.Fatalf("empty batch = %v, %v", batch, err)
+	}
+
+	for name, output := range map[string]string{
+		"bad marker":          "## alice user.profile 1\nx\n",
+		"missing field":       "@@ alice 1\nx\n",
+		"bad length":          "@@ alice user.profile one\nx\n",
+		"negative length":     "@@ alice user.profile -1\n\n",
+		"unsafe username":     "@@ ../alice user.profile 1\nx\n",
+		"unsafe file name":    "@@ alice ../user.profile 1\nx\n",
+		"short content":       "@@ alice user.profile 10\nx\n",
+		"content overrun":     "@@ alice user.profile 1\nxy\n",
+		"unterminated header": "@@ alice user.profile 1",
+	} {
+		if _, err := parseFetchBatch(strings.NewReader(output)); err == nil {
+			t.Errorf("%s: parseFetchBatch(%q) succeeded", name, output)
+		}
+	}
+}
+
+func TestBatchFetch(t *testing.T) {
+	useConfig(t, map[string]string{"BATCH_FETCH_COMMAND": "fetch-all"})
+	useFetchSlots(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	cloud.addPilot("bob", "name: Bob\n", []float64{3, 4})
+	// bob was added after the batch was put together, so isn't in it
+	embedding := testEmbedding(1, 2)
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		return "@@ alice user.profile 12\nname: Alice\n\n@@ alice user.embedding " + fmt.Sprint(len(embedding)) + "\n" + embedding + "\n", "", 0, command == "fetch-all"
+	})
+
+	list, err := GetPilots(context.Background(), cloud.connect(), nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	if len(list.Pilots) != 2 || !slices.Equal(list.Pilots[0].Embedding, []float64{1, 2}) || !slices.Equal(list.Pilots[1].Embedding, []float64{3, 4}) {
+		t.Fatalf("pilots = %+v", list.Pilots)
+	}
+	if cloud.count("cat "+homeFile("alice", "")+"/") != 0 {
+		t.Errorf("alice's files were fetched one by one: %v", cloud.ran())
+	}
+	if cloud.count("cat "+homeFile("bob", "user.profile")) != 1 {
+		t.Errorf("bob, missing from the batch, wasn't fetched: %v", cloud.ran())
+	}
+
+	// A broken batch falls back to fetching every file
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		return "@@ alice user.profile 100\nname", "", 0, command == "fetch-all"
+	})
+	if list, err := GetPilots(context.Background(), cloud.connect(), nil); err != nil || len(list.Pilots) != 2 {
+		t.Fatalf("GetPilots with a broken batch = %+v, %v", list, err)
+	}
+	if cloud.count("cat "+homeFile("alice", "user.profile")) != 1 {
+		t.Errorf("alice wasn't fetched after the batch failed: %v", cloud.ran())
+	}
+}
@@ -0,0 +1,5 @@
+//go:build production
+
+package main
+
+const productionBuild = true
@@ -1,218 +1,674 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/binary"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"math"
+	"io"
+	"maps"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
 	"github.com/goccy/go-yaml"
 )
 
-func GetPilots(ctx context.Context, api_client client.SocketClient) ([]PilotInfo, error) {
-	pilots := make([]PilotInfo, 0)
+// ErrTransport marks failures of the socket itself (as opposed to a command exiting non-zero)
+var ErrTransport = errors.New("command transport failed")
 
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
-	status, err := api_client.RunCommand(ctx, client.CommandOptions{
-		Command: "pilots",
-		Stdin:   strings.NewReader(""),
-		Stdout:  stdout,
-		Stderr:  stderr,
-	})
+// ErrUnexpectedResponse marks output that isn't what the cloud sends, such as an HTML error page
+// from a proxy in front of it; it is never stored
+var ErrUnexpectedResponse = errors.New("unexpected response from cloud")
+
+// looksLikeHTML spots proxy error and maintenance pages, which YAML would happily parse as a string
+func looksLikeHTML(data []byte) bool {
+	start := bytes.ToLower(bytes.TrimSpace(data[:min(len(data), 512)]))
+	return bytes.HasPrefix(start, []byte("<!doctype html")) || bytes.HasPrefix(start, []byte("<html"))
+}
+
+// ErrOutputTooLarge marks a command aborted for passing MAX_COMMAND_OUTPUT. Like any abandoned
+// command it's also an ErrTransport, so the client it ran on is dropped.
+var ErrOutputTooLarge = errors.New("command output too large")
+
+// ErrEmbeddingDecode marks a user.embedding that was fetched but couldn't be decoded
+var ErrEmbeddingDecode = errors.New("invalid embedding")
+
+func runCommand(ctx context.Context, api_client client.SocketClient, command string, stdout, stderr io.Writer) (int, error) {
+	return runCommandWithInput(ctx, api_client, command, strings.NewReader(""), stdout, stderr)
+}
+
+// runCommandWithInput runs a command on the cloud shell. Commands that are safe to repeat (see
+// idempotentCommand) are retried up to COMMAND_RETRIES times when the transport fails before
+// they produced any output; anything else fails right away, and it's up to the caller to find
+// out what happened before trying again.
+//
+// Concurrency: a SocketClient may be shared by any number of goroutines. The client library runs
+// one command at a time per client (RunCommand holds a per-client lock until CommandFinished), so
+// concurrent callers queue rather than interleave, and PILOT_FETCH_CONCURRENCY > 1 buys
+// pipelining across clients, never parallel commands on one. The protocol doesn't tag output
+// with the command it belongs to, though: a command abandoned mid-run (its ctx ended) keeps
+// streaming to that client, where the next command could pick it up. Such failures come back
+// as ErrTransport, and callers must then stop using the client and Invalidate the session.
+func runCommandWithInput(ctx context.Context, api_client client.SocketClient, command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return runCommandAttempts(ctx, api_client.RunCommand, command, stdin, stdout, stderr)
+}
+
+// runCommandAttempts is runCommandWithInput with the client's RunCommand as run
+func runCommandAttempts(ctx context.Context, run func(context.Context, client.CommandOptions) (int, error), command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	// Nothing is sent for a ctx that's already done, so the client is still fine to use
+	if ctx.Err() != nil {
+		return 0, fmt.Errorf("not running %q: %w", command, context.Cause(ctx))
+	}
+
+	retries := 0
+	if idempotentCommand(command) {
+		retries = cfg.CommandRetries
+	}
+
+	var limit *outputLimit
+	if cfg.MaxCommandOutput > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		limit = &outputLimit{cancel: cancel}
+		limit.remaining.Store(int64(cfg.MaxCommandOutput))
+		stdout = limitedWriter{w: stdout, limit: limit}
+		stderr = limitedWriter{w: stderr, limit: limit}
+	}
+
+	commands_running.Add(1)
+	defer commands_running.Add(-1)
+
+	out := &countingWriter{w: stdout}
+	errout := &countingWriter{w: stderr}
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		status, err := runClosedSafe(ctx, run, client.CommandOptions{
+			Command: command,
+			Stdin:   stdin,
+			Stdout:  out,
+			Stderr:  errout,
+		})
+		recordCommand(ctx, command, time.Since(start))
+		if limit != nil && limit.exceeded.Load() {
+			// The library only reports the write error in its log, and lets the command finish
+			return status, fmt.Errorf("%w: %w: %q produced over %d bytes", ErrTransport, ErrOutputTooLarge, command, cfg.MaxCommandOutput)
+		}
+		if err == nil {
+			return status, nil
+		}
+
+		// Output already passed on can't be taken back, so a retry would duplicate it
+		if attempt >= retries || out.n != 0 || errout.n != 0 || ctx.Err() != nil {
+			return status, fmt.Errorf("%w: %w", ErrTransport, err)
+		}
+		debugCtxf(ctx, "Retrying %q after transport failure: %v", command, err)
+		time.Sleep(commandRetryDelay)
+	}
+}
+
+const commandRetryDelay = 200 * time.Millisecond
+
+// errClientClosed marks a command run on a client whose socket was already closed, such as the
+// fallback client failBack replaced while a caller still held it
+var errClientClosed = errors.New("client's socket is closed")
+
+// runClosedSafe is run, except that the panic the client library raises when a command is sent
+// on a closed socket comes back as errClientClosed
+func runClosedSafe(ctx context.Context, run func(context.Context, client.CommandOptions) (int, error), opt client.CommandOptions) (status int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if closed, ok := r.(runtime.Error); !ok || !strings.Contains(closed.Error(), "closed channel") {
+				panic(r)
+			}
+			err = errClientClosed
+		}
+	}()
+	return run(ctx, opt)
+}
+
+// commands_running counts the cloud commands in progress, on any client
+var commands_running atomic.Int64
+
+// idempotentCommand reports whether running command twice is the same as running it once.
+// Reads (cat, ls, pilots, echo) and mkdir -p are; tee isn't treated as such, because its stdin
+// is consumed by the first attempt and because a write that may or may not have landed needs
+// reconciling (e.g. createFlight picking a new flight ID on retry would leave a duplicate
+// flight). Configured commands (PILOT_COUNT_COMMAND, ...) are unknown, so never retried.
+// Chains joined with && are idempotent when every part is.
+func idempotentCommand(command string) bool {
+	for part := range strings.SplitSeq(command, "&&") {
+		part = strings.TrimSpace(part)
+		if cfg.FlightCommandPrefix != "" {
+			part = strings.TrimSpace(strings.TrimPrefix(part, cfg.FlightCommandPrefix+" "))
+		}
+		name, args, _ := strings.Cut(part, " ")
+		switch {
+		case name == "cat" || name == "ls" || name == "pilots" || name == "echo":
+		case name == "mkdir" && strings.HasPrefix(args, "-p "):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// outputLimit is the output budget shared by a command's stdout and stderr, which the client
+// library writes from separate goroutines. Going over it cancels the command.
+type outputLimit struct {
+	remaining atomic.Int64
+	exceeded  atomic.Bool
+	cancel    context.CancelFunc
+}
+
+type limitedWriter struct {
+	w     io.Writer
+	limit *outputLimit
+}
+
+func (l limitedWriter) Write(p []byte) (int, error) {
+	if l.limit.remaining.Add(-int64(len(p))) < 0 {
+		l.limit.exceeded.Store(true)
+		l.limit.cancel()
+		return 0, ErrOutputTooLarge
+	}
+	return l.w.Write(p)
+}
+
+// stderrSummary prepares a failed command's stderr for error messages, cut to MAX_STDERR_LOG
+// bytes so a command dumping a lot of output can't flood the logs
+func stderrSummary(stderr string) string {
+	stderr = strings.TrimSpace(stderr)
+	if cfg.MaxStderrLog <= 0 || len(stderr) <= cfg.MaxStderrLog {
+		return fmt.Sprintf("%q", stderr)
+	}
+	return fmt.Sprintf("%q... (%d more bytes truncated)", strings.ToValidUTF8(stderr[:cfg.MaxStderrLog], ""), len(stderr)-cfg.MaxStderrLog)
+}
+
+// GetPilots fetches the pilots the cloud lists, all of them or those rotation picks. A pilot that
+// fails to fetch is listed in Failed rather than failing the others, unless the client itself
+// failed.
+func GetPilots(ctx context.Context, api_client client.SocketClient, rotation *pilotRotation) (PilotList, error) {
+	list := PilotList{Pilots: make([]PilotInfo, 0), Complete: true}
+
+	usernames, err := listPilots(ctx, api_client)
 	if err != nil {
-		return nil, fmt.Errorf("failed to run pilots command: %w", err)
+		return PilotList{}, err
 	}
 
-	if status != 0 {
-		return nil, fmt.Errorf("pilots command failed: %w", err)
+	if err := verifyPilotList(ctx, api_client, usernames); errors.Is(err, ErrPilotListMismatch) {
+		logf(ctx, "warning: pilot deletions disabled this cycle: %v", err)
+		list.Complete = false
+	} else if err != nil {
+		return PilotList{}, err
 	}
 
-	for username := range strings.SplitSeq(strings.Trim(stdout.String(), "\r\n "), "\r\n") {
+	var fetch []string
+	fetch, list.Deferred = rotation.pick(ctx, dropCaseCollisions(ctx, usernames))
+
+	if cfg.BatchFetchCommand != "" {
+		if batch, err := runBatchFetch(ctx, api_client); err != nil {
+			logf(ctx, "warning: batch fetch failed, fetching pilots one by one: %v", err)
+		} else {
+			// Decoding is CPU work the serial fetches below would otherwise take turns at
+			ctx = withPredecodedEmbeddings(withFetchBatch(ctx, batch), predecodeEmbeddings(batch, fetch))
+		}
+	}
+	for _, username := range fetch {
 		info, err := GetPilotFromServer(ctx, api_client, username)
+		if errors.Is(err, ErrPilotRejected) {
+			logf(ctx, "warning: skipping pilot %q: %v", username, err)
+			continue
+		}
+		if errors.Is(err, ErrTransport) || ctx.Err() != nil {
+			// Every fetch after it would fail the same way
+			return PilotList{}, fmt.Errorf("failed to get pilot (%q): %w", username, err)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to get pilot (%q): %w", username, err)
+			logf(ctx, "failed to get pilot %q: %v", username, err)
+			list.Failed = append(list.Failed, username)
+			continue
 		}
-		pilots = append(pilots, *info)
+		list.Pilots = append(list.Pilots, *info)
 	}
 
-	return pilots, nil
+	return list, nil
 }
 
-func GetPilotFromServer(ctx context.Context, api_client client.SocketClient, username string) (*PilotInfo, error) {
-	stdout := &bytes.Buffer{}
+// ErrPilotsUnavailable marks an API account that can't run the pilots command at all: it lacks
+// the permission, or the cloud doesn't have the command. Retrying won't help until the account is
+// fixed, but the cache can still be served meanwhile.
+var ErrPilotsUnavailable = errors.New("API account can't run the pilots command (check its permissions on the cloud)")
+
+// commandUnavailable recognizes the cloud shell refusing a command, rather than the command failing
+func commandUnavailable(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, refusal := range []string{"permission denied", "not permitted", "command not found", "unknown command"} {
+		if strings.Contains(stderr, refusal) {
+			return true
+		}
+	}
+	return false
+}
+
+// listPilots streams the output of the pilots command line by line, so only the (de-duplicated)
+// usernames are held in memory rather than the whole raw listing. Fetching can't overlap with
+// listing: the socket client runs one command at a time.
+func listPilots(ctx context.Context, api_client client.SocketClient) ([]string, error) {
+	reader, writer := io.Pipe()
+	scanned := make(chan []string, 1)
+	var scan_err error
+	go func() {
+		usernames := make([]string, 0)
+		seen := map[string]struct{}{}
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			username := strings.TrimSpace(scanner.Text())
+			if username == "" {
+				continue
+			}
+			if _, ok := seen[username]; ok {
+				continue
+			}
+			seen[username] = struct{}{}
+			usernames = append(usernames, username)
+		}
+		if scan_err = scanner.Err(); scan_err != nil {
+			io.Copy(io.Discard, reader)
+		}
+		scanned <- usernames
+	}()
+
 	stderr := &bytes.Buffer{}
-	status, err := api_client.RunCommand(ctx, client.CommandOptions{
-		Command: fmt.Sprintf("cat /home/%s/user.profile", username),
-		Stdin:   strings.NewReader(""),
-		Stdout:  stdout,
-		Stderr:  stderr,
-	})
+	status, err := runCommand(ctx, api_client, "pilots", writer, stderr)
+	writer.Close()
+	usernames := <-scanned
 	if err != nil {
-		return nil, fmt.Errorf("failed to get pilot's user profile: %v", err)
+		return nil, fmt.Errorf("failed to run pilots command: %w", err)
 	}
 
 	if status != 0 {
-		return nil, fmt.Errorf("cat command for pilot data failed: %s", stderr.String())
+		if commandUnavailable(stderr.String()) {
+			return nil, fmt.Errorf("%w: %s", ErrPilotsUnavailable, stderrSummary(stderr.String()))
+		}
+		return nil, fmt.Errorf("pilots command failed: %s", stderrSummary(stderr.String()))
+	}
+
+	// A partial listing would read as deleted pilots, so it can't be used
+	if scan_err != nil {
+		return nil, fmt.Errorf("failed to read pilots output: %w", scan_err)
+	}
+
+	return usernames, nil
+}
+
+// dropCaseCollisions keeps the first of the listed usernames that share a canonical username.
+// Storing both would have one silently overwrite the other, so each collision is logged as an
+// error for an operator to fix the provisioning.
+func dropCaseCollisions(ctx context.Context, usernames []string) []string {
+	if cfg.UsernameCase == "preserve" {
+		return usernames
+	}
+
+	kept := make([]string, 0, len(usernames))
+	first := map[string]string{}
+	for _, username := range usernames {
+		canonical := canonicalUsername(username)
+		if other, ok := first[canonical]; ok {
+			logf(ctx, "ERROR: pilots %q and %q are the same pilot under USERNAME_CASE=%s, skipping %q", other, username, cfg.UsernameCase, username)
+			continue
+		}
+		first[canonical] = username
+		kept = append(kept, username)
+	}
+	return kept
+}
+
+// ErrPilotListMismatch marks a pilot listing that doesn't match what PILOT_COUNT_COMMAND reports
+var ErrPilotListMismatch = errors.New("pilot list doesn't match the cloud's count")
+
+// verifyPilotList checks usernames against the output of PILOT_COUNT_COMMAND: the expected number
+// of pilots, optionally followed by the hex sha256 of the sorted usernames, newline-terminated.
+// Without the command configured every listing passes.
+func verifyPilotList(ctx context.Context, api_client client.SocketClient, usernames []string) error {
+	if cfg.PilotCountCommand == "" {
+		return nil
 	}
 
-	json_bytes, err := yaml.YAMLToJSON(stdout.Bytes())
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, cfg.PilotCountCommand, stdout, stderr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert user profile to JSON: %v", err)
+		return fmt.Errorf("failed to run pilot count command: %w", err)
+	}
+	if status != 0 {
+		return fmt.Errorf("pilot count command failed: %s", stderrSummary(stderr.String()))
 	}
 
-	stdout.Reset()
-	stderr.Reset()
-	status, err = api_client.RunCommand(ctx, client.CommandOptions{
-		Command: fmt.Sprintf("cat -n /home/%s/user.embedding", username),
-		Stdin:   strings.NewReader(""),
-		Stdout:  stdout,
-		Stderr:  stderr,
-	})
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("unexpected pilot count output %q", stdout.String())
+	}
+	count, err := strconv.Atoi(fields[0])
 	if err != nil {
-		return nil, fmt.Errorf("failed to run cat command for user embedding: %w", err)
+		return fmt.Errorf("unexpected pilot count output %q", stdout.String())
+	}
+	if count != len(usernames) {
+		return fmt.Errorf("%w: listed %d, expected %d", ErrPilotListMismatch, len(usernames), count)
 	}
 
-	var embedding []float64
-	if status != 0 {
-		if !strings.Contains(stderr.String(), "file does not exist") {
-			return nil, fmt.Errorf("cat returned an error when asked for embedding: %q", stderr.String())
+	if len(fields) == 2 {
+		sorted := slices.Sorted(slices.Values(usernames))
+		sum := sha256.New()
+		for _, username := range sorted {
+			io.WriteString(sum, username+"\n")
+		}
+		if checksum := hex.EncodeToString(sum.Sum(nil)); !strings.EqualFold(checksum, fields[1]) {
+			return fmt.Errorf("%w: checksum %s, expected %s", ErrPilotListMismatch, checksum, fields[1])
 		}
+	}
+	return nil
+}
+
+// fetch_slots bounds pilot fetches in flight across every caller (sync, pilot requests, ...)
+var (
+	fetch_slots      chan struct{}
+	fetch_slots_once sync.Once
+)
+
+func acquireFetchSlot(ctx context.Context) error {
+	fetch_slots_once.Do(func() {
+		fetch_slots = make(chan struct{}, max(cfg.PilotFetchConcurrency, 1))
+	})
+
+	select {
+	case fetch_slots <- struct{}{}:
+		metricPilotFetchesInFlight.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseFetchSlot() {
+	metricPilotFetchesInFlight.Add(-1)
+	<-fetch_slots
+}
+
+// ErrPilotNotFound marks a pilot without a profile in their home
+var ErrPilotNotFound = errors.New("pilot not found")
+
+func GetPilotFromServer(ctx context.Context, api_client client.SocketClient, username string) (*PilotInfo, error) {
+	if !validUsername(username) {
+		return nil, fmt.Errorf("%w: invalid username %q", ErrPilotRejected, username)
+	}
+
+	if err := acquireFetchSlot(ctx); err != nil {
+		return nil, fmt.Errorf("waiting to fetch pilot: %w", err)
+	}
+	defer releaseFetchSlot()
+
+	// Timed from getting a slot, so the histogram shows the cloud's latency rather than queueing
+	start := time.Now()
+	pilot, err := fetchPilot(ctx, api_client, username)
+	outcome := "success"
+	switch {
+	case errors.Is(err, ErrPilotNotFound):
+		outcome = "not_found"
+	case errors.Is(err, ErrPilotRejected):
+		outcome = "rejected"
+	case err != nil:
+		outcome = "error"
+	}
+	metricPilotFetchSeconds.Observe(outcome, time.Since(start).Seconds())
+	return pilot, err
+}
+
+// fetchPilot pulls everything stored about a pilot from the cloud
+func fetchPilot(ctx context.Context, api_client client.SocketClient, username string) (*PilotInfo, error) {
+	profile, found, err := catHomeFile(ctx, api_client, username, cfg.ProfileFilenames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pilot's user profile: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: no profile (tried %v)", ErrPilotNotFound, cfg.ProfileFilenames)
+	}
+	if looksLikeHTML(profile) {
+		return nil, fmt.Errorf("%w: profile of %q is an HTML page", ErrUnexpectedResponse, username)
+	}
+
+	pilot_status := PilotStatusOK
+	json_bytes, err := yaml.YAMLToJSON(profile)
+	if err != nil {
+		// A broken profile shouldn't hide the pilot (or fail the whole sync), so it's stored empty
+		logf(ctx, "warning: invalid user profile for %q: %v", username, err)
+		pilot_status = PilotStatusProfileInvalid
+		json_bytes = nil
+	} else if profileEmpty(json_bytes) {
+		// Empty, whitespace-only or comment-only files convert to "null", which consumers would
+		// take for a real profile
+		logf(ctx, "warning: user profile for %q is empty", username)
+		pilot_status = PilotStatusProfileEmpty
+		json_bytes = nil
+	} else if !bytes.HasPrefix(bytes.TrimSpace(json_bytes), []byte("{")) {
+		// Consumers expect a mapping; a bare string or list is as useless as invalid YAML
+		logf(ctx, "warning: user profile for %q isn't a mapping", username)
+		pilot_status = PilotStatusProfileInvalid
+		json_bytes = nil
 	} else {
-		data, err := base64.StdEncoding.DecodeString(stdout.String())
+		var redacted []string
+		json_bytes, redacted, err = redactProfile(json_bytes, cfg.RedactProfileFields)
 		if err != nil {
-			return nil, fmt.Errorf("user embedings have invalid base64: %w", err)
+			return nil, fmt.Errorf("failed to redact user profile: %v", err)
 		}
-		if len(data)%8 != 0 {
-			return nil, fmt.Errorf("user embedding have non-divisible length")
+		if len(redacted) != 0 {
+			debugCtxf(ctx, "Redacted profile fields for %q: %v", username, redacted)
 		}
 
-		embedding = make([]float64, len(data)/8)
-		for i := 0; i < len(embedding); i++ {
-			bits := binary.LittleEndian.Uint64(data[i*8 : (i+1)*8])
-			embedding[i] = math.Float64frombits(bits)
+		var truncated bool
+		json_bytes, truncated, err = limitProfileSize(ctx, username, json_bytes)
+		if err != nil {
+			return nil, err
+		}
+		if truncated {
+			pilot_status = PilotStatusProfileTruncated
 		}
 	}
 
-	stdout.Reset()
-	stderr.Reset()
-	status, err = api_client.RunCommand(ctx, client.CommandOptions{
-		Command: "mkdir -p flights && ls -yl flights",
-		Stdin:   strings.NewReader(""),
-		Stdout:  stdout,
-		Stderr:  stderr,
-	})
+	// Promoted fields come from the redacted profile, so redacted values can't leak through them
+	profile_fields, err := mapProfileFields(json_bytes, cfg.ProfileFieldMap)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check flights: %v", err)
+		return nil, fmt.Errorf("failed to map profile fields: %v", err)
 	}
 
-	if status != 0 {
-		return nil, fmt.Errorf("command failed while trying to get flight files: %v", err)
+	extra_files, err := fetchExtraFiles(ctx, api_client, username)
+	if err != nil {
+		return nil, err
 	}
 
-	var files []FileInfo
-	output := stdout.String()
-	if len(output) == 0 {
-		files = []FileInfo{}
-	} else {
-		if err := yaml.UnmarshalContext(ctx, []byte(output), &files); err != nil {
-			return nil, fmt.Errorf("ls returned invalid yaml: %v", err)
+	var pilot_id string
+	if cfg.PilotIDField != "" {
+		ids, err := mapProfileFields(json_bytes, map[string]string{cfg.PilotIDField: "pilot_id"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pilot ID: %v", err)
 		}
+		pilot_id = ids["pilot_id"]
+	}
+	var designated string
+	if cfg.PrimaryEmbeddingField != "" {
+		fields, err := mapProfileFields(json_bytes, map[string]string{cfg.PrimaryEmbeddingField: "primary_embedding"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read primary embedding: %v", err)
+		}
+		designated = fields["primary_embedding"]
 	}
 
-	latest_file := -1
-	max_num := 0
-	for i, file := range files {
-		flight_id, ok := strings.CutSuffix(file.Name, ".flight")
-		if !ok {
-			continue
+	var fingerprint, embedding_stale string
+	var embedding []float64
+	cached := false
+	if cfg.EmbeddingFingerprints {
+		if fingerprint, err = remoteEmbeddingFingerprint(ctx, api_client, username); err != nil {
+			return nil, err
 		}
-		var num int
-		if _, err := fmt.Sscan(flight_id, &num); err != nil {
-			continue
+		embedding, cached = cachedEmbedding(ctx, username, fingerprint)
+	}
+	if !cached {
+		embedding, err = fetchEmbedding(ctx, api_client, username)
+		if errors.Is(err, ErrEmbeddingNonFinite) {
+			logf(ctx, "warning: storing the embedding of %q zeroed where it isn't finite: %v", username, err)
+			pilot_status = PilotStatusNonFinite
+			// The cache wouldn't keep the flag, so flagged embeddings are fetched every time
+			fingerprint = ""
+		} else if errors.Is(err, ErrEmbeddingDecode) {
+			logf(ctx, "warning: treating pilot %q as having no embedding: %v", username, err)
+			pilot_status = PilotStatusDecodeError
+		} else if err != nil {
+			// A dead client fails everything after it, so only the embedding itself degrades; a
+			// rejected embedding is the pilot's own problem, which the stored one doesn't fix
+			if !cfg.DegradedEmbeddings || errors.Is(err, ErrTransport) || errors.Is(err, ErrPilotRejected) {
+				return nil, err
+			}
+			logf(ctx, "warning: keeping the stored embedding of %q, which couldn't be fetched: %v", username, err)
+			// The stored fingerprint goes with the stored embedding, so the cache can't mistake it
+			// for the current file
+			embedding, fingerprint, _ = storedEmbedding(ctx, username)
+			embedding_stale = "true"
 		}
-		if num > max_num {
-			latest_file = i
-			max_num = num
+	}
+	recognizable := ""
+	if embedding == nil && pilot_status == PilotStatusOK && embedding_stale == "" {
+		pilot_status = PilotStatusNoEmbedding
+		switch cfg.NoEmbeddingPolicy {
+		case "skip":
+			return nil, fmt.Errorf("%w: no embedding", ErrPilotRejected)
+		case "mark":
+			recognizable = "false"
 		}
 	}
 
-	flight_id := ""
-	if latest_file == -1 {
-		log.Println("No flight files, craeting one...")
-		stdout.Reset()
-		stderr.Reset()
-		timestamp := time.Now().UnixNano()
-		status, err := api_client.RunCommand(ctx, client.CommandOptions{
-			Command: fmt.Sprintf("tee flights/%d.flight", timestamp),
-			Stdin:   strings.NewReader(""),
-			Stdout:  stdout,
-			Stderr:  stderr,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to create flight (%d): %v", timestamp, err)
-		}
+	flight_id, err := CurrentFlight(ctx, api_client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PilotInfo{
+		Username:     username,
+		FlightID:     flight_id,
+		PersonalData: ProfileData(json_bytes),
+		Embedding:    embedding,
+
+		PrimaryEmbedding: primaryEmbeddingKey(username, designated, embedding),
+		Status:           pilot_status,
+		Recognizable:     recognizable,
+		EmbeddingStale:   embedding_stale,
+
+		EmbeddingFingerprint: fingerprint,
+		PilotID:              pilot_id,
+		ProfileFields:        profile_fields,
+		ExtraFiles:           extra_files,
+	}, nil
+}
 
-		if status != 0 {
-			return nil, fmt.Errorf("tee command failed for flight %d: %v", timestamp, err)
+// catHomeFile returns the contents of the first of names that exists in the pilot's home, as
+// tenants provisioned at different times name their files differently. found is false when none
+// of them exists; any other cat failure is an error.
+func catHomeFile(ctx context.Context, api_client client.SocketClient, username string, names []string) ([]byte, bool, error) {
+	if files, ok := batchedFiles(ctx, username); ok {
+		for _, name := range names {
+			if data, ok := files[name]; ok {
+				debugCtxf(ctx, "Using batched %s for %q", name, username)
+				return data, true, nil
+			}
 		}
-	} else {
-		log.Println("Found a flight file: ", max_num)
-		stdout.Reset()
-		stderr.Reset()
-		status, err := api_client.RunCommand(ctx, client.CommandOptions{
-			Command: fmt.Sprintf("cat flights/%d.flight", max_num),
-			Stdin:   strings.NewReader(""),
-			Stdout:  stdout,
-			Stderr:  stderr,
-		})
+		return nil, false, nil
+	}
+
+	for _, name := range names {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		status, err := runCommand(ctx, api_client, "cat "+homeFile(username, name), stdout, stderr)
 		if err != nil {
-			return nil, fmt.Errorf("failed to check flight (%d): %v", max_num, err)
+			return nil, false, err
 		}
 
-		if status != 0 {
-			return nil, fmt.Errorf("cat command failed for flight %d: %v", max_num, err)
+		if status == 0 {
+			debugCtxf(ctx, "Using %s for %q", name, username)
+			return stdout.Bytes(), true, nil
 		}
-
-		var file FlightFile
-		if err := yaml.UnmarshalContext(ctx, stdout.Bytes(), &file); err != nil {
-			return nil, fmt.Errorf("invalid flight YAML: %v", err)
+		if !strings.Contains(stderr.String(), "file does not exist") {
+			return nil, false, fmt.Errorf("cat %s failed: %s", name, stderrSummary(stderr.String()))
 		}
+	}
+	return nil, false, nil
+}
 
-		if file.EndTimestamp == 0 {
-			log.Println("Flight file relevant, no end yet")
-			flight_id = fmt.Sprint(max_num)
-		} else {
-			log.Println("Flight file is finalized, creating a new one...")
-			flight_id = fmt.Sprint(time.Now().UnixNano())
-			stdout.Reset()
-			stderr.Reset()
-			status, err := api_client.RunCommand(ctx, client.CommandOptions{
-				Command: fmt.Sprintf("tee flights/%s.flight", flight_id),
-				Stdin:   strings.NewReader(""),
-				Stdout:  stdout,
-				Stderr:  stderr,
-			})
-			if err != nil {
-				return nil, fmt.Errorf("failed to make flight file: %v", err)
-			}
+// fetchEmbedding fetches and decodes a pilot's embedding; pilots without one get nil
+func fetchEmbedding(ctx context.Context, api_client client.SocketClient, username string) ([]float64, error) {
+	predecoded, ok := predecodedEmbedding(ctx, username)
+	if !ok {
+		data, found, err := catHomeFile(ctx, api_client, username, cfg.EmbeddingFilenames)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user embedding: %w", err)
+		}
+		if !found {
+			return nil, nil
+		}
+		predecoded.embedding, predecoded.err = DecodeEmbedding(string(data))
+	}
+	decoded, err := predecoded.embedding, predecoded.err
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrEmbeddingDecode, err)
+	}
 
-			if status != 0 {
-				return nil, fmt.Errorf("tee command failed to create flight file: %v", err)
-			}
+	if len(decoded) == 0 {
+		// An empty file would otherwise be stored as "[]", which consumers can't tell apart from a real enrollment
+		if cfg.EmptyEmbeddingPolicy == "error" {
+			return nil, fmt.Errorf("%w: user embedding file is empty", ErrPilotRejected)
 		}
+		logf(ctx, "warning: embedding file for %q is empty, treating pilot as having no embedding", username)
+		return nil, nil
 	}
+	// ErrEmbeddingNonFinite is returned along with the zeroed embedding
+	return checkFinite(decoded)
+}
 
-	return &PilotInfo{
-		Username:     username,
-		FlightID:     flight_id,
-		PersonalData: string(json_bytes),
-		Embedding:    embedding,
-	}, nil
+// fetchExtraFiles fetches the EXTRA_FILES of a pilot, by the hash field each maps to. Missing
+// files are left out, so their fields are removed from the pilot hash like unmapped ones.
+func fetchExtraFiles(ctx context.Context, api_client client.SocketClient, username string) (map[string]string, error) {
+	if len(cfg.ExtraFiles) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string]string, len(cfg.ExtraFiles))
+	for _, name := range slices.Sorted(maps.Keys(cfg.ExtraFiles)) {
+		data, found, err := catHomeFile(ctx, api_client, username, []string{name})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %w", name, err)
+		}
+		if !found {
+			debugCtxf(ctx, "Pilot %q has no %s", username, name)
+			continue
+		}
+		fields[cfg.ExtraFiles[name]] = string(bytes.TrimRight(data, "\r\n"))
+	}
+	return fields, nil
 }
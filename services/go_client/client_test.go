@@ -0,0 +1,909 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
+)
+
+func TestEmptyEmbeddingIgnored(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{})
+
+	pilot, err := GetPilotFromServer(context.Background(), cloud.connect(), "alice")
+	if err != nil {
+		t.Fatalf("GetPilotFromServer: %v", err)
+	}
+	if pilot.Embedding != nil || pilot.Status != PilotStatusNoEmbedding {
+		t.Fatalf("got embedding %v, status %q; want none, %q", pilot.Embedding, pilot.Status, PilotStatusNoEmbedding)
+	}
+}
+
+func TestEmptyEmbeddingRejected(t *testing.T) {
+	for _, degraded := range []string{"false", "true"} {
+		t.Run("DEGRADED_EMBEDDINGS="+degraded, func(t *testing.T) {
+			useConfig(t, map[string]string{"EMPTY_EMBEDDING_POLICY": "error", "DEGRADED_EMBEDDINGS": degraded})
+			cloud := newFakeCloud(t)
+			cloud.addPilot("alice", "name: Alice\n", []float64{})
+			cloud.addPilot("bob", "name: Bob\n", []float64{1, 2})
+			api_client := cloud.connect()
+
+			_, err := GetPilotFromServer(context.Background(), api_client, "alice")
+			if !errors.Is(err, ErrPilotRejected) {
+				t.Fatalf("got %v, want ErrPilotRejected", err)
+			}
+
+			// Only the pilot with the empty file is skipped, the sync carries on
+			list, err := GetPilots(context.Background(), api_client, nil)
+			if err != nil {
+				t.Fatalf("GetPilots: %v", err)
+			}
+			if len(list.Pilots) != 1 || list.Pilots[0].Username != "bob" {
+				t.Fatalf("got pilots %+v, want only bob", list.Pilots)
+			}
+		})
+	}
+}
+
+func TestNoEmbeddingPolicyStore(t *testing.T) {
+	useConfig(t, map[string]string{"NO_EMBEDDING_POLICY": "store"})
+	fr := newFakeRedis(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", nil)
+
+	pilot, err := GetPilotFromServer(context.Background(), cloud.connect(), "alice")
+	if err != nil {
+		t.Fatalf("GetPilotFromServer: %v", err)
+	}
+	if pilot.Status != PilotStatusNoEmbedding || pilot.Recognizable != "" {
+		t.Fatalf("status %q, recognizable %q; want %q and unset", pilot.Status, pilot.Recognizable, PilotStatusNoEmbedding)
+	}
+	if err := writePilot(context.Background(), fr.client(0), *pilot); err != nil {
+		t.Fatalf("writePilot: %v", err)
+	}
+	if _, ok := fr.hash(0, pilotKey("alice"))["recognizable"]; ok {
+		t.Fatal("recognizable stored under the store policy")
+	}
+}
+
+func TestNoEmbeddingPolicyMark(t *testing.T) {
+	useConfig(t, map[string]string{"NO_EMBEDDING_POLICY": "mark"})
+	fr := newFakeRedis(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", nil)
+	cloud.addPilot("bob", "name: Bob\n", []float64{1, 2})
+	api_client := cloud.connect()
+
+	alice, err := GetPilotFromServer(context.Background(), api_client, "alice")
+	if err != nil {
+		t.Fatalf("GetPilotFromServer: %v", err)
+	}
+	if alice.Status != PilotStatusNoEmbedding || alice.Recognizable != "false" {
+		t.Fatalf("status %q, recognizable %q; want %q, \"false\"", alice.Status, alice.Recognizable, PilotStatusNoEmbedding)
+	}
+	if err := writePilot(context.Background(), fr.client(0), *alice); err != nil {
+		t.Fatalf("writePilot: %v", err)
+	}
+	if got := fr.hash(0, pilotKey("alice"))["recognizable"]; got != "false" {
+		t.Fatalf("stored recognizable = %q, want \"false\"", got)
+	}
+
+	// Pilots with an embedding aren't marked
+	if bob, err := GetPilotFromServer(context.Background(), api_client, "bob"); err != nil || bob.Recognizable != "" {
+		t.Fatalf("bob = %+v, %v; want recognizable unset", bob, err)
+	}
+}
+
+func TestNoEmbeddingPolicySkip(t *testing.T) {
+	useConfig(t, map[string]string{"NO_EMBEDDING_POLICY": "skip"})
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", nil)
+	cloud.addPilot("bob", "name: Bob\n", []float64{1, 2})
+	api_client := cloud.connect()
+
+	if _, err := GetPilotFromServer(context.Background(), api_client, "alice"); !errors.Is(err, ErrPilotRejected) {
+		t.Fatalf("GetPilotFromServer = %v, want ErrPilotRejected", err)
+	}
+	list, err := GetPilots(context.Background(), api_client, nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	if len(list.Pilots) != 1 || list.Pilots[0].Username != "bob" || len(list.Failed) != 0 {
+		t.Fatalf("list = %+v, want only bob, with nothing failed", list)
+	}
+}
+
+// listPilotsBuffered is how the listing used to be read: the whole output, then split
+func listPilotsBuffered(ctx context.Context, api_client client.SocketClient) ([]string, error) {
+	stdout := &bytes.Buffer{}
+	if _, err := runCommand(ctx, api_client, "pilots", stdout, io.Discard); err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0)
+	seen := map[string]struct{}{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		username := strings.TrimSpace(line)
+		if _, ok := seen[username]; ok || username == "" {
+			continue
+		}
+		seen[username] = struct{}{}
+		usernames = append(usernames, username)
+	}
+	return usernames, nil
+}
+
+func BenchmarkListPilots(b *testing.B) {
+	useConfig(b, nil)
+	cloud := newFakeCloud(b)
+	usernames := make([]string, 50000)
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("pilot-with-a-longish-username-%06d", i)
+	}
+	cloud.setPilots(usernames...)
+	api_client := cloud.connect()
+
+	for _, bench := range []struct {
+		name string
+		list func(context.Context, client.SocketClient) ([]string, error)
+	}{
+		{"buffered", listPilotsBuffered},
+		{"streamed", listPilots},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				listed, err := bench.list(context.Background(), api_client)
+				if err != nil || len(listed) != len(usernames) {
+					b.Fatalf("listed %d pilots (%v), want %d", len(listed), err, len(usernames))
+				}
+			}
+		})
+	}
+}
+
+// useFetchSlots starts the fetch limiter over with PILOT_FETCH_CONCURRENCY from the current cfg
+func useFetchSlots(t *testing.T) {
+	fetch_slots_once = sync.Once{}
+	t.Cleanup(func() { fetch_slots_once = sync.Once{} })
+}
+
+func TestFetchConcurrencyBound(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_FETCH_CONCURRENCY": "2"})
+	useFetchSlots(t)
+	cloud := newFakeCloud(t)
+	var mu sync.Mutex
+	running, most := 0, 0
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if !strings.HasPrefix(command, "cat /home/") {
+			return "", "", 0, false
+		}
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return "", "", 0, false
+	})
+
+	// Each on a client of its own, so only the limiter keeps them from running at once
+	usernames := []string{"p1", "p2", "p3", "p4", "p5", "p6"}
+	clients := make([]client.SocketClient, len(usernames))
+	for i, username := range usernames {
+		cloud.addPilot(username, "name: Pilot\n", []float64{1})
+		clients[i] = cloud.connect()
+	}
+	var wg sync.WaitGroup
+	for i, username := range usernames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := GetPilotFromServer(context.Background(), clients[i], username); err != nil {
+				t.Errorf("GetPilotFromServer(%q): %v", username, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if most != 2 {
+		t.Fatalf("up to %d fetches ran at once, want 2", most)
+	}
+	if in_flight := metricPilotFetchesInFlight.value.Load(); in_flight != 0 {
+		t.Fatalf("%d fetches still counted in flight", in_flight)
+	}
+}
+
+func TestFetchSlotWaitCancelled(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_FETCH_CONCURRENCY": "1"})
+	useFetchSlots(t)
+	if err := acquireFetchSlot(context.Background()); err != nil {
+		t.Fatalf("acquireFetchSlot: %v", err)
+	}
+	defer releaseFetchSlot()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := acquireFetchSlot(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquireFetchSlot with every slot taken = %v, want the deadline", err)
+	}
+}
+
+func TestPilotStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		env       map[string]string
+		profile   string
+		embedding string // file contents; "-" for no file
+		status    string
+	}{
+		{"ok", nil, "name: Alice\n", testEmbedding(1, 2), PilotStatusOK},
+		{"no embedding", nil, "name: Alice\n", "-", PilotStatusNoEmbedding},
+		{"undecodable embedding", nil, "name: Alice\n", "not base64!", PilotStatusDecodeError},
+		{"invalid profile", nil, "name: [Alice\n", testEmbedding(1, 2), PilotStatusProfileInvalid},
+		{"profile not a mapping", nil, "- Alice\n", testEmbedding(1, 2), PilotStatusProfileInvalid},
+		{"empty profile", nil, "# nothing yet\n", testEmbedding(1, 2), PilotStatusProfileEmpty},
+		{"truncated profile", map[string]string{"PROFILE_MAX_BYTES": "40", "PROFILE_SIZE_POLICY": "summary"}, "name: Alice\nhistory: [" + strings.Repeat("1, ", 20) + "1]\n", testEmbedding(1, 2), PilotStatusProfileTruncated},
+		{"non-finite embedding", map[string]string{"NON_FINITE_EMBEDDING_POLICY": "flag"}, "name: Alice\n", testEmbedding(math.NaN(), 2), PilotStatusNonFinite},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.env)
+			fr := newFakeRedis(t)
+			cloud := newFakeCloud(t)
+			cloud.addPilot("alice", tt.profile, nil)
+			if tt.embedding != "-" {
+				cloud.setFile(homeFile("alice", "user.embedding"), tt.embedding)
+			}
+
+			pilot, err := GetPilotFromServer(context.Background(), cloud.connect(), "alice")
+			if err != nil {
+				t.Fatalf("GetPilotFromServer: %v", err)
+			}
+			if pilot.Status != tt.status {
+				t.Fatalf("status = %q, want %q", pilot.Status, tt.status)
+			}
+			if err := writePilot(context.Background(), fr.client(0), *pilot); err != nil {
+				t.Fatalf("writePilot: %v", err)
+			}
+			if got := fr.hash(0, pilotKey("alice"))["status"]; got != tt.status {
+				t.Fatalf("stored status = %q, want %q", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestCatHomeFileCandidates(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	cloud.setFile(homeFile("alice", "face.embedding"), "face")
+	cloud.setFile(homeFile("alice", "embedding.bin"), "bin")
+	api_client := cloud.connect()
+	names := []string{"user.embedding", "face.embedding", "embedding.bin"}
+
+	data, found, err := catHomeFile(context.Background(), api_client, "alice", names)
+	if err != nil || !found || string(data) != "face" {
+		t.Fatalf("catHomeFile = %q, %v, %v, want face.embedding's contents", data, found, err)
+	}
+	if cloud.count("cat "+homeFile("alice", "user.embedding")) != 1 || cloud.count("cat "+homeFile("alice", "embedding.bin")) != 0 {
+		t.Fatalf("tried %v, want the candidates in order up to the first that exists", cloud.ran())
+	}
+
+	if _, found, err := catHomeFile(context.Background(), api_client, "bob", names); err != nil || found {
+		t.Fatalf("catHomeFile with no candidate present = %v, %v, want not found", found, err)
+	}
+	if cloud.count("cat "+homeFile("bob", "")+"/") != len(names) {
+		t.Fatalf("tried %v, want every candidate", cloud.ran())
+	}
+
+	// Only a missing file falls through; any other failure is reported
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command == "cat "+homeFile("alice", "user.embedding") {
+			return "", "cat: permission denied\n", 1, true
+		}
+		return "", "", 0, false
+	})
+	if _, _, err := catHomeFile(context.Background(), api_client, "alice", names); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("catHomeFile = %v, want the permission error", err)
+	}
+}
+
+func TestEmbeddingFilenames(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_FILENAMES": "user.embedding, face.embedding", "PROFILE_FILENAMES": "profile.yaml"})
+	cloud := newFakeCloud(t)
+	cloud.setPilots("alice")
+	cloud.setFile(homeFile("alice", "profile.yaml"), "name: Alice\n")
+	cloud.setFile(homeFile("alice", "face.embedding"), testEmbedding(1, 2))
+
+	pilot, err := fetchPilot(context.Background(), cloud.connect(), "alice")
+	if err != nil {
+		t.Fatalf("fetchPilot: %v", err)
+	}
+	if len(pilot.Embedding) != 2 || pilot.Embedding[0] != 1 || !strings.Contains(string(pilot.PersonalData), "Alice") {
+		t.Fatalf("pilot = %+v, want the profile and embedding from the configured names", pilot)
+	}
+}
+
+func TestStderrSummary(t *testing.T) {
+	for _, tt := range []struct {
+		limit  string
+		stderr string
+		want   string
+	}{
+		{"0", strings.Repeat("x", 1000), `"` + strings.Repeat("x", 1000) + `"`},
+		{"10", "  short\n", `"short"`},
+		{"10", "0123456789", `"0123456789"`},
+		{"10", "0123456789abc\n", `"0123456789"... (3 more bytes truncated)`},
+		{"4", "line 1\nline 2", `"line"... (9 more bytes truncated)`},
+		// A cut through a multi-byte rune drops the partial rune
+		{"5", "abcdé and more", `"abcd"... (10 more bytes truncated)`},
+	} {
+		t.Run(tt.limit+"/"+tt.want, func(t *testing.T) {
+			useConfig(t, map[string]string{"MAX_STDERR_LOG": tt.limit})
+			if got := stderrSummary(tt.stderr); got != tt.want {
+				t.Errorf("stderrSummary(%q) = %s, want %s", tt.stderr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailedCommandStderrTruncated(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_STDERR_LOG": "16"})
+	cloud := newFakeCloud(t)
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		return "", "cat: permission denied " + strings.Repeat("!", 10000), 1, strings.HasPrefix(command, "cat ")
+	})
+	_, _, err := catHomeFile(context.Background(), cloud.connect(), "alice", []string{"user.profile"})
+	if err == nil || !strings.Contains(err.Error(), `"cat: permission "... (10007 more bytes truncated)`) || len(err.Error()) > 200 {
+		t.Fatalf("catHomeFile = %v, want the stderr cut short", err)
+	}
+}
+
+func TestVerifyPilotList(t *testing.T) {
+	// sha256 of "alice\nbob\n"
+	sum := sha256.Sum256([]byte("alice\nbob\n"))
+	checksum := hex.EncodeToString(sum[:])
+	for _, tt := range []struct {
+		name   string
+		output string
+		status int
+		// Substring of the error, or "" for none
+		err      string
+		mismatch bool
+	}{
+		{"count", "2\n", 0, "", false},
+		{"count and checksum", "2 " + checksum + "\n", 0, "", false},
+		{"checksum in upper case", "2 " + strings.ToUpper(checksum) + "\n", 0, "", false},
+		{"count off", "3\n", 0, "listed 2, expected 3", true},
+		{"checksum off", "2 " + strings.Repeat("0", 64) + "\n", 0, "checksum " + checksum, true},
+		{"garbage", "two\n", 0, "unexpected pilot count output", false},
+		{"empty", "", 0, "unexpected pilot count output", false},
+		{"too many fields", "2 " + checksum + " extra\n", 0, "unexpected pilot count output", false},
+		{"command failed", "", 1, "pilot count command failed", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, map[string]string{"PILOT_COUNT_COMMAND": "pilot-count --sha256"})
+			cloud := newFakeCloud(t)
+			cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+				return tt.output, "pilot-count: broken\n", tt.status, command == "pilot-count --sha256"
+			})
+
+			// Listed in a different order than they're hashed in
+			err := verifyPilotList(context.Background(), cloud.connect(), []string{"bob", "alice"})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("verifyPilotList: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("verifyPilotList = %v, want %q", err, tt.err)
+			}
+			if errors.Is(err, ErrPilotListMismatch) != tt.mismatch {
+				t.Fatalf("verifyPilotList = %v, mismatch %v", err, tt.mismatch)
+			}
+		})
+	}
+}
+
+func TestPilotListMismatchKeepsPilots(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_COUNT_COMMAND": "pilot-count"})
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	// The listing was cut short: bob is missing from it
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		return "2\n", "", 0, command == "pilot-count"
+	})
+
+	list, err := GetPilots(context.Background(), cloud.connect(), nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	if list.Complete || len(list.Pilots) != 1 {
+		t.Fatalf("list = %+v, want alice with deletions disabled", list)
+	}
+	if cloud.count("pilot-count") != 1 {
+		t.Fatalf("ran %v", cloud.ran())
+	}
+}
+
+func TestPilotCountCommandUnset(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	if err := verifyPilotList(context.Background(), cloud.connect(), []string{"alice"}); err != nil {
+		t.Fatalf("verifyPilotList without a command: %v", err)
+	}
+	if len(cloud.ran()) != 1 {
+		t.Fatalf("ran %v, want only the client check", cloud.ran())
+	}
+}
+
+func TestHTMLProfileRejected(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "<!DOCTYPE html>\n<html><body><h1>502 Bad Gateway</h1></body></html>\n", []float64{1, 2})
+	cloud.addPilot("bob", "  <HTML>\n<title>Maintenance</title>\n", []float64{1, 2})
+	cloud.addPilot("carol", "name: Carol\nbio: <html> tags are fine in a value\n", []float64{1, 2})
+	api_client := cloud.connect()
+
+	for _, username := range []string{"alice", "bob"} {
+		if _, err := GetPilotFromServer(context.Background(), api_client, username); !errors.Is(err, ErrUnexpectedResponse) {
+			t.Errorf("GetPilotFromServer(%q) = %v, want ErrUnexpectedResponse", username, err)
+		}
+	}
+
+	list, err := GetPilots(context.Background(), api_client, nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	if len(list.Pilots) != 1 || list.Pilots[0].Username != "carol" || !slices.Equal(list.Failed, []string{"alice", "bob"}) {
+		t.Fatalf("list = %+v, want carol with alice and bob failed", list)
+	}
+	if _, err := runSyncCycle(context.Background(), rdb, list, map[string]pilotHash{}); err != nil {
+		t.Fatalf("runSyncCycle: %v", err)
+	}
+	if fr.exists(0, pilotKey("alice")) || fr.exists(0, pilotKey("bob")) {
+		t.Fatal("an HTML page was stored as a profile")
+	}
+}
+
+func TestUsernameCaseCollisions(t *testing.T) {
+	useConfig(t, map[string]string{"USERNAME_CASE": "lower"})
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("JohnDoe", "name: John (first)\n", []float64{1, 2})
+	cloud.addPilot("johndoe", "name: John (second)\n", []float64{3, 4})
+	cloud.addPilot("Alice", "name: Alice\n", []float64{5, 6})
+
+	list, err := GetPilots(context.Background(), cloud.connect(), nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	var usernames []string
+	for _, pilot := range list.Pilots {
+		usernames = append(usernames, pilot.Username)
+	}
+	if !slices.Equal(usernames, []string{"JohnDoe", "Alice"}) {
+		t.Fatalf("fetched %v, want the first of the colliding pilots and Alice", usernames)
+	}
+	if cloud.count("cat "+homeFile("johndoe", "user.profile")) != 0 {
+		t.Error("the colliding pilot was fetched anyway")
+	}
+	if !strings.Contains(logs.String(), `ERROR: pilots "JohnDoe" and "johndoe" are the same pilot under USERNAME_CASE=lower, skipping "johndoe"`) {
+		t.Errorf("collision wasn't logged:\n%s", logs)
+	}
+
+	if _, err := runSyncCycle(context.Background(), rdb, list, map[string]pilotHash{}); err != nil {
+		t.Fatalf("runSyncCycle: %v", err)
+	}
+	// Stored under the folded name, while cloud paths keep the name as provisioned
+	if got := fr.hash(0, "cognicore:data:pilot:johndoe")["personal_data"]; !strings.Contains(got, "first") {
+		t.Fatalf("johndoe's personal_data = %q, want the first pilot's", got)
+	}
+	if !fr.exists(0, "cognicore:data:pilot:alice") || fr.exists(0, "cognicore:data:pilot:Alice") {
+		t.Fatal("Alice wasn't stored under the folded name")
+	}
+}
+
+func TestUsernameCasePreserved(t *testing.T) {
+	useConfig(t, map[string]string{"USERNAME_CASE": "preserve"})
+	logs := captureLog(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("JohnDoe", "name: John (first)\n", []float64{1, 2})
+	cloud.addPilot("johndoe", "name: John (second)\n", []float64{3, 4})
+
+	list, err := GetPilots(context.Background(), cloud.connect(), nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	if len(list.Pilots) != 2 || strings.Contains(logs.String(), "same pilot") {
+		t.Fatalf("pilots %+v, log:\n%s; want both as distinct pilots", list.Pilots, logs)
+	}
+	if pilotKey("JohnDoe") == pilotKey("johndoe") {
+		t.Fatal("distinct pilots share a key")
+	}
+}
+
+func TestCommandUnavailable(t *testing.T) {
+	for stderr, want := range map[string]bool{
+		"pilots: Permission denied\n":         true,
+		"sudo: operation not permitted\n":     true,
+		"pilots: command not found\n":         true,
+		"Unknown command: pilots\n":           true,
+		"pilots: database temporarily down\n": false,
+		"":                                    false,
+		"cat: file does not exist\n":          false,
+	} {
+		if got := commandUnavailable(stderr); got != want {
+			t.Errorf("commandUnavailable(%q) = %v, want %v", stderr, got, want)
+		}
+	}
+}
+
+func TestPilotsPermissionDenied(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	stderr := "pilots: permission denied\n"
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command == "pilots" {
+			return "", stderr, 1, true
+		}
+		return "", "", 0, false
+	})
+	api_client := cloud.connect()
+
+	_, err := GetPilots(context.Background(), api_client, nil)
+	if !errors.Is(err, ErrPilotsUnavailable) || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("GetPilots = %v, want ErrPilotsUnavailable with the cloud's reason", err)
+	}
+
+	// Any other failure is worth retrying
+	stderr = "pilots: database temporarily down\n"
+	_, err = GetPilots(context.Background(), api_client, nil)
+	if err == nil || errors.Is(err, ErrPilotsUnavailable) {
+		t.Fatalf("GetPilots = %v, want a plain failure", err)
+	}
+}
+
+func TestIdempotentCommand(t *testing.T) {
+	useConfig(t, map[string]string{"FLIGHT_COMMAND_PREFIX": "sudo -u flights"})
+	for command, want := range map[string]bool{
+		"cat /home/alice/user.profile": true,
+		"ls -yl flights":               true,
+		"pilots":                       true,
+		"echo -n 1":                    true,
+		"mkdir -p flights":             true,
+		"sudo -u flights mkdir -p flights && ls -yl flights": true,
+		"mkdir flights":                      false,
+		"tee flights/1.flight":               false,
+		"cat a && tee b":                     false,
+		"sudo -u flights tee flights/1.open": false,
+		"pilot-count":                        false,
+	} {
+		if got := idempotentCommand(command); got != want {
+			t.Errorf("idempotentCommand(%q) = %v, want %v", command, got, want)
+		}
+	}
+}
+
+func TestCommandRetries(t *testing.T) {
+	useConfig(t, map[string]string{"COMMAND_RETRIES": "2"})
+	transport_err := errors.New("socket closed")
+	for _, tt := range []struct {
+		name    string
+		command string
+		// Attempts that fail before one succeeds, and whether a failing one writes output first
+		failures int
+		partial  bool
+		attempts int
+		ok       bool
+	}{
+		{"read recovers", "cat profile", 2, false, 3, true},
+		{"read out of retries", "cat profile", 3, false, 3, false},
+		{"write isn't retried", "tee profile", 1, false, 1, false},
+		{"output already passed on", "cat profile", 1, true, 1, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			run := func(ctx context.Context, opt client.CommandOptions) (int, error) {
+				attempts++
+				if attempts <= tt.failures {
+					if tt.partial {
+						opt.Stdout.Write([]byte("name: Al"))
+					}
+					return 0, transport_err
+				}
+				opt.Stdout.Write([]byte("name: Alice\n"))
+				return 0, nil
+			}
+			stdout := &bytes.Buffer{}
+
+			status, err := runCommandAttempts(context.Background(), run, tt.command, strings.NewReader(""), stdout, &bytes.Buffer{})
+			if attempts != tt.attempts {
+				t.Errorf("ran %d attempt(s), want %d", attempts, tt.attempts)
+			}
+			if !tt.ok {
+				if !errors.Is(err, ErrTransport) || !errors.Is(err, transport_err) {
+					t.Fatalf("runCommandAttempts = %v, want the transport failure", err)
+				}
+				return
+			}
+			if err != nil || status != 0 || stdout.String() != "name: Alice\n" {
+				t.Fatalf("runCommandAttempts = %d, %v with %q, want the output once", status, err, stdout)
+			}
+		})
+	}
+}
+
+func TestCommandNotRunAfterCancel(t *testing.T) {
+	useConfig(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ran := false
+	run := func(ctx context.Context, opt client.CommandOptions) (int, error) {
+		ran = true
+		return 0, nil
+	}
+
+	if _, err := runCommandAttempts(ctx, run, "cat profile", strings.NewReader(""), io.Discard, io.Discard); !errors.Is(err, context.Canceled) || errors.Is(err, ErrTransport) {
+		t.Fatalf("runCommandAttempts = %v, want the cancellation, not a transport failure", err)
+	}
+	if ran {
+		t.Error("a command was sent for a cancelled ctx")
+	}
+}
+
+func TestNonFiniteEmbeddingPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		status string
+		// Stored embedding, nil for none
+		stored []float64
+	}{
+		{"reject", PilotStatusDecodeError, nil},
+		{"flag", PilotStatusNonFinite, []float64{0, 2}},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			useConfig(t, map[string]string{"NON_FINITE_EMBEDDING_POLICY": tt.policy, "EMBEDDING_FINGERPRINTS": "true"})
+			logs := captureLog(t)
+			fr := newFakeRedis(t)
+			rdb := fr.client(0)
+			cloud := newFakeCloud(t)
+			cloud.addPilot("alice", "name: Alice\n", []float64{math.Inf(1), 2})
+
+			list, err := GetPilots(withEmbeddingCache(context.Background(), rdb), cloud.connect(), nil)
+			if err != nil {
+				t.Fatalf("GetPilots: %v", err)
+			}
+			if _, err := runSyncCycle(context.Background(), rdb, list, map[string]pilotHash{}); err != nil {
+				t.Fatalf("runSyncCycle: %v", err)
+			}
+
+			fields := fr.hash(0, pilotKey("alice"))
+			if fields["status"] != tt.status {
+				t.Errorf("status = %q, want %q", fields["status"], tt.status)
+			}
+			value, ok := fr.get(0, embeddingKey("alice"))
+			if tt.stored == nil {
+				if ok {
+					t.Errorf("rejected embedding stored as %q", value)
+				}
+				return
+			}
+			if got, err := decodeStoredEmbedding(value); err != nil || !slices.Equal(got, tt.stored) {
+				t.Errorf("stored embedding = %v (%v), want %v", got, err, tt.stored)
+			}
+			// The fingerprint cache wouldn't keep the flag, so the file is fetched again next time
+			if fields["embedding_fingerprint"] != "" {
+				t.Errorf("flagged embedding has fingerprint %q", fields["embedding_fingerprint"])
+			}
+			if !strings.Contains(logs.String(), `warning: storing the embedding of "alice" zeroed where it isn't finite`) {
+				t.Errorf("zeroing wasn't logged:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	cancelled := false
+	limit := &outputLimit{cancel: func() { cancelled = true }}
+	limit.remaining.Store(10)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	out, errout := limitedWriter{w: stdout, limit: limit}, limitedWriter{w: stderr, limit: limit}
+
+	// stdout and stderr share the budget
+	if n, err := out.Write([]byte("123456")); n != 6 || err != nil {
+		t.Fatalf("Write within the limit = %d, %v", n, err)
+	}
+	if n, err := errout.Write([]byte("7890")); n != 4 || err != nil {
+		t.Fatalf("Write up to the limit = %d, %v", n, err)
+	}
+	if limit.exceeded.Load() || cancelled {
+		t.Fatal("limit exceeded before it was passed")
+	}
+	if n, err := out.Write([]byte("!")); n != 0 || !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("Write past the limit = %d, %v, want ErrOutputTooLarge", n, err)
+	}
+	if !limit.exceeded.Load() || !cancelled {
+		t.Error("passing the limit didn't cancel the command")
+	}
+	if stdout.String() != "123456" || stderr.String() != "7890" {
+		t.Errorf("passed on %q and %q, want nothing past the limit", stdout, stderr)
+	}
+}
+
+func TestMaxCommandOutput(t *testing.T) {
+	huge := strings.Repeat("#", 4096)
+	run := func(ctx context.Context, opt client.CommandOptions) (int, error) {
+		// The library only logs write errors and lets the command run to the end
+		opt.Stdout.Write([]byte(huge[:2048]))
+		opt.Stdout.Write([]byte(huge[2048:]))
+		return 0, nil
+	}
+
+	useConfig(t, map[string]string{"MAX_COMMAND_OUTPUT": "1024"})
+	_, err := runCommandAttempts(context.Background(), run, "cat profile", strings.NewReader(""), io.Discard, io.Discard)
+	if !errors.Is(err, ErrOutputTooLarge) || !errors.Is(err, ErrTransport) {
+		t.Fatalf("runCommandAttempts = %v, want ErrOutputTooLarge as a transport failure", err)
+	}
+	if !strings.Contains(err.Error(), `"cat profile" produced over 1024 bytes`) {
+		t.Errorf("error %q doesn't name the command and the limit", err)
+	}
+
+	useConfig(t, map[string]string{"MAX_COMMAND_OUTPUT": "0"})
+	stdout := &bytes.Buffer{}
+	if _, err := runCommandAttempts(context.Background(), run, "cat profile", strings.NewReader(""), stdout, io.Discard); err != nil || stdout.Len() != len(huge) {
+		t.Fatalf("runCommandAttempts without a limit = %v with %d bytes, want all %d", err, stdout.Len(), len(huge))
+	}
+}
+
+func TestMaxCommandOutputOnTheCloud(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_COMMAND_OUTPUT": "1024"})
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\nnotes: "+strings.Repeat("#", 4096)+"\n", []float64{1, 2})
+
+	_, err := GetPilotFromServer(context.Background(), cloud.connect(), "alice")
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("GetPilotFromServer = %v, want ErrOutputTooLarge", err)
+	}
+}
+
+func TestDegradedEmbeddings(t *testing.T) {
+	useConfig(t, map[string]string{"DEGRADED_EMBEDDINGS": "true"})
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := withEmbeddingCache(context.Background(), rdb)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{3, 4})
+	cloud.addPilot("bob", "name: Bob\n", []float64{5, 6})
+	failing := func(command, stdin string) (string, string, int, bool) {
+		if strings.HasPrefix(command, "cat ") && strings.HasSuffix(command, "/user.embedding") {
+			return "", "cat: input/output error\n", 1, true
+		}
+		return "", "", 0, false
+	}
+	cloud.setHandler(failing)
+	api_client := cloud.connect()
+	stored := PilotInfo{Username: "alice", Embedding: []float64{1, 2}, EmbeddingFingerprint: "user.embedding:16:then"}
+	if err := writePilotParts(ctx, rdb, stored, true, true); err != nil {
+		t.Fatalf("seeding: %v", err)
+	}
+
+	alice, err := GetPilotFromServer(ctx, api_client, "alice")
+	if err != nil {
+		t.Fatalf("GetPilotFromServer: %v", err)
+	}
+	if !slices.Equal(alice.Embedding, stored.Embedding) || alice.EmbeddingFingerprint != stored.EmbeddingFingerprint {
+		t.Errorf("got embedding %v (%q), want the stored one", alice.Embedding, alice.EmbeddingFingerprint)
+	}
+	if alice.EmbeddingStale != "true" || alice.Status != PilotStatusOK {
+		t.Errorf("embedding_stale = %q, status %q; want flagged and ok", alice.EmbeddingStale, alice.Status)
+	}
+	if !strings.Contains(logs.String(), `warning: keeping the stored embedding of "alice"`) {
+		t.Errorf("log doesn't mention keeping alice's embedding:\n%s", logs)
+	}
+	// Nothing stored to fall back on isn't the same as having no embedding
+	if bob, err := GetPilotFromServer(ctx, api_client, "bob"); err != nil || bob.Embedding != nil || bob.Status != PilotStatusOK {
+		t.Errorf("bob = %+v (%v), want no embedding but status ok", bob, err)
+	}
+
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{*alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	if got := fr.hash(0, pilotKey("alice"))["embedding_stale"]; got != "true" {
+		t.Errorf("stored embedding_stale = %q, want true", got)
+	}
+	if pilot_hashes["alice"].Embedding != 0 {
+		t.Error("stale embedding hashed, so it wouldn't be rewritten once it comes through")
+	}
+
+	cloud.setHandler(nil)
+	if alice, err = GetPilotFromServer(ctx, api_client, "alice"); err != nil || alice.EmbeddingStale != "" {
+		t.Fatalf("once fetchable: %+v (%v), want it no longer stale", alice, err)
+	}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{*alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if _, ok := fr.hash(0, pilotKey("alice"))["embedding_stale"]; ok {
+		t.Error("embedding_stale kept after the embedding came through")
+	}
+	value, _ := fr.get(0, embeddingKey("alice"))
+	if embedding, err := decodeStoredEmbedding(value); err != nil || !slices.Equal(embedding, []float64{3, 4}) {
+		t.Errorf("stored embedding = %v (%v), want the fetched one", embedding, err)
+	}
+
+	useConfig(t, map[string]string{"DEGRADED_EMBEDDINGS": "false"})
+	cloud.setHandler(failing)
+	if _, err := GetPilotFromServer(ctx, api_client, "alice"); err == nil {
+		t.Error("fetch failure ignored without DEGRADED_EMBEDDINGS")
+	}
+}
+
+func TestExtraFiles(t *testing.T) {
+	useConfig(t, map[string]string{"EXTRA_FILES": "licence.txt=licence,medical.txt=medical"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	cloud.setFile(homeFile("alice", "licence.txt"), "ATPL-123\r\n")
+	api_client := cloud.connect()
+
+	alice, err := GetPilotFromServer(ctx, api_client, "alice")
+	if err != nil {
+		t.Fatalf("GetPilotFromServer: %v", err)
+	}
+	// The missing medical.txt is left out, trailing newlines trimmed
+	if want := map[string]string{"licence": "ATPL-123"}; !maps.Equal(alice.ExtraFiles, want) {
+		t.Fatalf("extra files = %v, want %v", alice.ExtraFiles, want)
+	}
+
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{*alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	if got := fr.hash(0, pilotKey("alice"))["licence"]; got != "ATPL-123" {
+		t.Errorf("licence = %q, want the file mirrored", got)
+	}
+
+	// Gone from the cloud, so gone from the hash
+	alice.ExtraFiles = map[string]string{"medical": "class 1"}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{*alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	fields := fr.hash(0, pilotKey("alice"))
+	if _, ok := fields["licence"]; ok || fields["medical"] != "class 1" {
+		t.Errorf("fields = %v, want medical mirrored and licence removed", fields)
+	}
+
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if strings.HasSuffix(command, "/licence.txt") {
+			return "", "cat: permission denied\n", 1, true
+		}
+		return "", "", 0, false
+	})
+	if _, err := GetPilotFromServer(ctx, api_client, "alice"); err == nil || !strings.Contains(err.Error(), "failed to get licence.txt") {
+		t.Errorf("GetPilotFromServer = %v, want the unreadable licence.txt failing the pilot", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Pilot hashes and embeddings are written and deleted as separate operations, so a crash between
+// them can leave one side behind. The compactor periodically reconciles the two key spaces.
+
+func Compactor(rdb *redis.Client, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := compactOrphans(context.Background(), rdb); err != nil {
+			log.Println("failed to compact orphaned keys: ", err)
+		}
+	}
+}
+
+// compactOrphans deletes embeddings whose pilot hash is gone, and clears primary_embedding on
+// pilots whose embedding is gone
+func compactOrphans(ctx context.Context, rdb *redis.Client) error {
+	iter := rdb.Scan(ctx, 0, embeddingKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		username, ok := usernameFromKey(iter.Val(), embeddingKey)
+		if !ok {
+			continue
+		}
+		exists, err := rdb.Exists(ctx, pilotKey(username)).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 && checkWrite(rdb.Del(ctx, iter.Val()).Err(), "remove orphaned embedding %q", username) {
+			log.Printf("Removed orphaned embedding for %q", username)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	iter = rdb.Scan(ctx, 0, pilotKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		primary, err := rdb.HGet(ctx, iter.Val(), "primary_embedding").Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		exists, err := rdb.Exists(ctx, primary).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 && checkWrite(rdb.HDel(ctx, iter.Val(), "primary_embedding").Err(), "clear primary_embedding on %q", iter.Val()) {
+			log.Printf("Cleared dangling primary_embedding on %s", iter.Val())
+		}
+	}
+	return iter.Err()
+}
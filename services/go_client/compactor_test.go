@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompactOrphans(t *testing.T) {
+	for _, scheme := range []string{"flat", "cluster"} {
+		t.Run(scheme, func(t *testing.T) {
+			useConfig(t, map[string]string{"KEY_SCHEME": scheme})
+			captureLog(t)
+			fr := newFakeRedis(t)
+			rdb := fr.client(0)
+			ctx := context.Background()
+
+			alice := PilotInfo{Username: "alice", Embedding: []float64{1, 2}, Status: PilotStatusOK}
+			alice.PrimaryEmbedding = primaryEmbeddingKey("alice", "", alice.Embedding)
+			if err := writePilotParts(ctx, rdb, alice, true, true); err != nil {
+				t.Fatalf("seeding: %v", err)
+			}
+			// bob's hash is gone, carol's embedding is gone, dave never had one
+			rdb.Set(ctx, embeddingKey("bob"), testEmbedding(1, 2), 0)
+			rdb.HSet(ctx, pilotKey("carol"), "pilot_username", "carol", "primary_embedding", embeddingKey("carol"))
+			rdb.HSet(ctx, pilotKey("dave"), "pilot_username", "dave")
+
+			if err := compactOrphans(ctx, rdb); err != nil {
+				t.Fatalf("compactOrphans: %v", err)
+			}
+			if !fr.exists(0, embeddingKey("alice")) || fr.hash(0, pilotKey("alice"))["primary_embedding"] != alice.PrimaryEmbedding {
+				t.Error("compacted a complete pilot")
+			}
+			if fr.exists(0, embeddingKey("bob")) {
+				t.Error("orphaned embedding not removed")
+			}
+			if fields := fr.hash(0, pilotKey("carol")); fields["pilot_username"] != "carol" {
+				t.Error("removed the pilot with a dangling primary_embedding")
+			} else if _, ok := fields["primary_embedding"]; ok {
+				t.Error("dangling primary_embedding not cleared")
+			}
+			if fields := fr.hash(0, pilotKey("dave")); len(fields) != 1 {
+				t.Errorf("pilot without an embedding changed to %v", fields)
+			}
+
+			// Nothing's left to do the second time around
+			before := len(fr.commands())
+			if err := compactOrphans(ctx, rdb); err != nil {
+				t.Fatalf("compactOrphans: %v", err)
+			}
+			for _, command := range fr.commands()[before:] {
+				if command == "DEL" || command == "HDEL" {
+					t.Fatalf("second pass ran %s", command)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,803 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type Config struct {
+	// Which subsystems run in this process: "all", "sync" or "request"
+	Mode string `env:"MODE"`
+
+	// REDIS_URL (redis:// or rediss://) takes precedence over the discrete REDIS_* vars
+	RedisURL      string `env:"REDIS_URL"`
+	RedisHost     string `env:"REDIS_HOST"`
+	RedisPort     int    `env:"REDIS_PORT"`
+	RedisPassword string `env:"REDIS_PASSWORD" secret:"true"`
+	RedisDB       int    `env:"REDIS_DB"`
+	// Connect without the password when the server turns out not to require one
+	RedisPasswordOptional bool `env:"REDIS_PASSWORD_OPTIONAL"`
+	// DB the sync side writes pilot data to, while requests keep being served from REDIS_DB (-1: the
+	// same DB). Lets a migration fill a staging DB before consumers cut over to it. The control keys
+	// the sync side watches (resync, sync_lock) move with it.
+	RedisWriteDB int `env:"REDIS_WRITE_DB"`
+	// Highest DB index the server accepts (REDIS_MAX_DB, "databases" - 1 in redis.conf)
+	RedisMaxDB int `env:"REDIS_MAX_DB"`
+
+	// Per-pilot key layout: "flat" (cognicore:data:pilot:<username>) or "cluster", which
+	// hash-tags the username so a pilot's keys share a Redis Cluster slot
+	KeyScheme string `env:"KEY_SCHEME"`
+
+	// How long startup waits for Redis to answer PING; 0 waits forever
+	RedisReadyTimeout time.Duration `env:"REDIS_READY_TIMEOUT"`
+
+	APIUsername string `env:"API_USERNAME"`
+	APIPassword string `env:"API_PASSWORD" secret:"true"`
+	// API_URL may list fallback endpoints after the primary, comma-separated
+	APIURLs []string `env:"API_URL,API_URL_FALLBACK"`
+
+	// Dotted JSON paths stripped from pilot profiles before they're stored in Redis
+	RedactProfileFields []string `env:"REDACT_PROFILE_FIELDS"`
+
+	// AES key (base64, 16/24/32 bytes) for encrypting embeddings at rest; with ENCRYPT_PROFILES
+	// personal_data is encrypted too
+	EncryptionKey   []byte `env:"ENCRYPTION_KEY" secret:"true"`
+	EncryptProfiles bool   `env:"ENCRYPT_PROFILES"`
+
+	// HMAC key (base64, at least 16 bytes) signing the pilot hash fields consumers trust for
+	// authentication (see signing.go)
+	SigningKey []byte `env:"PILOT_SIGNING_KEY" secret:"true"`
+
+	// Profile paths (dotted, as in REDACT_PROFILE_FIELDS) promoted to pilot hash fields of their
+	// own, from PROFILE_FIELD_MAP="path=field,..."; personal_data keeps the whole profile
+	ProfileFieldMap map[string]string `env:"PROFILE_FIELD_MAP"`
+
+	// Profile path (dotted) of a stable pilot ID, stored as pilot_id; with it, a pilot who
+	// disappears while a new username with their ID appears is migrated rather than purged
+	PilotIDField string `env:"PILOT_ID_FIELD"`
+	// Profile path (dotted) naming the embedding key that's the pilot's primary one (see
+	// primaryEmbedding); without it the newest enrollment is primary
+	PrimaryEmbeddingField string `env:"PRIMARY_EMBEDDING_FIELD"`
+
+	// Candidate file names in a pilot's home, tried in order (PROFILE_FILENAMES and
+	// EMBEDDING_FILENAMES, comma-separated)
+	ProfileFilenames   []string `env:"PROFILE_FILENAMES"`
+	EmbeddingFilenames []string `env:"EMBEDDING_FILENAMES"`
+
+	// Further files of a pilot's home mirrored to pilot hash fields, from EXTRA_FILES="file=field,..."
+	ExtraFiles map[string]string `env:"EXTRA_FILES"`
+
+	// Directory of the flight files, relative to the API account's home (may be nested)
+	FlightsDir string `env:"FLIGHTS_DIR"`
+
+	// Prepended to commands that write flights (e.g. to run them as a restricted account)
+	FlightCommandPrefix string `env:"FLIGHT_COMMAND_PREFIX"`
+
+	// Write flight files gzipped (and base64'd); off by default so they stay readable on the cloud
+	CompressFlights bool `env:"COMPRESS_FLIGHTS"`
+
+	// Open flights older than this are finalized on the next pilot request, which starts a new
+	// one, however recently they were used (syncs don't count); 0 keeps flights open until deauth
+	MaxFlightDuration time.Duration `env:"MAX_FLIGHT_DURATION"`
+
+	// Username of a pilot pinned as authenticated for bench testing
+	TestPilot string `env:"TEST_PILOT"`
+
+	// Check the embedding file's size and mtime before pulling it, and reuse the cached embedding
+	// when they're unchanged (costs an ls per pilot, saves the transfer)
+	EmbeddingFingerprints bool `env:"EMBEDDING_FINGERPRINTS"`
+
+	// "preserve" treats usernames differing only by case as different pilots; "lower" stores them
+	// under lowercased keys, skipping (loudly) cloud pilots whose names collide that way
+	UsernameCase string `env:"USERNAME_CASE"`
+
+	// Keep pilots marked manual=true even though the cloud doesn't list them
+	PreserveManualPilots bool `env:"PRESERVE_MANUAL_PILOTS"`
+
+	// Cloud command printing every pilot's files at once (see batch.go); unset fetches each
+	// file with its own cat
+	BatchFetchCommand string `env:"BATCH_FETCH_COMMAND"`
+
+	// Cloud command printing the expected pilot count, optionally followed by a sha256 of the
+	// sorted usernames; when set, cycles whose listing doesn't match it don't delete pilots
+	PilotCountCommand string `env:"PILOT_COUNT_COMMAND"`
+
+	// Largest profile JSON stored in Redis (0 is unlimited); over it, PROFILE_SIZE_POLICY
+	// decides between "reject" (skip the pilot) and "summary" (top-level scalars only)
+	ProfileMaxBytes   int    `env:"PROFILE_MAX_BYTES"`
+	ProfileSizePolicy string `env:"PROFILE_SIZE_POLICY"`
+
+	// Element type of embedding files: "float64" or "float32"
+	EmbeddingDtype string `env:"EMBEDDING_DTYPE"`
+
+	// What to do with an embedding file that exists but is empty: "ignore" (treat as no embedding) or "error" (skip that pilot)
+	EmptyEmbeddingPolicy string `env:"EMPTY_EMBEDDING_POLICY"`
+
+	// What to do with an embedding containing NaN or Inf: "reject" it (treated like one that
+	// can't be decoded) or "flag" it, storing it with those values zeroed and status non_finite
+	NonFiniteEmbeddingPolicy string `env:"NON_FINITE_EMBEDDING_POLICY"`
+
+	// Keep syncing profiles when a pilot's embedding can't be fetched, holding on to the stored
+	// embedding and flagging it embedding_stale=true, instead of failing the pilot
+	DegradedEmbeddings bool `env:"DEGRADED_EMBEDDINGS"`
+
+	// What to do with pilots that have no embedding file: "store" them like any other, "mark"
+	// them recognizable=false, or "skip" them (not stored, and removed if they were)
+	NoEmbeddingPolicy string `env:"NO_EMBEDDING_POLICY"`
+
+	// Lifetime of the authenticated flag by match confidence (see authTTL); 0 never expires
+	AuthConfidenceHigh float64       `env:"AUTH_CONFIDENCE_HIGH"`
+	AuthTTLLow         time.Duration `env:"AUTH_TTL_LOW"`
+	AuthTTLHigh        time.Duration `env:"AUTH_TTL_HIGH"`
+
+	// Upper bound on pilot fetches in flight against the cloud, shared by every subsystem
+	PilotFetchConcurrency int `env:"PILOT_FETCH_CONCURRENCY"`
+
+	// How often orphaned pilot/embedding keys are reconciled; 0 disables the compactor
+	CompactInterval time.Duration `env:"COMPACT_INTERVAL"`
+
+	// How often every cached embedding is checked against the cloud; 0 (the default) disables it,
+	// as it pulls every embedding
+	EmbeddingAuditInterval time.Duration `env:"EMBEDDING_AUDIT_INTERVAL"`
+
+	// How often the idle command socket is pinged; 0 disables the keepalive
+	KeepaliveInterval time.Duration `env:"KEEPALIVE_INTERVAL"`
+
+	// Finalize authenticated pilots' open flights on SIGINT/SIGTERM, within ShutdownTimeout
+	FinalizeFlightsOnShutdown bool          `env:"FINALIZE_FLIGHTS_ON_SHUTDOWN"`
+	ShutdownTimeout           time.Duration `env:"SHUTDOWN_TIMEOUT"`
+
+	// Minimum time between two syncs, scheduled or forced
+	MinSyncInterval time.Duration `env:"MIN_SYNC_INTERVAL"`
+
+	// Bounds of the sync period with adaptive syncing, which shortens it while cycles find
+	// changes and stretches it while they don't (0 for both keeps the fixed period)
+	SyncPeriodMin time.Duration `env:"ADAPTIVE_SYNC_MIN"`
+	SyncPeriodMax time.Duration `env:"ADAPTIVE_SYNC_MAX"`
+
+	// Lease of the lock that lets only one of several redundant syncers sync (0: no lock, every
+	// syncer syncs); see leader.go
+	SyncLockTTL time.Duration `env:"SYNC_LOCK_TTL"`
+
+	// With SYNC_LOG_SUMMARY, sync cycles that changed nothing are only logged at debug, and a
+	// rollup of every cycle is logged this often instead (0 logs every cycle)
+	SyncLogSummary time.Duration `env:"SYNC_LOG_SUMMARY"`
+
+	// Pilots are flagged stale=true once no sync has succeeded for this long (0 never flags them)
+	MaxStaleness time.Duration `env:"MAX_STALENESS"`
+
+	// The sync watchdog acts once no sync cycle finished in WATCHDOG_MULTIPLE sync periods
+	// (0 disables it): WATCHDOG_ACTION "log", "reconnect" or "exit"
+	WatchdogMultiple int    `env:"WATCHDOG_MULTIPLE"`
+	WatchdogAction   string `env:"WATCHDOG_ACTION"`
+
+	// Consecutive failed connects that open the cloud circuit breaker (0 disables it), and how
+	// long it stays open before a connect is tried again
+	BreakerThreshold int           `env:"BREAKER_THRESHOLD"`
+	BreakerCooldown  time.Duration `env:"BREAKER_COOLDOWN"`
+
+	// Cache misses of the same pilot are fetched at most once per FETCH_DEBOUNCE
+	FetchDebounce time.Duration `env:"FETCH_DEBOUNCE"`
+
+	// How often commands safe to repeat are retried after a transport failure (see runCommandWithInput)
+	CommandRetries int `env:"COMMAND_RETRIES"`
+
+	// Longest stderr included in command failure messages, in bytes (0 is unlimited)
+	MaxStderrLog int `env:"MAX_STDERR_LOG"`
+
+	// Most output (stdout and stderr together, in bytes) a command may produce before it's
+	// aborted (0 is unlimited)
+	MaxCommandOutput int `env:"MAX_COMMAND_OUTPUT"`
+
+	// Dormant (unauthenticated) pilots refreshed per sync cycle, in rotation; authenticated and
+	// new pilots are refreshed every cycle regardless (0 refreshes everyone every cycle)
+	DormantPilotsPerCycle int `env:"DORMANT_PILOTS_PER_CYCLE"`
+
+	// How long tombstones of deleted pilots are kept (0 records none), and whether deleting a
+	// pilot removes their keys (see tombstone.go)
+	TombstoneTTL    time.Duration `env:"TOMBSTONE_TTL"`
+	DeletePilotKeys bool          `env:"PILOT_DELETE_KEYS"`
+
+	// Where sync writes pilots: "keys", "json" and/or "stream" (PILOT_OUTPUTS, see stream.go), and the
+	// approximate length the stream is trimmed to
+	PilotOutputs      []string `env:"PILOT_OUTPUTS"`
+	PilotStreamMaxLen int      `env:"PILOT_STREAM_MAX_LEN"`
+
+	// Local command or URL notified after each successful sync, and how long it may take (see hook.go)
+	PostSyncHook        string        `env:"POST_SYNC_HOOK"`
+	PostSyncHookTimeout time.Duration `env:"POST_SYNC_HOOK_TIMEOUT"`
+
+	// Pilot audit log limits: entries kept (0 disables the log) and how long they're kept
+	AuditLogMaxEntries int           `env:"AUDIT_LOG_MAX_ENTRIES"`
+	AuditLogMaxAge     time.Duration `env:"AUDIT_LOG_MAX_AGE"`
+
+	// How many pilots may have a request waiting to be handled before the oldest is dropped
+	MaxPendingRequests int `env:"MAX_PENDING_REQUESTS"`
+	// A pilot request for another pilot cancels the one being handled and drops pending ones, so
+	// a face flickering past the camera isn't authenticated after the current one
+	SupersedePilotRequests bool `env:"SUPERSEDE_PILOT_REQUESTS"`
+
+	// Check at startup that keyspace notifications actually arrive (KEYSPACE_SELF_TEST=false skips it)
+	KeyspaceSelfTest bool `env:"KEYSPACE_SELF_TEST"`
+
+	// MAINTENANCE forces maintenance mode regardless of the control key; with
+	// MAINTENANCE_PAUSE_REQUESTS, pilot requests are ignored during maintenance as well as syncs
+	Maintenance               bool `env:"MAINTENANCE"`
+	MaintenancePausesRequests bool `env:"MAINTENANCE_PAUSE_REQUESTS"`
+
+	// Address for the /metrics and /healthz endpoints; empty disables the HTTP server
+	HTTPAddr string `env:"HTTP_ADDR"`
+
+	Debug bool `env:"LOG_LEVEL"`
+}
+
+// cfg holds the effective configuration, loaded once at startup
+var cfg Config
+
+func LoadConfig() (Config, error) {
+	config := Config{
+		Mode: "all",
+
+		RedisHost: "localhost",
+		RedisPort: 6379,
+		// Redis' default "databases 16"
+		RedisMaxDB:   15,
+		RedisWriteDB: -1,
+		KeyScheme:    "flat",
+		UsernameCase: "preserve",
+
+		RedisReadyTimeout: time.Minute,
+		KeepaliveInterval: time.Minute,
+		ShutdownTimeout:   10 * time.Second,
+		CompactInterval:   time.Hour,
+
+		MinSyncInterval:  30 * time.Second,
+		WatchdogMultiple: 3,
+
+		MaxPendingRequests: 256,
+		BreakerThreshold:   5,
+		BreakerCooldown:    30 * time.Second,
+		MaxStderrLog:       512,
+		MaxCommandOutput:   64 << 20,
+		CommandRetries:     1,
+		FetchDebounce:      30 * time.Second,
+		AuditLogMaxEntries: 1000,
+		AuditLogMaxAge:     24 * time.Hour,
+		WatchdogAction:     "log",
+		KeyspaceSelfTest:   true,
+
+		PostSyncHookTimeout: 10 * time.Second,
+
+		PilotOutputs:      []string{"keys"},
+		DeletePilotKeys:   true,
+		PilotStreamMaxLen: 10000,
+
+		FlightsDir:               "flights",
+		ProfileFilenames:         []string{"user.profile"},
+		EmbeddingFilenames:       []string{"user.embedding"},
+		ProfileSizePolicy:        "reject",
+		EmbeddingDtype:           "float64",
+		EmptyEmbeddingPolicy:     "ignore",
+		NonFiniteEmbeddingPolicy: "reject",
+		NoEmbeddingPolicy:        "store",
+		PilotFetchConcurrency:    4,
+		AuthConfidenceHigh:       0.9,
+	}
+
+	if mode := os.Getenv("MODE"); mode != "" {
+		if mode != "all" && mode != "sync" && mode != "request" {
+			return config, fmt.Errorf("invalid MODE %q (expected all, sync or request)", mode)
+		}
+		config.Mode = mode
+	}
+
+	config.RedisURL = os.Getenv("REDIS_URL")
+	if config.RedisURL != "" {
+		if _, err := redis.ParseURL(config.RedisURL); err != nil {
+			return config, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+	}
+	if host := os.Getenv("REDIS_HOST"); host != "" {
+		config.RedisHost = host
+	}
+	if err := envInt("REDIS_PORT", &config.RedisPort); err != nil {
+		return config, err
+	}
+	config.RedisPassword = os.Getenv("REDIS_PASSWORD")
+	if err := envBool("REDIS_PASSWORD_OPTIONAL", &config.RedisPasswordOptional); err != nil {
+		return config, err
+	}
+	if err := envInt("REDIS_DB", &config.RedisDB); err != nil {
+		return config, err
+	}
+	if err := envInt("REDIS_MAX_DB", &config.RedisMaxDB); err != nil {
+		return config, err
+	}
+	if err := envInt("REDIS_WRITE_DB", &config.RedisWriteDB); err != nil {
+		return config, err
+	}
+
+	if scheme := os.Getenv("KEY_SCHEME"); scheme != "" {
+		if scheme != "flat" && scheme != "cluster" {
+			return config, fmt.Errorf("invalid KEY_SCHEME %q (expected flat or cluster)", scheme)
+		}
+		config.KeyScheme = scheme
+	}
+
+	config.APIUsername = os.Getenv("API_USERNAME")
+	config.APIPassword = os.Getenv("API_PASSWORD")
+	config.APIURLs = envList("API_URL")
+	if fallback := os.Getenv("API_URL_FALLBACK"); fallback != "" {
+		config.APIURLs = append(config.APIURLs, fallback)
+	}
+	if config.APIUsername == "" {
+		return config, fmt.Errorf("API_USERNAME missing")
+	}
+	if config.APIPassword == "" {
+		return config, fmt.Errorf("API_PASSWORD missing")
+	}
+	if len(config.APIURLs) == 0 {
+		return config, fmt.Errorf("API_URL missing")
+	}
+	for i, api_url := range config.APIURLs {
+		// The socket URL is derived from the scheme, so a schemeless URL would only fail on connect
+		u, err := url.Parse(api_url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return config, fmt.Errorf("invalid API_URL/API_URL_FALLBACK %q (expected an http:// or https:// URL, e.g. https://cloud.example.com/api)", api_url)
+		}
+		// url.Parse lowercases the scheme; socketURL, matching it literally, needs the same
+		config.APIURLs[i] = strings.TrimSuffix(u.Scheme+api_url[len(u.Scheme):], "/")
+	}
+
+	config.RedactProfileFields = envList("REDACT_PROFILE_FIELDS")
+	config.ProfileFieldMap = map[string]string{}
+	for _, entry := range envList("PROFILE_FIELD_MAP") {
+		profile_path, field, ok := strings.Cut(entry, "=")
+		profile_path, field = strings.TrimSpace(profile_path), strings.TrimSpace(field)
+		if !ok || profile_path == "" || !plain_name.MatchString(field) || slices.Contains(reservedPilotFields, field) {
+			return config, fmt.Errorf("invalid PROFILE_FIELD_MAP entry %q (expected path=field, with a field name the pilot hash doesn't use)", entry)
+		}
+		config.ProfileFieldMap[profile_path] = field
+	}
+	config.PilotIDField = strings.TrimSpace(os.Getenv("PILOT_ID_FIELD"))
+	config.PrimaryEmbeddingField = strings.TrimSpace(os.Getenv("PRIMARY_EMBEDDING_FIELD"))
+	if names := envList("PROFILE_FILENAMES"); len(names) != 0 {
+		config.ProfileFilenames = names
+	}
+	if names := envList("EMBEDDING_FILENAMES"); len(names) != 0 {
+		config.EmbeddingFilenames = names
+	}
+	for _, name := range append(config.ProfileFilenames, config.EmbeddingFilenames...) {
+		if !validFilename(name) {
+			return config, fmt.Errorf("invalid file name %q in PROFILE_FILENAMES/EMBEDDING_FILENAMES", name)
+		}
+	}
+	config.ExtraFiles = map[string]string{}
+	taken_fields := append(slices.Clone(reservedPilotFields), slices.Collect(maps.Values(config.ProfileFieldMap))...)
+	for _, entry := range envList("EXTRA_FILES") {
+		name, field, ok := strings.Cut(entry, "=")
+		name, field = strings.TrimSpace(name), strings.TrimSpace(field)
+		taken := slices.Contains(taken_fields, field)
+		taken_fields = append(taken_fields, field)
+		if !ok || !validFilename(name) || !plain_name.MatchString(field) || taken {
+			return config, fmt.Errorf("invalid EXTRA_FILES entry %q (expected file=field, with a field name the pilot hash doesn't use)", entry)
+		}
+		config.ExtraFiles[name] = field
+	}
+	if key := os.Getenv("ENCRYPTION_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			return config, fmt.Errorf("invalid ENCRYPTION_KEY: %w", err)
+		}
+		if len(decoded) != 16 && len(decoded) != 24 && len(decoded) != 32 {
+			return config, fmt.Errorf("invalid ENCRYPTION_KEY: %d bytes (expected 16, 24 or 32)", len(decoded))
+		}
+		config.EncryptionKey = decoded
+	}
+	if err := envBool("ENCRYPT_PROFILES", &config.EncryptProfiles); err != nil {
+		return config, err
+	}
+	if key := os.Getenv("PILOT_SIGNING_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			return config, fmt.Errorf("invalid PILOT_SIGNING_KEY: %w", err)
+		}
+		if len(decoded) < 16 {
+			return config, fmt.Errorf("invalid PILOT_SIGNING_KEY: %d bytes (expected at least 16)", len(decoded))
+		}
+		config.SigningKey = decoded
+	}
+	if config.EncryptProfiles && config.EncryptionKey == nil {
+		return config, fmt.Errorf("ENCRYPT_PROFILES requires ENCRYPTION_KEY")
+	}
+	if dir := strings.TrimSpace(os.Getenv("FLIGHTS_DIR")); dir != "" {
+		if !validFlightsDir(dir) {
+			return config, fmt.Errorf("invalid FLIGHTS_DIR %q (expected a relative path of plain names)", dir)
+		}
+		config.FlightsDir = dir
+	}
+	config.FlightCommandPrefix = strings.TrimSpace(os.Getenv("FLIGHT_COMMAND_PREFIX"))
+	if config.FlightCommandPrefix != "" && !validCommandPrefix(config.FlightCommandPrefix) {
+		return config, fmt.Errorf("invalid FLIGHT_COMMAND_PREFIX %q", config.FlightCommandPrefix)
+	}
+	if err := envBool("COMPRESS_FLIGHTS", &config.CompressFlights); err != nil {
+		return config, err
+	}
+	if err := envDuration("MAX_FLIGHT_DURATION", &config.MaxFlightDuration); err != nil {
+		return config, err
+	}
+	config.TestPilot = os.Getenv("TEST_PILOT")
+	if config.TestPilot != "" && !validUsername(config.TestPilot) {
+		return config, fmt.Errorf("invalid TEST_PILOT %q", config.TestPilot)
+	}
+	if err := envBool("EMBEDDING_FINGERPRINTS", &config.EmbeddingFingerprints); err != nil {
+		return config, err
+	}
+	if username_case := os.Getenv("USERNAME_CASE"); username_case != "" {
+		if username_case != "preserve" && username_case != "lower" {
+			return config, fmt.Errorf("invalid USERNAME_CASE %q (expected preserve or lower)", username_case)
+		}
+		config.UsernameCase = username_case
+	}
+	if err := envBool("PRESERVE_MANUAL_PILOTS", &config.PreserveManualPilots); err != nil {
+		return config, err
+	}
+	config.PilotCountCommand = strings.TrimSpace(os.Getenv("PILOT_COUNT_COMMAND"))
+	config.BatchFetchCommand = strings.TrimSpace(os.Getenv("BATCH_FETCH_COMMAND"))
+	if err := envInt("PROFILE_MAX_BYTES", &config.ProfileMaxBytes); err != nil {
+		return config, err
+	}
+	if policy := os.Getenv("PROFILE_SIZE_POLICY"); policy != "" {
+		if policy != "reject" && policy != "summary" {
+			return config, fmt.Errorf("invalid PROFILE_SIZE_POLICY %q (expected reject or summary)", policy)
+		}
+		config.ProfileSizePolicy = policy
+	}
+	if dtype := os.Getenv("EMBEDDING_DTYPE"); dtype != "" {
+		if dtype != "float64" && dtype != "float32" {
+			return config, fmt.Errorf("invalid EMBEDDING_DTYPE %q (expected float64 or float32)", dtype)
+		}
+		config.EmbeddingDtype = dtype
+	}
+	if policy := os.Getenv("EMPTY_EMBEDDING_POLICY"); policy != "" {
+		if policy != "ignore" && policy != "error" {
+			return config, fmt.Errorf("invalid EMPTY_EMBEDDING_POLICY %q (expected ignore or error)", policy)
+		}
+		config.EmptyEmbeddingPolicy = policy
+	}
+	if err := envBool("DEGRADED_EMBEDDINGS", &config.DegradedEmbeddings); err != nil {
+		return config, err
+	}
+	if policy := os.Getenv("NON_FINITE_EMBEDDING_POLICY"); policy != "" {
+		if policy != "reject" && policy != "flag" {
+			return config, fmt.Errorf("invalid NON_FINITE_EMBEDDING_POLICY %q (expected reject or flag)", policy)
+		}
+		config.NonFiniteEmbeddingPolicy = policy
+	}
+	if policy := os.Getenv("NO_EMBEDDING_POLICY"); policy != "" {
+		if policy != "store" && policy != "mark" && policy != "skip" {
+			return config, fmt.Errorf("invalid NO_EMBEDDING_POLICY %q (expected store, mark or skip)", policy)
+		}
+		config.NoEmbeddingPolicy = policy
+	}
+	if err := envInt("PILOT_FETCH_CONCURRENCY", &config.PilotFetchConcurrency); err != nil {
+		return config, err
+	}
+	if value := os.Getenv("AUTH_CONFIDENCE_HIGH"); value != "" {
+		confidence, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid AUTH_CONFIDENCE_HIGH: %w", err)
+		}
+		config.AuthConfidenceHigh = confidence
+	}
+	if err := envDuration("AUTH_TTL_LOW", &config.AuthTTLLow); err != nil {
+		return config, err
+	}
+	if err := envDuration("AUTH_TTL_HIGH", &config.AuthTTLHigh); err != nil {
+		return config, err
+	}
+	if err := envDuration("REDIS_READY_TIMEOUT", &config.RedisReadyTimeout); err != nil {
+		return config, err
+	}
+	if err := envDuration("COMPACT_INTERVAL", &config.CompactInterval); err != nil {
+		return config, err
+	}
+	if err := envDuration("EMBEDDING_AUDIT_INTERVAL", &config.EmbeddingAuditInterval); err != nil {
+		return config, err
+	}
+	if err := envDuration("KEEPALIVE_INTERVAL", &config.KeepaliveInterval); err != nil {
+		return config, err
+	}
+	if err := envBool("FINALIZE_FLIGHTS_ON_SHUTDOWN", &config.FinalizeFlightsOnShutdown); err != nil {
+		return config, err
+	}
+	if err := envDuration("SHUTDOWN_TIMEOUT", &config.ShutdownTimeout); err != nil {
+		return config, err
+	}
+	if err := envDuration("MIN_SYNC_INTERVAL", &config.MinSyncInterval); err != nil {
+		return config, err
+	}
+	if err := envInt("WATCHDOG_MULTIPLE", &config.WatchdogMultiple); err != nil {
+		return config, err
+	}
+	if action := os.Getenv("WATCHDOG_ACTION"); action != "" {
+		if action != "log" && action != "reconnect" && action != "exit" {
+			return config, fmt.Errorf("invalid WATCHDOG_ACTION %q (expected log, reconnect or exit)", action)
+		}
+		config.WatchdogAction = action
+	}
+	if err := envInt("BREAKER_THRESHOLD", &config.BreakerThreshold); err != nil {
+		return config, err
+	}
+	if err := envDuration("BREAKER_COOLDOWN", &config.BreakerCooldown); err != nil {
+		return config, err
+	}
+	if err := envDuration("FETCH_DEBOUNCE", &config.FetchDebounce); err != nil {
+		return config, err
+	}
+	if err := envDuration("ADAPTIVE_SYNC_MIN", &config.SyncPeriodMin); err != nil {
+		return config, err
+	}
+	if err := envDuration("ADAPTIVE_SYNC_MAX", &config.SyncPeriodMax); err != nil {
+		return config, err
+	}
+	if err := envDuration("SYNC_LOCK_TTL", &config.SyncLockTTL); err != nil {
+		return config, err
+	}
+	if err := envDuration("SYNC_LOG_SUMMARY", &config.SyncLogSummary); err != nil {
+		return config, err
+	}
+	if err := envDuration("MAX_STALENESS", &config.MaxStaleness); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_STDERR_LOG", &config.MaxStderrLog); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_COMMAND_OUTPUT", &config.MaxCommandOutput); err != nil {
+		return config, err
+	}
+	if err := envInt("COMMAND_RETRIES", &config.CommandRetries); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_PENDING_REQUESTS", &config.MaxPendingRequests); err != nil {
+		return config, err
+	}
+	if err := envBool("SUPERSEDE_PILOT_REQUESTS", &config.SupersedePilotRequests); err != nil {
+		return config, err
+	}
+	if err := envInt("DORMANT_PILOTS_PER_CYCLE", &config.DormantPilotsPerCycle); err != nil {
+		return config, err
+	}
+	if err := envDuration("TOMBSTONE_TTL", &config.TombstoneTTL); err != nil {
+		return config, err
+	}
+	if err := envBool("PILOT_DELETE_KEYS", &config.DeletePilotKeys); err != nil {
+		return config, err
+	}
+	if outputs := envList("PILOT_OUTPUTS"); len(outputs) != 0 {
+		for _, output := range outputs {
+			if output != "keys" && output != "json" && output != "stream" {
+				return config, fmt.Errorf("invalid PILOT_OUTPUTS entry %q (expected keys, json or stream)", output)
+			}
+		}
+		config.PilotOutputs = outputs
+	}
+	if err := envInt("PILOT_STREAM_MAX_LEN", &config.PilotStreamMaxLen); err != nil {
+		return config, err
+	}
+	config.PostSyncHook = strings.TrimSpace(os.Getenv("POST_SYNC_HOOK"))
+	if err := envDuration("POST_SYNC_HOOK_TIMEOUT", &config.PostSyncHookTimeout); err != nil {
+		return config, err
+	}
+	if err := envInt("AUDIT_LOG_MAX_ENTRIES", &config.AuditLogMaxEntries); err != nil {
+		return config, err
+	}
+	if err := envDuration("AUDIT_LOG_MAX_AGE", &config.AuditLogMaxAge); err != nil {
+		return config, err
+	}
+	if err := envBool("KEYSPACE_SELF_TEST", &config.KeyspaceSelfTest); err != nil {
+		return config, err
+	}
+	if err := envBool("MAINTENANCE", &config.Maintenance); err != nil {
+		return config, err
+	}
+	if err := envBool("MAINTENANCE_PAUSE_REQUESTS", &config.MaintenancePausesRequests); err != nil {
+		return config, err
+	}
+	config.HTTPAddr = os.Getenv("HTTP_ADDR")
+	config.Debug = strings.EqualFold(os.Getenv("LOG_LEVEL"), "debug")
+
+	return config, config.validate()
+}
+
+// validate range-checks numeric settings, so typos fail at startup rather than as confusing
+// connection errors later
+func (c Config) validate() error {
+	if c.RedisPort < 1 || c.RedisPort > 65535 {
+		return fmt.Errorf("invalid REDIS_PORT %d (expected 1-65535)", c.RedisPort)
+	}
+	if c.RedisMaxDB < 0 {
+		return fmt.Errorf("invalid REDIS_MAX_DB %d (expected 0 or more)", c.RedisMaxDB)
+	}
+	if c.RedisDB < 0 || c.RedisDB > c.RedisMaxDB {
+		return fmt.Errorf("invalid REDIS_DB %d (expected 0-%d, see REDIS_MAX_DB)", c.RedisDB, c.RedisMaxDB)
+	}
+	if c.RedisWriteDB < -1 || c.RedisWriteDB > c.RedisMaxDB {
+		return fmt.Errorf("invalid REDIS_WRITE_DB %d (expected 0-%d, or -1 for the same DB)", c.RedisWriteDB, c.RedisMaxDB)
+	}
+	if c.RedisURL != "" {
+		if opts, err := redis.ParseURL(c.RedisURL); err == nil && opts.DB > c.RedisMaxDB {
+			return fmt.Errorf("invalid database %d in REDIS_URL (expected 0-%d, see REDIS_MAX_DB)", opts.DB, c.RedisMaxDB)
+		}
+	}
+	if c.PilotFetchConcurrency < 1 {
+		return fmt.Errorf("invalid PILOT_FETCH_CONCURRENCY %d (expected 1 or more)", c.PilotFetchConcurrency)
+	}
+	if c.BreakerThreshold < 0 {
+		return fmt.Errorf("invalid BREAKER_THRESHOLD %d (expected 0 or more)", c.BreakerThreshold)
+	}
+	if c.CommandRetries < 0 {
+		return fmt.Errorf("invalid COMMAND_RETRIES %d (expected 0 or more)", c.CommandRetries)
+	}
+	if c.MaxStderrLog < 0 {
+		return fmt.Errorf("invalid MAX_STDERR_LOG %d (expected 0 or more)", c.MaxStderrLog)
+	}
+	if (c.SyncPeriodMin != 0 || c.SyncPeriodMax != 0) && (c.SyncPeriodMin <= 0 || c.SyncPeriodMax < c.SyncPeriodMin) {
+		return fmt.Errorf("invalid ADAPTIVE_SYNC_MIN %v / ADAPTIVE_SYNC_MAX %v (expected both set, min above 0 and at most max)", c.SyncPeriodMin, c.SyncPeriodMax)
+	}
+	if !c.DeletePilotKeys && c.TombstoneTTL <= 0 {
+		return fmt.Errorf("PILOT_DELETE_KEYS=false requires TOMBSTONE_TTL, or deletions would leave no trace")
+	}
+	if c.MaxCommandOutput < 0 {
+		return fmt.Errorf("invalid MAX_COMMAND_OUTPUT %d (expected 0 or more)", c.MaxCommandOutput)
+	}
+	if c.MaxPendingRequests < 1 {
+		return fmt.Errorf("invalid MAX_PENDING_REQUESTS %d (expected 1 or more)", c.MaxPendingRequests)
+	}
+	if c.DormantPilotsPerCycle < 0 {
+		return fmt.Errorf("invalid DORMANT_PILOTS_PER_CYCLE %d (expected 0 or more)", c.DormantPilotsPerCycle)
+	}
+	if c.PilotStreamMaxLen < 1 {
+		return fmt.Errorf("invalid PILOT_STREAM_MAX_LEN %d (expected 1 or more)", c.PilotStreamMaxLen)
+	}
+	if c.PostSyncHookTimeout <= 0 {
+		return fmt.Errorf("invalid POST_SYNC_HOOK_TIMEOUT %v (expected more than 0)", c.PostSyncHookTimeout)
+	}
+	if c.AuditLogMaxEntries < 0 {
+		return fmt.Errorf("invalid AUDIT_LOG_MAX_ENTRIES %d (expected 0 or more)", c.AuditLogMaxEntries)
+	}
+	if c.WatchdogMultiple < 0 {
+		return fmt.Errorf("invalid WATCHDOG_MULTIPLE %d (expected 0 or more)", c.WatchdogMultiple)
+	}
+	if c.ProfileMaxBytes < 0 {
+		return fmt.Errorf("invalid PROFILE_MAX_BYTES %d (expected 0 or more)", c.ProfileMaxBytes)
+	}
+	if c.AuthConfidenceHigh < 0 || c.AuthConfidenceHigh > 1 {
+		return fmt.Errorf("invalid AUTH_CONFIDENCE_HIGH %v (expected 0-1)", c.AuthConfidenceHigh)
+	}
+
+	durations := map[string]time.Duration{
+		"AUTH_TTL_LOW":             c.AuthTTLLow,
+		"AUTH_TTL_HIGH":            c.AuthTTLHigh,
+		"REDIS_READY_TIMEOUT":      c.RedisReadyTimeout,
+		"COMPACT_INTERVAL":         c.CompactInterval,
+		"EMBEDDING_AUDIT_INTERVAL": c.EmbeddingAuditInterval,
+		"KEEPALIVE_INTERVAL":       c.KeepaliveInterval,
+		"SHUTDOWN_TIMEOUT":         c.ShutdownTimeout,
+		"MIN_SYNC_INTERVAL":        c.MinSyncInterval,
+		"FETCH_DEBOUNCE":           c.FetchDebounce,
+		"SYNC_LOCK_TTL":            c.SyncLockTTL,
+		"SYNC_LOG_SUMMARY":         c.SyncLogSummary,
+		"MAX_STALENESS":            c.MaxStaleness,
+		"TOMBSTONE_TTL":            c.TombstoneTTL,
+		"BREAKER_COOLDOWN":         c.BreakerCooldown,
+		"AUDIT_LOG_MAX_AGE":        c.AuditLogMaxAge,
+		"MAX_FLIGHT_DURATION":      c.MaxFlightDuration,
+	}
+	for name, duration := range durations {
+		if duration < 0 {
+			return fmt.Errorf("invalid %s %v (expected 0 or more)", name, duration)
+		}
+	}
+	return nil
+}
+
+// envList splits a comma-separated env var, dropping empty entries
+func envList(name string) []string {
+	list := make([]string, 0)
+	for item := range strings.SplitSeq(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envDuration parses a Go duration (e.g. "30s") into dst when the env var is set
+func envDuration(name string, dst *time.Duration) error {
+	if value := os.Getenv(name); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*dst = duration
+	}
+	return nil
+}
+
+// envInt parses an integer into dst when the env var is set
+func envInt(name string, dst *int) error {
+	if value := os.Getenv(name); value != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*dst = n
+	}
+	return nil
+}
+
+// envBool parses a boolean ("true", "1", "false", ...) into dst when the env var is set
+func envBool(name string, dst *bool) error {
+	if value := os.Getenv(name); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*dst = b
+	}
+	return nil
+}
+
+func (c Config) RedisOptions() *redis.Options {
+	if c.RedisURL != "" {
+		// Validated in LoadConfig
+		opts, _ := redis.ParseURL(c.RedisURL)
+		return opts
+	}
+
+	return &redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", c.RedisHost, c.RedisPort),
+		Password: c.RedisPassword,
+		DB:       c.RedisDB,
+	}
+}
+
+// RedisWriteOptions is RedisOptions on REDIS_WRITE_DB, when one is set
+func (c Config) RedisWriteOptions() *redis.Options {
+	opts := c.RedisOptions()
+	if c.RedisWriteDB >= 0 {
+		opts.DB = c.RedisWriteDB
+	}
+	return opts
+}
+
+// RedisTarget describes where RedisOptions connects, without the password
+func (c Config) RedisTarget() string {
+	opts := c.RedisOptions()
+	scheme := "redis"
+	if opts.TLSConfig != nil {
+		scheme = "rediss"
+	}
+	user := ""
+	if opts.Username != "" {
+		user = opts.Username + "@"
+	}
+	if opts.Password != "" {
+		user = opts.Username + ":***@"
+	}
+	return fmt.Sprintf("%s://%s%s/%d", scheme, user, opts.Addr, opts.DB)
+}
+
+func (c Config) APIConfig() APIConfig {
+	return APIConfig{c.APIUsername, c.APIPassword, c.APIURLs}
+}
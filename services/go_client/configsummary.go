@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// ConfigEntry is one tunable as the process resolved it. Source is "env" when any of the
+// variables feeding it was set, "default" otherwise.
+type ConfigEntry struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+const redacted = "<redacted>"
+
+// configSummary lists every Config field tagged with its env var, in declaration order. Fields
+// tagged secret are redacted when set; the userinfo password in REDIS_URL is too.
+func configSummary(c Config) []ConfigEntry {
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	entries := make([]ConfigEntry, 0, t.NumField())
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+		names := strings.Split(tag, ",")
+
+		source := "default"
+		for _, name := range names {
+			if _, ok := os.LookupEnv(name); ok {
+				source = "env"
+				break
+			}
+		}
+
+		value := formatConfigValue(v.Field(i))
+		switch {
+		case field.Tag.Get("secret") == "true" && !v.Field(i).IsZero():
+			value = redacted
+		case field.Name == "RedisURL":
+			value = redactURL(value)
+		}
+		entries = append(entries, ConfigEntry{Name: names[0], Value: value, Source: source})
+	}
+	return entries
+}
+
+func formatConfigValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return fmt.Sprintf("%d bytes", v.Len())
+		}
+		parts := make([]string, v.Len())
+		for i := range v.Len() {
+			parts[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(parts, ",")
+	case reflect.Map:
+		parts := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			parts = append(parts, fmt.Sprintf("%v=%v", iter.Key().Interface(), iter.Value().Interface()))
+		}
+		slices.Sort(parts)
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); !ok {
+		return raw
+	}
+	// Set as the password, the marker would come out percent-encoded
+	u.User = url.User(u.User.Username())
+	return strings.Replace(u.String(), "@", ":"+redacted+"@", 1)
+}
+
+// logConfigSummary prints the effective configuration once at startup, one tunable per line.
+func logConfigSummary(c Config) {
+	log.Printf("Effective configuration (version %s):", buildVersion())
+	for _, entry := range configSummary(c) {
+		log.Printf("  %s=%s (%s)", entry.Name, entry.Value, entry.Source)
+	}
+}
+
+// buildVersion is the module version, falling back to the VCS revision the binary was built from.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "devel"
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// With ENCRYPTION_KEY set, embeddings (and with ENCRYPT_PROFILES, personal_data) are stored
+// AES-GCM encrypted as "enc:v1:" + base64(nonce || ciphertext). Consumers then need the same key
+// to read them, which is the point: a shared Redis alone no longer exposes biometric data.
+// Values without the prefix are read as plaintext, so enabling encryption needs no migration.
+
+const encryptedPrefix = "enc:v1:"
+
+var ErrNoEncryptionKey = errors.New("value is encrypted but no ENCRYPTION_KEY is configured")
+
+func storageCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealValue encrypts value for storage, or returns it unchanged when encryption is off
+func sealValue(value string) (string, error) {
+	if cfg.EncryptionKey == nil {
+		return value, nil
+	}
+
+	aead, err := storageCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openValue decrypts a value written by sealValue; plaintext values are returned as they are
+func openValue(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return value, nil
+	}
+	if cfg.EncryptionKey == nil {
+		return "", ErrNoEncryptionKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	aead, err := storageCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted value: too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value (wrong ENCRYPTION_KEY?): %w", err)
+	}
+	return string(plain), nil
+}
+
+// openProfileField decrypts the personal_data of raw pilot hash fields in place
+func openProfileField(fields map[string]string) error {
+	data, ok := fields["personal_data"]
+	if !ok {
+		return nil
+	}
+	plain, err := openValue(data)
+	if err != nil {
+		return err
+	}
+	fields["personal_data"] = plain
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func useEncryptionKey(t *testing.T, key []byte) {
+	t.Helper()
+	previous := cfg.EncryptionKey
+	cfg.EncryptionKey = key
+	t.Cleanup(func() { cfg.EncryptionKey = previous })
+}
+
+func TestSealValueRoundTrip(t *testing.T) {
+	useConfig(t, nil)
+	for _, size := range []int{16, 24, 32} {
+		useEncryptionKey(t, bytes.Repeat([]byte{byte(size)}, size))
+		for _, value := range []string{"", "name: Alice", strings.Repeat("embedding", 1000)} {
+			sealed, err := sealValue(value)
+			if err != nil {
+				t.Fatalf("sealValue with a %d-byte key: %v", size, err)
+			}
+			if !strings.HasPrefix(sealed, encryptedPrefix) || (value != "" && strings.Contains(sealed, value)) {
+				t.Fatalf("sealValue(%.20q) = %.40q, want it encrypted", value, sealed)
+			}
+			opened, err := openValue(sealed)
+			if err != nil || opened != value {
+				t.Fatalf("openValue(sealValue(%.20q)) = %.20q, %v", value, opened, err)
+			}
+		}
+	}
+
+	// A fresh nonce per value, so equal values don't show as equal
+	first, _ := sealValue("same")
+	second, _ := sealValue("same")
+	if first == second {
+		t.Error("sealing the same value twice gave the same ciphertext")
+	}
+}
+
+func TestSealValuePlaintext(t *testing.T) {
+	useConfig(t, nil)
+	useEncryptionKey(t, nil)
+	sealed, err := sealValue("name: Alice")
+	if err != nil || sealed != "name: Alice" {
+		t.Fatalf("sealValue without a key = %q, %v, want it unchanged", sealed, err)
+	}
+
+	// Plaintext written before encryption was enabled still reads
+	useEncryptionKey(t, make([]byte, 32))
+	if opened, err := openValue("name: Alice"); err != nil || opened != "name: Alice" {
+		t.Fatalf("openValue of plaintext = %q, %v, want it unchanged", opened, err)
+	}
+}
+
+func TestOpenValueFailures(t *testing.T) {
+	useConfig(t, nil)
+	useEncryptionKey(t, bytes.Repeat([]byte{1}, 32))
+	sealed, err := sealValue("name: Alice")
+	if err != nil {
+		t.Fatalf("sealValue: %v", err)
+	}
+
+	useEncryptionKey(t, bytes.Repeat([]byte{2}, 32))
+	if _, err := openValue(sealed); err == nil || !strings.Contains(err.Error(), "wrong ENCRYPTION_KEY") {
+		t.Errorf("openValue with the wrong key = %v, want a decryption failure", err)
+	}
+	tampered := sealed[:len(sealed)-4] + "AAA="
+	useEncryptionKey(t, bytes.Repeat([]byte{1}, 32))
+	if _, err := openValue(tampered); err == nil {
+		t.Error("openValue accepted a tampered value")
+	}
+	for _, value := range []string{encryptedPrefix + "not base64!", encryptedPrefix + "AAAA"} {
+		if _, err := openValue(value); err == nil || !strings.Contains(err.Error(), "invalid encrypted value") {
+			t.Errorf("openValue(%q) = %v, want it rejected as invalid", value, err)
+		}
+	}
+
+	useEncryptionKey(t, nil)
+	if _, err := openValue(sealed); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Errorf("openValue without a key = %v, want ErrNoEncryptionKey", err)
+	}
+}
+
+func TestOpenProfileField(t *testing.T) {
+	useConfig(t, nil)
+	useEncryptionKey(t, make([]byte, 16))
+	sealed, _ := sealValue(`{"name":"Alice"}`)
+	fields := map[string]string{"personal_data": sealed, "status": "ok"}
+	if err := openProfileField(fields); err != nil {
+		t.Fatalf("openProfileField: %v", err)
+	}
+	if fields["personal_data"] != `{"name":"Alice"}` || fields["status"] != "ok" {
+		t.Fatalf("fields = %v", fields)
+	}
+	if err := openProfileField(map[string]string{"status": "ok"}); err != nil {
+		t.Fatalf("openProfileField without personal_data: %v", err)
+	}
+}
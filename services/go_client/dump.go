@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DumpRecord is the diagnostic view of one cached pilot
+type DumpRecord struct {
+	Key             string            `json:"key"`
+	Fields          map[string]string `json:"fields"`
+	EmbeddingLength int               `json:"embedding_length"`
+	EmbeddingHash   string            `json:"embedding_hash,omitempty"`
+	Embedding       []float64         `json:"embedding,omitempty"`
+}
+
+// RunDump writes every cached pilot to out as one JSON object per line, so large caches are
+// streamed rather than built up in memory. Usage: dump [--full]
+func RunDump(ctx context.Context, rdb *redis.Client, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	full := flags.Bool("full", false, "include the full embedding vector")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	iter := rdb.Scan(ctx, 0, pilotKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		fields, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+
+		if err := openProfileField(fields); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", key, err)
+		}
+		record := DumpRecord{Key: key, Fields: fields}
+		if username, ok := fields["pilot_username"]; ok {
+			value, err := rdb.Get(ctx, embeddingKey(username)).Result()
+			if err != nil && err != redis.Nil {
+				return fmt.Errorf("failed to read embedding for %q: %w", username, err)
+			}
+			if err == nil {
+				embedding, err := decodeStoredEmbedding(value)
+				if err != nil {
+					return fmt.Errorf("invalid stored embedding for %q: %w", username, err)
+				}
+				record.EmbeddingLength = len(embedding)
+				record.EmbeddingHash = embeddingHash(embedding)
+				if *full {
+					record.Embedding = embedding
+				}
+			}
+		}
+
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
+// embeddingHash is a short fingerprint for telling embeddings apart at a glance
+func embeddingHash(embedding []float64) string {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	for _, value := range embedding {
+		bits := math.Float64bits(value)
+		for i := range buf {
+			buf[i] = byte(bits >> (8 * i))
+		}
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
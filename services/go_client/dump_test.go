@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestRunDump(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Embedding: []float64{0.5, -1.25, 3}, Status: PilotStatusOK}
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusNoEmbedding}
+	for _, pilot := range []PilotInfo{alice, bob} {
+		if err := writePilotParts(ctx, rdb, pilot, true, true); err != nil {
+			t.Fatalf("seeding %s: %v", pilot.Username, err)
+		}
+	}
+
+	dump := func(args ...string) map[string]DumpRecord {
+		t.Helper()
+		out := &bytes.Buffer{}
+		if err := RunDump(ctx, rdb, args, out); err != nil {
+			t.Fatalf("RunDump(%v): %v", args, err)
+		}
+		records := map[string]DumpRecord{}
+		dec := json.NewDecoder(out)
+		for dec.More() {
+			var record DumpRecord
+			if err := dec.Decode(&record); err != nil {
+				t.Fatalf("dump output isn't JSON lines: %v", err)
+			}
+			records[record.Fields["pilot_username"]] = record
+		}
+		if len(records) != 2 {
+			t.Fatalf("dumped %d pilots, want 2", len(records))
+		}
+		return records
+	}
+
+	records := dump()
+	if record := records["alice"]; record.Key != pilotKey("alice") || record.Fields["personal_data"] != string(alice.PersonalData) {
+		t.Errorf("alice's record = %+v", record)
+	}
+	if record := records["alice"]; record.EmbeddingLength != 3 || record.EmbeddingHash != embeddingHash(alice.Embedding) || record.Embedding != nil {
+		t.Errorf("alice's embedding dumped as %d %q %v, want the length and hash only", record.EmbeddingLength, record.EmbeddingHash, record.Embedding)
+	}
+	if record := records["bob"]; record.EmbeddingLength != 0 || record.EmbeddingHash != "" || record.Embedding != nil {
+		t.Errorf("bob's record has an embedding: %+v", record)
+	}
+
+	records = dump("--full")
+	if record := records["alice"]; !slices.Equal(record.Embedding, alice.Embedding) || record.EmbeddingLength != 3 {
+		t.Errorf("--full dumped alice's embedding as %v", record.Embedding)
+	}
+	if record := records["bob"]; record.Embedding != nil {
+		t.Errorf("--full dumped an embedding for bob: %v", record.Embedding)
+	}
+
+	if err := RunDump(ctx, rdb, []string{"--bogus"}, &bytes.Buffer{}); err == nil {
+		t.Error("RunDump accepted an unknown flag")
+	}
+}
+
+func TestEmbeddingHash(t *testing.T) {
+	a, b := embeddingHash([]float64{1, 2}), embeddingHash([]float64{2, 1})
+	if len(a) != 12 || a == b || a != embeddingHash([]float64{1, 2}) {
+		t.Fatalf("embeddingHash gave %q and %q", a, b)
+	}
+}
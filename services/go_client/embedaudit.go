@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
+	"github.com/redis/go-redis/v9"
+)
+
+// EmbeddingAuditor re-fetches every cached pilot's embedding every EMBEDDING_AUDIT_INTERVAL and
+// repairs the cache where it drifted from the cloud. Sync only rewrites what changed since its
+// last cycle, so an embedding that went wrong in Redis any other way would otherwise stay wrong.
+func EmbeddingAuditor(rdb *redis.Client, sessions *SessionManager, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if inMaintenance(context.Background(), rdb) {
+			continue
+		}
+		ctx := withTrace(context.Background(), "audit")
+		api_client, gen, err := sessions.Client()
+		if err != nil {
+			logf(ctx, "skipping embedding audit, failed to connect to server: %v", err)
+			continue
+		}
+		if err := auditEmbeddings(ctx, rdb, api_client); err != nil {
+			if errors.Is(err, ErrTransport) {
+				sessions.Invalidate(gen)
+			}
+			logf(ctx, "embedding audit failed: %v", err)
+		}
+	}
+}
+
+func auditEmbeddings(ctx context.Context, rdb *redis.Client, api_client client.SocketClient) error {
+	checked, drifted := 0, 0
+	iter := rdb.Scan(ctx, 0, pilotKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		username, err := rdb.HGet(ctx, iter.Val(), "pilot_username").Result()
+		if err == redis.Nil || (err == nil && !validUsername(username)) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := acquireFetchSlot(ctx); err != nil {
+			return err
+		}
+		remote, err := fetchEmbedding(ctx, api_client, username)
+		releaseFetchSlot()
+		if errors.Is(err, ErrEmbeddingNonFinite) {
+			// Stored zeroed, which is what remote is now
+			err = nil
+		}
+		if errors.Is(err, ErrTransport) {
+			// The client may still be streaming the abandoned command, so it's done for this audit
+			return err
+		} else if err != nil {
+			logf(ctx, "audit: failed to fetch embedding of %q: %v", username, err)
+			continue
+		}
+
+		var local []float64
+		if value, err := rdb.Get(ctx, embeddingKey(username)).Result(); err == nil {
+			if local, err = decodeStoredEmbedding(value); err != nil {
+				logf(ctx, "audit: stored embedding of %q is undecodable: %v", username, err)
+			}
+		} else if err != redis.Nil {
+			return err
+		}
+		checked++
+
+		// Stored float32 embeddings lose precision, so both sides are compared at that precision
+		if slices.Equal(storedPrecision(remote), storedPrecision(local)) {
+			continue
+		}
+		drifted++
+		metricEmbeddingDrift.Inc()
+		logf(ctx, "warning: cached embedding of %q drifted from the cloud, repairing", username)
+
+		_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if remote == nil {
+				pipe.Del(ctx, embeddingKey(username))
+				pipe.HDel(ctx, pilotKey(username), "primary_embedding")
+				return nil
+			}
+			data, err := encodeStoredEmbedding(remote)
+			if err != nil {
+				return err
+			}
+			pipe.Set(ctx, embeddingKey(username), data, 0)
+			pipe.HSet(ctx, pilotKey(username), "primary_embedding", primaryEmbeddingKey(username, "", remote))
+			return nil
+		})
+		checkWrite(err, "repair embedding of %q", username)
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Embedding audit: %d pilot(s) checked, %d drifted", checked, drifted)
+	return nil
+}
+
+// storedPrecision rounds an embedding to the precision EMBEDDING_DTYPE stores
+func storedPrecision(embedding []float64) []float64 {
+	if embedding == nil || cfg.EmbeddingDtype != "float32" {
+		return embedding
+	}
+	rounded := make([]float64, len(embedding))
+	for i, value := range embedding {
+		rounded[i] = float64(float32(value))
+	}
+	return rounded
+}
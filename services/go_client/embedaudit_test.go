@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAuditEmbeddings(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_DTYPE": "float64"})
+	useFetchSlots(t)
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	cloud.addPilot("bob", "name: Bob\n", []float64{3, 4})
+	cloud.addPilot("carol", "name: Carol\n", []float64{5, 6})
+	cloud.addPilot("dave", "name: Dave\n", nil)
+	cloud.addPilot("erin", "name: Erin\n", nil)
+	cloud.setFile(homeFile("erin", "user.embedding"), "not base64!")
+
+	for _, pilot := range []PilotInfo{
+		// In step with the cloud
+		{Username: "alice", Embedding: []float64{1, 2}},
+		// Drifted
+		{Username: "bob", Embedding: []float64{3, 5}},
+		// Lost its embedding key
+		{Username: "carol"},
+		// Holds one the cloud no longer has
+		{Username: "dave", Embedding: []float64{7, 8}},
+		// The cloud's copy can't be decoded, so there's nothing to compare to
+		{Username: "erin", Embedding: []float64{9, 10}},
+	} {
+		pilot.PrimaryEmbedding = primaryEmbeddingKey(pilot.Username, "", pilot.Embedding)
+		if err := writePilotParts(ctx, rdb, pilot, true, true); err != nil {
+			t.Fatalf("seeding %s: %v", pilot.Username, err)
+		}
+	}
+	drift := metricEmbeddingDrift.value.Load()
+
+	if err := auditEmbeddings(ctx, rdb, cloud.connect()); err != nil {
+		t.Fatalf("auditEmbeddings: %v", err)
+	}
+
+	for username, want := range map[string][]float64{"alice": {1, 2}, "bob": {3, 4}, "carol": {5, 6}, "erin": {9, 10}} {
+		value, _ := fr.get(0, embeddingKey(username))
+		if got, err := decodeStoredEmbedding(value); err != nil || !slices.Equal(got, want) {
+			t.Errorf("%s's embedding = %v (%v), want %v", username, got, err, want)
+		}
+	}
+	if primary := fr.hash(0, pilotKey("carol"))["primary_embedding"]; primary != primaryEmbeddingKey("carol", "", []float64{5, 6}) {
+		t.Errorf("carol's primary_embedding = %q, want it pointing at the repaired embedding", primary)
+	}
+	if fr.exists(0, embeddingKey("dave")) || fr.hash(0, pilotKey("dave"))["primary_embedding"] != "" {
+		t.Error("dave's embedding, gone from the cloud, is still cached")
+	}
+	if got := metricEmbeddingDrift.value.Load() - drift; got != 3 {
+		t.Errorf("counted %d drifted embedding(s), want 3", got)
+	}
+	for _, want := range []string{
+		`warning: cached embedding of "bob" drifted from the cloud, repairing`,
+		`audit: failed to fetch embedding of "erin"`,
+		"Embedding audit: 4 pilot(s) checked, 3 drifted",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log doesn't mention %q:\n%s", want, logs)
+		}
+	}
+	if strings.Contains(logs.String(), `"alice" drifted`) {
+		t.Error("alice's matching embedding was reported as drifted")
+	}
+}
+
+func TestAuditEmbeddingsAtStoredPrecision(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_DTYPE": "float32"})
+	useFetchSlots(t)
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", nil)
+	cloud.setFile(homeFile("alice", "user.embedding"), testEmbedding32(0.1, 0.2))
+	// Stored as the shortest float32 digits, which read back as float64s that aren't the cloud's
+	if err := writePilotParts(ctx, rdb, PilotInfo{Username: "alice", Embedding: []float64{float64(float32(0.1)), float64(float32(0.2))}}, true, true); err != nil {
+		t.Fatalf("seeding: %v", err)
+	}
+
+	if err := auditEmbeddings(ctx, rdb, cloud.connect()); err != nil {
+		t.Fatalf("auditEmbeddings: %v", err)
+	}
+	if !strings.Contains(logs.String(), "Embedding audit: 1 pilot(s) checked, 0 drifted") {
+		t.Errorf("rounding was taken for drift:\n%s", logs)
+	}
+}
+
+func TestAuditEmbeddingsStopsOnTransportFailure(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_DTYPE": "float64", "MAX_COMMAND_OUTPUT": "1024"})
+	useFetchSlots(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	cloud := newFakeCloud(t)
+	for _, username := range []string{"alice", "bob"} {
+		cloud.addPilot(username, "name: "+username+"\n", nil)
+		// Overruns MAX_COMMAND_OUTPUT, abandoning the command
+		cloud.setFile(homeFile(username, "user.embedding"), strings.Repeat("A", 4096))
+		if err := writePilotParts(ctx, rdb, PilotInfo{Username: username, Embedding: []float64{1, 2}}, true, true); err != nil {
+			t.Fatalf("seeding %s: %v", username, err)
+		}
+	}
+
+	err := auditEmbeddings(ctx, rdb, cloud.connect())
+	if !errors.Is(err, ErrTransport) {
+		t.Fatalf("auditEmbeddings = %v, want the transport failure", err)
+	}
+	if n := cloud.count("cat "); n != 1 {
+		t.Errorf("ran %d fetches, want the audit to stop using the client after the first: %v", n, cloud.ran())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
+	"github.com/redis/go-redis/v9"
+)
+
+// With EMBEDDING_FINGERPRINTS, a pilot's embedding is only pulled when it changed. The cloud
+// shell can't hash files, but `ls -yl` of the pilot's home gives size and modification time,
+// which change on re-enrollment. That fingerprint is stored on the pilot hash; when the remote
+// one matches, the embedding already in Redis is reused instead of transferring the blob again.
+
+type embeddingCacheKey struct{}
+
+// withEmbeddingCache lets pilot fetches made with the returned context reuse embeddings from rdb
+func withEmbeddingCache(ctx context.Context, rdb *redis.Client) context.Context {
+	return context.WithValue(ctx, embeddingCacheKey{}, rdb)
+}
+
+// remoteEmbeddingFingerprint identifies the current version of a pilot's embedding file, or
+// returns "" when there is none
+func remoteEmbeddingFingerprint(ctx context.Context, api_client client.SocketClient, username string) (string, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, "ls -yl "+homeFile(username, ""), stdout, stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to list pilot home: %w", err)
+	}
+	if status != 0 {
+		return "", fmt.Errorf("ls command for pilot home failed: %s", stderrSummary(stderr.String()))
+	}
+
+	files, err := parseFileList(ctx, stdout.Bytes())
+	if err != nil {
+		return "", err
+	}
+	// Same order as catHomeFile, so the fingerprint is of the file that would be read
+	for _, name := range cfg.EmbeddingFilenames {
+		for _, file := range files {
+			if file.Name == name {
+				return fmt.Sprintf("%s:%d:%s", file.Name, file.FileSize, file.ModifiedTime), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// storedEmbedding returns the embedding stored in Redis for username and the fingerprint it was
+// stored with, whatever the remote file looks like now. ok is false when there is none.
+func storedEmbedding(ctx context.Context, username string) (embedding []float64, fingerprint string, ok bool) {
+	rdb, ok := ctx.Value(embeddingCacheKey{}).(*redis.Client)
+	if !ok {
+		return nil, "", false
+	}
+	value, err := rdb.Get(ctx, embeddingKey(username)).Result()
+	if err != nil {
+		return nil, "", false
+	}
+	if embedding, err = decodeStoredEmbedding(value); err != nil || len(embedding) == 0 {
+		return nil, "", false
+	}
+	fingerprint, _ = rdb.HGet(ctx, pilotKey(username), "embedding_fingerprint").Result()
+	return embedding, fingerprint, true
+}
+
+// cachedEmbedding returns the embedding stored in Redis for username if it was fetched from the
+// file version identified by fingerprint
+func cachedEmbedding(ctx context.Context, username, fingerprint string) ([]float64, bool) {
+	rdb, ok := ctx.Value(embeddingCacheKey{}).(*redis.Client)
+	if !ok || fingerprint == "" {
+		return nil, false
+	}
+
+	cached, err := rdb.HGet(ctx, pilotKey(username), "embedding_fingerprint").Result()
+	if err != nil || cached != fingerprint {
+		return nil, false
+	}
+	value, err := rdb.Get(ctx, embeddingKey(username)).Result()
+	if err != nil {
+		return nil, false
+	}
+	embedding, err := decodeStoredEmbedding(value)
+	if err != nil || len(embedding) == 0 {
+		return nil, false
+	}
+	debugCtxf(ctx, "Embedding of %q unchanged (%s), reusing the cached one", username, fingerprint)
+	return embedding, true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestEmbeddingFingerprintSkipsFetch(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_FINGERPRINTS": "true"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	api_client := cloud.connect()
+	ctx := withEmbeddingCache(context.Background(), rdb)
+	embedding_fetches := func() int { return cloud.count("cat " + homeFile("alice", "user.embedding")) }
+
+	fetch := func(ctx context.Context) *PilotInfo {
+		t.Helper()
+		pilot, err := GetPilotFromServer(ctx, api_client, "alice")
+		if err != nil {
+			t.Fatalf("GetPilotFromServer: %v", err)
+		}
+		if err := writePilot(ctx, rdb, *pilot); err != nil {
+			t.Fatalf("writePilot: %v", err)
+		}
+		return pilot
+	}
+
+	first := fetch(ctx)
+	if first.EmbeddingFingerprint == "" || embedding_fetches() != 1 {
+		t.Fatalf("first fetch: fingerprint %q, %d embedding fetches", first.EmbeddingFingerprint, embedding_fetches())
+	}
+	if got := fr.hash(0, pilotKey("alice"))["embedding_fingerprint"]; got != first.EmbeddingFingerprint {
+		t.Fatalf("stored fingerprint %q, want %q", got, first.EmbeddingFingerprint)
+	}
+
+	// Unchanged: the cached embedding is reused
+	second := fetch(ctx)
+	if embedding_fetches() != 1 {
+		t.Fatal("an unchanged embedding was fetched again")
+	}
+	if !slices.Equal(second.Embedding, []float64{1, 2}) || second.EmbeddingFingerprint != first.EmbeddingFingerprint {
+		t.Fatalf("reused embedding %v (%s)", second.Embedding, second.EmbeddingFingerprint)
+	}
+
+	// Without the cache in the context, it's always fetched
+	fetch(context.Background())
+	if embedding_fetches() != 2 {
+		t.Fatal("fetched without a cache, but the embedding wasn't pulled")
+	}
+
+	// Re-enrollment changes the file, so it's pulled again
+	cloud.setFile(homeFile("alice", "user.embedding"), testEmbedding(3, 4, 5))
+	third := fetch(ctx)
+	if embedding_fetches() != 3 || !slices.Equal(third.Embedding, []float64{3, 4, 5}) {
+		t.Fatalf("after re-enrollment: %d fetches, embedding %v", embedding_fetches(), third.Embedding)
+	}
+	if third.EmbeddingFingerprint == first.EmbeddingFingerprint {
+		t.Fatal("fingerprint unchanged after re-enrollment")
+	}
+}
+
+func TestRemoteEmbeddingFingerprint(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_FILENAMES": "user.embedding,face.embedding"})
+	cloud := newFakeCloud(t)
+	cloud.setFile(homeFile("alice", "face.embedding"), "12345")
+	cloud.setFile(homeFile("alice", "user.profile"), "name: Alice\n")
+	api_client := cloud.connect()
+
+	fingerprint, err := remoteEmbeddingFingerprint(context.Background(), api_client, "alice")
+	if err != nil || fingerprint != "face.embedding:5:2025-01-01T00:00:00Z" {
+		t.Fatalf("fingerprint = %q, %v", fingerprint, err)
+	}
+
+	// The first candidate wins, as it's the one catHomeFile reads
+	cloud.setFile(homeFile("alice", "user.embedding"), "123")
+	if fingerprint, _ := remoteEmbeddingFingerprint(context.Background(), api_client, "alice"); fingerprint != "user.embedding:3:2025-01-01T00:00:00Z" {
+		t.Fatalf("fingerprint = %q, want user.embedding's", fingerprint)
+	}
+
+	if fingerprint, err := remoteEmbeddingFingerprint(context.Background(), api_client, "bob"); err != nil || fingerprint != "" {
+		t.Fatalf("fingerprint without an embedding = %q, %v", fingerprint, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// user.embedding holds base64 of little-endian floats, float64 or (EMBEDDING_DTYPE=float32)
+// float32. Either way they're handled as float64 in memory. The cloud's cat has no flags (a "-n"
+// would be looked up as a file), and it terminates output with "\r\n", so DecodeEmbedding
+// tolerates surrounding whitespace, line breaks and even `cat -n` style line numbers.
+
+var line_number = regexp.MustCompile(`^\d+\s+(\S+)$`)
+
+func DecodeEmbedding(output string) ([]float64, error) {
+	var encoded strings.Builder
+	for line := range strings.Lines(output) {
+		line = strings.TrimSpace(line)
+		if match := line_number.FindStringSubmatch(line); match != nil {
+			line = match[1]
+		}
+		encoded.WriteString(line)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("user embedings have invalid base64: %w", err)
+	}
+	if cfg.EmbeddingDtype == "float32" {
+		if len(data)%4 != 0 {
+			return nil, fmt.Errorf("user embedding length %d isn't a multiple of 4 (float32)", len(data))
+		}
+
+		embedding := make([]float64, len(data)/4)
+		for i := 0; i < len(embedding); i++ {
+			bits := binary.LittleEndian.Uint32(data[i*4 : (i+1)*4])
+			embedding[i] = float64(math.Float32frombits(bits))
+		}
+		return embedding, nil
+	}
+
+	if len(data)%8 != 0 {
+		return nil, fmt.Errorf("user embedding have non-divisible length")
+	}
+
+	embedding := make([]float64, len(data)/8)
+	for i := 0; i < len(embedding); i++ {
+		bits := binary.LittleEndian.Uint64(data[i*8 : (i+1)*8])
+		embedding[i] = math.Float64frombits(bits)
+	}
+	return embedding, nil
+}
+
+// ErrEmbeddingNonFinite comes with the zeroed embedding under NON_FINITE_EMBEDDING_POLICY=flag;
+// under reject the embedding is an ErrEmbeddingDecode instead
+var ErrEmbeddingNonFinite = errors.New("embedding has non-finite values")
+
+// checkFinite applies NON_FINITE_EMBEDDING_POLICY to a decoded embedding. NaN spreads through
+// every distance computed with it, and JSON can't carry either NaN or Inf.
+func checkFinite(embedding []float64) ([]float64, error) {
+	bad := 0
+	for _, value := range embedding {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			bad++
+		}
+	}
+	if bad == 0 {
+		return embedding, nil
+	}
+	if cfg.NonFiniteEmbeddingPolicy != "flag" {
+		return nil, fmt.Errorf("%w: %d of %d values are NaN or Inf", ErrEmbeddingDecode, bad, len(embedding))
+	}
+
+	zeroed := make([]float64, len(embedding))
+	for i, value := range embedding {
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			zeroed[i] = value
+		}
+	}
+	return zeroed, fmt.Errorf("%w: %d of %d values are NaN or Inf", ErrEmbeddingNonFinite, bad, len(embedding))
+}
+
+// Embeddings are stored in Redis as a JSON array of numbers under embeddingKey(username),
+// encrypted when ENCRYPTION_KEY is set. float32 embeddings are written with float32 precision,
+// which round-trips exactly and takes about half the digits.
+
+func encodeStoredEmbedding(embedding []float64) (string, error) {
+	var values any = embedding
+	if cfg.EmbeddingDtype == "float32" {
+		compact := make([]float32, len(embedding))
+		for i, value := range embedding {
+			compact[i] = float32(value)
+		}
+		values = compact
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return sealValue(string(data))
+}
+
+func decodeStoredEmbedding(value string) ([]float64, error) {
+	value, err := openValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var embedding []float64
+	if err := json.Unmarshal([]byte(value), &embedding); err != nil {
+		return nil, err
+	}
+	return embedding, nil
+}
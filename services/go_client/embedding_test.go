@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testEmbedding32(values ...float32) string {
+	data := make([]byte, 0, len(values)*4)
+	for _, value := range values {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(value))
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestDecodeEmbedding(t *testing.T) {
+	useConfig(t, nil)
+	one_two := testEmbedding(1, 2)
+	for _, tt := range []struct {
+		name   string
+		output string
+		want   []float64
+		err    bool
+	}{
+		{"plain", one_two, []float64{1, 2}, false},
+		{"cat's CRLF", one_two + "\r\n", []float64{1, 2}, false},
+		{"surrounding whitespace", "  " + one_two + " \n\n", []float64{1, 2}, false},
+		{"wrapped", one_two[:12] + "\n" + one_two[12:] + "\n", []float64{1, 2}, false},
+		{"cat -n", "     1\t" + one_two + "\n", []float64{1, 2}, false},
+		{"cat -n wrapped", "     1\t" + one_two[:12] + "\n     2\t" + one_two[12:] + "\n", []float64{1, 2}, false},
+		{"numbered with spaces", "1  " + one_two + "\n", []float64{1, 2}, false},
+		// Lines are one base64 stream, not one value each
+		{"padded lines", "1  AAAAAAAA8D8=\n2  AAAAAAAAAEA=\n", nil, true},
+		{"negative and fractional", testEmbedding(-0.5, 1e-3, 123.25), []float64{-0.5, 1e-3, 123.25}, false},
+		{"empty", "", []float64{}, false},
+		{"invalid base64", "not base64!", nil, true},
+		{"partial value", "AAAA", nil, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			embedding, err := DecodeEmbedding(tt.output)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("DecodeEmbedding(%q) = %v, want an error", tt.output, embedding)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeEmbedding(%q): %v", tt.output, err)
+			}
+			if !slices.Equal(embedding, tt.want) {
+				t.Fatalf("DecodeEmbedding(%q) = %v, want %v", tt.output, embedding, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEmbeddingFloat32(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_DTYPE": "float32"})
+	embedding, err := DecodeEmbedding(testEmbedding32(1, -0.5, 0.1) + "\r\n")
+	if err != nil {
+		t.Fatalf("DecodeEmbedding: %v", err)
+	}
+	if want := []float64{1, -0.5, float64(float32(0.1))}; !slices.Equal(embedding, want) {
+		t.Fatalf("DecodeEmbedding = %v, want %v", embedding, want)
+	}
+
+	// 6 bytes: a float32 and a half
+	if _, err := DecodeEmbedding(base64.StdEncoding.EncodeToString(make([]byte, 6))); err == nil || !strings.Contains(err.Error(), "multiple of 4") {
+		t.Fatalf("DecodeEmbedding of a partial float32 = %v", err)
+	}
+	// 12 bytes decode as three float32s, where float64 would reject them
+	if embedding, err := DecodeEmbedding(testEmbedding32(1, 2, 3)); err != nil || len(embedding) != 3 {
+		t.Fatalf("DecodeEmbedding = %v, %v, want 3 values", embedding, err)
+	}
+}
+
+func TestStoredEmbeddingFloat32(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_DTYPE": "float32"})
+	value := []float64{float64(float32(0.1)), -2.5}
+	stored, err := encodeStoredEmbedding(value)
+	if err != nil {
+		t.Fatalf("encodeStoredEmbedding: %v", err)
+	}
+	// Written at float32 precision: the shortest digits that round-trip as a float32
+	if stored != "[0.1,-2.5]" {
+		t.Fatalf("stored %s, want float32 digits", stored)
+	}
+	decoded, err := decodeStoredEmbedding(stored)
+	if err != nil || float32(decoded[0]) != float32(value[0]) || decoded[1] != -2.5 {
+		t.Fatalf("decodeStoredEmbedding = %v, %v", decoded, err)
+	}
+
+	useConfig(t, map[string]string{"EMBEDDING_DTYPE": "float64"})
+	if stored, _ := encodeStoredEmbedding(value); stored == "[0.1,-2.5]" {
+		t.Fatalf("float64 stored %s, losing precision", stored)
+	}
+}
+
+func TestCheckFinite(t *testing.T) {
+	embedding := []float64{math.NaN(), 2, math.Inf(1), -3, math.Inf(-1)}
+
+	useConfig(t, map[string]string{"NON_FINITE_EMBEDDING_POLICY": "reject"})
+	got, err := checkFinite(embedding)
+	if !errors.Is(err, ErrEmbeddingDecode) || errors.Is(err, ErrEmbeddingNonFinite) || got != nil {
+		t.Fatalf("checkFinite under reject = %v, %v, want no embedding and ErrEmbeddingDecode", got, err)
+	}
+	if !strings.Contains(err.Error(), "3 of 5 values are NaN or Inf") {
+		t.Errorf("error %q doesn't count the bad values", err)
+	}
+
+	useConfig(t, map[string]string{"NON_FINITE_EMBEDDING_POLICY": "flag"})
+	got, err = checkFinite(embedding)
+	if !errors.Is(err, ErrEmbeddingNonFinite) || !slices.Equal(got, []float64{0, 2, 0, -3, 0}) {
+		t.Fatalf("checkFinite under flag = %v, %v, want the embedding zeroed where it isn't finite", got, err)
+	}
+	if !math.IsNaN(embedding[0]) {
+		t.Error("the decoded embedding was modified in place")
+	}
+
+	finite := []float64{1, -2}
+	if got, err := checkFinite(finite); err != nil || !slices.Equal(got, finite) {
+		t.Fatalf("checkFinite of a finite embedding = %v, %v", got, err)
+	}
+}
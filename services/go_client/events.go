@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PilotEvent is published as JSON on cognicore:pilot_events for services tracking pilot sessions
+type PilotEvent struct {
+	Event     string `json:"event"`
+	Username  string `json:"pilot_username,omitempty"`
+	FlightID  string `json:"flight_id,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+
+	Summary *SyncResult `json:"summary,omitempty"`
+}
+
+func publishPilotEvent(ctx context.Context, rdb *redis.Client, event PilotEvent) error {
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().Unix()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return rdb.Publish(ctx, pilotEventsChannel, string(data)).Err()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/types"
+	"github.com/goccy/go-yaml"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// fakeCloud serves the cloud's /login and /cmd-socket endpoints. Commands run against a small
+// in-memory shell (cat, tee, ls -yl, mkdir -p, echo -n, pilots, && chains); handle, when set,
+// gets the first go at every command.
+type fakeCloud struct {
+	t      testing.TB
+	server *httptest.Server
+	URL    string
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	pilots   []string
+	commands []string
+	logins   int
+	// Refuse logins with 503, as an endpoint that's down would
+	down bool
+	// Runs before the built-in shell; handled=false falls through to it
+	handle func(command, stdin string) (stdout, stderr string, status int, handled bool)
+	// Sockets currently open, closed by closeSockets
+	sockets []*websocket.Conn
+}
+
+func newFakeCloud(t testing.TB) *fakeCloud {
+	t.Helper()
+	cloud := &fakeCloud{t: t, files: map[string][]byte{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", cloud.login)
+	mux.HandleFunc("/cmd-socket", cloud.socket)
+	cloud.server = httptest.NewServer(mux)
+	cloud.URL = cloud.server.URL
+	t.Cleanup(func() {
+		cloud.closeSockets()
+		cloud.server.Close()
+	})
+	return cloud
+}
+
+func (c *fakeCloud) setFile(name string, data string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[name] = []byte(data)
+}
+
+func (c *fakeCloud) file(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.files[name]
+	return string(data), ok
+}
+
+// addPilot lists a pilot and puts their profile in their home, along with their embedding
+// unless it's nil. Embeddings are written as base64 of little-endian float64s.
+func (c *fakeCloud) addPilot(username, profile string, embedding []float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pilots = append(c.pilots, username)
+	c.files[homeFile(username, "user.profile")] = []byte(profile)
+	if embedding != nil {
+		c.files[homeFile(username, "user.embedding")] = []byte(testEmbedding(embedding...))
+	}
+}
+
+func testEmbedding(values ...float64) string {
+	data := make([]byte, 0, len(values)*8)
+	for _, value := range values {
+		data = binary.LittleEndian.AppendUint64(data, math.Float64bits(value))
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func (c *fakeCloud) setPilots(usernames ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pilots = usernames
+}
+
+func (c *fakeCloud) setDown(down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = down
+}
+
+func (c *fakeCloud) setHandler(handle func(command, stdin string) (string, string, int, bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handle = handle
+}
+
+// ran returns the commands run so far
+func (c *fakeCloud) ran() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.commands)
+}
+
+func (c *fakeCloud) loginCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logins
+}
+
+// count returns how many commands run so far start with prefix
+func (c *fakeCloud) count(prefix string) int {
+	n := 0
+	for _, command := range c.ran() {
+		if strings.HasPrefix(command, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *fakeCloud) closeSockets() {
+	c.mu.Lock()
+	sockets := c.sockets
+	c.sockets = nil
+	c.mu.Unlock()
+	for _, socket := range sockets {
+		socket.Close()
+	}
+}
+
+func (c *fakeCloud) login(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	down := c.down
+	if !down {
+		c.logins++
+	}
+	c.mu.Unlock()
+	if down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "sessid", Value: "test-session"})
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (c *fakeCloud) socket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.sockets = append(c.sockets, conn)
+	c.mu.Unlock()
+
+	var write_mu sync.Mutex
+	send := func(msg types.WebSocketMessage) {
+		data, err := msgpack.Marshal(msg)
+		if err != nil {
+			panic(err)
+		}
+		write_mu.Lock()
+		defer write_mu.Unlock()
+		conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+
+	var command string
+	var stdin strings.Builder
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg types.WebSocketMessage
+		if err := msgpack.Unmarshal(data, &msg); err != nil {
+			return
+		}
+
+		reply := types.WebSocketMessage{ClientID: msg.ClientID, RefID: msg.MessageID}
+		switch msg.MessageType {
+		case types.MsgConnect:
+			reply.MessageType = types.MsgConnectAck
+			send(reply)
+		case types.MsgDisconnect:
+			reply.MessageType = types.MsgDisconnectAck
+			send(reply)
+		case types.MsgRunCommand:
+			command = msg.Command
+			stdin.Reset()
+			reply.MessageType = types.MsgCommandRunning
+			send(reply)
+		case types.MsgInputStream:
+			stdin.WriteString(msg.InputStream)
+		case types.MsgInputEOF:
+			// Handled in the background, so a command can hang without stalling the socket
+			go func(command, stdin string) {
+				stdout, stderr, status := c.run(command, stdin)
+				if stdout != "" {
+					send(types.WebSocketMessage{ClientID: reply.ClientID, MessageType: types.MsgOutputStream, OutputStream: stdout})
+				}
+				if stderr != "" {
+					send(types.WebSocketMessage{ClientID: reply.ClientID, MessageType: types.MsgErrorStream, ErrorStream: stderr})
+				}
+				send(types.WebSocketMessage{ClientID: reply.ClientID, MessageType: types.MsgCommandFinished, CommandResult: &status})
+			}(command, stdin.String())
+		}
+	}
+}
+
+func (c *fakeCloud) run(command, stdin string) (string, string, int) {
+	c.mu.Lock()
+	c.commands = append(c.commands, command)
+	handle := c.handle
+	c.mu.Unlock()
+
+	if handle != nil {
+		if stdout, stderr, status, handled := handle(command, stdin); handled {
+			return stdout, stderr, status
+		}
+	}
+
+	var stdout strings.Builder
+	for part := range strings.SplitSeq(command, "&&") {
+		out, stderr, status := c.builtin(strings.TrimSpace(part), stdin)
+		stdout.WriteString(out)
+		if status != 0 {
+			return stdout.String(), stderr, status
+		}
+	}
+	return stdout.String(), "", 0
+}
+
+func (c *fakeCloud) builtin(command, stdin string) (string, string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name, arg, _ := strings.Cut(command, " ")
+	switch name {
+	case "echo":
+		return strings.TrimPrefix(arg, "-n "), "", 0
+	case "mkdir":
+		return "", "", 0
+	case "pilots":
+		return strings.Join(c.pilots, "\n") + "\n", "", 0
+	case "cat":
+		data, ok := c.files[arg]
+		if !ok {
+			return "", "cat: file does not exist\n", 1
+		}
+		return string(data), "", 0
+	case "tee":
+		c.files[arg] = []byte(stdin)
+		return stdin, "", 0
+	case "ls":
+		dir := strings.TrimSuffix(strings.TrimPrefix(arg, "-yl "), "/")
+		entries := make([]map[string]any, 0)
+		for name, data := range c.files {
+			if path.Dir(name) == dir {
+				entries = append(entries, map[string]any{"name": path.Base(name), "type": "file", "file_size": len(data), "modified_time": "2025-01-01T00:00:00Z"})
+			}
+		}
+		slices.SortFunc(entries, func(a, b map[string]any) int { return strings.Compare(a["name"].(string), b["name"].(string)) })
+		if len(entries) == 0 {
+			return "", "", 0
+		}
+		out, err := yaml.Marshal(entries)
+		if err != nil {
+			panic(err)
+		}
+		return string(out), "", 0
+	}
+	return "", fmt.Sprintf("%s: command not found\n", name), 127
+}
+
+// connect logs in to the fake cloud and returns a ready client
+func (c *fakeCloud) connect() client.SocketClient {
+	c.t.Helper()
+	socket, api_client, err := connectEndpoint(APIConfig{Username: "device", Password: "secret", URLs: []string{c.URL}}, c.URL)
+	if err != nil {
+		c.t.Fatalf("failed to connect to fake cloud: %v", err)
+	}
+	c.t.Cleanup(func() { socket.Close() })
+	return api_client
+}
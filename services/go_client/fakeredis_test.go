@@ -0,0 +1,1144 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis is an in-process server speaking enough of RESP2 for this client: strings, hashes
+// (with field TTLs), sorted sets, streams, SCAN, WATCH/MULTI/EXEC, pub/sub with keyspace
+// notifications, and Lua scripts registered by hash as Go functions.
+type fakeRedis struct {
+	t        *testing.T
+	listener net.Listener
+	Addr     string
+
+	mu       sync.Mutex
+	dbs      map[int]map[string]*fakeEntry
+	versions map[string]int
+	offset   time.Duration
+	// requirepass
+	password string
+	// Whether keyspace notifications are published (notify-keyspace-events "Kh" and up)
+	notify bool
+	// Commands fail with this error until it's cleared
+	fail string
+	// How many upcoming EXECs find a watched key changed, as they would with a concurrent writer
+	conflicts int
+	// Commands this server doesn't have, as an older Redis wouldn't
+	unknown map[string]bool
+	subs    map[*fakeConn]bool
+	scripts map[string]func(db map[string]*fakeEntry, keys, args []string) any
+	// Every command received, upper-cased name first
+	log [][]string
+}
+
+type fakeEntry struct {
+	kind          string
+	str           string
+	hash          map[string]string
+	zset          map[string]float64
+	stream        []fakeStreamEntry
+	expires       time.Time
+	field_expires map[string]time.Time
+}
+
+type fakeStreamEntry struct {
+	id     string
+	values []string
+}
+
+type fakeConn struct {
+	conn     net.Conn
+	write_mu sync.Mutex
+	w        *bufio.Writer
+
+	db       int
+	authed   bool
+	multi    [][]string
+	in_multi bool
+	// An unknown command was queued, so EXEC discards the transaction
+	aborted  bool
+	watched  map[string]int
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	fr := &fakeRedis{
+		t:        t,
+		listener: listener,
+		Addr:     listener.Addr().String(),
+		dbs:      map[int]map[string]*fakeEntry{},
+		versions: map[string]int{},
+		notify:   true,
+		subs:     map[*fakeConn]bool{},
+		scripts:  map[string]func(map[string]*fakeEntry, []string, []string) any{},
+	}
+	fr.scripts[renewSyncLock.Hash()] = func(db map[string]*fakeEntry, keys, args []string) any {
+		entry := db[keys[0]]
+		if entry == nil || entry.kind != "string" || entry.str != args[0] {
+			return int64(0)
+		}
+		ms, _ := strconv.ParseInt(args[1], 10, 64)
+		entry.expires = fr.now().Add(time.Duration(ms) * time.Millisecond)
+		return int64(1)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return fr
+}
+
+// client returns a client for DB db, closed with the test
+func (fr *fakeRedis) client(db int) *redis.Client {
+	rdb := redis.NewClient(fr.options(db))
+	fr.t.Cleanup(func() { rdb.Close() })
+	return rdb
+}
+
+func (fr *fakeRedis) options(db int) *redis.Options {
+	return &redis.Options{Addr: fr.Addr, DB: db, DisableIdentity: true, MaxRetries: -1}
+}
+
+func (fr *fakeRedis) now() time.Time {
+	return time.Now().Add(fr.offset)
+}
+
+// advance moves the server's clock, expiring keys and fields
+func (fr *fakeRedis) advance(d time.Duration) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.offset += d
+}
+
+func (fr *fakeRedis) db(n int) map[string]*fakeEntry {
+	db := fr.dbs[n]
+	if db == nil {
+		db = map[string]*fakeEntry{}
+		fr.dbs[n] = db
+	}
+	return db
+}
+
+// lookup returns a live entry, expiring it (or its fields) first
+func (fr *fakeRedis) lookup(db int, key string) *fakeEntry {
+	entry := fr.db(db)[key]
+	if entry == nil {
+		return nil
+	}
+	now := fr.now()
+	if !entry.expires.IsZero() && !now.Before(entry.expires) {
+		delete(fr.db(db), key)
+		return nil
+	}
+	for field, at := range entry.field_expires {
+		if !now.Before(at) {
+			delete(entry.hash, field)
+			delete(entry.field_expires, field)
+		}
+	}
+	if entry.kind == "hash" && len(entry.hash) == 0 {
+		delete(fr.db(db), key)
+		return nil
+	}
+	return entry
+}
+
+func (fr *fakeRedis) touch(db int, key, event string) {
+	fr.versions[fmt.Sprintf("%d/%s", db, key)]++
+	if event != "" && fr.notify {
+		fr.publish(fmt.Sprintf("__keyspace@%d__:%s", db, key), event)
+	}
+}
+
+// Inspection helpers for tests
+
+func (fr *fakeRedis) hash(db int, key string) map[string]string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	entry := fr.lookup(db, key)
+	if entry == nil || entry.kind != "hash" {
+		return nil
+	}
+	return maps.Clone(entry.hash)
+}
+
+func (fr *fakeRedis) get(db int, key string) (string, bool) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	entry := fr.lookup(db, key)
+	if entry == nil || entry.kind != "string" {
+		return "", false
+	}
+	return entry.str, true
+}
+
+func (fr *fakeRedis) exists(db int, key string) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.lookup(db, key) != nil
+}
+
+func (fr *fakeRedis) keys(db int) []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	keys := make([]string, 0)
+	for key := range fr.db(db) {
+		if fr.lookup(db, key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// fieldTTL returns how long a hash field has left, 0 if it has no TTL
+func (fr *fakeRedis) fieldTTL(db int, key, field string) time.Duration {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	entry := fr.lookup(db, key)
+	if entry == nil {
+		return 0
+	}
+	at, ok := entry.field_expires[field]
+	if !ok {
+		return 0
+	}
+	return at.Sub(fr.now())
+}
+
+func (fr *fakeRedis) ttl(db int, key string) time.Duration {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	entry := fr.lookup(db, key)
+	if entry == nil || entry.expires.IsZero() {
+		return 0
+	}
+	return entry.expires.Sub(fr.now())
+}
+
+func (fr *fakeRedis) zset(db int, key string) map[string]float64 {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	entry := fr.lookup(db, key)
+	if entry == nil || entry.kind != "zset" {
+		return nil
+	}
+	return maps.Clone(entry.zset)
+}
+
+// stream returns a stream's entries as field maps
+func (fr *fakeRedis) stream(db int, key string) []map[string]string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	entry := fr.lookup(db, key)
+	if entry == nil || entry.kind != "stream" {
+		return nil
+	}
+	entries := make([]map[string]string, 0, len(entry.stream))
+	for _, item := range entry.stream {
+		values := map[string]string{}
+		for i := 0; i+1 < len(item.values); i += 2 {
+			values[item.values[i]] = item.values[i+1]
+		}
+		entries = append(entries, values)
+	}
+	return entries
+}
+
+// commands returns the names of the commands received so far
+func (fr *fakeRedis) commands() []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	names := make([]string, 0, len(fr.log))
+	for _, args := range fr.log {
+		names = append(names, args[0])
+	}
+	return names
+}
+
+func (fr *fakeRedis) setFailure(msg string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.fail = msg
+}
+
+// setConflicts makes the next n transactions with watched keys fail, as if another client wrote
+// to them between WATCH and EXEC
+func (fr *fakeRedis) setConflicts(n int) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.conflicts = n
+}
+
+// setUnknown has the server reject the named commands as unknown, as a Redis predating them would
+func (fr *fakeRedis) setUnknown(names ...string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.unknown = map[string]bool{}
+	for _, name := range names {
+		fr.unknown[name] = true
+	}
+}
+
+// setNotify turns keyspace notifications on or off, as notify-keyspace-events would
+func (fr *fakeRedis) setNotify(notify bool) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.notify = notify
+}
+
+// Protocol
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &fakeConn{conn: conn, w: bufio.NewWriter(conn)}
+	defer func() {
+		fr.mu.Lock()
+		delete(fr.subs, c)
+		fr.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		fr.mu.Lock()
+		reply := fr.execute(c, args)
+		fr.mu.Unlock()
+		if _, ok := reply.(fakeNoReply); !ok {
+			c.send(reply)
+		}
+		if strings.EqualFold(args[0], "QUIT") {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimRight(header, "\r\n")[1:])
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+// Replies: fakeStatus, fakeError, string (bulk), int64, nil (null bulk), fakeNilArray, []any,
+// fakeQueued
+
+type fakeStatus string
+type fakeError string
+type fakeNilArray struct{}
+type fakeQueued struct{}
+
+// fakeNoReply is returned by commands that have already sent their replies
+type fakeNoReply struct{}
+
+func (c *fakeConn) send(reply any) {
+	c.write_mu.Lock()
+	defer c.write_mu.Unlock()
+	writeReply(c.w, reply)
+	c.w.Flush()
+}
+
+func writeReply(w *bufio.Writer, reply any) {
+	switch v := reply.(type) {
+	case fakeStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case fakeQueued:
+		w.WriteString("+QUEUED\r\n")
+	case fakeError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case nil:
+		w.WriteString("$-1\r\n")
+	case fakeNilArray:
+		w.WriteString("*-1\r\n")
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("fake redis: unknown reply type %T", reply))
+	}
+}
+
+var errWrongType = fakeError("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+func (fr *fakeRedis) execute(c *fakeConn, args []string) any {
+	name := strings.ToUpper(args[0])
+	fr.log = append(fr.log, append([]string{name}, args[1:]...))
+
+	switch name {
+	case "HELLO":
+		return fakeError("ERR unknown command 'HELLO'")
+	case "AUTH":
+		if fr.password == "" {
+			return fakeError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+		if args[len(args)-1] != fr.password {
+			return fakeError("WRONGPASS invalid username-password pair or user is disabled.")
+		}
+		c.authed = true
+		return fakeStatus("OK")
+	case "QUIT":
+		return fakeStatus("OK")
+	}
+	if fr.password != "" && !c.authed {
+		return fakeError("NOAUTH Authentication required.")
+	}
+	if fr.fail != "" {
+		return fakeError(fr.fail)
+	}
+	if fr.unknown[name] {
+		c.aborted = c.in_multi
+		return fakeError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+	}
+
+	if len(c.channels)+len(c.patterns) != 0 {
+		switch name {
+		case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING":
+		default:
+			return fakeError("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")
+		}
+	}
+
+	switch name {
+	case "MULTI":
+		c.in_multi = true
+		c.multi = nil
+		c.aborted = false
+		return fakeStatus("OK")
+	case "DISCARD":
+		c.in_multi = false
+		c.multi = nil
+		c.watched = nil
+		return fakeStatus("OK")
+	case "EXEC":
+		queued := c.multi
+		c.in_multi = false
+		c.multi = nil
+		watched := c.watched
+		c.watched = nil
+		if c.aborted {
+			c.aborted = false
+			return fakeError("EXECABORT Transaction discarded because of previous errors.")
+		}
+		if len(watched) != 0 && fr.conflicts > 0 {
+			fr.conflicts--
+			return fakeNilArray{}
+		}
+		for key, version := range watched {
+			if fr.versions[key] != version {
+				return fakeNilArray{}
+			}
+		}
+		replies := make([]any, 0, len(queued))
+		for _, queued_args := range queued {
+			replies = append(replies, fr.command(c, strings.ToUpper(queued_args[0]), queued_args))
+		}
+		return replies
+	case "WATCH":
+		if c.watched == nil {
+			c.watched = map[string]int{}
+		}
+		for _, key := range args[1:] {
+			// Expire first, so a lapse counts as a change only if it happened after WATCH
+			fr.lookup(c.db, key)
+			id := fmt.Sprintf("%d/%s", c.db, key)
+			c.watched[id] = fr.versions[id]
+		}
+		return fakeStatus("OK")
+	case "UNWATCH":
+		c.watched = nil
+		return fakeStatus("OK")
+	}
+	if c.in_multi {
+		c.multi = append(c.multi, args)
+		return fakeQueued{}
+	}
+	return fr.command(c, name, args)
+}
+
+func (fr *fakeRedis) command(c *fakeConn, name string, args []string) any {
+	db := fr.db(c.db)
+	switch name {
+	case "PING":
+		if len(c.channels)+len(c.patterns) != 0 {
+			return []any{"pong", ""}
+		}
+		return fakeStatus("PONG")
+	case "SELECT":
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || n > 15 {
+			return fakeError("ERR DB index is out of range")
+		}
+		c.db = n
+		return fakeStatus("OK")
+	case "CLIENT":
+		return fakeStatus("OK")
+
+	case "GET":
+		entry := fr.lookup(c.db, args[1])
+		if entry == nil {
+			return nil
+		}
+		if entry.kind != "string" {
+			return errWrongType
+		}
+		return entry.str
+	case "SET":
+		key, value := args[1], args[2]
+		var expires time.Time
+		nx, xx, keep := false, false, false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			case "KEEPTTL":
+				keep = true
+			case "EX":
+				n, _ := strconv.ParseInt(args[i+1], 10, 64)
+				expires = fr.now().Add(time.Duration(n) * time.Second)
+				i++
+			case "PX":
+				n, _ := strconv.ParseInt(args[i+1], 10, 64)
+				expires = fr.now().Add(time.Duration(n) * time.Millisecond)
+				i++
+			}
+		}
+		existing := fr.lookup(c.db, key)
+		if (nx && existing != nil) || (xx && existing == nil) {
+			return nil
+		}
+		if keep && existing != nil {
+			expires = existing.expires
+		}
+		db[key] = &fakeEntry{kind: "string", str: value, expires: expires}
+		fr.touch(c.db, key, "set")
+		return fakeStatus("OK")
+	case "DEL", "UNLINK":
+		n := int64(0)
+		for _, key := range args[1:] {
+			if fr.lookup(c.db, key) != nil {
+				delete(db, key)
+				fr.touch(c.db, key, "del")
+				n++
+			}
+		}
+		return n
+	case "EXISTS":
+		n := int64(0)
+		for _, key := range args[1:] {
+			if fr.lookup(c.db, key) != nil {
+				n++
+			}
+		}
+		return n
+	case "TYPE":
+		entry := fr.lookup(c.db, args[1])
+		if entry == nil {
+			return fakeStatus("none")
+		}
+		return fakeStatus(entry.kind)
+	case "EXPIRE", "PEXPIRE":
+		entry := fr.lookup(c.db, args[1])
+		if entry == nil {
+			return int64(0)
+		}
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		unit := time.Second
+		if name == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		entry.expires = fr.now().Add(time.Duration(n) * unit)
+		fr.touch(c.db, args[1], "expire")
+		return int64(1)
+	case "TTL", "PTTL":
+		entry := fr.lookup(c.db, args[1])
+		if entry == nil {
+			return int64(-2)
+		}
+		if entry.expires.IsZero() {
+			return int64(-1)
+		}
+		left := entry.expires.Sub(fr.now())
+		if name == "TTL" {
+			return int64(left.Round(time.Second) / time.Second)
+		}
+		return left.Milliseconds()
+	case "KEYS":
+		keys := make([]any, 0)
+		for _, key := range slices.Sorted(maps.Keys(db)) {
+			if globMatch(args[1], key) && fr.lookup(c.db, key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	case "SCAN":
+		pattern, kind := "*", ""
+		for i := 2; i+1 < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "MATCH":
+				pattern = args[i+1]
+			case "TYPE":
+				kind = args[i+1]
+			}
+		}
+		keys := make([]any, 0)
+		for _, key := range slices.Sorted(maps.Keys(db)) {
+			entry := fr.lookup(c.db, key)
+			if entry != nil && globMatch(pattern, key) && (kind == "" || kind == entry.kind) {
+				keys = append(keys, key)
+			}
+		}
+		return []any{"0", keys}
+
+	case "HSET", "HMSET":
+		entry, err := fr.hashFor(c.db, args[1], true)
+		if err != nil {
+			return err
+		}
+		added := int64(0)
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := entry.hash[args[i]]; !ok {
+				added++
+			}
+			entry.hash[args[i]] = args[i+1]
+			delete(entry.field_expires, args[i])
+		}
+		fr.touch(c.db, args[1], "hset")
+		if name == "HMSET" {
+			return fakeStatus("OK")
+		}
+		return added
+	case "HGET":
+		entry, err := fr.hashFor(c.db, args[1], false)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return nil
+		}
+		value, ok := entry.hash[args[2]]
+		if !ok {
+			return nil
+		}
+		return value
+	case "HMGET":
+		entry, err := fr.hashFor(c.db, args[1], false)
+		if err != nil {
+			return err
+		}
+		values := make([]any, 0, len(args)-2)
+		for _, field := range args[2:] {
+			if value, ok := entry.hashValue(field); ok {
+				values = append(values, value)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	case "HGETALL", "HKEYS":
+		entry, err := fr.hashFor(c.db, args[1], false)
+		if err != nil {
+			return err
+		}
+		values := make([]any, 0)
+		if entry != nil {
+			for _, field := range slices.Sorted(maps.Keys(entry.hash)) {
+				values = append(values, field)
+				if name == "HGETALL" {
+					values = append(values, entry.hash[field])
+				}
+			}
+		}
+		return values
+	case "HLEN":
+		entry, err := fr.hashFor(c.db, args[1], false)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return int64(0)
+		}
+		return int64(len(entry.hash))
+	case "HEXISTS":
+		entry, err := fr.hashFor(c.db, args[1], false)
+		if err != nil {
+			return err
+		}
+		if _, ok := entry.hashValue(args[2]); ok {
+			return int64(1)
+		}
+		return int64(0)
+	case "HDEL":
+		entry, err := fr.hashFor(c.db, args[1], false)
+		if err != nil {
+			return err
+		}
+		n := int64(0)
+		if entry != nil {
+			for _, field := range args[2:] {
+				if _, ok := entry.hash[field]; ok {
+					delete(entry.hash, field)
+					delete(entry.field_expires, field)
+					n++
+				}
+			}
+			if len(entry.hash) == 0 {
+				delete(db, args[1])
+			}
+		}
+		if n != 0 {
+			fr.touch(c.db, args[1], "hdel")
+		}
+		return n
+	case "HEXPIRE", "HPEXPIRE":
+		entry, err := fr.hashFor(c.db, args[1], false)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		unit := time.Second
+		if name == "HPEXPIRE" {
+			unit = time.Millisecond
+		}
+		fields := args[slices.IndexFunc(args, func(arg string) bool { return strings.EqualFold(arg, "FIELDS") })+2:]
+		results := make([]any, 0, len(fields))
+		for _, field := range fields {
+			if _, ok := entry.hashValue(field); !ok {
+				results = append(results, int64(-2))
+				continue
+			}
+			if entry.field_expires == nil {
+				entry.field_expires = map[string]time.Time{}
+			}
+			entry.field_expires[field] = fr.now().Add(time.Duration(n) * unit)
+			results = append(results, int64(1))
+		}
+		fr.touch(c.db, args[1], "hexpire")
+		return results
+	case "HTTL", "HPTTL":
+		entry, err := fr.hashFor(c.db, args[1], false)
+		if err != nil {
+			return err
+		}
+		unit := time.Second
+		if name == "HPTTL" {
+			unit = time.Millisecond
+		}
+		fields := args[slices.IndexFunc(args, func(arg string) bool { return strings.EqualFold(arg, "FIELDS") })+2:]
+		results := make([]any, 0, len(fields))
+		for _, field := range fields {
+			if _, ok := entry.hashValue(field); !ok {
+				results = append(results, int64(-2))
+			} else if expires, ok := entry.field_expires[field]; !ok {
+				results = append(results, int64(-1))
+			} else {
+				results = append(results, int64(expires.Sub(fr.now())/unit))
+			}
+		}
+		return results
+
+	case "ZADD":
+		entry, err := fr.zsetFor(c.db, args[1])
+		if err != nil {
+			return err
+		}
+		i := 2
+		for i < len(args) && slices.Contains([]string{"NX", "XX", "GT", "LT", "CH", "INCR"}, strings.ToUpper(args[i])) {
+			i++
+		}
+		added := int64(0)
+		for ; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			if _, ok := entry.zset[args[i+1]]; !ok {
+				added++
+			}
+			entry.zset[args[i+1]] = score
+		}
+		fr.touch(c.db, args[1], "zadd")
+		return added
+	case "ZREM":
+		entry, err := fr.zsetFor(c.db, args[1])
+		if err != nil {
+			return err
+		}
+		n := int64(0)
+		for _, member := range args[2:] {
+			if _, ok := entry.zset[member]; ok {
+				delete(entry.zset, member)
+				n++
+			}
+		}
+		fr.dropEmpty(c.db, args[1])
+		fr.touch(c.db, args[1], "zrem")
+		return n
+	case "ZCARD":
+		entry, err := fr.zsetFor(c.db, args[1])
+		if err != nil {
+			return err
+		}
+		n := int64(len(entry.zset))
+		fr.dropEmpty(c.db, args[1])
+		return n
+	case "ZSCORE":
+		entry, err := fr.zsetFor(c.db, args[1])
+		if err != nil {
+			return err
+		}
+		score, ok := entry.zset[args[2]]
+		fr.dropEmpty(c.db, args[1])
+		if !ok {
+			return nil
+		}
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	case "ZRANGEBYSCORE", "ZREMRANGEBYSCORE":
+		entry, err := fr.zsetFor(c.db, args[1])
+		if err != nil {
+			return err
+		}
+		lo, lo_open := parseScoreBound(args[2])
+		hi, hi_open := parseScoreBound(args[3])
+		members := entry.sorted()
+		in := make([]string, 0)
+		for _, member := range members {
+			score := entry.zset[member]
+			if score < lo || (lo_open && score == lo) || score > hi || (hi_open && score == hi) {
+				continue
+			}
+			in = append(in, member)
+		}
+		if name == "ZREMRANGEBYSCORE" {
+			for _, member := range in {
+				delete(entry.zset, member)
+			}
+			fr.dropEmpty(c.db, args[1])
+			fr.touch(c.db, args[1], "zremrangebyscore")
+			return int64(len(in))
+		}
+		fr.dropEmpty(c.db, args[1])
+		for i := 4; i+2 < len(args); i++ {
+			if strings.EqualFold(args[i], "LIMIT") {
+				offset, _ := strconv.Atoi(args[i+1])
+				count, _ := strconv.Atoi(args[i+2])
+				in = in[min(offset, len(in)):]
+				if count >= 0 {
+					in = in[:min(count, len(in))]
+				}
+			}
+		}
+		result := make([]any, 0, len(in))
+		for _, member := range in {
+			result = append(result, member)
+		}
+		return result
+	case "ZRANGE", "ZREMRANGEBYRANK":
+		entry, err := fr.zsetFor(c.db, args[1])
+		if err != nil {
+			return err
+		}
+		members := entry.sorted()
+		start, _ := strconv.Atoi(args[2])
+		stop, _ := strconv.Atoi(args[3])
+		if start < 0 {
+			start = max(len(members)+start, 0)
+		}
+		if stop < 0 {
+			stop = len(members) + stop
+		}
+		stop = min(stop, len(members)-1)
+		in := make([]string, 0)
+		if start <= stop {
+			in = members[start : stop+1]
+		}
+		if name == "ZREMRANGEBYRANK" {
+			for _, member := range in {
+				delete(entry.zset, member)
+			}
+			fr.dropEmpty(c.db, args[1])
+			fr.touch(c.db, args[1], "zremrangebyrank")
+			return int64(len(in))
+		}
+		fr.dropEmpty(c.db, args[1])
+		result := make([]any, 0, len(in))
+		for _, member := range in {
+			result = append(result, member)
+		}
+		return result
+
+	case "XADD":
+		entry := fr.lookup(c.db, args[1])
+		if entry == nil {
+			entry = &fakeEntry{kind: "stream"}
+			db[args[1]] = entry
+		} else if entry.kind != "stream" {
+			return errWrongType
+		}
+		i, max_len := 2, -1
+		if strings.EqualFold(args[i], "MAXLEN") {
+			i++
+			if args[i] == "~" || args[i] == "=" {
+				i++
+			}
+			max_len, _ = strconv.Atoi(args[i])
+			i++
+		}
+		id := fmt.Sprintf("%d-%d", fr.now().UnixMilli(), len(entry.stream))
+		entry.stream = append(entry.stream, fakeStreamEntry{id: id, values: slices.Clone(args[i+1:])})
+		if max_len >= 0 && len(entry.stream) > max_len {
+			entry.stream = entry.stream[len(entry.stream)-max_len:]
+		}
+		fr.touch(c.db, args[1], "xadd")
+		return id
+	case "XLEN":
+		entry := fr.lookup(c.db, args[1])
+		if entry == nil {
+			return int64(0)
+		}
+		return int64(len(entry.stream))
+
+	case "PUBLISH":
+		return int64(fr.publish(args[1], args[2]))
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		fr.subs[c] = true
+		for _, channel := range args[1:] {
+			kind := "subscribe"
+			if name == "PSUBSCRIBE" {
+				kind = "psubscribe"
+				if c.patterns == nil {
+					c.patterns = map[string]bool{}
+				}
+				c.patterns[channel] = true
+			} else {
+				if c.channels == nil {
+					c.channels = map[string]bool{}
+				}
+				c.channels[channel] = true
+			}
+			c.send([]any{kind, channel, int64(len(c.channels) + len(c.patterns))})
+		}
+		return fakeNoReply{}
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		set := c.channels
+		kind := "unsubscribe"
+		if name == "PUNSUBSCRIBE" {
+			set, kind = c.patterns, "punsubscribe"
+		}
+		names := args[1:]
+		if len(names) == 0 {
+			names = slices.Collect(maps.Keys(set))
+		}
+		for _, channel := range names {
+			delete(set, channel)
+			c.send([]any{kind, channel, int64(len(c.channels) + len(c.patterns))})
+		}
+		return fakeNoReply{}
+
+	case "EVALSHA", "EVAL":
+		sha := args[1]
+		if name == "EVAL" {
+			sum := sha1.Sum([]byte(args[1]))
+			sha = hex.EncodeToString(sum[:])
+		}
+		script, ok := fr.scripts[sha]
+		if !ok {
+			return fakeError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		n, _ := strconv.Atoi(args[2])
+		keys, script_args := args[3:3+n], args[3+n:]
+		for _, key := range keys {
+			fr.lookup(c.db, key)
+		}
+		reply := script(db, keys, script_args)
+		for _, key := range keys {
+			fr.touch(c.db, key, "")
+		}
+		return reply
+	}
+	return fakeError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+}
+
+func (fr *fakeRedis) hashFor(db int, key string, create bool) (*fakeEntry, any) {
+	entry := fr.lookup(db, key)
+	if entry == nil {
+		if !create {
+			return nil, nil
+		}
+		entry = &fakeEntry{kind: "hash", hash: map[string]string{}}
+		fr.db(db)[key] = entry
+	}
+	if entry.kind != "hash" {
+		return nil, errWrongType
+	}
+	return entry, nil
+}
+
+func (fr *fakeRedis) zsetFor(db int, key string) (*fakeEntry, any) {
+	entry := fr.lookup(db, key)
+	if entry == nil {
+		entry = &fakeEntry{kind: "zset", zset: map[string]float64{}}
+		fr.db(db)[key] = entry
+	}
+	if entry.kind != "zset" {
+		return nil, errWrongType
+	}
+	return entry, nil
+}
+
+// dropEmpty removes a sorted set left (or created) empty, as Redis doesn't keep empty keys
+func (fr *fakeRedis) dropEmpty(db int, key string) {
+	if entry := fr.db(db)[key]; entry != nil && entry.kind == "zset" && len(entry.zset) == 0 {
+		delete(fr.db(db), key)
+	}
+}
+
+func (e *fakeEntry) hashValue(field string) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	value, ok := e.hash[field]
+	return value, ok
+}
+
+func (e *fakeEntry) sorted() []string {
+	members := slices.Collect(maps.Keys(e.zset))
+	sort.Slice(members, func(i, j int) bool {
+		if e.zset[members[i]] != e.zset[members[j]] {
+			return e.zset[members[i]] < e.zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+func parseScoreBound(bound string) (float64, bool) {
+	open := strings.HasPrefix(bound, "(")
+	bound = strings.TrimPrefix(bound, "(")
+	switch bound {
+	case "-inf":
+		return math.Inf(-1), open
+	case "+inf", "inf":
+		return math.Inf(1), open
+	}
+	value, _ := strconv.ParseFloat(bound, 64)
+	return value, open
+}
+
+func (fr *fakeRedis) publish(channel, payload string) int {
+	n := 0
+	for c := range fr.subs {
+		if c.channels[channel] {
+			c.send([]any{"message", channel, payload})
+			n++
+		}
+		for pattern := range c.patterns {
+			if globMatch(pattern, channel) {
+				c.send([]any{"pmessage", pattern, channel, payload})
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// globMatch matches Redis glob patterns: *, ?, [...] and \ escapes
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			end := strings.IndexByte(pattern, ']')
+			if end < 0 || len(s) == 0 || !strings.ContainsRune(pattern[1:end], rune(s[0])) {
+				return false
+			}
+			pattern, s = pattern[end+1:], s[1:]
+		case '\\':
+			if len(pattern) < 2 || len(s) == 0 || s[0] != pattern[1] {
+				return false
+			}
+			pattern, s = pattern[2:], s[1:]
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
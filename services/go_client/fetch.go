@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Consumers that need a pilot the syncer hasn't stored yet (before the first sync, or a brand-new
+// pilot) HSET pilot_username on the fetch request key. Cache misses are fetched from the cloud and
+// stored like sync would; either way a "fetched" (or "fetch_failed") event on
+// cognicore:pilot_events signals that the consumer can read the pilot. Misses for the same pilot
+// are fetched at most once per FETCH_DEBOUNCE.
+
+var (
+	fetch_mu   sync.Mutex
+	last_fetch = map[string]time.Time{}
+)
+
+// fetchDebounced reports whether username was fetched within FETCH_DEBOUNCE, recording a fetch
+// now otherwise
+func fetchDebounced(username string) bool {
+	fetch_mu.Lock()
+	defer fetch_mu.Unlock()
+
+	now := time.Now()
+	for name, at := range last_fetch {
+		if now.Sub(at) >= cfg.FetchDebounce {
+			delete(last_fetch, name)
+		}
+	}
+	if _, ok := last_fetch[username]; ok {
+		return true
+	}
+	last_fetch[username] = now
+	return false
+}
+
+func HandleFetchRequest(rdb *redis.Client, sessions *SessionManager, username string) {
+	ctx := withTrace(context.Background(), "fetch")
+	if !validUsername(username) {
+		logf(ctx, "ignoring fetch request with invalid username %q", username)
+		return
+	}
+
+	event := PilotEvent{Event: "fetched", Username: username}
+	defer func() {
+		if err := publishPilotEvent(ctx, rdb, event); err != nil {
+			logf(ctx, "failed to publish fetch event: %v", err)
+		}
+	}()
+
+	exists, err := rdb.Exists(ctx, pilotKey(username)).Result()
+	if err != nil {
+		logf(ctx, "failed to check cache for %q: %v", username, err)
+		event.Event = "fetch_failed"
+		return
+	}
+	if exists != 0 {
+		debugCtxf(ctx, "Fetch request for %q is a cache hit", username)
+		return
+	}
+	if fetchDebounced(username) {
+		logf(ctx, "Pilot %q was fetched recently, not fetching again", username)
+		event.Event = "fetch_failed"
+		return
+	}
+
+	logf(ctx, "Cache miss for %q, fetching from the cloud", username)
+	api_client, gen, err := sessions.Client()
+	if err != nil {
+		logf(ctx, "failed to connect to server: %v", err)
+		event.Event = "fetch_failed"
+		return
+	}
+
+	pilot, err := GetPilotFromServer(ctx, api_client, username)
+	if err != nil {
+		logf(ctx, "failed to get pilot from server: %v", err)
+		if errors.Is(err, ErrTransport) {
+			sessions.Invalidate(gen)
+		}
+		event.Event = "fetch_failed"
+		return
+	}
+
+	if !checkWrite(writePilot(ctx, rdb, *pilot), "write pilot %q", username) {
+		event.Event = "fetch_failed"
+		return
+	}
+	event.FlightID = pilot.FlightID
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useFetchDebounce starts the test with no fetches recorded, and forgets its own afterwards
+func useFetchDebounce(t *testing.T) {
+	reset := func() {
+		fetch_mu.Lock()
+		last_fetch = map[string]time.Time{}
+		fetch_mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func nextEvent(t *testing.T, events <-chan PilotEvent) PilotEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pilot event published")
+		return PilotEvent{}
+	}
+}
+
+func TestFetchRequestMiss(t *testing.T) {
+	useConfig(t, nil)
+	useFetchDebounce(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	sessions := newTestSessions(cloud.URL)
+	events := subscribeEvents(t, rdb)
+
+	HandleFetchRequest(rdb, sessions, "alice")
+	if event := nextEvent(t, events); event.Event != "fetched" || event.Username != "alice" {
+		t.Fatalf("published %+v, want alice fetched", event)
+	}
+	if fields := fr.hash(0, pilotKey("alice")); fields["pilot_username"] != "alice" || fields["personal_data"] == "" {
+		t.Fatalf("alice after the fetch: %v", fields)
+	}
+	if !fr.exists(0, embeddingKey("alice")) {
+		t.Error("alice's embedding wasn't stored")
+	}
+
+	// Now a hit: answered from the cache without asking the cloud
+	fetches := cloud.count("cat " + homeFile("alice", "user.profile"))
+	HandleFetchRequest(rdb, sessions, "alice")
+	if event := nextEvent(t, events); event.Event != "fetched" {
+		t.Fatalf("published %+v for a cache hit", event)
+	}
+	if cloud.count("cat "+homeFile("alice", "user.profile")) != fetches {
+		t.Error("a cache hit fetched from the cloud")
+	}
+}
+
+func TestFetchRequestDebounced(t *testing.T) {
+	useConfig(t, map[string]string{"FETCH_DEBOUNCE": "1h"})
+	useFetchDebounce(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	sessions := newTestSessions(cloud.URL)
+	events := subscribeEvents(t, rdb)
+
+	// bob doesn't exist, so every request misses
+	HandleFetchRequest(rdb, sessions, "bob")
+	if event := nextEvent(t, events); event.Event != "fetch_failed" {
+		t.Fatalf("published %+v for an unknown pilot, want fetch_failed", event)
+	}
+	profile_fetches := cloud.count("cat " + homeFile("bob", "user.profile"))
+	if profile_fetches == 0 {
+		t.Fatal("the first miss didn't fetch")
+	}
+	for range 3 {
+		HandleFetchRequest(rdb, sessions, "bob")
+		if event := nextEvent(t, events); event.Event != "fetch_failed" {
+			t.Fatalf("published %+v for a debounced miss", event)
+		}
+	}
+	if cloud.count("cat "+homeFile("bob", "user.profile")) != profile_fetches {
+		t.Error("misses within FETCH_DEBOUNCE fetched again")
+	}
+}
+
+func TestFetchRequestFailures(t *testing.T) {
+	useConfig(t, nil)
+	useFetchDebounce(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	events := subscribeEvents(t, rdb)
+
+	// Invalid usernames are ignored outright
+	HandleFetchRequest(rdb, newTestSessions(cloud.URL), "../alice")
+	select {
+	case event := <-events:
+		t.Fatalf("published %+v for an invalid username", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cloud.setDown(true)
+	HandleFetchRequest(rdb, newTestSessions(cloud.URL), "alice")
+	if event := nextEvent(t, events); event.Event != "fetch_failed" {
+		t.Fatalf("published %+v with the cloud down, want fetch_failed", event)
+	}
+	if fr.exists(0, pilotKey("alice")) {
+		t.Error("a failed fetch wrote the pilot")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
+	"github.com/goccy/go-yaml"
+)
+
+// Flight files are YAML mappings. Besides end_timestamp they carry an "events" sequence that
+// grows as events are appended; keys this client doesn't know about are preserved on rewrite.
+// The cloud's tee can't append, so every write is a read-modify-write of the whole file.
+//
+// Checking whether a flight is open shouldn't mean reading the whole (growing) file, and the
+// cloud shell has neither tail nor rm. So empty sidecar files mark the state: <id>.open when the
+// flight is created and <id>.ended when it's finalized. Both show up in the ls CurrentFlight
+// runs anyway; only flights from before the markers existed still need their file read.
+
+// ErrInvalidFlight marks a flight file that isn't valid (YAML, or compressed) flight data
+var ErrInvalidFlight = errors.New("invalid flight file")
+
+// FlightEvent is one entry of a flight file's event log
+type FlightEvent struct {
+	Timestamp uint64         `yaml:"timestamp"`
+	Type      string         `yaml:"type"`
+	Payload   map[string]any `yaml:"payload,omitempty"`
+}
+
+type flightRotationKey struct{}
+
+// withFlightRotation lets CurrentFlight replace a flight open past MAX_FLIGHT_DURATION. Only
+// pilot activity does that: a sync looking up the flight for every pilot mustn't end one.
+func withFlightRotation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, flightRotationKey{}, true)
+}
+
+func flightRotation(ctx context.Context) bool {
+	rotate, _ := ctx.Value(flightRotationKey{}).(bool)
+	return rotate
+}
+
+// CurrentFlight returns the ID of the open flight activity should be attributed to,
+// creating a new flight when there is none or the latest one has been finalized (or, under
+// withFlightRotation, has been open longer than MAX_FLIGHT_DURATION)
+func CurrentFlight(ctx context.Context, api_client client.SocketClient) (string, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, fmt.Sprintf("%s && ls -yl %s", flightWriteCommand("mkdir -p "+cfg.FlightsDir), cfg.FlightsDir), stdout, stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to check flights: %w", err)
+	}
+
+	if status != 0 {
+		return "", fmt.Errorf("command failed while trying to get flight files: %s", stderrSummary(stderr.String()))
+	}
+
+	files, err := parseFileList(ctx, stdout.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	candidates := latestFlights(ctx, files)
+	if len(candidates) == 0 {
+		logf(ctx, "No flight files, creating one...")
+		return createFlight(ctx, api_client)
+	}
+
+	if len(candidates) > 1 {
+		logf(ctx, "warning: multiple flight files share the latest flight number: %v", candidates)
+	}
+
+	flight_id, err := firstOpenFlight(ctx, api_client, fileNames(files), candidates)
+	if err != nil {
+		return "", err
+	}
+	if flight_id == "" {
+		logf(ctx, "Flight file is finalized, creating a new one...")
+		return createFlight(ctx, api_client)
+	}
+	if start, ok := flightStart(flight_id); ok && cfg.MaxFlightDuration > 0 && time.Since(start) > cfg.MaxFlightDuration && flightRotation(ctx) {
+		logf(ctx, "Flight %s has been open since %s (MAX_FLIGHT_DURATION %v), finalizing it", flight_id, start.Format(time.RFC3339), cfg.MaxFlightDuration)
+		if err := FinalizeFlight(ctx, api_client, flight_id, time.Now()); err != nil {
+			return "", fmt.Errorf("failed to finalize flight %s: %w", flight_id, err)
+		}
+		return createFlight(ctx, api_client)
+	}
+	return flight_id, nil
+}
+
+// firstOpenFlight returns the first of candidates (the latest flights) that's open, or "" if
+// they're all finalized. With duplicates, the first open one wins; candidates are sorted so the
+// choice is deterministic.
+func firstOpenFlight(ctx context.Context, api_client client.SocketClient, names map[string]bool, candidates []string) (string, error) {
+	for _, flight_id := range candidates {
+		open, err := flightIsOpen(ctx, api_client, names, flight_id)
+		if err != nil {
+			return "", err
+		}
+		if open {
+			return flight_id, nil
+		}
+	}
+	return "", nil
+}
+
+func fileNames(files []FileInfo) map[string]bool {
+	names := map[string]bool{}
+	for _, file := range files {
+		names[file.Name] = true
+	}
+	return names
+}
+
+// flightIsOpen checks a flight against names, the files of the flights directory: it has to
+// exist and not be finalized
+func flightIsOpen(ctx context.Context, api_client client.SocketClient, names map[string]bool, flight_id string) (bool, error) {
+	switch {
+	case !names[path.Base(flightFile(flight_id))]:
+		return false, nil
+	case names[path.Base(flightMarker(flight_id, "ended"))]:
+		return false, nil
+	case names[path.Base(flightMarker(flight_id, "open"))]:
+		debugCtxf(ctx, "Flight %s is marked open", flight_id)
+		return true, nil
+	}
+
+	file, err := readFlightFile(ctx, api_client, flight_id)
+	if errors.Is(err, ErrInvalidFlight) {
+		// Typically a write cut short by a restart. Nothing says the flight ended, so it's resumed
+		// rather than every pilot request failing (or a new flight starting) over it.
+		logf(ctx, "warning: resuming flight %s despite unreadable file: %v", flight_id, err)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if file.EndTimestamp == 0 {
+		debugCtxf(ctx, "Flight file %s relevant, no end yet", flight_id)
+		return true, nil
+	}
+	return false, nil
+}
+
+// listFlightFiles lists the flights directory
+func listFlightFiles(ctx context.Context, api_client client.SocketClient) ([]FileInfo, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, "ls -yl "+cfg.FlightsDir, stdout, stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check flights: %w", err)
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("command failed while trying to get flight files: %s", stderrSummary(stderr.String()))
+	}
+	return parseFileList(ctx, stdout.Bytes())
+}
+
+// revalidateFlights re-checks the flight IDs of pilots right before they're written. They were
+// picked when each pilot was fetched, and the flight may have been finalized (or removed) since;
+// stale ones are replaced by the current flight so consumers don't log to a closed flight.
+func revalidateFlights(ctx context.Context, api_client client.SocketClient, pilots []PilotInfo) error {
+	flight_ids := map[string]bool{}
+	for _, pilot := range pilots {
+		flight_ids[pilot.FlightID] = true
+	}
+	if len(flight_ids) == 0 {
+		return nil
+	}
+
+	files, err := listFlightFiles(ctx, api_client)
+	if err != nil {
+		return err
+	}
+	names := fileNames(files)
+
+	replacements := map[string]string{}
+	for flight_id := range flight_ids {
+		if flight_id != "" {
+			open, err := flightIsOpen(ctx, api_client, names, flight_id)
+			if err != nil {
+				return err
+			}
+			if open {
+				continue
+			}
+		}
+		current, err := CurrentFlight(ctx, api_client)
+		if err != nil {
+			return err
+		}
+		logf(ctx, "Flight %q is no longer open, using %s instead", flight_id, current)
+		replacements[flight_id] = current
+	}
+
+	for i := range pilots {
+		if current, ok := replacements[pilots[i].FlightID]; ok {
+			pilots[i].FlightID = current
+		}
+	}
+	return nil
+}
+
+// parseFileList decodes `ls -yl` output one entry at a time, so a field whose type or layout
+// changes on the cloud's side costs that field rather than the whole listing. Unknown fields are
+// ignored; entries without a name are useless for flight detection and skipped.
+func parseFileList(ctx context.Context, output []byte) ([]FileInfo, error) {
+	if len(output) == 0 {
+		return nil, nil
+	}
+
+	var entries []map[string]any
+	if err := yaml.UnmarshalContext(ctx, output, &entries); err != nil {
+		return nil, fmt.Errorf("ls returned invalid yaml: %v", err)
+	}
+
+	files := make([]FileInfo, 0, len(entries))
+	for i, entry := range entries {
+		name, _ := entry["name"].(string)
+		if name == "" {
+			logf(ctx, "warning: ls entry %d has no name, skipping it", i)
+			continue
+		}
+
+		file := FileInfo{Name: name}
+		if raw, err := yaml.Marshal(entry); err == nil {
+			if err := yaml.UnmarshalContext(ctx, raw, &file); err != nil {
+				debugCtxf(ctx, "ls entry %q doesn't match the expected layout (%v), using its name only", name, err)
+				file = FileInfo{Name: name}
+			}
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// latestFlights returns the IDs of the flight files with the highest flight number, sorted.
+// Usually there's exactly one, but e.g. "0042.flight" and "42.flight" parse to the same number.
+func latestFlights(ctx context.Context, files []FileInfo) []string {
+	latest := make([]string, 0)
+	max_num := 0
+	for _, file := range files {
+		flight_id, ok := strings.CutSuffix(file.Name, ".flight")
+		if !ok {
+			continue
+		}
+		num, ok := parseFlightNumber(flight_id)
+		if !ok {
+			debugCtxf(ctx, "Ignoring malformed flight file %q", file.Name)
+			continue
+		}
+		if num > max_num {
+			latest = latest[:0]
+			max_num = num
+		}
+		if num == max_num {
+			latest = append(latest, flight_id)
+		}
+	}
+
+	slices.Sort(latest)
+	return latest
+}
+
+// parseFlightNumber parses a flight ID, which must be entirely decimal digits and positive.
+// fmt.Sscan would take "123abc" (or " 42") for a flight number too.
+func parseFlightNumber(flight_id string) (int, bool) {
+	if flight_id == "" || strings.Trim(flight_id, "0123456789") != "" {
+		return 0, false
+	}
+	num, err := strconv.ParseInt(flight_id, 10, 0)
+	if err != nil || num <= 0 {
+		return 0, false
+	}
+	return int(num), true
+}
+
+// flightStart recovers when a flight started from its ID, which createFlight takes from the clock.
+// Flights numbered some other way (e.g. "42") have no known start.
+func flightStart(flight_id string) (time.Time, bool) {
+	num, ok := parseFlightNumber(flight_id)
+	start := time.Unix(0, int64(num))
+	if !ok || start.Year() < 2000 {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// flightWriteCommand routes a command that modifies flights through FLIGHT_COMMAND_PREFIX, for
+// deployments where those need a different permission context; reads are never prefixed
+func flightWriteCommand(command string) string {
+	if cfg.FlightCommandPrefix == "" {
+		return command
+	}
+	return cfg.FlightCommandPrefix + " " + command
+}
+
+func createFlight(ctx context.Context, api_client client.SocketClient) (string, error) {
+	flight_id := fmt.Sprint(time.Now().UnixNano())
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, flightWriteCommand("tee "+flightFile(flight_id)), stdout, stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to create flight (%s): %w", flight_id, err)
+	}
+
+	if status != 0 {
+		return "", fmt.Errorf("tee command failed for flight %s: %s", flight_id, stderrSummary(stderr.String()))
+	}
+
+	// Without the marker the flight is still found open, just by reading it
+	if err := touchFlightMarker(ctx, api_client, flight_id, "open"); err != nil {
+		logf(ctx, "warning: failed to mark flight %s open: %v", flight_id, err)
+	}
+	return flight_id, nil
+}
+
+func touchFlightMarker(ctx context.Context, api_client client.SocketClient, flight_id, state string) error {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, flightWriteCommand("tee "+flightMarker(flight_id, state)), stdout, stderr)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("tee command failed: %s", stderrSummary(stderr.String()))
+	}
+	return nil
+}
+
+func catFlight(ctx context.Context, api_client client.SocketClient, flight_id string) ([]byte, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, "cat "+flightFile(flight_id), stdout, stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flight (%s): %w", flight_id, err)
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("cat command failed for flight %s: %s", flight_id, stderrSummary(stderr.String()))
+	}
+	return decodeFlight(stdout.Bytes())
+}
+
+// With COMPRESS_FLIGHTS, flight files are written as gzip:v1: followed by base64 of the gzipped
+// YAML (the command streams are text, so raw gzip wouldn't survive cat). Reads accept both forms
+// whatever the setting, so it can be flipped with flights of either kind around.
+const compressedFlightPrefix = "gzip:v1:"
+
+func encodeFlight(data []byte) ([]byte, error) {
+	if !cfg.CompressFlights {
+		return data, nil
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(compressedFlightPrefix + base64.StdEncoding.EncodeToString(compressed.Bytes()) + "\n"), nil
+}
+
+func decodeFlight(data []byte) ([]byte, error) {
+	encoded, ok := bytes.CutPrefix(bytes.TrimSpace(data), []byte(compressedFlightPrefix))
+	if !ok {
+		return data, nil
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad base64: %w", ErrInvalidFlight, err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFlight, err)
+	}
+	defer gz.Close()
+	decompressed, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFlight, err)
+	}
+	return decompressed, nil
+}
+
+func readFlightFile(ctx context.Context, api_client client.SocketClient, flight_id string) (FlightFile, error) {
+	var file FlightFile
+	data, err := catFlight(ctx, api_client, flight_id)
+	if err != nil {
+		return file, err
+	}
+
+	if err := yaml.UnmarshalContext(ctx, data, &file); err != nil {
+		return file, fmt.Errorf("%w: %v", ErrInvalidFlight, err)
+	}
+	return file, nil
+}
+
+func readFlight(ctx context.Context, api_client client.SocketClient, flight_id string) (map[string]any, error) {
+	data, err := catFlight(ctx, api_client, flight_id)
+	if err != nil {
+		return nil, err
+	}
+
+	file := map[string]any{}
+	if err := yaml.UnmarshalContext(ctx, data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFlight, err)
+	}
+	if file == nil {
+		file = map[string]any{}
+	}
+	return file, nil
+}
+
+func writeFlight(ctx context.Context, api_client client.SocketClient, flight_id string, file map[string]any) error {
+	data, err := yaml.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("failed to marshal flight: %v", err)
+	}
+
+	if data, err = encodeFlight(data); err != nil {
+		return fmt.Errorf("failed to compress flight: %v", err)
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommandWithInput(ctx, api_client, flightWriteCommand("tee "+flightFile(flight_id)), bytes.NewReader(data), stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("failed to write flight (%s): %w", flight_id, err)
+	}
+	if status != 0 {
+		return fmt.Errorf("tee command failed for flight %s: %s", flight_id, stderrSummary(stderr.String()))
+	}
+	return nil
+}
+
+// AppendFlightEvent adds an event to the end of a flight's event log
+func AppendFlightEvent(ctx context.Context, api_client client.SocketClient, flight_id string, event FlightEvent) error {
+	file, err := readFlight(ctx, api_client, flight_id)
+	if err != nil {
+		return err
+	}
+
+	if event.Timestamp == 0 {
+		event.Timestamp = uint64(time.Now().UnixNano())
+	}
+	events, _ := file["events"].([]any)
+	file["events"] = append(events, event)
+
+	return writeFlight(ctx, api_client, flight_id, file)
+}
+
+// FinalizeFlight writes end_timestamp into a flight file, keeping whatever else it already holds
+func FinalizeFlight(ctx context.Context, api_client client.SocketClient, flight_id string, end time.Time) error {
+	file, err := readFlight(ctx, api_client, flight_id)
+	if errors.Is(err, ErrInvalidFlight) {
+		// Rewriting it would lose whatever is salvageable, but the marker alone ends the flight
+		logf(ctx, "warning: flight %s is unreadable, only marking it ended: %v", flight_id, err)
+	} else if err != nil {
+		return err
+	} else if end_timestamp, ok := file["end_timestamp"]; !ok || fmt.Sprint(end_timestamp) == "0" {
+		file["end_timestamp"] = uint64(end.UnixNano())
+		if err := writeFlight(ctx, api_client, flight_id, file); err != nil {
+			return err
+		}
+	}
+
+	// CurrentFlight takes the open marker's word without reading the file, so without the ended
+	// marker the flight would still be resumed as open
+	if err := touchFlightMarker(ctx, api_client, flight_id, "ended"); err != nil {
+		return fmt.Errorf("failed to mark flight %s ended: %w", flight_id, err)
+	}
+	return nil
+}
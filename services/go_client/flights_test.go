@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+func TestMaxFlightDurationRotatesOnRequestsOnly(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_FLIGHT_DURATION": "1h"})
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	old := fmt.Sprint(time.Now().Add(-2 * time.Hour).UnixNano())
+	cloud.setFile(flightFile(old), "events: []\n")
+	cloud.setFile(flightMarker(old, "open"), "")
+	api_client := cloud.connect()
+
+	// Syncs keep attributing pilots to the flight, however old
+	list, err := GetPilots(context.Background(), api_client, nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	if len(list.Pilots) != 1 || list.Pilots[0].FlightID != old {
+		t.Fatalf("synced pilots %+v, want alice on flight %s", list.Pilots, old)
+	}
+	if _, ok := cloud.file(flightMarker(old, "ended")); ok {
+		t.Fatal("a sync finalized the flight")
+	}
+
+	// A pilot request ends it and starts a new one
+	fr := newFakeRedis(t)
+	sessions := newTestSessions(cloud.URL)
+	HandlePilotRequest(context.Background(), fr.client(0), sessions, map[string]string{"pilot_username": "alice"})
+	if _, ok := cloud.file(flightMarker(old, "ended")); !ok {
+		t.Fatal("the pilot request didn't finalize the flight")
+	}
+	flight_id := fr.hash(0, pilotKey("alice"))["flight_id"]
+	if flight_id == "" || flight_id == old {
+		t.Fatalf("alice is on flight %q, want a new one", flight_id)
+	}
+	if _, ok := cloud.file(flightMarker(flight_id, "open")); !ok {
+		t.Fatalf("new flight %s isn't marked open", flight_id)
+	}
+}
+
+func TestAppendFlightEvent(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	const flight_id = "1700000000000000000"
+	cloud.setFile(flightFile(flight_id), "end_timestamp: 0\ncrew: [alice]\nevents:\n- timestamp: 1\n  type: takeoff\n")
+	api_client := cloud.connect()
+	ctx := context.Background()
+
+	before := uint64(time.Now().UnixNano())
+	if err := AppendFlightEvent(ctx, api_client, flight_id, FlightEvent{Type: "alert", Payload: map[string]any{"level": "high"}}); err != nil {
+		t.Fatalf("AppendFlightEvent: %v", err)
+	}
+	if err := AppendFlightEvent(ctx, api_client, flight_id, FlightEvent{Type: "deauth", Timestamp: 42}); err != nil {
+		t.Fatalf("AppendFlightEvent: %v", err)
+	}
+
+	data, _ := cloud.file(flightFile(flight_id))
+	var file struct {
+		EndTimestamp uint64        `yaml:"end_timestamp"`
+		Crew         []string      `yaml:"crew"`
+		Events       []FlightEvent `yaml:"events"`
+	}
+	if err := yaml.Unmarshal([]byte(data), &file); err != nil {
+		t.Fatalf("flight file isn't YAML: %v\n%s", err, data)
+	}
+	if len(file.Crew) != 1 || file.Crew[0] != "alice" {
+		t.Errorf("unknown key not preserved:\n%s", data)
+	}
+	if file.EndTimestamp != 0 {
+		t.Errorf("appending ended the flight:\n%s", data)
+	}
+	if len(file.Events) != 3 {
+		t.Fatalf("got %d events, want 3:\n%s", len(file.Events), data)
+	}
+	if event := file.Events[0]; event.Type != "takeoff" || event.Timestamp != 1 {
+		t.Errorf("existing event changed to %+v", event)
+	}
+	if event := file.Events[1]; event.Type != "alert" || event.Timestamp < before || event.Payload["level"] != "high" {
+		t.Errorf("appended event = %+v, want an alert stamped now", event)
+	}
+	if event := file.Events[2]; event.Type != "deauth" || event.Timestamp != 42 || event.Payload != nil {
+		t.Errorf("appended event = %+v, want a deauth at 42", event)
+	}
+	// Events without a payload leave the key out
+	if strings.Count(data, "payload:") != 1 {
+		t.Errorf("payload keys in:\n%s", data)
+	}
+}
+
+func TestAppendFlightEventWithoutFlight(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	const flight_id = "1700000000000000000"
+
+	err := AppendFlightEvent(context.Background(), cloud.connect(), flight_id, FlightEvent{Type: "alert"})
+	if err == nil || errors.Is(err, ErrTransport) {
+		t.Fatalf("AppendFlightEvent = %v, want the cat failure", err)
+	}
+	if _, ok := cloud.file(flightFile(flight_id)); ok {
+		t.Error("appending created the missing flight")
+	}
+	if cloud.count("tee") != 0 {
+		t.Errorf("wrote after a failed read: %v", cloud.ran())
+	}
+}
+
+func TestLatestFlightsSharingANumber(t *testing.T) {
+	files := []FileInfo{{Name: "7.flight"}, {Name: "42.flight"}, {Name: "0042.flight"}, {Name: "42.flight.ended"}, {Name: "x.flight"}}
+	if got := latestFlights(context.Background(), files); !slices.Equal(got, []string{"0042", "42"}) {
+		t.Fatalf("latestFlights = %v, want [0042 42]", got)
+	}
+}
+
+func TestCurrentFlightPicksAmongDuplicates(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"both open", map[string]string{"42": "end_timestamp: 0\n", "0042": "end_timestamp: 0\n"}, "0042"},
+		{"first ended", map[string]string{"42": "end_timestamp: 0\n", "0042": "end_timestamp: 5\n"}, "42"},
+		{"older open", map[string]string{"41": "end_timestamp: 0\n", "42": "end_timestamp: 0\n", "0042": "end_timestamp: 5\n"}, "42"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			cloud := newFakeCloud(t)
+			for flight_id, data := range tt.files {
+				cloud.setFile(flightFile(flight_id), data)
+			}
+			api_client := cloud.connect()
+
+			// The pick doesn't change from one call to the next
+			for range 3 {
+				flight_id, err := CurrentFlight(context.Background(), api_client)
+				if err != nil {
+					t.Fatalf("CurrentFlight: %v", err)
+				}
+				if flight_id != tt.want {
+					t.Fatalf("CurrentFlight = %s, want %s", flight_id, tt.want)
+				}
+			}
+			if cloud.count("tee") != 0 {
+				t.Fatalf("created a flight despite an open one: %v", cloud.ran())
+			}
+		})
+	}
+}
+
+func TestFlightIDFollowsRotation(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	sessions := newTestSessions(cloud.URL)
+	ctx := context.Background()
+	request := map[string]string{"pilot_username": "alice"}
+	flight := func() string { return fr.hash(0, pilotKey("alice"))["flight_id"] }
+
+	HandlePilotRequest(ctx, rdb, sessions, request)
+	first := flight()
+	if _, ok := cloud.file(flightFile(first)); first == "" || !ok {
+		t.Fatalf("pilot request stored flight %q, which has no file", first)
+	}
+
+	HandleDeauthRequest(rdb, sessions, "alice")
+	if got := flight(); got != "" {
+		t.Fatalf("flight_id = %q after deauth finalized it", got)
+	}
+
+	// The next session starts a new flight, also when the profile can't be fetched
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command == "cat "+homeFile("alice", "user.profile") {
+			return "", "cat: permission denied\n", 1, true
+		}
+		return "", "", 0, false
+	})
+	HandlePilotRequest(ctx, rdb, sessions, request)
+	second := flight()
+	if second == "" || second == first {
+		t.Fatalf("flight_id = %q after the flight rotated, want a new one", second)
+	}
+	current, err := CurrentFlight(ctx, cloud.connect())
+	if err != nil {
+		t.Fatalf("CurrentFlight: %v", err)
+	}
+	if second != current {
+		t.Fatalf("flight_id = %s, want the current flight %s", second, current)
+	}
+
+	// A sync stamps the same flight
+	cloud.setHandler(nil)
+	list, err := GetPilots(ctx, cloud.connect(), nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	if _, err := syncPilots(ctx, rdb, list, map[string]pilotHash{}); err != nil {
+		t.Fatalf("syncPilots: %v", err)
+	}
+	if got := flight(); got != second {
+		t.Fatalf("flight_id = %q after a sync, want %s", got, second)
+	}
+
+	// Finalizing the earlier flight again leaves the pilot on their new one
+	clearFlight(ctx, rdb, "alice", first)
+	if got := flight(); got != second {
+		t.Fatalf("flight_id = %q after clearing an old flight, want %s", got, second)
+	}
+}
+
+func TestParseFileList(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		output string
+		want   []FileInfo
+		err    bool
+	}{
+		{"empty", "", nil, false},
+		{
+			"expected layout",
+			"- name: 42.flight\n  type: file\n  file_size: 120\n  modified_time: \"2025-01-01T00:00:00Z\"\n- name: 42.open\n  type: file\n  file_size: 0\n",
+			[]FileInfo{{Name: "42.flight", Type: "file", FileSize: 120, ModifiedTime: "2025-01-01T00:00:00Z"}, {Name: "42.open", Type: "file"}},
+			false,
+		},
+		{
+			"unknown fields",
+			"- name: 42.flight\n  type: file\n  owner: device\n  checksum: {sha256: abc}\n",
+			[]FileInfo{{Name: "42.flight", Type: "file"}},
+			false,
+		},
+		{
+			// A field whose type changed costs only that entry's other fields
+			"changed field type",
+			"- name: 42.flight\n  file_size: {bytes: 120}\n  type: file\n- name: 43.flight\n  file_size: 7\n",
+			[]FileInfo{{Name: "42.flight"}, {Name: "43.flight", FileSize: 7}},
+			false,
+		},
+		{
+			"entries without a name",
+			"- type: file\n  file_size: 3\n- name: \"\"\n- name: 42.flight\n",
+			[]FileInfo{{Name: "42.flight"}},
+			false,
+		},
+		{"non-string name", "- name: [a, b]\n- name: 42.flight\n", []FileInfo{{Name: "42.flight"}}, false},
+		{"not a list", "name: 42.flight\n", nil, true},
+		{"invalid yaml", "- name: [42.flight\n", nil, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := parseFileList(context.Background(), []byte(tt.output))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseFileList = %+v, want an error", files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFileList: %v", err)
+			}
+			if !reflect.DeepEqual(files, tt.want) {
+				t.Fatalf("parseFileList = %+v, want %+v", files, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlightIsOpen(t *testing.T) {
+	useConfig(t, nil)
+	const flight_id = "1700000000000000000"
+	file := path.Base(flightFile(flight_id))
+	open := path.Base(flightMarker(flight_id, "open"))
+	ended := path.Base(flightMarker(flight_id, "ended"))
+	for _, tt := range []struct {
+		name     string
+		names    []string
+		contents string
+		want     bool
+		// Whether the flight file has to be read to tell
+		reads bool
+	}{
+		{"missing", []string{open}, "", false, false},
+		{"marked open", []string{file, open}, "end_timestamp: 1\n", true, false},
+		{"marked ended", []string{file, ended}, "", false, false},
+		{"ended wins over open", []string{file, open, ended}, "", false, false},
+		{"unmarked and running", []string{file}, "start_timestamp: 1\n", true, true},
+		{"unmarked and finished", []string{file}, "end_timestamp: 2\n", false, true},
+		{"unmarked and unreadable", []string{file}, "events: [\n", true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := newFakeCloud(t)
+			cloud.setFile(flightFile(flight_id), tt.contents)
+			names := map[string]bool{}
+			for _, name := range tt.names {
+				names[name] = true
+			}
+
+			got, err := flightIsOpen(context.Background(), cloud.connect(), names, flight_id)
+			if err != nil {
+				t.Fatalf("flightIsOpen: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("open = %v, want %v", got, tt.want)
+			}
+			if read := cloud.count("cat "+flightFile(flight_id)) != 0; read != tt.reads {
+				t.Errorf("read the flight file: %v, want %v", read, tt.reads)
+			}
+		})
+	}
+}
+
+func TestFlightCommandPrefix(t *testing.T) {
+	const prefix = "sudo -u flights"
+	useConfig(t, map[string]string{"FLIGHT_COMMAND_PREFIX": prefix})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	// Flight writes only work through the prefix, and nothing else may use it
+	var denied []string
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		var stdout strings.Builder
+		for part := range strings.SplitSeq(command, "&&") {
+			part = strings.TrimSpace(part)
+			unprefixed, prefixed := strings.CutPrefix(part, prefix+" ")
+			write := strings.HasPrefix(unprefixed, "tee "+cfg.FlightsDir) || strings.HasPrefix(unprefixed, "mkdir ")
+			if prefixed != write {
+				denied = append(denied, part)
+				return stdout.String(), "permission denied\n", 1, true
+			}
+			out, stderr, status := cloud.builtin(unprefixed, stdin)
+			stdout.WriteString(out)
+			if status != 0 {
+				return stdout.String(), stderr, status, true
+			}
+		}
+		return stdout.String(), "", 0, true
+	})
+	sessions := newTestSessions(cloud.URL)
+
+	HandlePilotRequest(context.Background(), rdb, sessions, map[string]string{"pilot_username": "alice"})
+	flight_id := fr.hash(0, pilotKey("alice"))["flight_id"]
+	if flight_id == "" {
+		t.Fatalf("no flight started; denied %q", denied)
+	}
+	HandleDeauthRequest(rdb, sessions, "alice")
+	if _, ok := cloud.file(flightMarker(flight_id, "ended")); !ok {
+		t.Fatalf("flight wasn't finalized; denied %q", denied)
+	}
+	if len(denied) != 0 {
+		t.Fatalf("commands with the wrong permission context: %q", denied)
+	}
+	if cloud.count(prefix+" tee "+flightFile(flight_id)) == 0 {
+		t.Fatalf("flight file never written through the prefix: %q", cloud.ran())
+	}
+	// The prefix doesn't hide what the command is from retries
+	if !idempotentCommand(prefix + " mkdir -p flights && ls -yl flights") {
+		t.Error("a prefixed mkdir -p isn't retried")
+	}
+
+	for _, invalid := range []string{"sudo; rm -rf /", "sudo -u flights &&", "$(whoami)"} {
+		if _, err := loadConfig(t, map[string]string{"FLIGHT_COMMAND_PREFIX": invalid}); err == nil {
+			t.Errorf("accepted FLIGHT_COMMAND_PREFIX %q", invalid)
+		}
+	}
+}
+
+func TestParseFlightNumber(t *testing.T) {
+	for _, tt := range []struct {
+		flight_id string
+		num       int
+		ok        bool
+	}{
+		{"42", 42, true},
+		{"0042", 42, true},
+		{"1700000000000000000", 1700000000000000000, true},
+		{"", 0, false},
+		{"0", 0, false},
+		{"000", 0, false},
+		{"-42", 0, false},
+		{"+42", 0, false},
+		{" 42", 0, false},
+		{"42 ", 0, false},
+		{"123abc", 0, false},
+		{"4_2", 0, false},
+		{"0x2a", 0, false},
+		{"1e3", 0, false},
+		// Past int64
+		{"99999999999999999999", 0, false},
+	} {
+		num, ok := parseFlightNumber(tt.flight_id)
+		if num != tt.num || ok != tt.ok {
+			t.Errorf("parseFlightNumber(%q) = %d, %v, want %d, %v", tt.flight_id, num, ok, tt.num, tt.ok)
+		}
+	}
+}
+
+func TestMalformedFlightFilesIgnored(t *testing.T) {
+	files := []FileInfo{{Name: "123abc.flight"}, {Name: " 9000.flight"}, {Name: "-9000.flight"}, {Name: "0.flight"}, {Name: "12.flight"}}
+	if got := latestFlights(context.Background(), files); !slices.Equal(got, []string{"12"}) {
+		t.Fatalf("latestFlights = %v, want [12]", got)
+	}
+	if got := latestFlights(context.Background(), files[:4]); len(got) != 0 {
+		t.Fatalf("latestFlights of malformed names only = %v, want none", got)
+	}
+}
+
+func TestFlightStart(t *testing.T) {
+	start, ok := flightStart("1700000000000000000")
+	if !ok || !start.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("flightStart = %v, %v", start, ok)
+	}
+	for _, flight_id := range []string{"42", "abc", ""} {
+		if _, ok := flightStart(flight_id); ok {
+			t.Errorf("flightStart(%q) has a start", flight_id)
+		}
+	}
+}
+
+func TestRevalidateFlights(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	cloud.setFile(flightFile("100"), "end_timestamp: 1\n")
+	cloud.setFile(flightMarker("100", "ended"), "")
+	cloud.setFile(flightFile("200"), "start_timestamp: 2\n")
+	cloud.setFile(flightMarker("200", "open"), "")
+	api_client := cloud.connect()
+
+	pilots := []PilotInfo{
+		{Username: "open", FlightID: "200"},
+		{Username: "ended", FlightID: "100"},
+		{Username: "removed", FlightID: "300"},
+		{Username: "none"},
+	}
+	if err := revalidateFlights(context.Background(), api_client, pilots); err != nil {
+		t.Fatalf("revalidateFlights: %v", err)
+	}
+	for _, pilot := range pilots {
+		if pilot.FlightID != "200" {
+			t.Errorf("%s pilot's flight = %q, want the open 200", pilot.Username, pilot.FlightID)
+		}
+	}
+
+	// Nothing to check, nothing run
+	ran := len(cloud.ran())
+	if err := revalidateFlights(context.Background(), api_client, nil); err != nil || len(cloud.ran()) != ran {
+		t.Fatalf("revalidateFlights without pilots = %v, ran %v", err, cloud.ran()[ran:])
+	}
+}
+
+func TestRevalidateFlightsStartsAFlight(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	// The only flight ended since the pilots were fetched
+	cloud.setFile(flightFile("100"), "end_timestamp: 1\n")
+	cloud.setFile(flightMarker("100", "ended"), "")
+
+	pilots := []PilotInfo{{Username: "alice", FlightID: "100"}, {Username: "bob", FlightID: "100"}}
+	if err := revalidateFlights(context.Background(), cloud.connect(), pilots); err != nil {
+		t.Fatalf("revalidateFlights: %v", err)
+	}
+	if pilots[0].FlightID == "100" || pilots[0].FlightID == "" || pilots[1].FlightID != pilots[0].FlightID {
+		t.Fatalf("flights = %q, %q; want one new flight for both", pilots[0].FlightID, pilots[1].FlightID)
+	}
+	if _, ok := cloud.file(flightFile(pilots[0].FlightID)); !ok {
+		t.Fatalf("flight %s wasn't created", pilots[0].FlightID)
+	}
+}
+
+func TestRevalidateFlightsListFailure(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		return "", "ls: permission denied\n", 1, strings.Contains(command, "ls -yl")
+	})
+	pilots := []PilotInfo{{Username: "alice", FlightID: "100"}}
+	if err := revalidateFlights(context.Background(), cloud.connect(), pilots); err == nil {
+		t.Fatal("revalidateFlights succeeded without a listing")
+	}
+	if pilots[0].FlightID != "100" {
+		t.Fatalf("flight changed to %q without a listing", pilots[0].FlightID)
+	}
+}
+
+func TestEncodeFlightRoundTrip(t *testing.T) {
+	data := []byte("start_timestamp: 1\nevents:\n" + strings.Repeat("  - type: auth\n    payload: {pilot_username: alice}\n", 50))
+
+	useConfig(t, map[string]string{"COMPRESS_FLIGHTS": "true"})
+	encoded, err := encodeFlight(data)
+	if err != nil {
+		t.Fatalf("encodeFlight: %v", err)
+	}
+	if !bytes.HasPrefix(encoded, []byte(compressedFlightPrefix)) || len(encoded) >= len(data) {
+		t.Fatalf("encoded %d bytes into %q", len(data), encoded[:min(len(encoded), 40)])
+	}
+	// cat's line ending doesn't get in the way
+	decoded, err := decodeFlight(append(bytes.TrimSpace(encoded), '\r', '\n'))
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("decodeFlight = %q, %v", decoded, err)
+	}
+
+	// Either form reads whatever the setting
+	useConfig(t, map[string]string{"COMPRESS_FLIGHTS": "false"})
+	if plain, err := encodeFlight(data); err != nil || !bytes.Equal(plain, data) {
+		t.Fatalf("encodeFlight without compression = %q, %v", plain, err)
+	}
+	if decoded, err := decodeFlight(encoded); err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("decodeFlight of a compressed flight = %q, %v", decoded, err)
+	}
+	if decoded, err := decodeFlight(data); err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("decodeFlight of a plain flight = %q, %v", decoded, err)
+	}
+
+	for name, corrupt := range map[string]string{
+		"bad base64":  compressedFlightPrefix + "not base64!",
+		"not gzip":    compressedFlightPrefix + "aGVsbG8=",
+		"cut short":   string(encoded[:len(encoded)/2]),
+		"prefix only": compressedFlightPrefix,
+	} {
+		if _, err := decodeFlight([]byte(corrupt)); !errors.Is(err, ErrInvalidFlight) {
+			t.Errorf("%s: decodeFlight = %v, want ErrInvalidFlight", name, err)
+		}
+	}
+}
+
+func TestCompressedFlightOnTheCloud(t *testing.T) {
+	useConfig(t, map[string]string{"COMPRESS_FLIGHTS": "true"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	sessions := newTestSessions(cloud.URL)
+
+	HandlePilotRequest(context.Background(), rdb, sessions, map[string]string{"pilot_username": "alice"})
+	flight_id := fr.hash(0, pilotKey("alice"))["flight_id"]
+	// Finalizing writes the deauth event and the end
+	HandleDeauthRequest(rdb, sessions, "alice")
+	stored, ok := cloud.file(flightFile(flight_id))
+	if flight_id == "" || !ok || !strings.HasPrefix(stored, compressedFlightPrefix) {
+		t.Fatalf("flight %q stored as %q", flight_id, stored)
+	}
+	file, err := readFlightFile(context.Background(), cloud.connect(), flight_id)
+	if err != nil || file.EndTimestamp == 0 || len(file.Events) != 1 || file.Events[0].Type != "deauth" {
+		t.Fatalf("readFlightFile = %+v, %v", file, err)
+	}
+}
+
+func TestCurrentFlightResumesUnreadableFlight(t *testing.T) {
+	useConfig(t, nil)
+	logs := captureLog(t)
+	cloud := newFakeCloud(t)
+	const flight_id = "1700000000000000000"
+	// A write cut short, from before the markers existed
+	cloud.setFile(flightFile(flight_id), "events:\n- timestamp: 1\n  type: [\n")
+
+	got, err := CurrentFlight(context.Background(), cloud.connect())
+	if err != nil {
+		t.Fatalf("CurrentFlight: %v", err)
+	}
+	if got != flight_id {
+		t.Fatalf("CurrentFlight = %s, want the unreadable flight %s resumed", got, flight_id)
+	}
+	if cloud.count("tee ") != 0 {
+		t.Errorf("resuming wrote to the cloud: %v", cloud.ran())
+	}
+	if !strings.Contains(logs.String(), "warning: resuming flight "+flight_id+" despite unreadable file") {
+		t.Errorf("resume wasn't logged:\n%s", logs)
+	}
+}
+
+func TestFinalizeFlight(t *testing.T) {
+	useConfig(t, nil)
+	const flight_id = "1700000000000000000"
+	end := time.Unix(0, 1700000001000000000)
+
+	t.Run("running", func(t *testing.T) {
+		cloud := newFakeCloud(t)
+		cloud.setFile(flightFile(flight_id), "end_timestamp: 0\ncrew: [alice]\n")
+		if err := FinalizeFlight(context.Background(), cloud.connect(), flight_id, end); err != nil {
+			t.Fatalf("FinalizeFlight: %v", err)
+		}
+		data, _ := cloud.file(flightFile(flight_id))
+		if !strings.Contains(data, "end_timestamp: 1700000001000000000") || !strings.Contains(data, "crew:") {
+			t.Errorf("flight file = %q, want the end written and crew kept", data)
+		}
+		if _, ok := cloud.file(flightMarker(flight_id, "ended")); !ok {
+			t.Error("flight wasn't marked ended")
+		}
+	})
+
+	t.Run("already ended", func(t *testing.T) {
+		cloud := newFakeCloud(t)
+		cloud.setFile(flightFile(flight_id), "end_timestamp: 5\n")
+		if err := FinalizeFlight(context.Background(), cloud.connect(), flight_id, end); err != nil {
+			t.Fatalf("FinalizeFlight: %v", err)
+		}
+		if cloud.count("tee "+flightFile(flight_id)) != 0 {
+			t.Error("the end of an ended flight was rewritten")
+		}
+		if _, ok := cloud.file(flightMarker(flight_id, "ended")); !ok {
+			t.Error("flight wasn't marked ended")
+		}
+	})
+
+	t.Run("unreadable", func(t *testing.T) {
+		logs := captureLog(t)
+		cloud := newFakeCloud(t)
+		const broken = "events: [\n"
+		cloud.setFile(flightFile(flight_id), broken)
+		if err := FinalizeFlight(context.Background(), cloud.connect(), flight_id, end); err != nil {
+			t.Fatalf("FinalizeFlight: %v", err)
+		}
+		if data, _ := cloud.file(flightFile(flight_id)); data != broken {
+			t.Errorf("unreadable flight file was rewritten: %q", data)
+		}
+		if _, ok := cloud.file(flightMarker(flight_id, "ended")); !ok {
+			t.Error("unreadable flight wasn't marked ended")
+		}
+		if !strings.Contains(logs.String(), "warning: flight "+flight_id+" is unreadable, only marking it ended") {
+			t.Errorf("unreadable flight wasn't logged:\n%s", logs)
+		}
+	})
+
+	t.Run("marker fails", func(t *testing.T) {
+		cloud := newFakeCloud(t)
+		cloud.setFile(flightFile(flight_id), "end_timestamp: 0\n")
+		cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+			if strings.HasSuffix(command, flightMarker(flight_id, "ended")) {
+				return "", "tee: permission denied\n", 1, true
+			}
+			return "", "", 0, false
+		})
+		err := FinalizeFlight(context.Background(), cloud.connect(), flight_id, end)
+		if err == nil || !strings.Contains(err.Error(), "failed to mark flight "+flight_id+" ended") || !strings.Contains(err.Error(), "permission denied") {
+			t.Fatalf("FinalizeFlight = %v, want the marker failure", err)
+		}
+		// The end is in the file, but the open marker would still win without the ended one
+		data, _ := cloud.file(flightFile(flight_id))
+		if !strings.Contains(data, "end_timestamp: 1700000001000000000") {
+			t.Errorf("flight file = %q, want the end written before the marker", data)
+		}
+	})
+}
+
+func TestCurrentFlightInFlightsDir(t *testing.T) {
+	useConfig(t, map[string]string{"FLIGHTS_DIR": "flights/ZS-ABC"})
+	cloud := newFakeCloud(t)
+	// Another aircraft's open flight, one level up
+	cloud.setFile("flights/1700000000000000000.flight", "events: []\n")
+	cloud.setFile("flights/1700000000000000000.open", "")
+	api_client := cloud.connect()
+
+	flight_id, err := CurrentFlight(context.Background(), api_client)
+	if err != nil {
+		t.Fatalf("CurrentFlight: %v", err)
+	}
+	if flight_id == "1700000000000000000" {
+		t.Fatal("picked up a flight outside FLIGHTS_DIR")
+	}
+	if _, ok := cloud.file("flights/ZS-ABC/" + flight_id + ".flight"); !ok {
+		t.Fatalf("flight %s wasn't created in FLIGHTS_DIR: %v", flight_id, cloud.ran())
+	}
+	if _, ok := cloud.file("flights/ZS-ABC/" + flight_id + ".open"); !ok {
+		t.Fatalf("flight %s wasn't marked open in FLIGHTS_DIR", flight_id)
+	}
+	if cloud.count("mkdir -p flights/ZS-ABC && ls -yl flights/ZS-ABC") != 1 {
+		t.Errorf("FLIGHTS_DIR wasn't created and listed: %v", cloud.ran())
+	}
+
+	// And it's resumed from there
+	again, err := CurrentFlight(context.Background(), api_client)
+	if err != nil || again != flight_id {
+		t.Fatalf("CurrentFlight = %s, %v, want %s resumed", again, err, flight_id)
+	}
+}
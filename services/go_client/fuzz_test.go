@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzDecodeEmbedding(f *testing.F) {
+	f.Add("")
+	f.Add("AAAAAAAA8D8=\r\n")
+	f.Add("AAAAAAAA8D8AAAAAAAAAQA==")
+	f.Add("1  AAAAAAAA8D8=\n2  AAAAAAAAAEA=\n")
+	f.Add("AAAA")
+	f.Add("not base64!")
+	f.Add("     1\tAAAAAAAA8D8=")
+
+	f.Fuzz(func(t *testing.T, output string) {
+		embedding, err := DecodeEmbedding(output)
+		if err != nil && embedding != nil {
+			t.Fatalf("got both an embedding and an error: %v", err)
+		}
+		if err == nil && embedding == nil {
+			t.Fatal("got neither an embedding nor an error")
+		}
+	})
+}
+
+func FuzzValidUsername(f *testing.F) {
+	f.Add("pilot1")
+	f.Add("j.smith")
+	f.Add("a_b-c")
+	f.Add("")
+	f.Add("..")
+	f.Add("-rf")
+	f.Add("pilot; rm -rf /")
+	f.Add("$(whoami)")
+	f.Add("a/../b")
+	f.Add("name\n")
+
+	f.Fuzz(func(t *testing.T, username string) {
+		if !validUsername(username) {
+			return
+		}
+		if strings.ContainsAny(username, " \t\r\n;&|$`'\"\\<>(){}[]*?!~#/") {
+			t.Fatalf("accepted username with shell metacharacters: %q", username)
+		}
+		if strings.HasPrefix(username, "-") || strings.HasPrefix(username, ".") {
+			t.Fatalf("accepted username with a leading %q", username[:1])
+		}
+	})
+}
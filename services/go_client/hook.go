@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST_SYNC_HOOK runs after every successful sync cycle, e.g. to reload a downstream process.
+// An http:// or https:// URL is POSTed the summary as JSON; anything else runs as a shell command
+// with the summary as JSON on stdin and in SYNC_ADDED, SYNC_CHANGED, SYNC_DELETED and
+// SYNC_ERRORS. Either way it's cut off after POST_SYNC_HOOK_TIMEOUT, and failures are only logged.
+
+func runPostSyncHook(ctx context.Context, result SyncResult) {
+	if cfg.PostSyncHook == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.PostSyncHookTimeout)
+	defer cancel()
+
+	var err error
+	if strings.HasPrefix(cfg.PostSyncHook, "http://") || strings.HasPrefix(cfg.PostSyncHook, "https://") {
+		err = postSyncHookURL(ctx, result)
+	} else {
+		err = postSyncHookCommand(ctx, result)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		logf(ctx, "warning: post-sync hook timed out after %v", cfg.PostSyncHookTimeout)
+	} else if err != nil {
+		logf(ctx, "warning: post-sync hook failed: %v", err)
+	} else {
+		debugCtxf(ctx, "Post-sync hook done")
+	}
+}
+
+func postSyncHookCommand(ctx context.Context, result SyncResult) error {
+	summary, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", cfg.PostSyncHook)
+	cmd.Stdin = bytes.NewReader(summary)
+	cmd.Env = append(os.Environ(),
+		"SYNC_ADDED="+strconv.Itoa(result.Added),
+		"SYNC_CHANGED="+strconv.Itoa(result.Changed),
+		"SYNC_DELETED="+strconv.Itoa(result.Deleted),
+		"SYNC_ERRORS="+strconv.Itoa(result.Errors),
+	)
+	// Killing sh leaves anything it started holding the output pipe; don't wait on them
+	cmd.WaitDelay = 100 * time.Millisecond
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, stderrSummary(string(output)))
+	}
+	return nil
+}
+
+func postSyncHookURL(ctx context.Context, result SyncResult) error {
+	summary, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.PostSyncHook, bytes.NewReader(summary))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("hook URL returned %s", resp.Status)
+	}
+	return nil
+}
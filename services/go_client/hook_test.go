@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostSyncHookCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.out")
+	useConfig(t, map[string]string{"POST_SYNC_HOOK": `{ echo "$SYNC_ADDED $SYNC_CHANGED $SYNC_DELETED $SYNC_ERRORS"; cat; } > ` + out})
+	logs := captureLog(t)
+
+	runPostSyncHook(context.Background(), SyncResult{Added: 1, Changed: 2, Deleted: 3, Errors: 4})
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook didn't run: %v", err)
+	}
+	env, stdin, _ := strings.Cut(string(data), "\n")
+	if env != "1 2 3 4" {
+		t.Errorf("hook environment = %q, want \"1 2 3 4\"", env)
+	}
+	var summary SyncResult
+	if err := json.Unmarshal([]byte(stdin), &summary); err != nil || summary != (SyncResult{Added: 1, Changed: 2, Deleted: 3, Errors: 4}) {
+		t.Errorf("hook stdin = %q (%v), want the summary as JSON", stdin, err)
+	}
+	if strings.Contains(logs.String(), "warning") {
+		t.Errorf("successful hook logged a warning:\n%s", logs)
+	}
+}
+
+func TestPostSyncHookCommandFailure(t *testing.T) {
+	useConfig(t, map[string]string{"POST_SYNC_HOOK": "echo reload refused >&2; exit 3"})
+	logs := captureLog(t)
+
+	runPostSyncHook(context.Background(), SyncResult{})
+
+	if !strings.Contains(logs.String(), "warning: post-sync hook failed: exit status 3: \"reload refused\"") {
+		t.Errorf("failure wasn't logged with the hook's output:\n%s", logs)
+	}
+}
+
+func TestPostSyncHookURL(t *testing.T) {
+	var method, content_type string
+	var summary SyncResult
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, content_type = r.Method, r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &summary)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	useConfig(t, map[string]string{"POST_SYNC_HOOK": server.URL + "/reload"})
+	logs := captureLog(t)
+
+	runPostSyncHook(context.Background(), SyncResult{Added: 2, Errors: 1})
+	if method != http.MethodPost || content_type != "application/json" || summary != (SyncResult{Added: 2, Errors: 1}) {
+		t.Fatalf("hook got %s %s %+v, want the summary POSTed as JSON", method, content_type, summary)
+	}
+	if strings.Contains(logs.String(), "warning") {
+		t.Errorf("successful hook logged a warning:\n%s", logs)
+	}
+
+	status = http.StatusBadGateway
+	runPostSyncHook(context.Background(), SyncResult{})
+	if !strings.Contains(logs.String(), "warning: post-sync hook failed: hook URL returned 502 Bad Gateway") {
+		t.Errorf("non-2xx response wasn't logged:\n%s", logs)
+	}
+}
+
+func TestPostSyncHookTimeout(t *testing.T) {
+	useConfig(t, map[string]string{"POST_SYNC_HOOK": "sleep 5", "POST_SYNC_HOOK_TIMEOUT": "50ms"})
+	logs := captureLog(t)
+
+	start := time.Now()
+	runPostSyncHook(context.Background(), SyncResult{})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("hook ran for %v, want it cut off at POST_SYNC_HOOK_TIMEOUT", elapsed)
+	}
+	if !strings.Contains(logs.String(), "warning: post-sync hook timed out after 50ms") {
+		t.Errorf("timeout wasn't logged:\n%s", logs)
+	}
+}
+
+func TestPostSyncHookUnset(t *testing.T) {
+	useConfig(t, map[string]string{"POST_SYNC_HOOK": "", "LOG_LEVEL": "debug"})
+	logs := captureLog(t)
+
+	runPostSyncHook(context.Background(), SyncResult{Added: 1})
+	if logs.String() != "" {
+		t.Errorf("unset hook logged:\n%s", logs)
+	}
+}
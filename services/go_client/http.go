@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+func ServeHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/version", versionHandler)
+
+	log.Println("Serving HTTP on ", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("http server stopped: ", err)
+	}
+}
+
+// healthzHandler reports liveness; a paused service is still healthy, just idle. When the sync
+// thread runs here, the age of its last cycle is included and a stalled one fails the check.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case maintenance_active.Load():
+		fmt.Fprintln(w, "paused")
+	case syncStalled(longestSyncPeriod()):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "stalled")
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+
+	fmt.Fprintf(w, "cloud_breaker %s\n", breakerStateNames[breaker_state.Load()])
+	if age, ok := lastSyncCycleAge(); ok {
+		fmt.Fprintf(w, "last_sync_cycle_age %.0fs\n", age.Seconds())
+	}
+}
+
+// versionHandler reports the build and the effective configuration, secrets redacted.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version string        `json:"version"`
+		Config  []ConfigEntry `json:"config"`
+	}{buildVersion(), configSummary(cfg)})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// With KEY_SCHEME=cluster, per-pilot keys hash-tag the username so Redis Cluster puts all of a
+// pilot's keys in the same slot; the default flat scheme keeps the original key names.
+//
+// Keys are built from the canonical username: with USERNAME_CASE=lower, "JohnDoe" and "johndoe"
+// are the same pilot in Redis, while cloud paths keep the name as provisioned.
+
+func canonicalUsername(username string) string {
+	if cfg.UsernameCase == "lower" {
+		return strings.ToLower(username)
+	}
+	return username
+}
+
+func pilotKey(username string) string {
+	username = canonicalUsername(username)
+	if cfg.KeyScheme == "cluster" {
+		return fmt.Sprintf("cognicore:data:{%s}:pilot", username)
+	}
+	return fmt.Sprintf("cognicore:data:pilot:%s", username)
+}
+
+func embeddingKey(username string) string {
+	username = canonicalUsername(username)
+	if cfg.KeyScheme == "cluster" {
+		return fmt.Sprintf("cognicore:data:{%s}:embedding", username)
+	}
+	return fmt.Sprintf("cognicore:data:embedding:%s", username)
+}
+
+func pilotJSONKey(username string) string {
+	username = canonicalUsername(username)
+	if cfg.KeyScheme == "cluster" {
+		return fmt.Sprintf("cognicore:data:{%s}:pilot_json", username)
+	}
+	return fmt.Sprintf("cognicore:data:pilot_json:%s", username)
+}
+
+// usernameFromKey recovers the username from a key built by key_func (e.g. pilotKey)
+func usernameFromKey(key string, key_func func(string) string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(key_func("\x00"), "\x00")
+	if len(key) < len(prefix)+len(suffix) || !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) {
+		return "", false
+	}
+	return key[len(prefix) : len(key)-len(suffix)], true
+}
+
+// embeddingEnrollment is an embedding stored for a pilot, and when it was enrolled (zero when
+// that isn't known)
+type embeddingEnrollment struct {
+	key      string
+	enrolled time.Time
+}
+
+// primaryEmbedding picks the enrollment consumers should prefer: the one designated by the
+// profile (PRIMARY_EMBEDDING_FIELD) if the pilot has it, otherwise the newest, ties going to the
+// lowest key so the choice doesn't depend on the order enrollments are listed in. A single
+// enrollment is trivially primary; pilots without one have no primary.
+func primaryEmbedding(designated string, enrollments []embeddingEnrollment) string {
+	primary := ""
+	var newest time.Time
+	for _, enrollment := range enrollments {
+		if designated != "" && enrollment.key == designated {
+			return enrollment.key
+		}
+		if primary == "" || enrollment.enrolled.After(newest) || (enrollment.enrolled.Equal(newest) && enrollment.key < primary) {
+			primary, newest = enrollment.key, enrollment.enrolled
+		}
+	}
+	return primary
+}
+
+// primaryEmbeddingKey picks the embedding key consumers should prefer for a pilot. Only a
+// single enrollment (the first of EMBEDDING_FILENAMES found) is fetched per pilot, stored under
+// embeddingKey, so whatever the profile designates it's the primary one when it exists.
+func primaryEmbeddingKey(username, designated string, embedding []float64) string {
+	if embedding == nil {
+		return ""
+	}
+	return primaryEmbedding(designated, []embeddingEnrollment{{key: embeddingKey(username)}})
+}
+
+const (
+	pilotIDRequestKey     = "cognicore:data:pilot_id_request"
+	pilotDeauthRequestKey = "cognicore:data:pilot_deauth_request"
+	pilotFetchRequestKey  = "cognicore:data:pilot_fetch_request"
+	pilotEventsChannel    = "cognicore:pilot_events"
+	maintenanceKey        = "cognicore:control:maintenance"
+	resyncKey             = "cognicore:control:resync"
+	pilotChangesKey       = "cognicore:data:pilot_changes"
+	keyspaceSelfTestKey   = "cognicore:control:keyspace_self_test"
+	fieldTTLCheckKey      = "cognicore:control:field_ttl_check"
+	pilotStreamKey        = "cognicore:stream:pilots"
+	syncLockKey           = "cognicore:control:sync_lock"
+	deletedPilotsKey      = "cognicore:data:deleted_pilots"
+)
+
+// keyspaceChannel is where Redis announces changes to key in DB db
+func keyspaceChannel(db int, key string) string {
+	return fmt.Sprintf("__keyspace@%d__:%s", db, key)
+}
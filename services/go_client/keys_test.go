@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrimaryEmbedding(t *testing.T) {
+	older := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	tests := []struct {
+		name        string
+		designated  string
+		enrollments []embeddingEnrollment
+		want        string
+	}{
+		{"none", "", nil, ""},
+		{"single", "", []embeddingEnrollment{{key: "a"}}, "a"},
+		{"single, designation missing", "b", []embeddingEnrollment{{key: "a"}}, "a"},
+		{"newest", "", []embeddingEnrollment{{key: "a", enrolled: older}, {key: "b", enrolled: newer}}, "b"},
+		{"newest listed first", "", []embeddingEnrollment{{key: "b", enrolled: newer}, {key: "a", enrolled: older}}, "b"},
+		{"designated over newest", "a", []embeddingEnrollment{{key: "a", enrolled: older}, {key: "b", enrolled: newer}}, "a"},
+		{"designation missing, newest", "c", []embeddingEnrollment{{key: "a", enrolled: older}, {key: "b", enrolled: newer}}, "b"},
+		{"tie goes to lowest key", "", []embeddingEnrollment{{key: "b", enrolled: older}, {key: "a", enrolled: older}}, "a"},
+		{"unknown enrollment times", "", []embeddingEnrollment{{key: "c"}, {key: "a"}, {key: "b"}}, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := primaryEmbedding(tt.designated, tt.enrollments); got != tt.want {
+				t.Errorf("primaryEmbedding(%q, %v) = %q, want %q", tt.designated, tt.enrollments, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchedPrimaryEmbedding(t *testing.T) {
+	useConfig(t, map[string]string{"PRIMARY_EMBEDDING_FIELD": "recognition.primary"})
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "recognition:\n  primary: elsewhere\n", []float64{1, 2})
+	cloud.addPilot("bob", "name: Bob\n", nil)
+	api_client := cloud.connect()
+
+	// alice's only enrollment is primary, whatever her profile designates
+	alice, err := GetPilotFromServer(context.Background(), api_client, "alice")
+	if err != nil {
+		t.Fatalf("GetPilotFromServer: %v", err)
+	}
+	if alice.PrimaryEmbedding != embeddingKey("alice") {
+		t.Errorf("alice's primary embedding = %q, want %q", alice.PrimaryEmbedding, embeddingKey("alice"))
+	}
+	bob, err := GetPilotFromServer(context.Background(), api_client, "bob")
+	if err != nil {
+		t.Fatalf("GetPilotFromServer: %v", err)
+	}
+	if bob.PrimaryEmbedding != "" {
+		t.Errorf("bob has no embedding but primary embedding %q", bob.PrimaryEmbedding)
+	}
+}
+
+// keySlot is the Redis Cluster hash slot of key: CRC16 (XMODEM) of its hash tag (the part
+// between the first "{" and the next "}", if not empty) or else of the whole key, mod 16384
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % 16384
+}
+
+func TestKeySlot(t *testing.T) {
+	// Examples from the Redis Cluster specification
+	for key, want := range map[string]int{"foo": 12182, "bar": 5061, "{user1000}.following": keySlot("user1000"), "foo{bar}{zap}": keySlot("bar")} {
+		if got := keySlot(key); got != want {
+			t.Errorf("keySlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+	if keySlot("foo{}{bar}") == keySlot("bar") {
+		t.Error("an empty hash tag was used")
+	}
+}
+
+func TestClusterKeysShareSlot(t *testing.T) {
+	useConfig(t, map[string]string{"KEY_SCHEME": "cluster"})
+	for _, username := range []string{"alice", "bob", "j.smith", "pilot_42", "x-1"} {
+		keys := []string{pilotKey(username), embeddingKey(username), pilotJSONKey(username)}
+		for _, key := range keys {
+			if keySlot(key) != keySlot(keys[0]) {
+				t.Errorf("%s is in slot %d, but %s is in %d", key, keySlot(key), keys[0], keySlot(keys[0]))
+			}
+			if got, ok := usernameFromKey(key, pilotKey); key == keys[0] && (!ok || got != username) {
+				t.Errorf("usernameFromKey(%q) = %q, %v", key, got, ok)
+			}
+		}
+	}
+	// Different pilots spread over the slots rather than all landing in one
+	if keySlot(pilotKey("alice")) == keySlot(pilotKey("bob")) {
+		t.Error("alice and bob share a slot")
+	}
+}
+
+func TestClusterKeysFollowUsernameCase(t *testing.T) {
+	useConfig(t, map[string]string{"KEY_SCHEME": "cluster", "USERNAME_CASE": "lower"})
+	if pilotKey("JohnDoe") != "cognicore:data:{johndoe}:pilot" || keySlot(embeddingKey("JohnDoe")) != keySlot(pilotKey("johndoe")) {
+		t.Fatalf("keys of JohnDoe: %s, %s", pilotKey("JohnDoe"), embeddingKey("JohnDoe"))
+	}
+}
+
+func TestFlatKeys(t *testing.T) {
+	useConfig(t, nil)
+	for _, tt := range []struct{ got, want string }{
+		{pilotKey("alice"), "cognicore:data:pilot:alice"},
+		{embeddingKey("alice"), "cognicore:data:embedding:alice"},
+		{pilotJSONKey("alice"), "cognicore:data:pilot_json:alice"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With SYNC_LOCK_TTL, redundant syncers share Redis and only the holder of cognicore:control:sync_lock
+// syncs; the others stand by. The holder renews its lease every third of the TTL, so the lock
+// lapses within SYNC_LOCK_TTL of the holder dying, and a standby takes over. A standby that
+// takes over finalizes the flights the dead holder left dangling (see finalizeOrphanedFlights).
+
+// renewSyncLock extends the lease only while it's still ours
+var renewSyncLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+type syncLock struct {
+	rdb   *redis.Client
+	ttl   time.Duration
+	token string
+
+	held atomic.Bool
+	// Signalled whenever the lock is acquired
+	acquired chan struct{}
+}
+
+// newSyncLock returns nil without SYNC_LOCK_TTL; a nil lock is always held
+func newSyncLock(rdb *redis.Client, ttl time.Duration) *syncLock {
+	if ttl <= 0 {
+		return nil
+	}
+	host, _ := os.Hostname()
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	return &syncLock{
+		rdb:      rdb,
+		ttl:      ttl,
+		token:    fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(nonce)),
+		acquired: make(chan struct{}, 1),
+	}
+}
+
+func (l *syncLock) Held() bool {
+	return l == nil || l.held.Load()
+}
+
+// Run keeps trying to acquire the lock, and renews it once held
+func (l *syncLock) Run() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		if l.held.Load() {
+			renewed, err := renewSyncLock.Run(ctx, l.rdb, []string{syncLockKey}, l.token, l.ttl.Milliseconds()).Int()
+			if err != nil || renewed == 0 {
+				// A failed renewal may still have gone through, but the lease can't be vouched for
+				log.Printf("Lost the sync lock, standing by (renewed %d, err %v)", renewed, err)
+				l.held.Store(false)
+			}
+		} else {
+			ok, err := l.rdb.SetNX(ctx, syncLockKey, l.token, l.ttl).Result()
+			if err != nil {
+				log.Println("failed to try the sync lock: ", err)
+			} else if ok {
+				log.Println("Acquired the sync lock")
+				l.held.Store(true)
+				select {
+				case l.acquired <- struct{}{}:
+				default:
+				}
+			}
+		}
+		cancel()
+	}
+}
+
+// wait blocks until the lock is held. A standby is idle rather than stalled, so it keeps the
+// sync watchdog fed meanwhile.
+func (l *syncLock) wait() {
+	if l.Held() {
+		return
+	}
+	log.Println("Another syncer holds the sync lock, standing by")
+	for !l.Held() {
+		markSyncCycle()
+		select {
+		case <-l.acquired:
+		case <-time.After(l.ttl):
+		}
+	}
+}
+
+// finalizeOrphanedFlights finalizes open flights that only pilots who aren't authenticated refer
+// to. Deauthenticating finalizes a pilot's flight, so these are the ones a syncer dying mid-way
+// left behind; flights of authenticated pilots, and the current flight, carry on under the new
+// holder.
+func finalizeOrphanedFlights(ctx context.Context, rdb *redis.Client, sessions *SessionManager) {
+	in_use := map[string]bool{}
+	orphaned := map[string][]string{}
+	iter := rdb.Scan(ctx, 0, pilotKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		values, err := rdb.HMGet(ctx, iter.Val(), "pilot_username", "authenticated", "flight_id").Result()
+		if err != nil {
+			logf(ctx, "failed to look for orphaned flights: %v", err)
+			return
+		}
+		username, _ := values[0].(string)
+		authenticated, _ := values[1].(string)
+		flight_id, _ := values[2].(string)
+		if username == "" || flight_id == "" {
+			continue
+		}
+		var flag AuthFlag
+		if flag.ScanRedis(authenticated) == nil && bool(flag) {
+			in_use[flight_id] = true
+		} else {
+			orphaned[flight_id] = append(orphaned[flight_id], username)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		logf(ctx, "failed to look for orphaned flights: %v", err)
+		return
+	}
+	for flight_id := range in_use {
+		delete(orphaned, flight_id)
+	}
+	if len(orphaned) == 0 {
+		return
+	}
+
+	api_client, gen, err := sessions.Client()
+	if err != nil {
+		logf(ctx, "failed to connect to finalize orphaned flights: %v", err)
+		return
+	}
+	files, err := listFlightFiles(ctx, api_client)
+	if err != nil {
+		logf(ctx, "failed to list flights: %v", err)
+		return
+	}
+	names := fileNames(files)
+
+	// Syncs put the shared flight on every pilot, authenticated or not, so the flight CurrentFlight
+	// hands out is live even when none of its pilots are authenticated right now
+	current, err := firstOpenFlight(ctx, api_client, names, latestFlights(ctx, files))
+	if err != nil {
+		if errors.Is(err, ErrTransport) {
+			sessions.Invalidate(gen)
+		}
+		logf(ctx, "failed to determine current flight, leaving flights open: %v", err)
+		return
+	}
+
+	for flight_id, usernames := range orphaned {
+		if flight_id == current {
+			debugCtxf(ctx, "Not finalizing flight %s, it's the current flight", flight_id)
+			continue
+		}
+		open, err := flightIsOpen(ctx, api_client, names, flight_id)
+		if err == nil && open {
+			err = FinalizeFlight(ctx, api_client, flight_id, time.Now())
+			if err == nil {
+				logf(ctx, "Finalized orphaned flight %s", flight_id)
+			}
+		}
+		if errors.Is(err, ErrTransport) {
+			sessions.Invalidate(gen)
+			logf(ctx, "failed to finalize orphaned flight %s, leaving the rest open: %v", flight_id, err)
+			return
+		} else if err != nil {
+			logf(ctx, "failed to finalize orphaned flight %s: %v", flight_id, err)
+			continue
+		}
+		for _, username := range usernames {
+			clearFlight(ctx, rdb, username, flight_id)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTakeoverKeepsCurrentFlight(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	sessions := newTestSessions(cloud.URL)
+
+	// An older flight the dead holder never finalized, and the current one, both open
+	const orphaned, current = "1700000000000000000", "1800000000000000000"
+	for _, flight_id := range []string{orphaned, current} {
+		cloud.setFile(flightFile(flight_id), "events: []\n")
+		cloud.setFile(flightMarker(flight_id, "open"), "")
+	}
+	// Neither pilot is authenticated, but alice got the current flight from a sync
+	ctx := context.Background()
+	rdb.HSet(ctx, pilotKey("alice"), "pilot_username", "alice", "authenticated", "false", "flight_id", current)
+	rdb.HSet(ctx, pilotKey("bob"), "pilot_username", "bob", "authenticated", "false", "flight_id", orphaned)
+
+	finalizeOrphanedFlights(ctx, rdb, sessions)
+
+	if _, ok := cloud.file(flightMarker(orphaned, "ended")); !ok {
+		t.Errorf("orphaned flight %s wasn't finalized", orphaned)
+	}
+	if got := fr.hash(0, pilotKey("bob"))["flight_id"]; got != "" {
+		t.Errorf("bob still has finalized flight %q", got)
+	}
+	if _, ok := cloud.file(flightMarker(current, "ended")); ok {
+		t.Errorf("current flight %s was finalized", current)
+	}
+	if got := fr.hash(0, pilotKey("alice"))["flight_id"]; got != current {
+		t.Errorf("alice's flight = %q, want %q", got, current)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+)
+
+// debugf logs only when LOG_LEVEL=debug
+func debugf(format string, args ...any) {
+	if cfg.Debug {
+		log.Printf("[debug] "+format, args...)
+	}
+}
+
+type traceKey struct{}
+
+// withTrace tags ctx with a short random ID (e.g. "req-1a2b3c4d") so the log lines of one pilot
+// request or sync cycle can be grepped together
+func withTrace(ctx context.Context, kind string) context.Context {
+	var id [4]byte
+	rand.Read(id[:])
+	return context.WithValue(ctx, traceKey{}, kind+"-"+hex.EncodeToString(id[:]))
+}
+
+// logf is log.Printf prefixed with the trace ID carried by ctx, if any
+func logf(ctx context.Context, format string, args ...any) {
+	if id, ok := ctx.Value(traceKey{}).(string); ok {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// debugCtxf is debugf prefixed with the trace ID carried by ctx, if any
+func debugCtxf(ctx context.Context, format string, args ...any) {
+	if cfg.Debug {
+		logf(ctx, "[debug] "+format, args...)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects log output for a test
+type logBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the standard logger to a buffer, without timestamps, until the test ends
+func captureLog(t testing.TB) *logBuffer {
+	out := &logBuffer{}
+	previous, flags := log.Writer(), log.Flags()
+	log.SetOutput(out)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(previous)
+		log.SetFlags(flags)
+	})
+	return out
+}
+
+var trace_prefix = regexp.MustCompile(`^\[(req-[0-9a-f]{8})\] `)
+
+func TestLogTracePrefix(t *testing.T) {
+	useConfig(t, nil)
+	logs := captureLog(t)
+
+	ctx := withTrace(context.Background(), "req")
+	logf(ctx, "fetched %q", "alice")
+	logf(context.Background(), "untraced %d", 1)
+	debugCtxf(ctx, "hidden")
+
+	lines := strings.Split(strings.TrimSuffix(logs.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, want 2 lines (debug is off)", lines)
+	}
+	match := trace_prefix.FindStringSubmatch(lines[0])
+	if match == nil || strings.TrimPrefix(lines[0], match[0]) != `fetched "alice"` {
+		t.Errorf("traced line = %q", lines[0])
+	}
+	if lines[1] != "untraced 1" {
+		t.Errorf("untraced line = %q", lines[1])
+	}
+
+	// Each trace gets its own ID, and nested traces keep the innermost
+	other := withTrace(ctx, "req")
+	logf(other, "x")
+	if strings.Contains(logs.String(), "["+match[1]+"] x") {
+		t.Error("a new trace reused the ID of the one it was derived from")
+	}
+}
+
+func TestDebugCtxfTrace(t *testing.T) {
+	useConfig(t, map[string]string{"LOG_LEVEL": "debug"})
+	logs := captureLog(t)
+
+	ctx := withTrace(context.Background(), "sync")
+	debugCtxf(ctx, "cycle %d", 3)
+	debugCtxf(context.Background(), "no trace")
+	if !regexp.MustCompile(`^\[sync-[0-9a-f]{8}\] \[debug\] cycle 3\n\[debug\] no trace\n$`).MatchString(logs.String()) {
+		t.Fatalf("debug output:\n%s", logs)
+	}
+}
+
+func TestPilotRequestLinesShareTrace(t *testing.T) {
+	useConfig(t, nil)
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+
+	HandlePilotRequest(context.Background(), fr.client(0), newTestSessions(cloud.URL), map[string]string{"pilot_username": "alice"})
+	ids := map[string]bool{}
+	for line := range strings.Lines(logs.String()) {
+		if match := trace_prefix.FindStringSubmatch(line); match != nil {
+			ids[match[1]] = true
+		}
+	}
+	if len(ids) != 1 || !strings.Contains(logs.String(), `Handled pilot request for "alice"`) {
+		t.Fatalf("request logged under trace IDs %v:\n%s", ids, logs)
+	}
+}
@@ -2,113 +2,119 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"os"
-	"strings"
-	"time"
 
-	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/redis/go-redis/v9"
 )
 
 func main() {
-	redis_host := "localhost"
-	if host := os.Getenv("REDIS_HOST"); host != "" {
-		redis_host = host
+	config, err := LoadConfig()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
 	}
-	redis_port := 6379
-	if port := os.Getenv("REDIS_PORT"); port != "" {
-		if _, err := fmt.Sscan(port, &redis_port); err != nil {
-			log.Println("invalid REDIS_PORT: ", err)
-			os.Exit(1)
-		}
+	cfg = config
+	logConfigSummary(cfg)
+	checkTestPilotAllowed()
+
+	log.Println("Initializing redis client for ", cfg.RedisTarget())
+	rdb := redis.NewClient(cfg.RedisOptions())
+	// The sync side writes to REDIS_WRITE_DB when one is set, requests keep using REDIS_DB
+	wdb := rdb
+	if cfg.RedisWriteDB >= 0 && cfg.RedisWriteDB != rdb.Options().DB {
+		log.Printf("Writing synced pilot data to DB %d", cfg.RedisWriteDB)
+		wdb = redis.NewClient(cfg.RedisWriteOptions())
 	}
-	redis_password := os.Getenv("REDIS_PASSWORD")
-	redis_db := 0
-	if db := os.Getenv("REDIS_DB"); db != "" {
-		if _, err := fmt.Sscan(db, &redis_db); err != nil {
-			log.Println("invalid REDIS_DB: ", err)
-			os.Exit(1)
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dump":
+			if err := RunDump(context.Background(), rdb, os.Args[2:], os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+		case "time-sync", "--time-sync":
+			if err := RunTimeSync(context.Background(), rdb, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+		case "changes":
+			if err := RunChanges(context.Background(), rdb, os.Args[2:], os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+		case "verify":
+			if err := RunVerify(context.Background(), rdb, os.Args[2:], os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+		case "migrate":
+			if err := RunMigrate(context.Background(), rdb, wdb, os.Args[2:], os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+		case "export":
+			if err := RunExport(context.Background(), rdb, os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+		case "import":
+			if err := RunImport(context.Background(), rdb, os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
 		}
+		return
 	}
 
-	api_username := os.Getenv("API_USERNAME")
-	api_password := os.Getenv("API_PASSWORD")
-	api_url := os.Getenv("API_URL")
-	if api_username == "" {
-		log.Println("API_USERNAME missing")
-		os.Exit(1)
-	}
-	if api_password == "" {
-		log.Println("API_PASSWORD missing")
+	if err := waitForRedis(rdb, cfg.RedisReadyTimeout); err != nil {
+		log.Println(err)
 		os.Exit(1)
 	}
-	if api_url == "" {
-		log.Println("API_URL missing")
-		os.Exit(1)
+	if wdb != rdb {
+		if err := waitForRedis(wdb, cfg.RedisReadyTimeout); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
 	}
 
-	log.Println("Initializing redis client...")
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", redis_host, redis_port),
-		Password: redis_password,
-		DB:       redis_db,
-	})
-
-	go SyncThread(rdb, APIConfig{api_username, api_password, api_url}, 5*time.Minute)
-	sub := rdb.PSubscribe(context.Background(), "__keyspace@0__:cognicore:data:pilot_id_request")
-
-	log.Println("Awaiting incoming messages...")
-	for msg := range sub.Channel() {
-		if msg.Payload == "hset" {
-			val := rdb.HGetAll(context.Background(), "cognicore:data:pilot_id_request")
-			if err := val.Err(); err != nil {
-				log.Println("failed to get id request from redis: ", err)
-				continue
-			}
-
-			keys := val.Val()
-			username, ok := keys["pilot_username"]
-			if !ok {
-				continue
-			}
-
-			confidence, ok := keys["confidence"]
-			if ok {
-				log.Printf("Received pilot request for %q (confidence: %s)", username, confidence)
-			} else {
-				log.Printf("Received pilot request for %q (no confidence set)", username)
-			}
+	run_sync, run_requests := modeSubsystems(cfg.Mode)
+	if run_requests && (cfg.AuthTTLLow > 0 || cfg.AuthTTLHigh > 0) {
+		if err := checkFieldTTLs(rdb); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
 
-			sessID, err := client.Login(api_url+"/login", api_username, api_password)
-			if err != nil {
-				log.Println("failed to log in to API: ", err)
-				continue
-			}
+	if cfg.HTTPAddr != "" {
+		go ServeHTTP(cfg.HTTPAddr)
+	}
 
-			socket, err := client.ConnectSocket(strings.Replace(api_url, "http", "ws", 1)+"/cmd-socket", sessID)
-			if err != nil {
-				log.Println("failed to open socket connection: ", err)
-				continue
-			}
+	// MODE picks which subsystems this process runs; both share the same Redis and cloud config
+	log.Printf("Running in %s mode", cfg.Mode)
+	sessions := NewSessionManager(cfg.APIConfig())
+	go sessions.Keepalive(cfg.KeepaliveInterval)
+	go HandleShutdown(rdb, sessions)
+	if cfg.TestPilot != "" {
+		go pinTestPilot(rdb, sessions)
+	}
 
-			session := client.NewSocketSession(socket)
-			api_client, err := session.ConnectClient("https-client")
-			if err != nil {
-				log.Println("failed to create client on socket: ", err)
-				socket.Close()
-				continue
-			}
+	if run_sync {
+		go Compactor(wdb, cfg.CompactInterval)
+		go EmbeddingAuditor(wdb, sessions, cfg.EmbeddingAuditInterval)
+		go SyncWatchdog(sessions, longestSyncPeriod())
+	}
+	if !run_requests {
+		SyncThread(wdb, sessions, syncPeriod)
+		return
+	}
 
-			if pilot, err := GetPilotFromServer(context.Background(), api_client, username); err != nil {
-				log.Printf("failed to get pilot from server: %v", err)
-				rdb.HSet(context.Background(), fmt.Sprintf("cognicore:data:pilot:%s", username), "authenticated", true)
-			} else {
-				pilot.Authenticated = "true"
-				rdb.HSet(context.Background(), fmt.Sprintf("cognicore:data:pilot:%s", username), pilot)
-			}
-		}
+	go sessions.Prewarm()
+	if run_sync {
+		go SyncThread(wdb, sessions, syncPeriod)
 	}
+	RequestHandler(rdb, sessions)
+}
+
+// modeSubsystems reports whether MODE runs the syncer (with its compactor, auditor and watchdog)
+// and the request handler
+func modeSubsystems(mode string) (sync, requests bool) {
+	return mode == "all" || mode == "sync", mode == "all" || mode == "request"
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMode(t *testing.T) {
+	for _, tt := range []struct {
+		env            string
+		want           string
+		sync, requests bool
+	}{
+		{"", "all", true, true},
+		{"all", "all", true, true},
+		{"sync", "sync", true, false},
+		{"request", "request", false, true},
+	} {
+		config, err := loadConfig(t, map[string]string{"MODE": tt.env})
+		if err != nil {
+			t.Fatalf("MODE=%q: %v", tt.env, err)
+		}
+		if config.Mode != tt.want {
+			t.Errorf("MODE=%q loaded as %q, want %q", tt.env, config.Mode, tt.want)
+		}
+		sync, requests := modeSubsystems(config.Mode)
+		if sync != tt.sync || requests != tt.requests {
+			t.Errorf("MODE=%q runs sync %v and requests %v, want %v and %v", tt.env, sync, requests, tt.sync, tt.requests)
+		}
+	}
+
+	for _, mode := range []string{"both", "ALL", "requests", " sync"} {
+		_, err := loadConfig(t, map[string]string{"MODE": mode})
+		if err == nil || !strings.Contains(err.Error(), "invalid MODE") {
+			t.Errorf("MODE=%q: got %v, want it rejected", mode, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Maintenance mode quiesces the service during cloud maintenance windows without stopping it.
+// It's on while MAINTENANCE is set, or while the control key holds anything but "", "0" or
+// "false", and clears itself as soon as neither is the case.
+
+const maintenancePollInterval = 5 * time.Second
+
+// maintenance_active is the state last observed by inMaintenance, as reported on /healthz
+var maintenance_active atomic.Bool
+
+// inMaintenance checks whether maintenance mode is on, logging transitions. If the control key
+// can't be read, the previously observed state is kept.
+func inMaintenance(ctx context.Context, rdb *redis.Client) bool {
+	active := cfg.Maintenance
+	if !active {
+		value, err := rdb.Get(ctx, maintenanceKey).Result()
+		if err != nil && err != redis.Nil {
+			log.Println("failed to check maintenance mode: ", err)
+			return maintenance_active.Load()
+		}
+		value = strings.TrimSpace(value)
+		active = value != "" && value != "0" && !strings.EqualFold(value, "false")
+	}
+
+	if maintenance_active.Swap(active) != active {
+		if active {
+			log.Println("Maintenance mode on, syncing paused")
+		} else {
+			log.Println("Maintenance mode cleared, resuming")
+		}
+	}
+	return active
+}
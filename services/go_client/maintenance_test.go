@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useMaintenanceState starts the test with maintenance off, as last observed
+func useMaintenanceState(t *testing.T) {
+	previous := maintenance_active.Load()
+	maintenance_active.Store(false)
+	t.Cleanup(func() { maintenance_active.Store(previous) })
+}
+
+func TestInMaintenance(t *testing.T) {
+	useConfig(t, nil)
+	useMaintenanceState(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	if inMaintenance(ctx, rdb) {
+		t.Fatal("in maintenance without the control key")
+	}
+	for _, tt := range []struct {
+		value string
+		want  bool
+	}{
+		{"", false},
+		{"0", false},
+		{"false", false},
+		{" FALSE\n", false},
+		{"1", true},
+		{" 1 ", true},
+		{"true", true},
+		{"until 14:00", true},
+	} {
+		rdb.Set(ctx, maintenanceKey, tt.value, 0)
+		if got := inMaintenance(ctx, rdb); got != tt.want {
+			t.Errorf("control key %q: in maintenance %v, want %v", tt.value, got, tt.want)
+		}
+		if maintenance_active.Load() != tt.want {
+			t.Errorf("control key %q: observed state not updated", tt.value)
+		}
+	}
+
+	// Clears itself once the key is gone
+	rdb.Set(ctx, maintenanceKey, "1", 0)
+	inMaintenance(ctx, rdb)
+	rdb.Del(ctx, maintenanceKey)
+	if inMaintenance(ctx, rdb) {
+		t.Fatal("still in maintenance after the control key was deleted")
+	}
+}
+
+func TestMaintenanceKeepsStateWhenUnreadable(t *testing.T) {
+	useConfig(t, nil)
+	useMaintenanceState(t)
+	captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	rdb.Set(ctx, maintenanceKey, "1", 0)
+	inMaintenance(ctx, rdb)
+	fr.setFailure("LOADING Redis is loading the dataset in memory")
+	if !inMaintenance(ctx, rdb) {
+		t.Fatal("left maintenance when the control key couldn't be read")
+	}
+	fr.setFailure("")
+	rdb.Del(ctx, maintenanceKey)
+	inMaintenance(ctx, rdb)
+	fr.setFailure("LOADING Redis is loading the dataset in memory")
+	if inMaintenance(ctx, rdb) {
+		t.Fatal("entered maintenance when the control key couldn't be read")
+	}
+}
+
+func TestMaintenanceForcedByConfig(t *testing.T) {
+	useConfig(t, map[string]string{"MAINTENANCE": "true"})
+	useMaintenanceState(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	rdb.Set(context.Background(), maintenanceKey, "false", 0)
+
+	if !inMaintenance(context.Background(), rdb) {
+		t.Fatal("MAINTENANCE=true didn't force maintenance mode")
+	}
+}
+
+func TestMaintenanceTransitionsLogged(t *testing.T) {
+	useConfig(t, nil)
+	useMaintenanceState(t)
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	rdb.Set(ctx, maintenanceKey, "1", 0)
+	inMaintenance(ctx, rdb)
+	inMaintenance(ctx, rdb)
+	rdb.Del(ctx, maintenanceKey)
+	inMaintenance(ctx, rdb)
+	inMaintenance(ctx, rdb)
+	if on, off := strings.Count(logs.String(), "Maintenance mode on"), strings.Count(logs.String(), "Maintenance mode cleared"); on != 1 || off != 1 {
+		t.Fatalf("logged %d starts and %d ends, want one of each:\n%s", on, off, logs)
+	}
+}
+
+func TestHealthzPausedInMaintenance(t *testing.T) {
+	useConfig(t, nil)
+	useMaintenanceState(t)
+	maintenance_active.Store(true)
+
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "paused\n") {
+		t.Fatalf("/healthz in maintenance = %d %q", w.Code, w.Body)
+	}
+}
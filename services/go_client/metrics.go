@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics are exposed in the Prometheus text format on /metrics when HTTP_ADDR is set
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metrics_mu sync.Mutex
+	metrics    []metric
+)
+
+func register(m metric) {
+	metrics_mu.Lock()
+	defer metrics_mu.Unlock()
+	metrics = append(metrics, m)
+}
+
+type Counter struct {
+	name, help string
+	value      atomic.Int64
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *Counter) Add(n int) {
+	c.value.Add(int64(n))
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value.Load())
+}
+
+type Gauge struct {
+	name, help string
+	value      atomic.Int64
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Add(n int) {
+	g.value.Add(int64(n))
+}
+
+func (g *Gauge) Set(n int) {
+	g.value.Store(int64(n))
+}
+
+func (g *Gauge) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value.Load())
+}
+
+// Histogram is a histogram partitioned by one label, whose values should be a small fixed set
+type Histogram struct {
+	name, help, label string
+	buckets           []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []int64 // per bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+func NewHistogram(name, help, label string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, label: label, buckets: buckets, series: map[string]*histogramSeries{}}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(label_value string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[label_value]
+	if !ok {
+		series = &histogramSeries{counts: make([]int64, len(h.buckets))}
+		h.series[label_value] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *Histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	label_values := slices.Sorted(maps.Keys(h.series))
+	for _, label_value := range label_values {
+		series := h.series[label_value]
+		var cumulative int64
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%g\"} %d\n", h.name, h.label, label_value, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, label_value, series.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", h.name, h.label, label_value, series.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.label, label_value, series.count)
+	}
+}
+
+var (
+	metricSyncCycles  = NewCounter("cogniflight_sync_cycles_total", "Completed pilot sync cycles")
+	metricSyncAdded   = NewCounter("cogniflight_sync_pilots_added_total", "Pilots added to Redis by sync")
+	metricSyncChanged = NewCounter("cogniflight_sync_pilots_changed_total", "Pilots updated in Redis by sync")
+	metricSyncDeleted = NewCounter("cogniflight_sync_pilots_deleted_total", "Pilots removed from Redis by sync")
+	metricSyncErrors  = NewCounter("cogniflight_sync_errors_total", "Pilots skipped during sync due to errors")
+
+	metricRedisWriteErrors = NewCounter("cogniflight_redis_write_errors_total", "Failed Redis writes")
+	metricEmbeddingDrift   = NewCounter("cogniflight_embedding_drift_total", "Cached embeddings found out of step with the cloud and repaired")
+
+	metricCloudBreakerState = NewGauge("cogniflight_cloud_breaker_state", "Cloud circuit breaker: 0 closed, 1 half-open, 2 open")
+
+	metricPilotFetchesInFlight = NewGauge("cogniflight_pilot_fetches_in_flight", "Pilot fetches currently running against the cloud")
+	metricPilotFetchSeconds    = NewHistogram("cogniflight_pilot_fetch_seconds", "Time to fetch a pilot from the cloud, by outcome", "outcome",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+
+	metricFirstRequestSeconds = NewHistogram("cogniflight_first_request_seconds", "Time to handle the first pilot request after startup, by whether the cloud session was already up", "session",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+
+	metricRequestsPending   = NewGauge("cogniflight_requests_pending", "Pilot and deauth requests waiting to be handled")
+	metricRequestsCoalesced = NewCounter("cogniflight_requests_coalesced_total", "Requests superseded by a newer one for the same pilot")
+	metricRequestsDropped   = NewCounter("cogniflight_requests_dropped_total", "Requests dropped because the queue was full")
+)
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metrics_mu.Lock()
+	defer metrics_mu.Unlock()
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{name: "test_seconds", help: "Test latency", label: "outcome", buckets: []float64{0.1, 1}, series: map[string]*histogramSeries{}}
+	for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe("success", value)
+	}
+	h.Observe("error", 0.2)
+
+	out := &strings.Builder{}
+	h.writeTo(out)
+	want := `# HELP test_seconds Test latency
+# TYPE test_seconds histogram
+test_seconds_bucket{outcome="error",le="0.1"} 0
+test_seconds_bucket{outcome="error",le="1"} 1
+test_seconds_bucket{outcome="error",le="+Inf"} 1
+test_seconds_sum{outcome="error"} 0.2
+test_seconds_count{outcome="error"} 1
+test_seconds_bucket{outcome="success",le="0.1"} 2
+test_seconds_bucket{outcome="success",le="1"} 3
+test_seconds_bucket{outcome="success",le="+Inf"} 4
+test_seconds_sum{outcome="success"} 3.65
+test_seconds_count{outcome="success"} 4
+`
+	if out.String() != want {
+		t.Fatalf("histogram output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+// fetchCount is how many pilot fetches were observed with an outcome
+func fetchCount(outcome string) int64 {
+	metricPilotFetchSeconds.mu.Lock()
+	defer metricPilotFetchSeconds.mu.Unlock()
+	if series, ok := metricPilotFetchSeconds.series[outcome]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func TestPilotFetchLatencyOutcomes(t *testing.T) {
+	useConfig(t, map[string]string{"NO_EMBEDDING_POLICY": "skip"})
+	useFetchSlots(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	cloud.addPilot("carol", "name: Carol\n", []float64{1, 2})
+	cloud.addPilot("erin", "name: Erin\n", nil)
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		return "", "cat: permission denied\n", 1, command == "cat "+homeFile("carol", "user.profile")
+	})
+	api_client := cloud.connect()
+
+	for _, tt := range []struct{ username, outcome string }{
+		{"alice", "success"},
+		{"bob", "not_found"},
+		{"carol", "error"},
+		{"erin", "rejected"},
+		// Refused before fetching, so not timed
+		{"../dave", ""},
+	} {
+		before := map[string]int64{}
+		for _, outcome := range []string{"success", "not_found", "rejected", "error"} {
+			before[outcome] = fetchCount(outcome)
+		}
+		GetPilotFromServer(context.Background(), api_client, tt.username)
+		for outcome, count := range before {
+			want := count
+			if outcome == tt.outcome {
+				want++
+			}
+			if got := fetchCount(outcome); got != want {
+				t.Errorf("fetching %q: %s count went from %d to %d", tt.username, outcome, count, got)
+			}
+		}
+	}
+}
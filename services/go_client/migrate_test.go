@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func seedMigration(t *testing.T, fr *fakeRedis) {
+	t.Helper()
+	for _, pilot := range []PilotInfo{
+		{Username: "alice", PersonalData: `{"name":"Alice"}`, Embedding: []float64{1, 2}, Status: PilotStatusOK},
+		{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusNoEmbedding},
+	} {
+		if err := writePilotParts(context.Background(), fr.client(0), pilot, true, true); err != nil {
+			t.Fatalf("seeding %s: %v", pilot.Username, err)
+		}
+	}
+}
+
+func TestRunMigrateToWriteDB(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	seedMigration(t, fr)
+	rdb, wdb := fr.client(0), fr.client(1)
+	ctx := context.Background()
+
+	out := &bytes.Buffer{}
+	if err := RunMigrate(ctx, rdb, wdb, []string{"--dry-run"}, out); err != nil {
+		t.Fatalf("RunMigrate --dry-run: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	slices.Sort(lines[:len(lines)-1])
+	want := []string{
+		"alice -> " + pilotKey("alice"),
+		"bob -> " + pilotKey("bob"),
+		"Would migrate 2 pilot(s) from DB 0 (flat keys) to DB 1 (flat keys)",
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("dry run printed %q, want %q", lines, want)
+	}
+	if keys := fr.keys(1); len(keys) != 0 {
+		t.Fatalf("dry run wrote %v", keys)
+	}
+
+	out.Reset()
+	if err := RunMigrate(ctx, rdb, wdb, nil, out); err != nil {
+		t.Fatalf("RunMigrate: %v", err)
+	}
+	if got := out.String(); got != "Migrated 2 pilot(s) from DB 0 (flat keys) to DB 1 (flat keys)\n" {
+		t.Errorf("printed %q", got)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		source, migrated := fr.hash(0, pilotKey(username)), fr.hash(1, pilotKey(username))
+		if migrated["personal_data"] != source["personal_data"] || migrated["status"] != source["status"] {
+			t.Errorf("%s migrated as %v, want %v", username, migrated, source)
+		}
+	}
+	value, _ := fr.get(1, embeddingKey("alice"))
+	if embedding, err := decodeStoredEmbedding(value); err != nil || !slices.Equal(embedding, []float64{1, 2}) {
+		t.Errorf("alice's migrated embedding = %v (%v)", embedding, err)
+	}
+	// The source is only read
+	if !fr.exists(0, pilotKey("alice")) || !fr.exists(0, embeddingKey("alice")) {
+		t.Error("migration removed pilots from REDIS_DB")
+	}
+}
+
+func TestRunMigrateKeyScheme(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	seedMigration(t, fr)
+	flat_keys := fr.keys(0)
+	useConfig(t, map[string]string{"KEY_SCHEME": "cluster"})
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	out := &bytes.Buffer{}
+	if err := RunMigrate(ctx, rdb, rdb, []string{"--from-scheme", "flat", "--dry-run"}, out); err != nil {
+		t.Fatalf("RunMigrate --dry-run: %v", err)
+	}
+	if !strings.Contains(out.String(), "alice -> cognicore:data:{alice}:pilot\n") {
+		t.Errorf("dry run printed %q, want alice's cluster key", out)
+	}
+	if keys := fr.keys(0); !slices.Equal(keys, flat_keys) {
+		t.Fatalf("dry run changed the keys to %v", keys)
+	}
+
+	out.Reset()
+	if err := RunMigrate(ctx, rdb, rdb, []string{"--from-scheme", "flat"}, out); err != nil {
+		t.Fatalf("RunMigrate: %v", err)
+	}
+	if got := out.String(); got != "Migrated 2 pilot(s) from DB 0 (flat keys) to DB 0 (cluster keys)\n" {
+		t.Errorf("printed %q", got)
+	}
+	if got := fr.hash(0, pilotKey("alice"))["personal_data"]; got != `{"name":"Alice"}` {
+		t.Errorf("alice's cluster-keyed personal_data = %q", got)
+	}
+	if !fr.exists(0, embeddingKey("alice")) {
+		t.Error("alice's embedding wasn't migrated to its cluster key")
+	}
+	if cfg.KeyScheme != "cluster" {
+		t.Errorf("KEY_SCHEME left as %q", cfg.KeyScheme)
+	}
+}
+
+func TestRunMigrateKeepsAuthTTL(t *testing.T) {
+	useConfig(t, map[string]string{"AUTH_TTL_LOW": "1m"})
+	fr := newFakeRedis(t)
+	rdb, wdb := fr.client(0), fr.client(1)
+	ctx := context.Background()
+	if err := updatePilot(withAuthTTL(ctx, time.Minute), rdb, "alice", []any{"pilot_username", "alice", "authenticated", AuthFlag(true)}); err != nil {
+		t.Fatalf("authenticating alice: %v", err)
+	}
+
+	if err := RunMigrate(ctx, rdb, wdb, nil, &bytes.Buffer{}); err != nil {
+		t.Fatalf("RunMigrate: %v", err)
+	}
+	if got := fr.hash(1, pilotKey("alice"))["authenticated"]; got != "true" {
+		t.Fatalf("migrated authenticated = %q, want true", got)
+	}
+	if ttl := fr.fieldTTL(1, pilotKey("alice"), "authenticated"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("migrated authenticated expires in %v, want the TTL it had", ttl)
+	}
+	fr.advance(time.Minute + time.Second)
+	if _, ok := fr.hash(1, pilotKey("alice"))["authenticated"]; ok {
+		t.Error("migrated authentication outlived its TTL")
+	}
+}
+
+func TestRunMigrateRejects(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+
+	for _, tt := range []struct {
+		args []string
+		// Start of the expected error
+		err string
+	}{
+		{[]string{"--from-scheme", "nested"}, `invalid --from-scheme "nested"`},
+		{nil, "nothing to migrate"},
+		{[]string{"--from-scheme", "flat"}, "nothing to migrate"},
+		{[]string{"--bogus"}, "flag provided but not defined"},
+	} {
+		err := RunMigrate(context.Background(), rdb, rdb, tt.args, &bytes.Buffer{})
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("RunMigrate(%q) = %v, want %q", tt.args, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// The socket's CommandOptions only carries the command line and std streams (no working
+// directory or environment), and `cd` on the cloud shell changes PWD for every later command on
+// the same client. So instead of switching directories, all cloud paths are built here: pilot
+// files absolute under their home, flight files relative to the API account's home, in
+// FLIGHTS_DIR ("flights" by default).
+
+func homeFile(username, name string) string {
+	return path.Join("/home", username, name)
+}
+
+func flightFile(flight_id string) string {
+	return path.Join(cfg.FlightsDir, flight_id+".flight")
+}
+
+// flightMarker is the empty sidecar file marking a flight as "open" or "ended"
+func flightMarker(flight_id, state string) string {
+	return path.Join(cfg.FlightsDir, flight_id+"."+state)
+}
+
+// Usernames and file names end up in command lines and paths, so only plain names are accepted:
+// no shell metacharacters, whitespace or separators, and no leading "." or "-" (no "..", no flags)
+var plain_name = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,63}$`)
+
+func validUsername(username string) bool {
+	return plain_name.MatchString(username)
+}
+
+func validFilename(name string) bool {
+	return plain_name.MatchString(name)
+}
+
+// validFlightsDir accepts a relative path of plain names, e.g. "flights" or "flights/ZS-ABC"
+func validFlightsDir(dir string) bool {
+	for segment := range strings.SplitSeq(dir, "/") {
+		if !validFilename(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+// A command prefix is a few plain words and flags, with no way to start a second command
+var command_prefix = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_./=-]*( +[A-Za-z0-9_./=-]+)*$`)
+
+func validCommandPrefix(prefix string) bool {
+	return command_prefix.MatchString(prefix)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPaths(t *testing.T) {
+	useConfig(t, nil)
+	for _, tt := range []struct{ got, want string }{
+		{homeFile("alice", "user.profile"), "/home/alice/user.profile"},
+		{homeFile("alice", "face.embedding"), "/home/alice/face.embedding"},
+		{flightFile("1700000000000000000"), "flights/1700000000000000000.flight"},
+		{flightMarker("42", "open"), "flights/42.open"},
+		{flightMarker("42", "ended"), "flights/42.ended"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+
+	useConfig(t, map[string]string{"FLIGHTS_DIR": "flights/ZS-ABC"})
+	if got := flightFile("42"); got != "flights/ZS-ABC/42.flight" {
+		t.Errorf("flightFile under FLIGHTS_DIR = %q", got)
+	}
+	if got := flightMarker("42", "open"); got != "flights/ZS-ABC/42.open" {
+		t.Errorf("flightMarker under FLIGHTS_DIR = %q", got)
+	}
+}
+
+func TestValidNames(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		valid bool
+	}{
+		{"alice", true},
+		{"a.b-c_d", true},
+		{"_svc", true},
+		{"0042", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"", false},
+		{".hidden", false},
+		{"..", false},
+		{"-rf", false},
+		{"a/b", false},
+		{"a b", false},
+		{"a;rm", false},
+		{"$(id)", false},
+		{"a\nb", false},
+	} {
+		if got := validUsername(tt.name); got != tt.valid {
+			t.Errorf("validUsername(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+		if got := validFilename(tt.name); got != tt.valid {
+			t.Errorf("validFilename(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestValidFlightsDir(t *testing.T) {
+	for _, tt := range []struct {
+		dir   string
+		valid bool
+	}{
+		{"flights", true},
+		{"flights/ZS-ABC", true},
+		{"", false},
+		{"/flights", false},
+		{"flights/", false},
+		{"flights/../etc", false},
+		{"flights//x", false},
+		{"flights x", false},
+	} {
+		if got := validFlightsDir(tt.dir); got != tt.valid {
+			t.Errorf("validFlightsDir(%q) = %v, want %v", tt.dir, got, tt.valid)
+		}
+	}
+}
+
+func TestValidCommandPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		prefix string
+		valid  bool
+	}{
+		{"sudo", true},
+		{"sudo -u flights", true},
+		{"run-as --user=flights ./bin", true},
+		{"", false},
+		{"-u flights", false},
+		{"sudo;", false},
+		{"sudo && rm", false},
+		{"sudo | tee", false},
+		{"sudo $(id)", false},
+		{"sudo ", false},
+	} {
+		if got := validCommandPrefix(tt.prefix); got != tt.valid {
+			t.Errorf("validCommandPrefix(%q) = %v, want %v", tt.prefix, got, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With PILOT_OUTPUTS including "json", every pilot sync stores is also kept as one JSON document
+// under cognicore:data:pilot_json:<username>, for consumers that would rather GET a whole pilot
+// than HGETALL a hash. The document carries what sync knows about the pilot (the fields it
+// writes to the hash, promoted profile fields included) plus the embedding's length and, when
+// the keys output is on, the key it's stored under. Fields set by requests (flight_id,
+// authenticated) only live on the hash.
+
+// PilotDocument is the JSON stored for a pilot
+type PilotDocument struct {
+	Username             string            `json:"pilot_username"`
+	PilotID              string            `json:"pilot_id,omitempty"`
+	PersonalData         string            `json:"personal_data,omitempty"`
+	Status               string            `json:"status,omitempty"`
+	Recognizable         string            `json:"recognizable,omitempty"`
+	EmbeddingFingerprint string            `json:"embedding_fingerprint,omitempty"`
+	EmbeddingStale       string            `json:"embedding_stale,omitempty"`
+	ProfileFields        map[string]string `json:"profile_fields,omitempty"`
+	ExtraFiles           map[string]string `json:"extra_files,omitempty"`
+	EmbeddingKey         string            `json:"embedding_key,omitempty"`
+	EmbeddingLength      int               `json:"embedding_length"`
+}
+
+func pilotDocument(pilot PilotInfo) (PilotDocument, error) {
+	// Sealed like the hash field under ENCRYPT_PROFILES
+	personal_data, err := pilot.PersonalData.MarshalBinary()
+	if err != nil {
+		return PilotDocument{}, fmt.Errorf("failed to encrypt profile: %w", err)
+	}
+
+	document := PilotDocument{
+		Username:             pilot.Username,
+		PilotID:              pilot.PilotID,
+		PersonalData:         string(personal_data),
+		Status:               pilot.Status,
+		Recognizable:         pilot.Recognizable,
+		EmbeddingFingerprint: pilot.EmbeddingFingerprint,
+		EmbeddingStale:       pilot.EmbeddingStale,
+		ProfileFields:        pilot.ProfileFields,
+		ExtraFiles:           pilot.ExtraFiles,
+		EmbeddingLength:      len(pilot.Embedding),
+	}
+	if outputEnabled("keys") {
+		document.EmbeddingKey = pilot.PrimaryEmbedding
+	}
+	return document, nil
+}
+
+// writePilotJSON replaces a pilot's JSON document
+func writePilotJSON(ctx context.Context, rdb *redis.Client, pilot PilotInfo) error {
+	document, err := pilotDocument(pilot)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pilot document: %w", err)
+	}
+	return rdb.Set(ctx, pilotJSONKey(pilot.Username), data, 0).Err()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func storedDocument(t *testing.T, fr *fakeRedis, username string) (PilotDocument, bool) {
+	t.Helper()
+	data, ok := fr.get(0, pilotJSONKey(username))
+	if !ok {
+		return PilotDocument{}, false
+	}
+	var document PilotDocument
+	if err := json.Unmarshal([]byte(data), &document); err != nil {
+		t.Fatalf("document of %s isn't JSON: %v", username, err)
+	}
+	return document, true
+}
+
+func TestPilotJSONOutput(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_OUTPUTS": "keys,json"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{
+		Username:      "alice",
+		FlightID:      "1700000000000000000",
+		PersonalData:  `{"name":"Alice"}`,
+		Status:        PilotStatusOK,
+		PilotID:       "P-1",
+		Embedding:     []float64{1, 2, 3},
+		ProfileFields: map[string]string{"rank": "captain"},
+	}
+	alice.PrimaryEmbedding = primaryEmbeddingKey("alice", "", alice.Embedding)
+	pilot_hashes := map[string]pilotHash{}
+
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	document, ok := storedDocument(t, fr, "alice")
+	if !ok {
+		t.Fatal("no document for alice")
+	}
+	want := PilotDocument{
+		Username:        "alice",
+		PilotID:         "P-1",
+		PersonalData:    `{"name":"Alice"}`,
+		Status:          PilotStatusOK,
+		ProfileFields:   map[string]string{"rank": "captain"},
+		EmbeddingKey:    embeddingKey("alice"),
+		EmbeddingLength: 3,
+	}
+	if !reflect.DeepEqual(document, want) {
+		t.Fatalf("document = %+v, want %+v", document, want)
+	}
+	// Request-owned fields stay on the hash
+	data, _ := fr.get(0, pilotJSONKey("alice"))
+	var raw map[string]any
+	json.Unmarshal([]byte(data), &raw)
+	for _, field := range []string{"flight_id", "authenticated"} {
+		if _, ok := raw[field]; ok {
+			t.Errorf("document carries %s", field)
+		}
+	}
+
+	alice.PersonalData = `{"name":"Alice Smith"}`
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if document, _ := storedDocument(t, fr, "alice"); document.PersonalData != `{"name":"Alice Smith"}` {
+		t.Errorf("personal_data = %q after a change, want it rewritten", document.PersonalData)
+	}
+
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("third cycle: %v", err)
+	}
+	if _, ok := storedDocument(t, fr, "alice"); ok {
+		t.Error("document kept after the pilot was deleted")
+	}
+}
+
+func TestPilotJSONOnly(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_OUTPUTS": "json"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK, Embedding: []float64{1, 2}}
+	alice.PrimaryEmbedding = primaryEmbeddingKey("alice", "", alice.Embedding)
+
+	if _, err := runSyncCycle(context.Background(), rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, map[string]pilotHash{}); err != nil {
+		t.Fatalf("runSyncCycle: %v", err)
+	}
+	document, ok := storedDocument(t, fr, "alice")
+	if !ok {
+		t.Fatal("no document for alice")
+	}
+	// Nothing is stored under the embedding key for it to point at
+	if document.EmbeddingKey != "" || document.EmbeddingLength != 2 {
+		t.Errorf("document embedding = %q (%d values), want no key and 2 values", document.EmbeddingKey, document.EmbeddingLength)
+	}
+	if fr.exists(0, pilotKey("alice")) || fr.exists(0, embeddingKey("alice")) {
+		t.Error("pilot keys were written without the keys output")
+	}
+}
+
+func TestPilotJSONEncryptedProfile(t *testing.T) {
+	useConfig(t, map[string]string{
+		"PILOT_OUTPUTS":    "keys,json",
+		"ENCRYPTION_KEY":   base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"ENCRYPT_PROFILES": "true",
+	})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK}
+
+	if err := writePilotJSON(context.Background(), rdb, alice); err != nil {
+		t.Fatalf("writePilotJSON: %v", err)
+	}
+	document, _ := storedDocument(t, fr, "alice")
+	if document.PersonalData == `{"name":"Alice"}` {
+		t.Fatal("personal_data stored in the clear under ENCRYPT_PROFILES")
+	}
+	if opened, err := openValue(document.PersonalData); err != nil || opened != `{"name":"Alice"}` {
+		t.Errorf("personal_data opens to %q (%v), want the profile", opened, err)
+	}
+}
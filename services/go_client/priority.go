@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PilotList is what a sync cycle got from the cloud
+type PilotList struct {
+	Pilots []PilotInfo
+	// False when the listing failed verification against PILOT_COUNT_COMMAND; pilots missing
+	// from it can't be taken as deleted
+	Complete bool
+	// Listed pilots the rotation left for a later cycle: neither rewritten nor deleted
+	Deferred []string
+	// Listed pilots that couldn't be fetched: kept as they are, and counted as sync errors
+	Failed []string
+}
+
+// pilotRotation picks which listed pilots a cycle fetches. Authenticated pilots, pilots sync
+// hasn't stored yet and pilots whose embedding is stale (zero embedding hash) are fetched every
+// cycle; the dormant rest DORMANT_PILOTS_PER_CYCLE at a time, picking up where the last cycle
+// left off.
+type pilotRotation struct {
+	rdb *redis.Client
+	// The sync thread's pilot_hashes; zero hashes are pilots left over from an earlier run
+	stored map[string]pilotHash
+	next   int
+}
+
+// pick splits usernames into the pilots to fetch this cycle and those deferred to a later one.
+// Without a rotation (or with DORMANT_PILOTS_PER_CYCLE unset) every pilot is fetched.
+func (r *pilotRotation) pick(ctx context.Context, usernames []string) (fetch, deferred []string) {
+	if r == nil || cfg.DormantPilotsPerCycle == 0 {
+		return usernames, nil
+	}
+
+	active, err := activePilots(ctx, r.rdb)
+	if err != nil {
+		logf(ctx, "warning: failed to list active pilots, fetching every pilot: %v", err)
+		return usernames, nil
+	}
+
+	dormant := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		_, is_active := active[username]
+		if is_active || r.stored[canonicalUsername(username)].Embedding == 0 {
+			fetch = append(fetch, username)
+		} else {
+			dormant = append(dormant, username)
+		}
+	}
+	if len(dormant) <= cfg.DormantPilotsPerCycle {
+		r.next = 0
+		return append(fetch, dormant...), nil
+	}
+
+	// The listing can change between cycles, so this is a position rather than a username;
+	// at worst a pilot waits one extra lap
+	start := r.next % len(dormant)
+	for i := range dormant {
+		username := dormant[(start+i)%len(dormant)]
+		if i < cfg.DormantPilotsPerCycle {
+			fetch = append(fetch, username)
+		} else {
+			deferred = append(deferred, username)
+		}
+	}
+	r.next = start + cfg.DormantPilotsPerCycle
+	debugCtxf(ctx, "Fetching %d active/new and %d dormant pilot(s), deferring %d", len(fetch)-cfg.DormantPilotsPerCycle, cfg.DormantPilotsPerCycle, len(deferred))
+	return fetch, deferred
+}
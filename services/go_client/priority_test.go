@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestPilotRotation(t *testing.T) {
+	useConfig(t, map[string]string{"DORMANT_PILOTS_PER_CYCLE": "2"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	rdb.HSet(ctx, pilotKey("active"), "pilot_username", "active", "authenticated", "true")
+	rdb.HSet(ctx, pilotKey("d1"), "pilot_username", "d1", "authenticated", "false")
+	stored := map[string]pilotHash{
+		"active": {Profile: 1, Embedding: 1},
+		"d1":     {Profile: 1, Embedding: 1},
+		"d2":     {Profile: 1, Embedding: 1},
+		"d3":     {Profile: 1, Embedding: 1},
+		"d4":     {Profile: 1, Embedding: 1},
+		// Left over from an earlier run, so refreshed like a new pilot
+		"leftover": {},
+	}
+	rotation := &pilotRotation{rdb: rdb, stored: stored}
+	usernames := []string{"active", "d1", "d2", "d3", "d4", "leftover", "new"}
+
+	for i, want := range []struct{ fetch, deferred []string }{
+		{[]string{"active", "leftover", "new", "d1", "d2"}, []string{"d3", "d4"}},
+		{[]string{"active", "leftover", "new", "d3", "d4"}, []string{"d1", "d2"}},
+		{[]string{"active", "leftover", "new", "d1", "d2"}, []string{"d3", "d4"}},
+	} {
+		fetch, deferred := rotation.pick(ctx, usernames)
+		if !slices.Equal(fetch, want.fetch) || !slices.Equal(deferred, want.deferred) {
+			t.Fatalf("cycle %d: fetch %v, deferred %v; want %v, %v", i+1, fetch, deferred, want.fetch, want.deferred)
+		}
+	}
+
+	// Few enough dormant pilots are all fetched, and the rotation starts over
+	fetch, deferred := rotation.pick(ctx, []string{"active", "d3", "d4"})
+	if !slices.Equal(fetch, []string{"active", "d3", "d4"}) || deferred != nil || rotation.next != 0 {
+		t.Fatalf("fetch %v, deferred %v, next %d", fetch, deferred, rotation.next)
+	}
+}
+
+func TestPilotRotationFetchesEveryone(t *testing.T) {
+	usernames := []string{"d1", "d2", "d3"}
+	stored := map[string]pilotHash{"d1": {1, 1}, "d2": {1, 1}, "d3": {1, 1}}
+
+	useConfig(t, map[string]string{"DORMANT_PILOTS_PER_CYCLE": "1"})
+	fr := newFakeRedis(t)
+	var none *pilotRotation
+	if fetch, deferred := none.pick(context.Background(), usernames); !slices.Equal(fetch, usernames) || deferred != nil {
+		t.Errorf("without a rotation: fetch %v, deferred %v", fetch, deferred)
+	}
+
+	// Without knowing who's active, nobody is deferred
+	fr.setFailure("ERR out of memory")
+	rotation := &pilotRotation{rdb: fr.client(0), stored: stored}
+	if fetch, deferred := rotation.pick(context.Background(), usernames); !slices.Equal(fetch, usernames) || deferred != nil {
+		t.Errorf("with Redis failing: fetch %v, deferred %v", fetch, deferred)
+	}
+	fr.setFailure("")
+
+	useConfig(t, map[string]string{"DORMANT_PILOTS_PER_CYCLE": "0"})
+	if fetch, deferred := rotation.pick(context.Background(), usernames); !slices.Equal(fetch, usernames) || deferred != nil {
+		t.Errorf("with DORMANT_PILOTS_PER_CYCLE=0: fetch %v, deferred %v", fetch, deferred)
+	}
+}
+
+func TestDeferredPilotsKept(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK}
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice, bob}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+
+	result, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Deferred: []string{"bob"}, Complete: true}, pilot_hashes)
+	if err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if result.Deleted != 0 || !fr.exists(0, pilotKey("bob")) {
+		t.Fatalf("deferred bob was deleted (%v)", result)
+	}
+}
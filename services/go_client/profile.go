@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrPilotRejected marks a pilot that was fetched fine but shouldn't be stored; GetPilots skips
+// such pilots instead of failing the whole listing
+var ErrPilotRejected = errors.New("pilot rejected")
+
+// limitProfileSize enforces PROFILE_MAX_BYTES on the stored profile JSON. Oversized profiles are
+// rejected, or with PROFILE_SIZE_POLICY=summary cut down to their top-level scalar fields (which
+// is reported as truncated).
+func limitProfileSize(ctx context.Context, username string, json_bytes []byte) ([]byte, bool, error) {
+	if cfg.ProfileMaxBytes <= 0 || len(json_bytes) <= cfg.ProfileMaxBytes {
+		return json_bytes, false, nil
+	}
+
+	if cfg.ProfileSizePolicy == "summary" {
+		summary, err := summarizeProfile(json_bytes)
+		if err == nil && len(summary) <= cfg.ProfileMaxBytes {
+			logf(ctx, "warning: profile for %q is %d bytes (limit %d), storing a summary", username, len(json_bytes), cfg.ProfileMaxBytes)
+			return summary, true, nil
+		}
+	}
+
+	return nil, false, fmt.Errorf("%w: profile is %d bytes, over the %d byte limit", ErrPilotRejected, len(json_bytes), cfg.ProfileMaxBytes)
+}
+
+// profileEmpty reports whether converted profile JSON carries nothing at all
+func profileEmpty(json_bytes []byte) bool {
+	switch string(bytes.TrimSpace(json_bytes)) {
+	case "", "null", "{}":
+		return true
+	}
+	return false
+}
+
+// mapProfileFields picks the values PROFILE_FIELD_MAP promotes to hash fields out of a profile.
+// Scalars are stored as text, anything else as JSON; paths missing from the profile are skipped.
+func mapProfileFields(json_bytes []byte, mapping map[string]string) (map[string]string, error) {
+	if len(mapping) == 0 || len(json_bytes) == 0 {
+		return nil, nil
+	}
+
+	var profile any
+	if err := decodeProfile(json_bytes, &profile); err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{}
+	for profile_path, field := range mapping {
+		value, ok := lookupPath(profile, strings.Split(profile_path, "."))
+		if !ok || value == nil {
+			continue
+		}
+		switch value := value.(type) {
+		case string:
+			fields[field] = value
+		case json.Number:
+			fields[field] = value.String()
+		case bool:
+			fields[field] = fmt.Sprint(value)
+		default:
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			fields[field] = string(data)
+		}
+	}
+	return fields, nil
+}
+
+// decodeProfile is json.Unmarshal keeping numbers as json.Number, so IDs and other large integers
+// come back out digit for digit rather than through a float64
+func decodeProfile(json_bytes []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(json_bytes))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return nil
+}
+
+func lookupPath(node any, path []string) (any, bool) {
+	for _, key := range path {
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if node, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// summarizeProfile keeps only the top-level scalar fields of a profile and marks it truncated
+func summarizeProfile(json_bytes []byte) ([]byte, error) {
+	var profile map[string]any
+	if err := decodeProfile(json_bytes, &profile); err != nil {
+		return nil, err
+	}
+
+	summary := map[string]any{"_truncated": true}
+	for key, value := range profile {
+		switch value.(type) {
+		case map[string]any, []any:
+		default:
+			summary[key] = value
+		}
+	}
+	return json.Marshal(summary)
+}
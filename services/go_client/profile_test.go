@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProfileSizeLimit(t *testing.T) {
+	// About 300 bytes as JSON, mostly in the nested history
+	profile := "name: Alice\nage: 42\nlicense:\n  class: A\nhistory: [" + strings.Repeat("\"KJFK-EGLL\", ", 20) + "\"KJFK-EGLL\"]\n"
+	for _, tt := range []struct {
+		name   string
+		env    map[string]string
+		status string
+		// Top-level keys of the stored profile, or nil for a rejected pilot
+		keys []string
+	}{
+		{"unlimited", nil, PilotStatusOK, []string{"age", "history", "license", "name"}},
+		{"under the limit", map[string]string{"PROFILE_MAX_BYTES": "4096"}, PilotStatusOK, []string{"age", "history", "license", "name"}},
+		{"rejected", map[string]string{"PROFILE_MAX_BYTES": "100"}, "", nil},
+		{"summary", map[string]string{"PROFILE_MAX_BYTES": "100", "PROFILE_SIZE_POLICY": "summary"}, PilotStatusProfileTruncated, []string{"_truncated", "age", "name"}},
+		{"summary still too large", map[string]string{"PROFILE_MAX_BYTES": "20", "PROFILE_SIZE_POLICY": "summary"}, "", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.env)
+			cloud := newFakeCloud(t)
+			cloud.addPilot("alice", profile, []float64{1, 2})
+
+			pilot, err := GetPilotFromServer(context.Background(), cloud.connect(), "alice")
+			if tt.keys == nil {
+				if !errors.Is(err, ErrPilotRejected) || !strings.Contains(err.Error(), "byte limit") {
+					t.Fatalf("GetPilotFromServer = %v, want the pilot rejected for size", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetPilotFromServer: %v", err)
+			}
+			if pilot.Status != tt.status {
+				t.Errorf("status = %q, want %q", pilot.Status, tt.status)
+			}
+			var stored map[string]any
+			if err := json.Unmarshal([]byte(pilot.PersonalData), &stored); err != nil {
+				t.Fatalf("personal_data isn't JSON: %v", err)
+			}
+			if keys := slices.Sorted(maps.Keys(stored)); !slices.Equal(keys, tt.keys) {
+				t.Errorf("stored keys %v, want %v", keys, tt.keys)
+			}
+			if tt.status == PilotStatusProfileTruncated && (stored["_truncated"] != true || stored["name"] != "Alice" || stored["age"] != float64(42)) {
+				t.Errorf("summary = %s", pilot.PersonalData)
+			}
+		})
+	}
+}
+
+func TestEmptyProfileFlagged(t *testing.T) {
+	for _, tt := range []struct {
+		name, profile string
+	}{
+		{"empty file", ""},
+		{"whitespace only", "  \n\t\n"},
+		{"comment only", "# profile pending\n# filled in at onboarding\n"},
+		{"empty mapping", "{}\n"},
+		{"explicit null", "null\n"},
+		{"document marker", "---\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			cloud := newFakeCloud(t)
+			cloud.addPilot("alice", tt.profile, []float64{1, 2})
+
+			pilot, err := GetPilotFromServer(context.Background(), cloud.connect(), "alice")
+			if err != nil {
+				t.Fatalf("GetPilotFromServer: %v", err)
+			}
+			if pilot.Status != PilotStatusProfileEmpty {
+				t.Errorf("status = %q, want %q", pilot.Status, PilotStatusProfileEmpty)
+			}
+			if pilot.PersonalData != "" {
+				t.Errorf("stored personal_data %q for an empty profile", pilot.PersonalData)
+			}
+			if len(pilot.Embedding) != 2 {
+				t.Error("the embedding of a pilot with an empty profile was dropped")
+			}
+		})
+	}
+}
+
+func TestProfileEmpty(t *testing.T) {
+	for json_bytes, want := range map[string]bool{
+		"":                 true,
+		"null":             true,
+		" null\n":          true,
+		"{}":               true,
+		`{"name":"Alice"}`: false,
+		`{"name":null}`:    false,
+		`[]`:               false,
+		`""`:               false,
+	} {
+		if got := profileEmpty([]byte(json_bytes)); got != want {
+			t.Errorf("profileEmpty(%q) = %v, want %v", json_bytes, got, want)
+		}
+	}
+}
+
+func TestMapProfileFields(t *testing.T) {
+	profile := []byte(`{"name":"Alice","age":42,"active":true,"license":{"class":"A","ratings":["IR","ME"]},"base":null}`)
+	fields, err := mapProfileFields(profile, map[string]string{
+		"name":            "display_name",
+		"age":             "age",
+		"active":          "active",
+		"license.class":   "license_class",
+		"license.ratings": "ratings",
+		"license":         "license",
+		"base":            "base",
+		"missing":         "missing",
+		"name.first":      "first_name",
+	})
+	if err != nil {
+		t.Fatalf("mapProfileFields: %v", err)
+	}
+	want := map[string]string{
+		"display_name":  "Alice",
+		"age":           "42",
+		"active":        "true",
+		"license_class": "A",
+		"ratings":       `["IR","ME"]`,
+		"license":       `{"class":"A","ratings":["IR","ME"]}`,
+	}
+	if !maps.Equal(fields, want) {
+		t.Fatalf("fields = %v, want %v", fields, want)
+	}
+
+	if fields, err := mapProfileFields(nil, map[string]string{"name": "display_name"}); err != nil || fields != nil {
+		t.Fatalf("mapping an empty profile = %v, %v", fields, err)
+	}
+}
+
+func TestMapProfileFieldsNumbers(t *testing.T) {
+	profile := []byte(`{"employee":1234567,"id":12345678901234567,"hours":1500.25,"ratio":1e-7}`)
+	fields, err := mapProfileFields(profile, map[string]string{"employee": "employee", "id": "id", "hours": "hours", "ratio": "ratio"})
+	if err != nil {
+		t.Fatalf("mapProfileFields: %v", err)
+	}
+	// Written as they appear in the profile, whatever a float64 would make of them
+	want := map[string]string{"employee": "1234567", "id": "12345678901234567", "hours": "1500.25", "ratio": "1e-7"}
+	if !maps.Equal(fields, want) {
+		t.Fatalf("fields = %v, want %v", fields, want)
+	}
+}
+
+func TestProfileNumbersKept(t *testing.T) {
+	// Above 2^53, so a float64 would round it
+	const profile = `{"id":12345678901234567,"medical":{"notes":"none"}}`
+	redacted, _, err := redactProfile([]byte(profile), []string{"medical.notes"})
+	if err != nil || !strings.Contains(string(redacted), `"id":12345678901234567`) {
+		t.Errorf("redacted profile = %s (%v), want the id unchanged", redacted, err)
+	}
+	summary, err := summarizeProfile([]byte(profile))
+	if err != nil || !strings.Contains(string(summary), `"id":12345678901234567`) {
+		t.Errorf("summary = %s (%v), want the id unchanged", summary, err)
+	}
+	if _, err := mapProfileFields([]byte(profile+"{}"), map[string]string{"id": "id"}); err == nil {
+		t.Error("accepted a profile with trailing data")
+	}
+}
+
+func TestProfileFieldsPromoted(t *testing.T) {
+	useConfig(t, map[string]string{"PROFILE_FIELD_MAP": "name=display_name,license.class=license_class"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\nlicense:\n  class: A\n", []float64{1, 2})
+	api_client := cloud.connect()
+	write := func() {
+		t.Helper()
+		pilot, err := GetPilotFromServer(context.Background(), api_client, "alice")
+		if err != nil {
+			t.Fatalf("GetPilotFromServer: %v", err)
+		}
+		if err := writePilot(context.Background(), rdb, *pilot); err != nil {
+			t.Fatalf("writePilot: %v", err)
+		}
+	}
+
+	write()
+	fields := fr.hash(0, pilotKey("alice"))
+	if fields["display_name"] != "Alice" || fields["license_class"] != "A" {
+		t.Fatalf("pilot hash = %v, want the mapped fields", fields)
+	}
+
+	// A value gone from the profile is removed from the hash
+	cloud.setFile(homeFile("alice", "user.profile"), "name: Alice Smith\n")
+	write()
+	fields = fr.hash(0, pilotKey("alice"))
+	if fields["display_name"] != "Alice Smith" {
+		t.Errorf("display_name = %q after the profile changed", fields["display_name"])
+	}
+	if _, ok := fields["license_class"]; ok {
+		t.Errorf("license_class kept after leaving the profile: %v", fields)
+	}
+
+	for _, invalid := range []string{"name=personal_data", "name", "=display_name", "name=bad field"} {
+		if _, err := loadConfig(t, map[string]string{"PROFILE_FIELD_MAP": invalid}); err == nil {
+			t.Errorf("accepted PROFILE_FIELD_MAP %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Requests are read off Redis as soon as they're announced (the request keys are overwritten by
+// the next one) and handled one at a time from this queue. Only the latest request per pilot
+// matters, so a newer one replaces any still pending for the same pilot; past
+// MAX_PENDING_REQUESTS pilots, the oldest pending request is dropped.
+//
+// With SUPERSEDE_PILOT_REQUESTS only the latest pilot to be recognized matters: a request
+// authenticating one pilot drops those pending for others, and cancels the one being handled.
+
+// ErrRequestSuperseded is the cause of a pilot request cancelled by one for another pilot
+var ErrRequestSuperseded = errors.New("superseded by a request for another pilot")
+
+// pendingRequest is a pilot or deauth request waiting to be handled
+type pendingRequest struct {
+	// pilotIDRequestKey, pilotDeauthRequestKey or pilotFetchRequestKey
+	kind   string
+	fields map[string]string
+}
+
+// coalesceKey groups requests that supersede each other: authentication and deauth of a pilot
+// do, but embedding refreshes and fetches are independent of them
+func (r pendingRequest) coalesceKey() string {
+	if r.kind == pilotFetchRequestKey {
+		return r.fields["pilot_username"] + "/fetch"
+	}
+	return r.fields["pilot_username"] + "/" + r.fields["scope"]
+}
+
+// authenticates reports whether a request is one SUPERSEDE_PILOT_REQUESTS applies to
+func (r pendingRequest) authenticates() bool {
+	return r.kind == pilotIDRequestKey && r.fields["scope"] == ""
+}
+
+// supersedes reports whether r makes other moot under SUPERSEDE_PILOT_REQUESTS. Notifications
+// can arrive out of order, so a request stamped before other never supersedes it.
+func (r pendingRequest) supersedes(other pendingRequest) bool {
+	if !cfg.SupersedePilotRequests || !r.authenticates() || !other.authenticates() || r.fields["pilot_username"] == other.fields["pilot_username"] {
+		return false
+	}
+	made, ok := r.timestamp()
+	other_made, other_ok := other.timestamp()
+	return !ok || !other_ok || made >= other_made
+}
+
+// timestamp is when the request was made (the timestamp field, in seconds since the epoch);
+// ok is false for requests without a valid one
+func (r pendingRequest) timestamp() (float64, bool) {
+	value, err := strconv.ParseFloat(r.fields["timestamp"], 64)
+	return value, err == nil
+}
+
+type requestQueue struct {
+	mu      sync.Mutex
+	pending []pendingRequest
+	ready   chan struct{}
+
+	// The request being handled and how to cancel it
+	current        pendingRequest
+	cancel_current context.CancelCauseFunc
+}
+
+func newRequestQueue() *requestQueue {
+	return &requestQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *requestQueue) push(request pendingRequest) {
+	q.mu.Lock()
+	for i, pending := range q.pending {
+		if pending.coalesceKey() == request.coalesceKey() {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			metricRequestsCoalesced.Inc()
+			debugf("Request for %q superseded by a newer one", request.fields["pilot_username"])
+			break
+		}
+	}
+	q.pending = slices.DeleteFunc(q.pending, func(pending pendingRequest) bool {
+		if !request.supersedes(pending) {
+			return false
+		}
+		metricRequestsCoalesced.Inc()
+		debugf("Request for %q superseded by one for %q", pending.fields["pilot_username"], request.fields["pilot_username"])
+		return true
+	})
+	if q.cancel_current != nil && request.supersedes(q.current) {
+		q.cancel_current(ErrRequestSuperseded)
+	}
+	if len(q.pending) >= max(cfg.MaxPendingRequests, 1) {
+		log.Printf("warning: request queue full, dropping request for %q", q.pending[0].fields["pilot_username"])
+		q.pending = q.pending[1:]
+		metricRequestsDropped.Inc()
+	}
+	q.pending = append(q.pending, request)
+	metricRequestsPending.Set(len(q.pending))
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *requestQueue) pop() (pendingRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return pendingRequest{}, false
+	}
+	request := q.pending[0]
+	q.pending = q.pending[1:]
+	metricRequestsPending.Set(len(q.pending))
+	return request, true
+}
+
+// begin returns the context to handle a popped request with, cancelled if the request is
+// superseded meanwhile; done has to be called once it's handled
+func (q *requestQueue) begin(request pendingRequest) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.current, q.cancel_current = request, cancel
+	// A superseding request may have been pushed between pop and begin
+	for _, pending := range q.pending {
+		if pending.supersedes(request) {
+			cancel(ErrRequestSuperseded)
+			break
+		}
+	}
+
+	return ctx, func() {
+		q.mu.Lock()
+		q.current, q.cancel_current = pendingRequest{}, nil
+		q.mu.Unlock()
+		cancel(nil)
+	}
+}
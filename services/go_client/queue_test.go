@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// drain pops every pending request, as "username/kind/timestamp"
+func drain(queue *requestQueue) []string {
+	var popped []string
+	for {
+		request, ok := queue.pop()
+		if !ok {
+			return popped
+		}
+		popped = append(popped, request.fields["pilot_username"]+"/"+request.kind+"/"+request.fields["timestamp"])
+	}
+}
+
+func TestRequestBurstCoalesces(t *testing.T) {
+	useConfig(t, nil)
+	request := func(kind, username string, timestamp int) pendingRequest {
+		return pendingRequest{kind: kind, fields: map[string]string{"pilot_username": username, "timestamp": strconv.Itoa(timestamp)}}
+	}
+	coalesced := metricRequestsCoalesced.value.Load()
+
+	queue := newRequestQueue()
+	for i := range 10 {
+		queue.push(request(pilotIDRequestKey, "alice", i))
+		queue.push(request(pilotIDRequestKey, "bob", i))
+	}
+	// A deauth supersedes a pending authentication, a fetch is independent of both
+	queue.push(request(pilotFetchRequestKey, "alice", 10))
+	queue.push(request(pilotDeauthRequestKey, "bob", 10))
+	if got := metricRequestsPending.value.Load(); got != 3 {
+		t.Errorf("pending gauge = %d, want 3", got)
+	}
+
+	want := []string{
+		"alice/" + pilotIDRequestKey + "/9",
+		"alice/" + pilotFetchRequestKey + "/10",
+		"bob/" + pilotDeauthRequestKey + "/10",
+	}
+	if popped := drain(queue); !slices.Equal(popped, want) {
+		t.Fatalf("popped %v, want %v", popped, want)
+	}
+	if got := metricRequestsCoalesced.value.Load() - coalesced; got != 19 {
+		t.Errorf("coalesced %d requests, want 19", got)
+	}
+	if got := metricRequestsPending.value.Load(); got != 0 {
+		t.Errorf("pending gauge = %d after draining, want 0", got)
+	}
+
+	// The ready signal doesn't pile up either
+	select {
+	case <-queue.ready:
+	default:
+		t.Fatal("no ready signal after pushes")
+	}
+	select {
+	case <-queue.ready:
+		t.Fatal("more than one ready signal pending")
+	default:
+	}
+}
+
+func TestRequestQueueFull(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_PENDING_REQUESTS": "3"})
+	logs := captureLog(t)
+	dropped := metricRequestsDropped.value.Load()
+
+	queue := newRequestQueue()
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		queue.push(pendingRequest{kind: pilotIDRequestKey, fields: map[string]string{"pilot_username": username}})
+	}
+	if got := metricRequestsDropped.value.Load() - dropped; got != 2 {
+		t.Errorf("dropped %d requests, want 2", got)
+	}
+	want := []string{"carol/" + pilotIDRequestKey + "/", "dave/" + pilotIDRequestKey + "/", "erin/" + pilotIDRequestKey + "/"}
+	if popped := drain(queue); !slices.Equal(popped, want) {
+		t.Fatalf("popped %v, want the newest %v", popped, want)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if !strings.Contains(logs.String(), `dropping request for "`+username+`"`) {
+			t.Errorf("dropping %s wasn't logged:\n%s", username, logs)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// redactProfile removes the given dotted paths (e.g. "medical.notes") from a JSON profile.
+// It returns the resulting JSON along with the paths that were actually present.
+func redactProfile(json_bytes []byte, fields []string) ([]byte, []string, error) {
+	if len(fields) == 0 {
+		return json_bytes, nil, nil
+	}
+
+	var profile any
+	if err := decodeProfile(json_bytes, &profile); err != nil {
+		return nil, nil, err
+	}
+
+	redacted := make([]string, 0)
+	for _, field := range fields {
+		if deletePath(profile, strings.Split(field, ".")) {
+			redacted = append(redacted, field)
+		}
+	}
+
+	if len(redacted) == 0 {
+		return json_bytes, redacted, nil
+	}
+
+	out, err := json.Marshal(profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, redacted, nil
+}
+
+func deletePath(node any, path []string) bool {
+	obj, ok := node.(map[string]any)
+	if !ok {
+		return false
+	}
+
+	child, ok := obj[path[0]]
+	if !ok {
+		return false
+	}
+
+	if len(path) == 1 {
+		delete(obj, path[0])
+		return true
+	}
+	return deletePath(child, path[1:])
+}
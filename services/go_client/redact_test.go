@@ -0,0 +1,43 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRedactProfile(t *testing.T) {
+	const profile = `{"name":"Alice","medical":{"notes":"asthma","blood_type":"O+"},"licenses":["ATPL"]}`
+	tests := []struct {
+		name         string
+		fields       []string
+		want         string
+		want_removed []string
+	}{
+		{"nothing to redact", nil, profile, nil},
+		{"top level", []string{"name"}, `{"licenses":["ATPL"],"medical":{"blood_type":"O+","notes":"asthma"}}`, []string{"name"}},
+		{"nested", []string{"medical.notes"}, `{"licenses":["ATPL"],"medical":{"blood_type":"O+"},"name":"Alice"}`, []string{"medical.notes"}},
+		{"whole subtree", []string{"medical"}, `{"licenses":["ATPL"],"name":"Alice"}`, []string{"medical"}},
+		{"missing path", []string{"address.street"}, profile, []string{}},
+		{"missing leaf", []string{"medical.allergies"}, profile, []string{}},
+		{"through a non-object", []string{"licenses.0", "name.first"}, profile, []string{}},
+		{"present and missing", []string{"medical.notes", "address", "medical.blood_type"}, `{"licenses":["ATPL"],"medical":{},"name":"Alice"}`, []string{"medical.notes", "medical.blood_type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, removed, err := redactProfile([]byte(profile), tt.fields)
+			if err != nil {
+				t.Fatalf("redactProfile: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if !slices.Equal(removed, tt.want_removed) || (removed == nil) != (tt.want_removed == nil) {
+				t.Errorf("removed %#v, want %#v", removed, tt.want_removed)
+			}
+		})
+	}
+
+	if _, _, err := redactProfile([]byte(`{"name":`), []string{"name"}); err == nil {
+		t.Error("invalid JSON redacted without an error")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// waitForRedis PINGs Redis with backoff until it answers, giving up after timeout (0 waits forever).
+// A password mismatch won't fix itself, so it fails right away, saying what to change.
+func waitForRedis(rdb *redis.Client, timeout time.Duration) error {
+	start := time.Now()
+	for delay := 500 * time.Millisecond; ; delay = min(delay*2, 10*time.Second) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := rdb.Ping(ctx).Err()
+		cancel()
+		if err == nil {
+			log.Printf("Redis ready after %v", time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+
+		switch redisAuthProblem(err) {
+		case redisAuthNotRequired:
+			if !cfg.RedisPasswordOptional {
+				return fmt.Errorf("a Redis password is configured but %s doesn't require one (no requirepass); unset REDIS_PASSWORD (or the password in REDIS_URL), or set REDIS_PASSWORD_OPTIONAL=true to connect without it: %w", cfg.RedisTarget(), err)
+			}
+			log.Printf("warning: %s doesn't require a password, connecting without the configured one", cfg.RedisTarget())
+			// Nothing else uses the client yet; new connections pick the change up
+			rdb.Options().Password = ""
+			continue
+		case redisAuthRequired:
+			return fmt.Errorf("%s requires a password but none is configured; set REDIS_PASSWORD (or put it in REDIS_URL): %w", cfg.RedisTarget(), err)
+		case redisAuthRejected:
+			return fmt.Errorf("%s rejected the configured credentials; check REDIS_PASSWORD (or REDIS_URL): %w", cfg.RedisTarget(), err)
+		}
+
+		if timeout > 0 && time.Since(start)+delay > timeout {
+			return fmt.Errorf("redis not ready after %v: %w", timeout, err)
+		}
+		log.Printf("Redis not ready, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+const (
+	redisAuthOK = iota
+	redisAuthNotRequired
+	redisAuthRequired
+	redisAuthRejected
+)
+
+// redisAuthProblem recognizes the replies of a server whose auth doesn't match the configuration.
+// The wording differs between Redis versions, hence the alternatives.
+func redisAuthProblem(err error) int {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "without any password configured") || strings.Contains(msg, "but no password is set"):
+		return redisAuthNotRequired
+	case strings.HasPrefix(msg, "NOAUTH"):
+		return redisAuthRequired
+	case strings.HasPrefix(msg, "WRONGPASS") || strings.Contains(msg, "invalid password"):
+		return redisAuthRejected
+	}
+	return redisAuthOK
+}
+
+// checkFieldTTLs makes sure Redis has hash field TTLs (HPEXPIRE, Redis 7.4+), which AUTH_TTL_LOW
+// and AUTH_TTL_HIGH rely on. Without them every authentication would fail to be written.
+func checkFieldTTLs(rdb *redis.Client) error {
+	ctx := context.Background()
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, fieldTTLCheckKey, "at", time.Now().UnixNano())
+		pipe.HPExpire(ctx, fieldTTLCheckKey, time.Minute, "at")
+		return nil
+	})
+	rdb.Del(ctx, fieldTTLCheckKey)
+	if err != nil {
+		return fmt.Errorf("AUTH_TTL_LOW/AUTH_TTL_HIGH need hash field TTLs (Redis 7.4+), which %s doesn't support; upgrade Redis or unset them: %w", cfg.RedisTarget(), err)
+	}
+	return nil
+}
+
+// keyspaceSelfTest proves keyspace notifications reach this process: it HSETs a scratch key the
+// same way requests arrive and waits for the event. Without them no request would ever be
+// handled, and nothing else would say so.
+func keyspaceSelfTest(rdb *redis.Client, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sub := rdb.Subscribe(ctx, keyspaceChannel(rdb.Options().DB, keyspaceSelfTestKey))
+	defer sub.Close()
+	// Wait for the subscription to be confirmed, or the event could be published before it
+	if _, err := sub.Receive(ctx); err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	if err := rdb.HSet(ctx, keyspaceSelfTestKey, "at", time.Now().UnixNano()).Err(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", keyspaceSelfTestKey, err)
+	}
+	defer rdb.Del(context.Background(), keyspaceSelfTestKey)
+
+	for {
+		msg, err := sub.ReceiveMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("no keyspace event for %s within %v (is notify-keyspace-events set to at least \"Kh\"?): %w", keyspaceSelfTestKey, timeout, err)
+		}
+		if msg.Payload == "hset" {
+			return nil
+		}
+	}
+}
+
+// writePilot stores a pilot hash and their embedding (deleting a stored one the pilot no longer
+// has), plus the pilot's JSON document when that output is on
+func writePilot(ctx context.Context, rdb *redis.Client, pilot PilotInfo) error {
+	if err := writePilotParts(ctx, rdb, pilot, true, true); err != nil {
+		return err
+	}
+	if outputEnabled("json") {
+		return writePilotJSON(ctx, rdb, pilot)
+	}
+	return nil
+}
+
+// writePilotParts stores the pilot hash, the embedding or both, in one MULTI/EXEC so readers
+// never see a half-updated pilot (e.g. a primary_embedding ahead of the embedding it names).
+//
+// The hash includes the profile fields promoted by PROFILE_FIELD_MAP. HSET alone never removes
+// anything, so fields the hash shouldn't carry anymore (left over from older versions, unmapped
+// profile fields, values that are now empty) are deleted in the same transaction. The hash is
+// WATCHed while they're worked out, and the write retried if it changed meanwhile.
+func writePilotParts(ctx context.Context, rdb *redis.Client, pilot PilotInfo, hash, embedding bool) error {
+	var stored_embedding string
+	if embedding && pilot.Embedding != nil {
+		var err error
+		if stored_embedding, err = encodeStoredEmbedding(pilot.Embedding); err != nil {
+			return fmt.Errorf("failed to marshal embedding: %w", err)
+		}
+	}
+
+	key := pilotKey(pilot.Username)
+	var auth_ttl time.Duration
+	if hash && bool(pilot.Authenticated) {
+		auth_ttl = authTTLOf(ctx)
+	}
+	var stale []string
+	var expire *redis.IntSliceCmd
+	write := func(tx *redis.Tx) error {
+		stale = nil
+		var signature string
+		var signature_ttl time.Duration
+		if hash {
+			existing, err := tx.HKeys(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			stale = stalePilotFields(existing, pilot)
+
+			if cfg.SigningKey != nil {
+				// Fields the pilot leaves out (omitempty) keep their current values
+				values, err := tx.HMGet(ctx, key, "authenticated", "flight_id").Result()
+				if err != nil {
+					return err
+				}
+				authenticated, _ := values[0].(string)
+				flight_id, _ := values[1].(string)
+				if pilot.Authenticated {
+					authenticated = fieldString(pilot.Authenticated)
+				}
+				if pilot.FlightID != "" {
+					flight_id = pilot.FlightID
+				}
+				signature = pilotSignature(cfg.SigningKey, pilot.Username, authenticated, flight_id)
+				if !pilot.Authenticated {
+					signature_ttl = authenticationTTL(ctx, tx, key)
+				}
+			}
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if hash {
+				pipe.HSet(ctx, key, pilot)
+				if len(pilot.ProfileFields) != 0 {
+					pipe.HSet(ctx, key, pilot.ProfileFields)
+				}
+				if len(pilot.ExtraFiles) != 0 {
+					pipe.HSet(ctx, key, pilot.ExtraFiles)
+				}
+				if len(stale) != 0 {
+					pipe.HDel(ctx, key, stale...)
+				}
+				if signature != "" {
+					pipe.HSet(ctx, key, "signature", signature)
+				}
+				if signature_ttl > 0 {
+					pipe.HPExpire(ctx, key, signature_ttl, "signature")
+				}
+				if auth_ttl > 0 {
+					expire = expireAuthentication(ctx, pipe, key, auth_ttl)
+				}
+			}
+			if stored_embedding != "" {
+				pipe.Set(ctx, embeddingKey(pilot.Username), stored_embedding, 0)
+			} else if embedding {
+				// The pilot no longer has an embedding, so neither should Redis
+				pipe.Del(ctx, embeddingKey(pilot.Username))
+			}
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for range 3 {
+		if err = rdb.Watch(ctx, write, key); err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err == nil && len(stale) != 0 {
+		debugf("Removed stale fields %v from %q", stale, pilot.Username)
+	}
+	return checkAuthExpiry(ctx, rdb, key, expire, err)
+}
+
+// stalePilotFields picks the fields of an existing pilot hash that writing pilot should remove
+func stalePilotFields(existing []string, pilot PilotInfo) []string {
+	// Written by sync but omitted when empty, so an empty value means the old one is stale
+	emptied := map[string]bool{
+		"personal_data":         pilot.PersonalData == "",
+		"primary_embedding":     pilot.PrimaryEmbedding == "",
+		"status":                pilot.Status == "",
+		"embedding_fingerprint": pilot.EmbeddingFingerprint == "",
+		"recognizable":          pilot.Recognizable == "",
+		"pilot_id":              pilot.PilotID == "",
+		"embedding_stale":       pilot.EmbeddingStale == "",
+	}
+
+	stale := make([]string, 0)
+	for _, field := range existing {
+		if _, mapped := pilot.ProfileFields[field]; mapped {
+			continue
+		}
+		if _, fetched := pilot.ExtraFiles[field]; fetched {
+			continue
+		}
+		if slices.Contains(reservedPilotFields, field) && !emptied[field] {
+			continue
+		}
+		stale = append(stale, field)
+	}
+	return stale
+}
+
+// checkWrite logs and counts a failed Redis write, reporting whether the write succeeded
+func checkWrite(err error, format string, args ...any) bool {
+	if err == nil {
+		return true
+	}
+
+	metricRedisWriteErrors.Inc()
+	log.Printf("redis write failed (%s): %v", fmt.Sprintf(format, args...), err)
+	return false
+}
+
+// activePilots maps the username of every authenticated pilot in Redis to their flight_id
+func activePilots(ctx context.Context, rdb *redis.Client) (map[string]string, error) {
+	active := map[string]string{}
+	iter := rdb.Scan(ctx, 0, pilotKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		values, err := rdb.HMGet(ctx, iter.Val(), "pilot_username", "authenticated", "flight_id").Result()
+		if err != nil {
+			return nil, err
+		}
+
+		username, _ := values[0].(string)
+		authenticated, _ := values[1].(string)
+		flight_id, _ := values[2].(string)
+		var flag AuthFlag
+		if username == "" || flag.ScanRedis(authenticated) != nil || !flag {
+			continue
+		}
+		active[username] = flight_id
+	}
+	return active, iter.Err()
+}
+
+// isManualPilot reports whether a pilot was inserted by hand (manual=true on its hash) and should
+// survive not being listed by the cloud. Only with PRESERVE_MANUAL_PILOTS; by default sync purges
+// every pilot the cloud doesn't know.
+func isManualPilot(ctx context.Context, rdb *redis.Client, username string) bool {
+	if !cfg.PreserveManualPilots {
+		return false
+	}
+	manual, err := rdb.HGet(ctx, pilotKey(username), "manual").Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("failed to check whether %q is a manual pilot: %v", username, err)
+		// Keeping a pilot by mistake is cheaper than deleting one
+		return true
+	}
+	return manual == "true"
+}
+
+// inActiveFlight reports whether a pilot is authenticated with a flight that hasn't been finalized
+// (finalizing clears flight_id). Such pilots are never deleted, whatever the cloud lists: a
+// pilot dropping out of the listing mid-flight must not lose their keys until the flight ends.
+func inActiveFlight(ctx context.Context, rdb *redis.Client, username string) bool {
+	values, err := rdb.HMGet(ctx, pilotKey(username), "authenticated", "flight_id").Result()
+	if err != nil {
+		log.Printf("failed to check whether %q is in a flight: %v", username, err)
+		// Keeping a pilot by mistake is cheaper than deleting one
+		return true
+	}
+	authenticated, _ := values[0].(string)
+	flight_id, _ := values[1].(string)
+	var flag AuthFlag
+	return flag.ScanRedis(authenticated) == nil && bool(flag) && flight_id != ""
+}
+
+// clearFlight removes a finalized flight from the pilot hash, unless the pilot has already
+// moved on to a different flight
+func clearFlight(ctx context.Context, rdb *redis.Client, username, flight_id string) {
+	current, err := rdb.HGet(ctx, pilotKey(username), "flight_id").Result()
+	if err != nil || current != flight_id {
+		return
+	}
+	checkWrite(updatePilot(ctx, rdb, username, nil, "flight_id"), "clear flight of %q", username)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestWritePilotParts(t *testing.T) {
+	seed := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Embedding: []float64{1, 2}, Status: PilotStatusOK}
+	seed.PrimaryEmbedding = primaryEmbeddingKey("alice", "", seed.Embedding)
+	changed := []float64{3, 4}
+
+	tests := []struct {
+		name            string
+		pilot           PilotInfo
+		hash, embedding bool
+		// Expected personal_data, and embedding (nil for no key)
+		want_profile   string
+		want_embedding []float64
+	}{
+		{
+			name:  "profile only",
+			pilot: PilotInfo{Username: "alice", PersonalData: `{"name":"Alice B"}`, Status: PilotStatusOK},
+			hash:  true, want_profile: `{"name":"Alice B"}`, want_embedding: seed.Embedding,
+		},
+		{
+			name:      "embedding only",
+			pilot:     PilotInfo{Username: "alice", PersonalData: `{"name":"Alice B"}`, Embedding: changed},
+			embedding: true, want_profile: `{"name":"Alice"}`, want_embedding: changed,
+		},
+		{
+			name:      "embedding removed",
+			pilot:     PilotInfo{Username: "alice", PersonalData: `{"name":"Alice B"}`},
+			embedding: true, want_profile: `{"name":"Alice"}`,
+		},
+		{
+			name:  "both",
+			pilot: PilotInfo{Username: "alice", PersonalData: `{"name":"Alice B"}`, Status: PilotStatusNoEmbedding},
+			hash:  true, embedding: true, want_profile: `{"name":"Alice B"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			fr := newFakeRedis(t)
+			rdb := fr.client(0)
+			ctx := context.Background()
+			if err := writePilotParts(ctx, rdb, seed, true, true); err != nil {
+				t.Fatalf("seeding: %v", err)
+			}
+
+			if err := writePilotParts(ctx, rdb, tt.pilot, tt.hash, tt.embedding); err != nil {
+				t.Fatalf("writePilotParts: %v", err)
+			}
+			fields := fr.hash(0, pilotKey("alice"))
+			if fields["personal_data"] != tt.want_profile {
+				t.Errorf("personal_data = %q, want %q", fields["personal_data"], tt.want_profile)
+			}
+			stored, ok := fr.get(0, embeddingKey("alice"))
+			switch {
+			case tt.want_embedding == nil && ok:
+				t.Errorf("embedding key still holds %q", stored)
+			case tt.want_embedding != nil:
+				want, _ := encodeStoredEmbedding(tt.want_embedding)
+				if stored != want {
+					t.Errorf("embedding = %q, want %q", stored, want)
+				}
+			}
+			if tt.hash && tt.want_embedding == nil && fields["primary_embedding"] != "" {
+				t.Errorf("primary_embedding %q names a deleted embedding", fields["primary_embedding"])
+			}
+		})
+	}
+}
+
+func TestStalePilotFields(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		existing []string
+		pilot    PilotInfo
+		want     []string
+	}{
+		{
+			"state kept",
+			[]string{"pilot_username", "flight_id", "authenticated", "match_cosine", "match_l2", "manual", "stale", "signature"},
+			PilotInfo{Username: "alice"},
+			[]string{},
+		},
+		{
+			"synced fields kept while set",
+			[]string{"personal_data", "status", "pilot_id", "recognizable", "primary_embedding", "embedding_fingerprint", "embedding_stale"},
+			PilotInfo{PersonalData: "{}", Status: PilotStatusOK, PilotID: "P1", Recognizable: "true", PrimaryEmbedding: "x", EmbeddingFingerprint: "f", EmbeddingStale: "true"},
+			[]string{},
+		},
+		{
+			"synced fields emptied",
+			[]string{"personal_data", "status", "pilot_id", "recognizable", "primary_embedding", "embedding_fingerprint", "embedding_stale"},
+			PilotInfo{},
+			[]string{"personal_data", "status", "pilot_id", "recognizable", "primary_embedding", "embedding_fingerprint", "embedding_stale"},
+		},
+		{
+			"mapped and extra fields",
+			[]string{"display_name", "license_class", "notes", "old_file"},
+			PilotInfo{ProfileFields: map[string]string{"display_name": "Alice"}, ExtraFiles: map[string]string{"notes": "hi"}},
+			[]string{"license_class", "old_file"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stalePilotFields(tt.existing, tt.pilot); !slices.Equal(got, tt.want) {
+				t.Errorf("stalePilotFields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWritePilotRemovesStaleFields(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	rdb.HSet(ctx, pilotKey("alice"), "pilot_username", "alice", "authenticated", "true", "flight_id", "42", "status", PilotStatusDecodeError, "pilot_id", "P1", "license_class", "A")
+
+	if err := writePilot(ctx, rdb, PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Embedding: []float64{1, 2}, Status: PilotStatusOK}); err != nil {
+		t.Fatalf("writePilot: %v", err)
+	}
+	fields := fr.hash(0, pilotKey("alice"))
+	for _, gone := range []string{"pilot_id", "license_class"} {
+		if _, ok := fields[gone]; ok {
+			t.Errorf("%s survived the write: %v", gone, fields)
+		}
+	}
+	if fields["flight_id"] != "42" || fields["status"] != PilotStatusOK || fields["personal_data"] != `{"name":"Alice"}` {
+		t.Errorf("pilot hash after the write: %v", fields)
+	}
+}
+
+func TestWaitForRedis(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	if err := waitForRedis(rdb, time.Second); err != nil {
+		t.Fatalf("waitForRedis: %v", err)
+	}
+
+	// Still loading at first, then ready
+	fr.setFailure("LOADING Redis is loading the dataset in memory")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		fr.setFailure("")
+	}()
+	start := time.Now()
+	if err := waitForRedis(rdb, 10*time.Second); err != nil {
+		t.Fatalf("waitForRedis while loading: %v", err)
+	}
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Fatalf("ready after %v, before Redis was", took)
+	}
+}
+
+func TestWaitForRedisTimeout(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	fr.setFailure("LOADING Redis is loading the dataset in memory")
+
+	start := time.Now()
+	err := waitForRedis(fr.client(0), time.Second)
+	if err == nil || !strings.Contains(err.Error(), "redis not ready after 1s") || !strings.Contains(err.Error(), "LOADING") {
+		t.Fatalf("waitForRedis = %v, want a timeout with the last error", err)
+	}
+	// No retry is started that would end past the timeout
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("gave up after %v, past the 1s timeout", took)
+	}
+}
+
+func TestCheckWrite(t *testing.T) {
+	logs := captureLog(t)
+	before := metricRedisWriteErrors.value.Load()
+
+	if !checkWrite(nil, "write pilot %q", "alice") {
+		t.Fatal("checkWrite(nil) reported a failure")
+	}
+	if metricRedisWriteErrors.value.Load() != before || logs.String() != "" {
+		t.Fatal("a successful write was counted or logged")
+	}
+
+	if checkWrite(errors.New("READONLY You can't write against a read only replica."), "write pilot %q", "alice") {
+		t.Fatal("checkWrite(err) reported success")
+	}
+	if got := metricRedisWriteErrors.value.Load() - before; got != 1 {
+		t.Fatalf("counted %d write errors, want 1", got)
+	}
+	if !strings.Contains(logs.String(), `redis write failed (write pilot "alice"): READONLY`) {
+		t.Fatalf("log lacks the failed write:\n%s", logs)
+	}
+}
+
+func TestFailedRequestWriteIsCounted(t *testing.T) {
+	useConfig(t, nil)
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	before := metricRedisWriteErrors.value.Load()
+
+	fr.setFailure("READONLY You can't write against a read only replica.")
+	HandlePilotRequest(context.Background(), fr.client(0), newTestSessions(cloud.URL), map[string]string{"pilot_username": "alice"})
+	if got := metricRedisWriteErrors.value.Load() - before; got != 1 {
+		t.Fatalf("counted %d write errors, want 1:\n%s", got, logs)
+	}
+	if !strings.Contains(logs.String(), `redis write failed (write pilot "alice")`) {
+		t.Fatalf("log lacks the failed write:\n%s", logs)
+	}
+}
+
+func TestManualPilotsPreserved(t *testing.T) {
+	for _, preserve := range []bool{true, false} {
+		t.Run(fmt.Sprint("preserve=", preserve), func(t *testing.T) {
+			useConfig(t, map[string]string{"PRESERVE_MANUAL_PILOTS": fmt.Sprint(preserve)})
+			fr := newFakeRedis(t)
+			rdb := fr.client(0)
+			ctx := context.Background()
+			rdb.HSet(ctx, pilotKey("mike"), "pilot_username", "mike", "manual", "true")
+			rdb.HSet(ctx, pilotKey("nora"), "pilot_username", "nora", "manual", "false")
+			rdb.HSet(ctx, pilotKey("oscar"), "pilot_username", "oscar")
+
+			if got := isManualPilot(ctx, rdb, "mike"); got != preserve {
+				t.Errorf("isManualPilot(mike) = %v", got)
+			}
+			for _, username := range []string{"nora", "oscar", "nobody"} {
+				if isManualPilot(ctx, rdb, username) {
+					t.Errorf("isManualPilot(%s) = true", username)
+				}
+			}
+
+			alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK}
+			if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, cachedPilotHashes(ctx, rdb)); err != nil {
+				t.Fatalf("runSyncCycle: %v", err)
+			}
+			if fr.exists(0, pilotKey("mike")) != preserve {
+				t.Errorf("manual pilot kept: %v, want %v", fr.exists(0, pilotKey("mike")), preserve)
+			}
+			if fr.exists(0, pilotKey("nora")) || fr.exists(0, pilotKey("oscar")) {
+				t.Error("pilots not marked manual were kept")
+			}
+		})
+	}
+}
+
+func TestManualPilotCheckFailureKeepsPilot(t *testing.T) {
+	useConfig(t, map[string]string{"PRESERVE_MANUAL_PILOTS": "true"})
+	captureLog(t)
+	fr := newFakeRedis(t)
+	fr.setFailure("LOADING Redis is loading the dataset in memory")
+	if !isManualPilot(context.Background(), fr.client(0), "nora") {
+		t.Fatal("a pilot whose manual flag couldn't be read isn't kept")
+	}
+}
+
+func TestKeyspaceSelfTest(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(2)
+
+	if err := keyspaceSelfTest(rdb, time.Second); err != nil {
+		t.Fatalf("keyspaceSelfTest: %v", err)
+	}
+	if fr.exists(2, keyspaceSelfTestKey) {
+		t.Error("the scratch key was left behind")
+	}
+
+	fr.setNotify(false)
+	start := time.Now()
+	err := keyspaceSelfTest(rdb, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), `notify-keyspace-events set to at least "Kh"`) {
+		t.Fatalf("keyspaceSelfTest without notifications = %v, want the notify-keyspace-events hint", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("self-test took %v, want it to give up after its timeout", elapsed)
+	}
+	if fr.exists(2, keyspaceSelfTestKey) {
+		t.Error("the scratch key was left behind after a failure")
+	}
+}
+
+func TestKeyspaceSelfTestRedisDown(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	fr.setFailure("ERR busy")
+
+	if err := keyspaceSelfTest(rdb, 100*time.Millisecond); err == nil {
+		t.Fatal("keyspaceSelfTest passed with Redis failing")
+	}
+}
+
+func TestWritePilotPartsRetriesConflicts(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	pilot := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Embedding: []float64{1, 2}, Status: PilotStatusOK}
+	execs := func() int {
+		return len(slices.DeleteFunc(fr.commands(), func(name string) bool { return name != "EXEC" }))
+	}
+
+	// Another writer gets in twice; the third attempt goes through
+	fr.setConflicts(2)
+	if err := writePilotParts(ctx, rdb, pilot, true, true); err != nil {
+		t.Fatalf("writePilotParts: %v", err)
+	}
+	if n := execs(); n != 3 {
+		t.Errorf("ran %d transactions, want 3", n)
+	}
+	if fr.hash(0, pilotKey("alice"))["personal_data"] != string(pilot.PersonalData) || !fr.exists(0, embeddingKey("alice")) {
+		t.Fatal("pilot wasn't written after the conflicts")
+	}
+
+	// Three conflicts in a row give up rather than spin
+	fr.setConflicts(3)
+	pilot.PersonalData = `{"name":"Alice B"}`
+	err := writePilotParts(ctx, rdb, pilot, true, false)
+	if !errors.Is(err, redis.TxFailedErr) {
+		t.Fatalf("writePilotParts = %v, want %v", err, redis.TxFailedErr)
+	}
+	if n := execs(); n != 6 {
+		t.Errorf("ran %d transactions, want 3 more", n-3)
+	}
+	if got := fr.hash(0, pilotKey("alice"))["personal_data"]; got != `{"name":"Alice"}` {
+		t.Errorf("personal_data = %q, want the failed write to leave it alone", got)
+	}
+}
+
+func TestRedisAuthProblem(t *testing.T) {
+	for msg, want := range map[string]int{
+		// Redis 6+
+		"ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?": redisAuthNotRequired,
+		"NOAUTH Authentication required.":                               redisAuthRequired,
+		"WRONGPASS invalid username-password pair or user is disabled.": redisAuthRejected,
+		// Redis 5 and older
+		"ERR Client sent AUTH, but no password is set":         redisAuthNotRequired,
+		"ERR invalid password":                                 redisAuthRejected,
+		"LOADING Redis is loading the dataset in memory":       redisAuthOK,
+		"dial tcp 127.0.0.1:6379: connect: connection refused": redisAuthOK,
+	} {
+		if got := redisAuthProblem(errors.New(msg)); got != want {
+			t.Errorf("redisAuthProblem(%q) = %d, want %d", msg, got, want)
+		}
+	}
+}
+
+func TestWaitForRedisAuth(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		requirepass string
+		env         map[string]string
+		// Part of the expected error, "" for success
+		err string
+	}{
+		{"password missing", "hunter2", nil, "requires a password but none is configured; set REDIS_PASSWORD"},
+		{"password wrong", "hunter2", map[string]string{"REDIS_PASSWORD": "hunter3"}, "rejected the configured credentials; check REDIS_PASSWORD"},
+		{"password right", "hunter2", map[string]string{"REDIS_PASSWORD": "hunter2"}, ""},
+		{"password not required", "", map[string]string{"REDIS_PASSWORD": "hunter2"}, "doesn't require one (no requirepass); unset REDIS_PASSWORD"},
+		{"password optional", "", map[string]string{"REDIS_PASSWORD": "hunter2", "REDIS_PASSWORD_OPTIONAL": "true"}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.env)
+			logs := captureLog(t)
+			fr := newFakeRedis(t)
+			fr.password = tt.requirepass
+			options := fr.options(0)
+			options.Password = cfg.RedisPassword
+			rdb := redis.NewClient(options)
+			defer rdb.Close()
+
+			start := time.Now()
+			err := waitForRedis(rdb, 10*time.Second)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("waitForRedis: %v", err)
+				}
+				if tt.requirepass == "" && !strings.Contains(logs.String(), "doesn't require a password, connecting without the configured one") {
+					t.Errorf("connecting without the password wasn't logged:\n%s", logs)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("waitForRedis = %v, want %q", err, tt.err)
+			}
+			// A mismatch won't fix itself, so it isn't retried
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("gave up after %v, want right away", took)
+			}
+		})
+	}
+}
+
+func TestInActiveFlight(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	const flight_id = "1700000000000000000"
+	for _, tt := range []struct {
+		username string
+		fields   []any
+		want     bool
+	}{
+		{"flying", []any{"authenticated", "true", "flight_id", flight_id}, true},
+		{"landed", []any{"authenticated", "true"}, false},
+		{"deauthenticated", []any{"authenticated", "false", "flight_id", flight_id}, false},
+		{"never_authenticated", []any{"flight_id", flight_id}, false},
+		{"garbled", []any{"authenticated", "maybe", "flight_id", flight_id}, false},
+		{"uncached", nil, false},
+	} {
+		if tt.fields != nil {
+			rdb.HSet(ctx, pilotKey(tt.username), tt.fields...)
+		}
+		if got := inActiveFlight(ctx, rdb, tt.username); got != tt.want {
+			t.Errorf("inActiveFlight(%s) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+
+	// Keeping a pilot by mistake is cheaper than deleting one
+	fr.setFailure("ERR busy")
+	if !inActiveFlight(ctx, rdb, "landed") {
+		t.Error("a failed check took the pilot for out of a flight")
+	}
+}
+
+func TestPilotInActiveFlightNotDeleted(t *testing.T) {
+	useConfig(t, nil)
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK, Embedding: []float64{1, 2}}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	const flight_id = "1700000000000000000"
+	rdb.HSet(ctx, pilotKey("alice"), "authenticated", "true", "flight_id", flight_id)
+
+	// Dropped from the cloud mid-flight
+	result, err := runSyncCycle(ctx, rdb, PilotList{Complete: true}, pilot_hashes)
+	if err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if result.Deleted != 0 || !fr.exists(0, pilotKey("alice")) || !fr.exists(0, embeddingKey("alice")) {
+		t.Fatalf("result %v: alice's keys went while she was in a flight", result)
+	}
+	if _, ok := pilot_hashes["alice"]; !ok {
+		t.Fatal("alice was dropped from the pilot hashes, so her deletion won't be retried")
+	}
+	if !strings.Contains(logs.String(), `Pilot "alice" is gone from the cloud but in an active flight, keeping them until it ends`) {
+		t.Errorf("keeping alice wasn't logged:\n%s", logs)
+	}
+
+	// Once the flight is finalized, the deletion goes through
+	clearFlight(ctx, rdb, "alice", flight_id)
+	result, err = runSyncCycle(ctx, rdb, PilotList{Complete: true}, pilot_hashes)
+	if err != nil {
+		t.Fatalf("third cycle: %v", err)
+	}
+	if result.Deleted != 1 || fr.exists(0, pilotKey("alice")) {
+		t.Fatalf("result %v: alice wasn't deleted after her flight ended", result)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With PILOT_ID_FIELD, a username that disappears from the cloud in the same cycle a new
+// username with the same pilot ID appears is taken for a rename. The state that doesn't come
+// from the cloud (the open flight, authentication, match quality) is carried over to the new
+// username and the old keys removed, instead of the old pilot being purged and the new one
+// starting from scratch. Stored pilot IDs are read from the pilot hashes, so renames are only
+// detected with the keys output on.
+
+// pilotStateFields are set on the pilot hash by requests rather than sync, so a rename carries them
+var pilotStateFields = []string{"flight_id", "authenticated", "match_cosine", "match_l2"}
+
+// renameTargets maps pilot IDs to the canonical usernames that are new this cycle. IDs claimed by
+// more than one new username are left out, as there's no telling which one is the rename.
+func renameTargets(new_pilots map[string]PilotInfo, pilot_hashes map[string]pilotHash) map[string]string {
+	if cfg.PilotIDField == "" {
+		return nil
+	}
+
+	targets := map[string]string{}
+	ambiguous := map[string]bool{}
+	for pilot_name, pilot := range new_pilots {
+		if _, existed := pilot_hashes[pilot_name]; existed || pilot.PilotID == "" {
+			continue
+		}
+		if _, ok := targets[pilot.PilotID]; ok {
+			ambiguous[pilot.PilotID] = true
+		}
+		targets[pilot.PilotID] = pilot_name
+	}
+	for pilot_id := range ambiguous {
+		delete(targets, pilot_id)
+	}
+	return targets
+}
+
+// renamedTo looks up the new username of a pilot that's gone from the cloud, if they were renamed
+func renamedTo(ctx context.Context, rdb *redis.Client, pilot_name string, targets map[string]string) (string, bool) {
+	if len(targets) == 0 {
+		return "", false
+	}
+	pilot_id, err := rdb.HGet(ctx, pilotKey(pilot_name), "pilot_id").Result()
+	if err != nil {
+		if err != redis.Nil {
+			logf(ctx, "failed to read pilot ID of %q: %v", pilot_name, err)
+		}
+		return "", false
+	}
+	new_name, ok := targets[pilot_id]
+	return new_name, ok
+}
+
+// migratePilot moves a renamed pilot's state to their new username and drops the old keys, in one
+// transaction. The new username's hash, embedding and document are written by sync as usual.
+func migratePilot(ctx context.Context, rdb *redis.Client, old_name, new_name string) error {
+	values, err := rdb.HMGet(ctx, pilotKey(old_name), pilotStateFields...).Result()
+	if err != nil {
+		return err
+	}
+	state := map[string]any{}
+	for i, value := range values {
+		if value, ok := value.(string); ok && value != "" {
+			state[pilotStateFields[i]] = value
+		}
+	}
+
+	pipelined := rdb.TxPipelined
+	if cfg.KeyScheme == "cluster" {
+		// The two usernames' keys are in different slots, which MULTI can't span
+		pipelined = rdb.Pipelined
+	}
+	_, err = pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(state) != 0 {
+			pipe.HSet(ctx, pilotKey(new_name), state)
+		}
+		pipe.Del(ctx, pilotKey(old_name), embeddingKey(old_name), pilotJSONKey(old_name))
+		addTombstone(ctx, pipe, old_name)
+		return nil
+	})
+	return err
+}
+
+// streamPilotRename tells stream consumers the old username is gone; the new one follows as a change
+func streamPilotRename(ctx context.Context, rdb *redis.Client, old_name, new_name string) error {
+	return rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: pilotStreamKey,
+		MaxLen: int64(cfg.PilotStreamMaxLen),
+		Approx: true,
+		Values: map[string]any{"event": "renamed", "username": new_name, "from": old_name},
+	}).Err()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRenameTargets(t *testing.T) {
+	new_pilots := map[string]PilotInfo{
+		"alicia": {Username: "alicia", PilotID: "P-1"},
+		// Stored already, so not new
+		"bob": {Username: "bob", PilotID: "P-2"},
+		// Claimed twice
+		"carl":   {Username: "carl", PilotID: "P-3"},
+		"carlos": {Username: "carlos", PilotID: "P-3"},
+		"dave":   {Username: "dave"},
+	}
+	pilot_hashes := map[string]pilotHash{"bob": {}}
+
+	useConfig(t, map[string]string{"PILOT_ID_FIELD": ""})
+	if targets := renameTargets(new_pilots, pilot_hashes); targets != nil {
+		t.Errorf("renameTargets without PILOT_ID_FIELD = %v, want none", targets)
+	}
+
+	useConfig(t, map[string]string{"PILOT_ID_FIELD": "id"})
+	if targets := renameTargets(new_pilots, pilot_hashes); !maps.Equal(targets, map[string]string{"P-1": "alicia"}) {
+		t.Errorf("renameTargets = %v, want only P-1 to alicia", targets)
+	}
+}
+
+func TestPilotRename(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_ID_FIELD": "id", "PILOT_OUTPUTS": "keys,json,stream", "TOMBSTONE_TTL": "24h"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PilotID: "P-1", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK, Embedding: []float64{1, 2}}
+	pilot_hashes := map[string]pilotHash{}
+	start := time.Now()
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	const flight_id = "1700000000000000000"
+	rdb.HSet(ctx, pilotKey("alice"), "flight_id", flight_id, "authenticated", "true", "match_cosine", "0.9")
+
+	alicia := alice
+	alicia.Username = "alicia"
+	alicia.PersonalData = `{"name":"Alicia"}`
+	result, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alicia}, Complete: true}, pilot_hashes)
+	if err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+
+	fields := fr.hash(0, pilotKey("alicia"))
+	for field, want := range map[string]string{"flight_id": flight_id, "authenticated": "true", "match_cosine": "0.9", "personal_data": `{"name":"Alicia"}`, "pilot_id": "P-1"} {
+		if fields[field] != want {
+			t.Errorf("alicia's %s = %q, want %q", field, fields[field], want)
+		}
+	}
+	if _, ok := fields["match_l2"]; ok {
+		t.Error("an unset state field was carried over")
+	}
+	for _, key := range []string{pilotKey("alice"), embeddingKey("alice"), pilotJSONKey("alice")} {
+		if fr.exists(0, key) {
+			t.Errorf("%s survived the rename", key)
+		}
+	}
+	if !fr.exists(0, embeddingKey("alicia")) || !fr.exists(0, pilotJSONKey("alicia")) {
+		t.Error("alicia's embedding and document weren't written")
+	}
+	if _, ok := fr.zset(0, deletedPilotsKey)["alice"]; !ok {
+		t.Error("alice wasn't tombstoned")
+	}
+	if _, ok := pilot_hashes["alice"]; ok || len(pilot_hashes) != 1 {
+		t.Errorf("pilot hashes = %v, want only alicia", pilot_hashes)
+	}
+	if result.Deleted != 0 || result.Changed != 1 {
+		t.Errorf("result = %v, want the rename counted as a change", result)
+	}
+
+	changes, err := PilotChangesSince(ctx, rdb, start.Add(-time.Millisecond))
+	if err != nil {
+		t.Fatalf("PilotChangesSince: %v", err)
+	}
+	// Changes in the same millisecond come back in no particular order
+	if !slices.ContainsFunc(changes, func(change PilotChange) bool {
+		return change.Event == "renamed" && change.Username == "alicia" && change.From == "alice"
+	}) {
+		t.Errorf("changes = %+v, want alice renamed to alicia among them", changes)
+	}
+	entries := fr.stream(0, pilotStreamKey)
+	if len(entries) != 3 || entries[1]["event"] != "renamed" || entries[1]["from"] != "alice" || entries[2]["event"] != "changed" || entries[2]["username"] != "alicia" {
+		t.Errorf("streamed %v, want the rename followed by alicia as a change", entries)
+	}
+}
+
+func TestAmbiguousRenameDeletes(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_ID_FIELD": "id"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PilotID: "P-1", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	rdb.HSet(ctx, pilotKey("alice"), "authenticated", "true")
+
+	first, second := alice, alice
+	first.Username, second.Username = "alicia", "ali"
+	result, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{first, second}, Complete: true}, pilot_hashes)
+	if err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if result.Deleted != 1 || result.Added != 2 {
+		t.Errorf("result = %v, want alice deleted and both new pilots added", result)
+	}
+	for _, username := range []string{"alicia", "ali"} {
+		if got := fr.hash(0, pilotKey(username))["authenticated"]; got != "" {
+			t.Errorf("%s inherited authenticated = %q", username, got)
+		}
+	}
+}
+
+func TestPilotRenameNumericID(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_ID_FIELD": "id"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	cloud := newFakeCloud(t)
+	// Both above 2^53 and a float64 apart, so they'd round to the same ID
+	cloud.addPilot("alice", "id: 12345678901234567\n", nil)
+	cloud.addPilot("bob", "id: 12345678901234568\n", nil)
+	api_client := cloud.connect()
+	fetch := func(username string) PilotInfo {
+		t.Helper()
+		pilot, err := GetPilotFromServer(ctx, api_client, username)
+		if err != nil {
+			t.Fatalf("GetPilotFromServer(%s): %v", username, err)
+		}
+		return *pilot
+	}
+
+	alice := fetch("alice")
+	if alice.PilotID != "12345678901234567" {
+		t.Fatalf("pilot_id = %q, want the ID digit for digit", alice.PilotID)
+	}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	rdb.HSet(ctx, pilotKey("alice"), "authenticated", "true")
+
+	// alice is renamed to alicia as bob turns up
+	cloud.setPilots("alicia", "bob")
+	cloud.setFile(homeFile("alicia", "user.profile"), "id: 12345678901234567\n")
+	alicia := fetch("alicia")
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alicia, fetch("bob")}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if got := fr.hash(0, pilotKey("alicia"))["authenticated"]; got != "true" {
+		t.Errorf("alicia's authenticated = %q, want alice's state carried over", got)
+	}
+	if got := fr.hash(0, pilotKey("bob"))["authenticated"]; got != "" {
+		t.Errorf("bob inherited authenticated = %q", got)
+	}
+}
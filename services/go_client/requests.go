@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RequestHandler reacts to pilot_id_request, pilot_deauth_request and pilot_fetch_request writes
+// until the subscription closes. Requests are captured as they arrive and handled in the background (see requestQueue).
+func RequestHandler(rdb *redis.Client, sessions *SessionManager) {
+	db := rdb.Options().DB
+	sub := rdb.PSubscribe(context.Background(), keyspaceChannel(db, pilotIDRequestKey), keyspaceChannel(db, pilotDeauthRequestKey), keyspaceChannel(db, pilotFetchRequestKey))
+
+	if cfg.KeyspaceSelfTest {
+		if err := keyspaceSelfTest(rdb, 5*time.Second); err != nil {
+			log.Println("ERROR: keyspace self-test failed, pilot requests will NOT be received: ", err)
+		} else {
+			log.Println("Keyspace self-test passed")
+		}
+	}
+
+	queue := newRequestQueue()
+	go handleRequests(rdb, sessions, queue)
+
+	log.Println("Awaiting incoming messages...")
+	for msg := range sub.Channel() {
+		if msg.Payload != "hset" {
+			continue
+		}
+		if cfg.MaintenancePausesRequests && inMaintenance(context.Background(), rdb) {
+			log.Printf("Maintenance mode, ignoring %s", msg.Channel)
+			continue
+		}
+
+		var kind string
+		switch msg.Channel {
+		case keyspaceChannel(db, pilotIDRequestKey):
+			kind = pilotIDRequestKey
+		case keyspaceChannel(db, pilotDeauthRequestKey):
+			kind = pilotDeauthRequestKey
+		case keyspaceChannel(db, pilotFetchRequestKey):
+			kind = pilotFetchRequestKey
+		default:
+			continue
+		}
+
+		fields, err := rdb.HGetAll(context.Background(), kind).Result()
+		if err != nil {
+			log.Printf("failed to get %s from redis: %v", kind, err)
+			continue
+		}
+		if _, ok := fields["pilot_username"]; !ok {
+			continue
+		}
+		queue.push(pendingRequest{kind: kind, fields: fields})
+	}
+}
+
+func handleRequests(rdb *redis.Client, sessions *SessionManager, queue *requestQueue) {
+	for range queue.ready {
+		for {
+			request, ok := queue.pop()
+			if !ok {
+				break
+			}
+
+			switch request.kind {
+			case pilotIDRequestKey:
+				ctx, done := queue.begin(request)
+				HandlePilotRequest(ctx, rdb, sessions, request.fields)
+				done()
+			case pilotDeauthRequestKey:
+				HandleDeauthRequest(rdb, sessions, request.fields["pilot_username"])
+			case pilotFetchRequestKey:
+				HandleFetchRequest(rdb, sessions, request.fields["pilot_username"])
+			}
+		}
+	}
+}
+
+// HandlePilotRequest authenticates a pilot, unless ctx is cancelled before the pilot is written
+// (see SUPERSEDE_PILOT_REQUESTS)
+func HandlePilotRequest(ctx context.Context, rdb *redis.Client, sessions *SessionManager, keys map[string]string) {
+	ctx = withFlightRotation(withTrace(ctx, "req"))
+	username := keys["pilot_username"]
+	if !validUsername(username) {
+		logf(ctx, "ignoring pilot request with invalid username %q", username)
+		return
+	}
+
+	// scope=embedding only refreshes the embedding (e.g. after re-enrollment), leaving the
+	// profile, flight and authentication state alone
+	if keys["scope"] == "embedding" {
+		logf(ctx, "Received embedding refresh for %q", username)
+		refreshEmbedding(ctx, rdb, sessions, username)
+		return
+	}
+
+	confidence, ok := keys["confidence"]
+	if ok {
+		logf(ctx, "Received pilot request for %q (confidence: %s)", username, confidence)
+	} else {
+		logf(ctx, "Received pilot request for %q (no confidence set)", username)
+	}
+
+	start := time.Now()
+	warm := sessions.connected()
+	written := false
+	ttl := authTTL(confidence)
+	auth_ctx := withAuthTTL(ctx, ttl)
+	var embedding []float64
+	if api_client, gen, err := sessions.Client(); err != nil {
+		// Don't keep the pilot waiting on the cloud: authenticate against what's cached
+		logf(ctx, "failed to connect to server, using cached pilot: %v", err)
+		written = checkWrite(updatePilot(auth_ctx, rdb, username, []any{"authenticated", AuthFlag(true)}), "authenticate %q", username)
+	} else if pilot, err := GetPilotFromServer(ctx, api_client, username); err != nil {
+		if transportFailed(ctx, err) {
+			sessions.Invalidate(gen)
+		}
+		if ctx.Err() != nil {
+			logf(ctx, "Not authenticating %q: %v", username, context.Cause(ctx))
+			return
+		}
+		logf(ctx, "failed to get pilot from server: %v", err)
+		fields := []any{"authenticated", AuthFlag(true)}
+		if !errors.Is(err, ErrTransport) {
+			// Keep the pilot attributed to the current flight even when their profile couldn't be fetched
+			if flight_id, err := CurrentFlight(ctx, api_client); err != nil {
+				logf(ctx, "failed to determine current flight: %v", err)
+			} else {
+				fields = append(fields, "flight_id", flight_id)
+			}
+		}
+		written = checkWrite(updatePilot(auth_ctx, rdb, username, fields), "authenticate %q", username)
+	} else {
+		pilots := []PilotInfo{*pilot}
+		if err := revalidateFlights(ctx, api_client, pilots); err != nil {
+			logf(ctx, "warning: failed to recheck flight: %v", err)
+		}
+		if ctx.Err() != nil {
+			logf(ctx, "Not authenticating %q: %v", username, context.Cause(ctx))
+			return
+		}
+		pilots[0].Authenticated = true
+		written = checkWrite(writePilot(auth_ctx, rdb, pilots[0]), "write pilot %q", username)
+		embedding = pilot.Embedding
+	}
+	// Once the pilot is written, cancelling can't undo it
+	ctx = context.WithoutCancel(ctx)
+
+	if written {
+		recordMatchQuality(ctx, rdb, username, keys["live_embedding"], embedding)
+		if ttl > 0 {
+			debugCtxf(ctx, "Authentication of %q expires in %v", username, ttl)
+		}
+	}
+	logf(ctx, "Handled pilot request for %q in %v", username, time.Since(start))
+	recordFirstRequest(ctx, warm, time.Since(start))
+}
+
+func refreshEmbedding(ctx context.Context, rdb *redis.Client, sessions *SessionManager, username string) {
+	api_client, gen, err := sessions.Client()
+	if err != nil {
+		logf(ctx, "failed to connect to server: %v", err)
+		return
+	}
+
+	if err := acquireFetchSlot(ctx); err != nil {
+		logf(ctx, "waiting to fetch embedding: %v", err)
+		return
+	}
+	embedding, err := fetchEmbedding(ctx, api_client, username)
+	releaseFetchSlot()
+	if errors.Is(err, ErrEmbeddingNonFinite) {
+		logf(ctx, "warning: storing the embedding of %q zeroed where it isn't finite: %v", username, err)
+	} else if err != nil {
+		logf(ctx, "failed to get embedding from server: %v", err)
+		if transportFailed(ctx, err) {
+			sessions.Invalidate(gen)
+		}
+		return
+	}
+
+	if embedding == nil {
+		checkWrite(rdb.Del(ctx, embeddingKey(username)).Err(), "remove embedding for %q", username)
+	} else {
+		data, err := encodeStoredEmbedding(embedding)
+		if err != nil {
+			logf(ctx, "failed to marshal embedding: %v", err)
+			return
+		}
+		if !checkWrite(rdb.Set(ctx, embeddingKey(username), data, 0).Err(), "write embedding for %q", username) {
+			return
+		}
+	}
+
+	// Don't create a partial pilot hash for a pilot the syncer hasn't stored yet
+	if exists, err := rdb.Exists(ctx, pilotKey(username)).Result(); err == nil && exists != 0 {
+		checkWrite(rdb.HSet(ctx, pilotKey(username), "primary_embedding", primaryEmbeddingKey(username, "", embedding)).Err(), "update primary embedding of %q", username)
+	}
+	logf(ctx, "Refreshed embedding for %q (%d values)", username, len(embedding))
+}
+
+// transportFailed reports whether err means the session has to be invalidated. A superseded
+// request abandons its command on purpose, which says nothing about the socket, so it doesn't.
+func transportFailed(ctx context.Context, err error) bool {
+	return errors.Is(err, ErrTransport) && !errors.Is(context.Cause(ctx), ErrRequestSuperseded)
+}
+
+// authTTL maps a match confidence to how long the authenticated flag should live: borderline
+// (or missing) confidences get AUTH_TTL_LOW, those at or above AUTH_CONFIDENCE_HIGH get
+// AUTH_TTL_HIGH. A zero TTL means the flag doesn't expire.
+func authTTL(confidence string) time.Duration {
+	var value float64
+	if _, err := fmt.Sscan(confidence, &value); err != nil {
+		return cfg.AuthTTLLow
+	}
+
+	if value >= cfg.AuthConfidenceHigh {
+		return cfg.AuthTTLHigh
+	}
+	return cfg.AuthTTLLow
+}
+
+type authTTLKey struct{}
+
+// withAuthTTL has writes made with the returned context that authenticate a pilot expire the flag
+// after ttl (HPEXPIRE, Redis 7.4+), forcing re-recognition while the profile stays cached. The
+// signature goes with it, since it vouches for the flag. Both are set in the same transaction as
+// the flag, so a flag is never left without its TTL.
+func withAuthTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, authTTLKey{}, ttl)
+}
+
+func authTTLOf(ctx context.Context) time.Duration {
+	ttl, _ := ctx.Value(authTTLKey{}).(time.Duration)
+	return ttl
+}
+
+// HandleDeauthRequest ends the session of the pilot named in the deauth request:
+// the pilot is marked unauthenticated and their open flight is finalized
+func HandleDeauthRequest(rdb *redis.Client, sessions *SessionManager, username string) {
+	ctx := withTrace(context.Background(), "deauth")
+	if !validUsername(username) {
+		logf(ctx, "ignoring deauth request with invalid username %q", username)
+		return
+	}
+
+	logf(ctx, "Received deauth request for %q", username)
+	if !checkWrite(updatePilot(ctx, rdb, username, []any{"authenticated", AuthFlag(false)}), "deauthenticate %q", username) {
+		return
+	}
+
+	flight_id, err := rdb.HGet(ctx, pilotKey(username), "flight_id").Result()
+	if err != nil && err != redis.Nil {
+		logf(ctx, "failed to get flight for %q: %v", username, err)
+	}
+
+	if flight_id != "" {
+		if api_client, gen, err := sessions.Client(); err != nil {
+			logf(ctx, "failed to connect to finalize flight %s: %v", flight_id, err)
+		} else if err := AppendFlightEvent(ctx, api_client, flight_id, FlightEvent{Type: "deauth", Payload: map[string]any{"pilot_username": username}}); errors.Is(err, ErrTransport) {
+			// The client may still be streaming the failed command, so the flight stays open
+			// (and on the pilot) rather than being finalized through it
+			logf(ctx, "failed to record deauth in flight %s, leaving it open: %v", flight_id, err)
+			if transportFailed(ctx, err) {
+				sessions.Invalidate(gen)
+			}
+		} else {
+			if err != nil {
+				logf(ctx, "failed to record deauth in flight %s: %v", flight_id, err)
+			}
+			if err := FinalizeFlight(ctx, api_client, flight_id, time.Now()); err != nil {
+				if transportFailed(ctx, err) {
+					sessions.Invalidate(gen)
+				}
+				logf(ctx, "failed to finalize flight %s: %v", flight_id, err)
+			} else {
+				logf(ctx, "Finalized flight %s for %q", flight_id, username)
+				clearFlight(ctx, rdb, username, flight_id)
+			}
+		}
+	}
+
+	if err := publishPilotEvent(ctx, rdb, PilotEvent{Event: "deauth", Username: username, FlightID: flight_id}); err != nil {
+		logf(ctx, "failed to publish deauth event: %v", err)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestPilotRequestSupersededByAnotherPilot(t *testing.T) {
+	useConfig(t, map[string]string{"SUPERSEDE_PILOT_REQUESTS": "true"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	cloud.addPilot("bob", "name: Bob\n", []float64{3, 4})
+	sessions := newTestSessions(cloud.URL)
+
+	// Alice's profile is held back until Bob's request has arrived
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command != "cat "+homeFile("alice", "user.profile") {
+			return "", "", 0, false
+		}
+		close(started)
+		<-release
+		return "", "", 0, false
+	})
+	if _, _, err := sessions.Client(); err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	in_use := sessions.api_client
+
+	queue := newRequestQueue()
+	queue.push(pendingRequest{kind: pilotIDRequestKey, fields: map[string]string{"pilot_username": "alice", "timestamp": "100"}})
+	alice, _ := queue.pop()
+	ctx, done := queue.begin(alice)
+	handled := make(chan struct{})
+	go func() {
+		HandlePilotRequest(ctx, rdb, sessions, alice.fields)
+		done()
+		close(handled)
+	}()
+	<-started
+
+	queue.push(pendingRequest{kind: pilotIDRequestKey, fields: map[string]string{"pilot_username": "bob", "timestamp": "101"}})
+	close(release)
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("alice's request didn't stop")
+	}
+	if fr.exists(0, pilotKey("alice")) {
+		t.Fatalf("superseded request still wrote alice: %v", fr.hash(0, pilotKey("alice")))
+	}
+	if sessions.api_client != in_use {
+		t.Fatal("superseded request invalidated the session")
+	}
+	if n := cloud.count("cat " + homeFile("alice", "user.embedding")); n != 0 {
+		t.Fatalf("superseded request kept fetching alice (%d embedding fetches)", n)
+	}
+
+	bob, ok := queue.pop()
+	if !ok || bob.fields["pilot_username"] != "bob" {
+		t.Fatalf("popped %+v, want bob's request", bob)
+	}
+	cloud.setHandler(nil)
+	ctx, done = queue.begin(bob)
+	HandlePilotRequest(ctx, rdb, sessions, bob.fields)
+	done()
+	if got := fr.hash(0, pilotKey("bob"))["authenticated"]; got != "true" {
+		t.Fatalf("bob authenticated = %q, want \"true\"", got)
+	}
+}
+
+func TestStaleRequestDoesNotSupersede(t *testing.T) {
+	useConfig(t, map[string]string{"SUPERSEDE_PILOT_REQUESTS": "true"})
+	request := func(username, timestamp string) pendingRequest {
+		fields := map[string]string{"pilot_username": username}
+		if timestamp != "" {
+			fields["timestamp"] = timestamp
+		}
+		return pendingRequest{kind: pilotIDRequestKey, fields: fields}
+	}
+
+	queue := newRequestQueue()
+	queue.push(request("alice", "200"))
+	alice, _ := queue.pop()
+	ctx, done := queue.begin(alice)
+	defer done()
+
+	// Bob's request was made before Alice's, its notification just arrived late
+	queue.push(request("bob", "199.5"))
+	if ctx.Err() != nil {
+		t.Fatal("an older request cancelled a newer one")
+	}
+	queue.push(request("carol", "200.25"))
+	if context.Cause(ctx) != ErrRequestSuperseded {
+		t.Fatalf("cause = %v, want ErrRequestSuperseded", context.Cause(ctx))
+	}
+	if _, ok := queue.pop(); !ok {
+		t.Fatal("queue empty")
+	}
+	if next, ok := queue.pop(); ok {
+		t.Fatalf("bob's stale request is still pending after carol's: %+v", next)
+	}
+
+	for _, tt := range []struct {
+		r, other pendingRequest
+		want     bool
+	}{
+		{request("bob", "2"), request("alice", "1"), true},
+		{request("bob", "1"), request("alice", "2"), false},
+		{request("bob", "1"), request("alice", "1"), true},
+		{request("bob", ""), request("alice", "2"), true},
+		{request("bob", "1"), request("alice", "not a time"), true},
+		{request("alice", "2"), request("alice", "1"), false},
+	} {
+		if got := tt.r.supersedes(tt.other); got != tt.want {
+			t.Errorf("%v supersedes %v = %v, want %v", tt.r.fields, tt.other.fields, got, tt.want)
+		}
+	}
+}
+
+// subscribeEvents collects the pilot events published from now on
+func subscribeEvents(t *testing.T, rdb *redis.Client) <-chan PilotEvent {
+	t.Helper()
+	sub := rdb.Subscribe(context.Background(), pilotEventsChannel)
+	if _, err := sub.Receive(context.Background()); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	events := make(chan PilotEvent, 16)
+	go func() {
+		for msg := range sub.Channel() {
+			var event PilotEvent
+			json.Unmarshal([]byte(msg.Payload), &event)
+			events <- event
+		}
+	}()
+	return events
+}
+
+func TestDeauthFinalizesFlight(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	const flight_id = "1700000000000000000"
+	cloud.setFile(flightFile(flight_id), "events: []\n")
+	cloud.setFile(flightMarker(flight_id, "open"), "")
+	rdb.HSet(context.Background(), pilotKey("alice"), "pilot_username", "alice", "authenticated", "true", "flight_id", flight_id)
+	events := subscribeEvents(t, rdb)
+
+	HandleDeauthRequest(rdb, newTestSessions(cloud.URL), "alice")
+
+	fields := fr.hash(0, pilotKey("alice"))
+	if fields["authenticated"] != "false" {
+		t.Errorf("authenticated = %q, want \"false\"", fields["authenticated"])
+	}
+	if fields["flight_id"] != "" {
+		t.Errorf("finalized flight %q still on the pilot", fields["flight_id"])
+	}
+	if _, ok := cloud.file(flightMarker(flight_id, "ended")); !ok {
+		t.Error("flight not marked ended")
+	}
+	data, _ := cloud.file(flightFile(flight_id))
+	var file FlightFile
+	if err := yaml.Unmarshal([]byte(data), &file); err != nil {
+		t.Fatalf("flight file: %v\n%s", err, data)
+	}
+	if file.EndTimestamp == 0 || len(file.Events) != 1 || file.Events[0].Type != "deauth" || file.Events[0].Payload["pilot_username"] != "alice" {
+		t.Errorf("flight file after deauth:\n%s", data)
+	}
+
+	select {
+	case event := <-events:
+		if event.Event != "deauth" || event.Username != "alice" || event.FlightID != flight_id {
+			t.Errorf("published %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no deauth event published")
+	}
+}
+
+func TestDeauthLeavesFlightOpenOnTransportFailure(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_COMMAND_OUTPUT": "1024"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	const flight_id = "1700000000000000000"
+	cloud.setFile(flightFile(flight_id), "events: []\n")
+	cloud.setFile(flightMarker(flight_id, "open"), "")
+	rdb.HSet(context.Background(), pilotKey("alice"), "pilot_username", "alice", "authenticated", "true", "flight_id", flight_id)
+	sessions := newTestSessions(cloud.URL)
+	if _, _, err := sessions.Client(); err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	// Reading the flight overruns MAX_COMMAND_OUTPUT, abandoning the command
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command == "cat "+flightFile(flight_id) {
+			return strings.Repeat("#", 4096), "", 0, true
+		}
+		return "", "", 0, false
+	})
+
+	HandleDeauthRequest(rdb, sessions, "alice")
+
+	fields := fr.hash(0, pilotKey("alice"))
+	if fields["authenticated"] != "false" {
+		t.Errorf("authenticated = %q, want \"false\"", fields["authenticated"])
+	}
+	if fields["flight_id"] != flight_id {
+		t.Errorf("flight_id = %q, want the still open %s", fields["flight_id"], flight_id)
+	}
+	if _, ok := cloud.file(flightMarker(flight_id, "ended")); ok {
+		t.Error("flight finalized through a failed client")
+	}
+	if sessions.connected() {
+		t.Error("session kept after a transport failure")
+	}
+}
+
+func TestDeauthWithoutFlight(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	rdb.HSet(context.Background(), pilotKey("alice"), "pilot_username", "alice", "authenticated", "true")
+
+	HandleDeauthRequest(rdb, newTestSessions(cloud.URL), "alice")
+
+	if got := fr.hash(0, pilotKey("alice"))["authenticated"]; got != "false" {
+		t.Errorf("authenticated = %q, want \"false\"", got)
+	}
+	if len(cloud.ran()) != 0 {
+		t.Errorf("ran %v for a pilot without a flight", cloud.ran())
+	}
+}
+
+func TestAuthTTL(t *testing.T) {
+	useConfig(t, map[string]string{"AUTH_TTL_LOW": "1m", "AUTH_TTL_HIGH": "1h", "AUTH_CONFIDENCE_HIGH": "0.9"})
+	for _, tt := range []struct {
+		confidence string
+		want       time.Duration
+	}{
+		{"0.95", time.Hour},
+		{"0.9", time.Hour},
+		{"1", time.Hour},
+		{"0.89", time.Minute},
+		{"0", time.Minute},
+		{"", time.Minute},
+		{"high", time.Minute},
+	} {
+		if got := authTTL(tt.confidence); got != tt.want {
+			t.Errorf("authTTL(%q) = %v, want %v", tt.confidence, got, tt.want)
+		}
+	}
+}
+
+func TestLowConfidenceAuthenticationExpires(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		env        map[string]string
+		confidence string
+		want       time.Duration
+	}{
+		{"low", map[string]string{"AUTH_TTL_LOW": "1m", "AUTH_TTL_HIGH": "1h"}, "0.5", time.Minute},
+		{"high", map[string]string{"AUTH_TTL_LOW": "1m", "AUTH_TTL_HIGH": "1h"}, "0.99", time.Hour},
+		{"missing", map[string]string{"AUTH_TTL_LOW": "1m", "AUTH_TTL_HIGH": "1h"}, "", time.Minute},
+		{"high without TTL", map[string]string{"AUTH_TTL_LOW": "1m"}, "0.99", 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.env)
+			fr := newFakeRedis(t)
+			rdb := fr.client(0)
+			cloud := newFakeCloud(t)
+			cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+			request := map[string]string{"pilot_username": "alice"}
+			if tt.confidence != "" {
+				request["confidence"] = tt.confidence
+			}
+
+			HandlePilotRequest(context.Background(), rdb, newTestSessions(cloud.URL), request)
+			if got := fr.fieldTTL(0, pilotKey("alice"), "authenticated").Round(time.Second); got != tt.want {
+				t.Fatalf("authenticated expires in %v, want %v", got, tt.want)
+			}
+			if got := fr.ttl(0, pilotKey("alice")); got != 0 {
+				t.Fatalf("the pilot hash expires in %v", got)
+			}
+			if tt.want == 0 {
+				return
+			}
+
+			// Only the flag goes once it expires, not the cached profile
+			fr.advance(tt.want + time.Second)
+			fields := fr.hash(0, pilotKey("alice"))
+			if _, ok := fields["authenticated"]; ok {
+				t.Fatal("authenticated outlived its TTL")
+			}
+			if fields["pilot_username"] != "alice" || fields["personal_data"] == "" {
+				t.Fatalf("pilot after the flag expired: %v", fields)
+			}
+		})
+	}
+}
+
+func TestAuthenticationTTLWrittenWithTheFlag(t *testing.T) {
+	for _, signing := range []string{"", base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))} {
+		for _, path := range []string{"fetched", "fetch failed", "cloud down"} {
+			t.Run(fmt.Sprintf("%s signed=%v", path, signing != ""), func(t *testing.T) {
+				useConfig(t, map[string]string{"AUTH_TTL_LOW": "1m", "PILOT_SIGNING_KEY": signing})
+				fr := newFakeRedis(t)
+				rdb := fr.client(0)
+				cloud := newFakeCloud(t)
+				cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+				switch path {
+				case "fetch failed":
+					cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+						if strings.HasSuffix(command, "/user.profile") {
+							return "", "cat: permission denied\n", 1, true
+						}
+						return "", "", 0, false
+					})
+				case "cloud down":
+					cloud.setDown(true)
+				}
+
+				HandlePilotRequest(context.Background(), rdb, newTestSessions(cloud.URL), map[string]string{"pilot_username": "alice"})
+				if got := fr.fieldTTL(0, pilotKey("alice"), "authenticated").Round(time.Second); got != time.Minute {
+					t.Fatalf("authenticated expires in %v, want 1m", got)
+				}
+				if signing != "" && fr.fieldTTL(0, pilotKey("alice"), "signature").Round(time.Second) != time.Minute {
+					t.Error("the signature doesn't expire with the flag")
+				}
+				// Queued in the transaction that sets the flag, not after it
+				commands := fr.commands()
+				expire := slices.Index(commands, "HPEXPIRE")
+				multi := -1
+				for i := expire - 1; i >= 0 && multi < 0; i-- {
+					if commands[i] == "MULTI" {
+						multi = i
+					}
+				}
+				if multi < 0 || slices.Contains(commands[multi:expire], "EXEC") || !slices.Contains(commands[multi:expire], "HSET") {
+					t.Errorf("commands %v, want HPEXPIRE in the MULTI that sets the flag", commands)
+				}
+			})
+		}
+	}
+}
+
+func TestAuthenticationWithoutFieldTTLs(t *testing.T) {
+	useConfig(t, map[string]string{"AUTH_TTL_LOW": "1m", "PILOT_SIGNING_KEY": base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))})
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	// Authenticated by an earlier request
+	if err := updatePilot(ctx, rdb, "alice", []any{"pilot_username", "alice", "authenticated", AuthFlag(true)}); err != nil {
+		t.Fatalf("seeding: %v", err)
+	}
+	// Redis before 7.4
+	fr.setUnknown("HEXPIRE", "HPEXPIRE", "HTTL", "HPTTL")
+
+	HandlePilotRequest(ctx, rdb, newTestSessions(cloud.URL), map[string]string{"pilot_username": "alice"})
+	fields := fr.hash(0, pilotKey("alice"))
+	for _, field := range []string{"authenticated", "signature"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("%s kept without a TTL: %v", field, fields)
+		}
+	}
+	if !strings.Contains(logs.String(), "failed to set authentication TTL") {
+		t.Errorf("log doesn't mention the TTL failing:\n%s", logs)
+	}
+	if err := checkFieldTTLs(rdb); err == nil || !strings.Contains(err.Error(), "Redis 7.4+") {
+		t.Errorf("checkFieldTTLs = %v, want field TTLs reported missing", err)
+	}
+
+	fr.setUnknown()
+	if err := checkFieldTTLs(rdb); err != nil {
+		t.Errorf("checkFieldTTLs: %v", err)
+	}
+	if fr.exists(0, fieldTTLCheckKey) {
+		t.Error("checkFieldTTLs left its key behind")
+	}
+}
+
+func TestEmbeddingRefresh(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	sessions := newTestSessions(cloud.URL)
+	ctx := context.Background()
+	const flight_id = "1700000000000000000"
+	rdb.HSet(ctx, pilotKey("alice"), "pilot_username", "alice", "personal_data", `{"name":"Alice"}`, "authenticated", "false", "flight_id", flight_id)
+	refresh := map[string]string{"pilot_username": "alice", "scope": "embedding"}
+	stored := func() []float64 {
+		t.Helper()
+		value, ok := fr.get(0, embeddingKey("alice"))
+		if !ok {
+			return nil
+		}
+		embedding, err := decodeStoredEmbedding(value)
+		if err != nil {
+			t.Fatalf("stored embedding: %v", err)
+		}
+		return embedding
+	}
+
+	// Re-enrolled
+	cloud.setFile(homeFile("alice", "user.embedding"), testEmbedding(3, 4, 5))
+	HandlePilotRequest(ctx, rdb, sessions, refresh)
+	if got := stored(); !slices.Equal(got, []float64{3, 4, 5}) {
+		t.Fatalf("stored embedding = %v, want the refreshed one", got)
+	}
+	fields := fr.hash(0, pilotKey("alice"))
+	if fields["primary_embedding"] != embeddingKey("alice") {
+		t.Errorf("primary_embedding = %q", fields["primary_embedding"])
+	}
+	if fields["personal_data"] != `{"name":"Alice"}` || fields["authenticated"] != "false" || fields["flight_id"] != flight_id {
+		t.Errorf("refresh touched more than the embedding: %v", fields)
+	}
+	if cloud.count("cat "+homeFile("alice", "user.profile")) != 0 || cloud.count("ls") != 0 {
+		t.Errorf("refresh fetched more than the embedding: %v", cloud.ran())
+	}
+
+	// A fetch that fails keeps what's stored
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		return "", "cat: permission denied\n", 1, true
+	})
+	HandlePilotRequest(ctx, rdb, sessions, refresh)
+	if got := stored(); !slices.Equal(got, []float64{3, 4, 5}) {
+		t.Fatalf("stored embedding = %v after a failed refresh", got)
+	}
+	cloud.setHandler(nil)
+
+	// Unenrolled
+	cloud.setFile(homeFile("alice", "user.embedding"), "")
+	HandlePilotRequest(ctx, rdb, sessions, refresh)
+	if fr.exists(0, embeddingKey("alice")) {
+		t.Fatal("embedding kept after the pilot was unenrolled")
+	}
+	if got := fr.hash(0, pilotKey("alice"))["primary_embedding"]; got != "" {
+		t.Fatalf("primary_embedding = %q without an embedding", got)
+	}
+}
+
+func TestEmbeddingRefreshOfUncachedPilot(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("bob", "name: Bob\n", []float64{1, 2})
+
+	HandlePilotRequest(context.Background(), fr.client(0), newTestSessions(cloud.URL), map[string]string{"pilot_username": "bob", "scope": "embedding"})
+	if !fr.exists(0, embeddingKey("bob")) {
+		t.Fatal("embedding not stored")
+	}
+	if fr.exists(0, pilotKey("bob")) {
+		t.Fatal("refresh created a partial pilot hash")
+	}
+}
+
+func TestPilotRequestDropsClientAfterTransportFailure(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_COMMAND_OUTPUT": "1024"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", strings.Repeat("#", 4096), []float64{1, 2})
+	sessions := newTestSessions(cloud.URL)
+	if _, _, err := sessions.Client(); err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+
+	HandlePilotRequest(context.Background(), rdb, sessions, map[string]string{"pilot_username": "alice"})
+	if sessions.connected() {
+		t.Fatal("client kept after its command was abandoned")
+	}
+	// The pilot isn't kept waiting on the cloud
+	if got := fr.hash(0, pilotKey("alice"))["authenticated"]; got != "true" {
+		t.Errorf("authenticated = %q, want \"true\"", got)
+	}
+}
+
+func TestTransportFailed(t *testing.T) {
+	failure := fmt.Errorf("%w: socket closed", ErrTransport)
+	superseded, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrRequestSuperseded)
+	timed_out, cancel_timeout := context.WithTimeout(context.Background(), 0)
+	defer cancel_timeout()
+
+	for _, tt := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"transport", context.Background(), failure, true},
+		{"timed out", timed_out, failure, true},
+		{"superseded", superseded, failure, false},
+		{"command failed", context.Background(), errors.New("cat: permission denied"), false},
+		{"none", context.Background(), nil, false},
+	} {
+		if got := transportFailed(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("%s: transportFailed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
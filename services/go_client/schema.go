@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
+)
+
+// supportedSchemaVersion is the version of the cloud's profile, embedding and flight formats this
+// build understands. The cloud announces its version in schema_version in the API account's home;
+// without that file it's assumed to predate versioning, which is version 1.
+const supportedSchemaVersion = 1
+
+const schemaVersionFile = "schema_version"
+
+var ErrSchemaMismatch = errors.New("unsupported cloud schema version")
+
+// checkSchemaVersion fails with ErrSchemaMismatch when the cloud's data may be in a format this
+// build would misparse
+func checkSchemaVersion(ctx context.Context, api_client client.SocketClient) error {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := runCommand(ctx, api_client, "cat "+schemaVersionFile, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	version := 1
+	if status != 0 {
+		if !strings.Contains(stderr.String(), "file does not exist") {
+			return fmt.Errorf("cat command for schema version failed: %s", stderrSummary(stderr.String()))
+		}
+	} else if version, err = strconv.Atoi(strings.TrimSpace(stdout.String())); err != nil {
+		return fmt.Errorf("%w: unreadable %s %q", ErrSchemaMismatch, schemaVersionFile, stdout.String())
+	}
+
+	if version != supportedSchemaVersion {
+		return fmt.Errorf("%w: cloud has version %d, this build supports %d", ErrSchemaMismatch, version, supportedSchemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSchemaVersion(t *testing.T) {
+	useConfig(t, nil)
+	for _, tt := range []struct {
+		name string
+		// Contents of schema_version, or "" for no file
+		file string
+		// Substring of the error, or "" for none
+		err      string
+		mismatch bool
+	}{
+		{"no file", "", "", false},
+		{"supported", "1\n", "", false},
+		{"newer", "2\n", "cloud has version 2, this build supports 1", true},
+		{"older", "0", "cloud has version 0", true},
+		{"unreadable", "v2\n", `unreadable schema_version "v2\n"`, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := newFakeCloud(t)
+			if tt.file != "" {
+				cloud.setFile(schemaVersionFile, tt.file)
+			}
+			err := checkSchemaVersion(context.Background(), cloud.connect())
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("checkSchemaVersion: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("checkSchemaVersion = %v, want %q", err, tt.err)
+			}
+			if errors.Is(err, ErrSchemaMismatch) != tt.mismatch {
+				t.Fatalf("checkSchemaVersion = %v, mismatch %v", err, tt.mismatch)
+			}
+		})
+	}
+
+	// A failure to read the file isn't taken for a mismatch
+	cloud := newFakeCloud(t)
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		return "", "cat: permission denied\n", 1, command == "cat "+schemaVersionFile
+	})
+	if err := checkSchemaVersion(context.Background(), cloud.connect()); err == nil || errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("checkSchemaVersion = %v, want a read failure", err)
+	}
+}
+
+func TestSchemaMismatchHoldsInitialSync(t *testing.T) {
+	useConfig(t, nil)
+	previous_delay, previous_max := initialRetryDelay, initialRetryMaxDelay
+	initialRetryDelay, initialRetryMaxDelay = 10*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { initialRetryDelay, initialRetryMaxDelay = previous_delay, previous_max })
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	cloud.setFile(schemaVersionFile, "2\n")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cloud.setFile(schemaVersionFile, "1\n")
+	}()
+
+	list := initialPilots(fr.client(0), newTestSessions(cloud.URL))
+	if len(list.Pilots) != 1 {
+		t.Fatalf("initial pilots = %+v, want alice", list.Pilots)
+	}
+	if !strings.Contains(logs.String(), "unsupported cloud schema version") {
+		t.Fatalf("mismatch wasn't logged:\n%s", logs)
+	}
+	// Nothing was fetched while the versions differed
+	if fetches := cloud.count("cat " + homeFile("alice", "user.profile")); fetches != 1 {
+		t.Fatalf("fetched alice's profile %d times, want once", fetches)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
+)
+
+var ErrInvalidCredentials = errors.New("invalid API credentials")
+
+// ErrCircuitOpen is returned without trying to connect while the breaker is open
+var ErrCircuitOpen = errors.New("cloud unavailable (circuit breaker open)")
+
+const (
+	clientName = "https-client"
+
+	primaryRetryInterval = 5 * time.Minute
+)
+
+// keepaliveTimeout is how long a keepalive may take before the socket is considered dead (a
+// variable so tests don't have to wait that long)
+var keepaliveTimeout = 30 * time.Second
+
+// SessionManager owns the login/socket/client chain to the cloud and rebuilds it when it dies
+type SessionManager struct {
+	api_cfg APIConfig
+
+	mu         sync.Mutex
+	socket     io.Closer
+	api_client *client.SocketClient
+	// Bumped whenever a new client is installed, so Invalidate can tell whether the client a
+	// caller saw fail is still the current one
+	gen uint64
+	// Set while a connect is in progress (outside mu); closed once its outcome is installed
+	connecting *connectAttempt
+
+	// Index into api_cfg.URLs of the endpoint currently in use
+	endpoint      int
+	primary_tried time.Time
+
+	// Circuit breaker: after BREAKER_THRESHOLD consecutive failed connects, Client fails fast
+	// until open_until; then a single attempt (half-open) decides whether it closes again
+	failures   int
+	open_until time.Time
+}
+
+// Breaker states, as exposed on /healthz and the cogniflight_cloud_breaker_state gauge
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var breakerStateNames = []string{"closed", "half-open", "open"}
+
+// breaker_state is the state of the process' session manager's breaker
+var breaker_state atomic.Int32
+
+func (s *SessionManager) breakerState() int {
+	switch {
+	case cfg.BreakerThreshold <= 0 || s.failures < cfg.BreakerThreshold:
+		return breakerClosed
+	case time.Now().Before(s.open_until):
+		return breakerOpen
+	}
+	return breakerHalfOpen
+}
+
+// recordConnect updates the breaker with the outcome of a connection attempt
+func (s *SessionManager) recordConnect(err error) {
+	before := s.breakerState()
+	if err == nil {
+		s.failures = 0
+	} else {
+		s.failures++
+		if cfg.BreakerThreshold > 0 && s.failures >= cfg.BreakerThreshold {
+			s.open_until = time.Now().Add(cfg.BreakerCooldown)
+		}
+	}
+
+	after := s.breakerState()
+	if after != before {
+		log.Printf("Cloud circuit breaker %s", breakerStateNames[after])
+	}
+	breaker_state.Store(int32(after))
+	metricCloudBreakerState.Set(after)
+}
+
+func NewSessionManager(api_cfg APIConfig) *SessionManager {
+	return &SessionManager{api_cfg: api_cfg}
+}
+
+// connectAttempt is a connect in progress, shared by every Client call that arrives meanwhile
+type connectAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+// Client returns the current socket client, connecting first if there isn't a live one, along
+// with its generation to hand Invalidate if the client fails. Connecting happens outside s.mu,
+// so connected, Invalidate and other callers aren't held up by a slow or unreachable endpoint.
+func (s *SessionManager) Client() (client.SocketClient, uint64, error) {
+	s.mu.Lock()
+	for s.connecting != nil {
+		attempt := s.connecting
+		s.mu.Unlock()
+		<-attempt.done
+		if attempt.err != nil {
+			return client.SocketClient{}, 0, attempt.err
+		}
+		s.mu.Lock()
+	}
+
+	if s.api_client != nil {
+		defer s.mu.Unlock()
+		return *s.api_client, s.gen, nil
+	}
+	if s.breakerState() == breakerOpen {
+		s.mu.Unlock()
+		return client.SocketClient{}, 0, ErrCircuitOpen
+	}
+
+	// Stay on the endpoint that last worked, but give the primary another go every so often
+	order := []int{s.endpoint}
+	if s.primaryDue() {
+		order = []int{0, s.endpoint}
+		s.primary_tried = time.Now()
+	}
+	for i := range s.api_cfg.URLs {
+		if !slices.Contains(order, i) {
+			order = append(order, i)
+		}
+	}
+	attempt := &connectAttempt{done: make(chan struct{})}
+	s.connecting = attempt
+	s.mu.Unlock()
+
+	socket, api_client, endpoint, err := s.connectAny(order)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connecting = nil
+	attempt.err = err
+	close(attempt.done)
+	if err != nil {
+		// Bad credentials are bad everywhere, and say nothing about the endpoints' health
+		if !errors.Is(err, ErrInvalidCredentials) {
+			s.recordConnect(err)
+		}
+		return client.SocketClient{}, 0, err
+	}
+
+	s.recordConnect(nil)
+	if s.api_client != nil {
+		// failBack installed a client meanwhile
+		socket.Close()
+		return *s.api_client, s.gen, nil
+	}
+	if endpoint != s.endpoint {
+		log.Printf("Switched API endpoint to %s", s.api_cfg.URLs[endpoint])
+		if endpoint != 0 {
+			s.primary_tried = time.Now()
+		}
+	}
+	s.endpoint = endpoint
+	s.install(socket, api_client)
+	return api_client, s.gen, nil
+}
+
+// connectAny tries the endpoints in order, returning the first connection that comes up
+func (s *SessionManager) connectAny(order []int) (io.Closer, client.SocketClient, int, error) {
+	var err error
+	for _, i := range order {
+		var socket io.Closer
+		var api_client client.SocketClient
+		socket, api_client, err = connectEndpoint(s.api_cfg, s.api_cfg.URLs[i])
+		if err == nil {
+			return socket, api_client, i, nil
+		}
+
+		// Bad credentials are bad everywhere, so only connection problems fail over
+		if errors.Is(err, ErrInvalidCredentials) {
+			return nil, client.SocketClient{}, 0, err
+		}
+		if len(order) > 1 {
+			log.Printf("failed to connect to %s: %v", s.api_cfg.URLs[i], err)
+		}
+	}
+	return nil, client.SocketClient{}, 0, err
+}
+
+// install makes a new connection the current one. s.mu must be held.
+func (s *SessionManager) install(socket io.Closer, api_client client.SocketClient) {
+	s.socket = socket
+	s.api_client = &api_client
+	s.gen++
+}
+
+func (s *SessionManager) primaryDue() bool {
+	return s.endpoint != 0 && time.Since(s.primary_tried) >= primaryRetryInterval
+}
+
+// socketURL maps an API URL, which LoadConfig requires to be http or https, to its ws or wss
+// counterpart
+func socketURL(api_url string) string {
+	if rest, ok := strings.CutPrefix(api_url, "https://"); ok {
+		return "wss://" + rest
+	}
+	return "ws://" + strings.TrimPrefix(api_url, "http://")
+}
+
+func connectEndpoint(api_cfg APIConfig, url string) (io.Closer, client.SocketClient, error) {
+	sessID, err := client.Login(url+"/login", api_cfg.Username, api_cfg.Password)
+	if err != nil {
+		if strings.Contains(err.Error(), "401") {
+			return nil, client.SocketClient{}, ErrInvalidCredentials
+		}
+		if strings.Contains(err.Error(), "no sessid cookie") {
+			// A 200 without a session is a page served by something other than the API
+			return nil, client.SocketClient{}, fmt.Errorf("failed to log in to API: %w: no session in login response", ErrUnexpectedResponse)
+		}
+		return nil, client.SocketClient{}, fmt.Errorf("failed to log in to API: %w", err)
+	}
+	if strings.ContainsAny(sessID, " \t\r\n<>\";") {
+		return nil, client.SocketClient{}, fmt.Errorf("failed to log in to API: %w: malformed session ID", ErrUnexpectedResponse)
+	}
+
+	socket, err := client.ConnectSocket(socketURL(url)+"/cmd-socket", sessID)
+	if err != nil {
+		return nil, client.SocketClient{}, fmt.Errorf("failed to open socket connection: %w", err)
+	}
+
+	session := client.NewSocketSession(socket)
+	api_client, err := session.ConnectClient(clientName)
+	if err != nil {
+		socket.Close()
+		return nil, client.SocketClient{}, fmt.Errorf("failed to create client on socket: %w", err)
+	}
+
+	// A client that connected but can't run commands otherwise only fails later, deep inside a sync
+	if err := validateClient(api_client); err != nil {
+		socket.Close()
+		return nil, client.SocketClient{}, err
+	}
+
+	return socket, api_client, nil
+}
+
+func validateClient(api_client client.SocketClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), keepaliveTimeout)
+	defer cancel()
+
+	stderr := &strings.Builder{}
+	status, err := runCommand(ctx, api_client, "echo -n ok", io.Discard, stderr)
+	if err != nil {
+		return fmt.Errorf("client %q not available on server: %w", clientName, err)
+	}
+	if status != 0 {
+		return fmt.Errorf("client %q not available on server: test command exited %d: %s", clientName, status, stderrSummary(stderr.String()))
+	}
+	return nil
+}
+
+// Prewarm connects in the background so the first pilot request doesn't pay for login and
+// socket setup. Failures are retried until a connection succeeds or the credentials are rejected.
+// How much that saves shows in the first request's latency (see recordFirstRequest).
+func (s *SessionManager) Prewarm() {
+	start := time.Now()
+	for delay := time.Second; ; delay = min(delay*2, time.Minute) {
+		_, _, err := s.Client()
+		if err == nil {
+			log.Printf("Cloud session ready after %v", time.Since(start))
+			return
+		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			log.Println("failed to pre-warm cloud session: ", err)
+			return
+		}
+
+		log.Printf("failed to pre-warm cloud session, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// connected reports whether a client is ready, so the next Client call won't have to connect
+func (s *SessionManager) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.api_client != nil
+}
+
+// first_request makes recordFirstRequest report only once per run
+var first_request sync.Once
+
+// recordFirstRequest logs and exports how long the first pilot request took, and whether the
+// session was already up when it arrived (warm, thanks to Prewarm) or had to be connected (cold)
+func recordFirstRequest(ctx context.Context, warm bool, took time.Duration) {
+	first_request.Do(func() {
+		session := "cold"
+		if warm {
+			session = "warm"
+		}
+		logf(ctx, "First pilot request handled in %v (%s session)", took, session)
+		metricFirstRequestSeconds.Observe(session, took.Seconds())
+	})
+}
+
+// Invalidate drops the connection of generation gen, as returned by Client, so the next Client
+// call reconnects. A client that was already replaced (by a reconnect or failBack) is left
+// alone: its failure says nothing about the connection that took its place.
+func (s *SessionManager) Invalidate(gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.gen {
+		return
+	}
+	if s.socket != nil {
+		s.socket.Close()
+	}
+	s.socket = nil
+	s.api_client = nil
+}
+
+// generation is the generation of the current client, for dropping it without having called Client
+func (s *SessionManager) generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen
+}
+
+// failBack connects to the primary endpoint alongside the fallback one in use, and switches to
+// it once that connection is up and no command is running. The fallback client stays put
+// meanwhile, so commands on it aren't cut short, and a primary that's still down costs nothing.
+func (s *SessionManager) failBack() {
+	s.mu.Lock()
+	s.primary_tried = time.Now()
+	s.mu.Unlock()
+
+	socket, api_client, err := connectEndpoint(s.api_cfg, s.api_cfg.URLs[0])
+	if err != nil {
+		log.Printf("primary endpoint %s still unavailable: %v", s.api_cfg.URLs[0], err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if commands_running.Load() != 0 {
+		// Due again on the next keepalive
+		s.primary_tried = time.Time{}
+		socket.Close()
+		return
+	}
+	if s.socket != nil {
+		s.socket.Close()
+	}
+	log.Printf("Switched API endpoint back to %s", s.api_cfg.URLs[0])
+	s.endpoint = 0
+	s.install(socket, api_client)
+}
+
+// Keepalive runs a no-op command on the live client every interval, so idle NAT/firewall drops
+// are noticed (and reconnected) before the next real command needs the socket
+func (s *SessionManager) Keepalive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.keepalive()
+	}
+}
+
+// keepalive is one tick of Keepalive
+func (s *SessionManager) keepalive() {
+	s.mu.Lock()
+	api_client, gen := s.api_client, s.gen
+	fail_back := api_client != nil && s.primaryDue()
+	s.mu.Unlock()
+	if api_client == nil {
+		return
+	}
+
+	// A healthy fallback connection never needs to reconnect, so retry the primary from here
+	if fail_back {
+		s.failBack()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), keepaliveTimeout)
+	_, err := runCommand(ctx, *api_client, "echo -n keepalive", io.Discard, io.Discard)
+	cancel()
+	if err == nil {
+		return
+	}
+
+	log.Println("keepalive failed, reconnecting: ", err)
+	s.Invalidate(gen)
+	if _, _, err := s.Client(); err != nil {
+		log.Println("failed to reconnect after keepalive failure: ", err)
+	}
+}
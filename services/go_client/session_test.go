@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSessions(urls ...string) *SessionManager {
+	return NewSessionManager(APIConfig{Username: "device", Password: "secret", URLs: urls})
+}
+
+func runEcho(t *testing.T, sessions *SessionManager, text string) {
+	t.Helper()
+	api_client, _, err := sessions.Client()
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	stdout := &strings.Builder{}
+	if _, err := runCommand(context.Background(), api_client, "echo -n "+text, stdout, io.Discard); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	if stdout.String() != text {
+		t.Fatalf("echo printed %q, want %q", stdout.String(), text)
+	}
+}
+
+func TestClientFailsOverToFallback(t *testing.T) {
+	useConfig(t, nil)
+	primary, fallback := newFakeCloud(t), newFakeCloud(t)
+	primary.setDown(true)
+
+	sessions := newTestSessions(primary.URL, fallback.URL)
+	runEcho(t, sessions, "hello")
+	if sessions.endpoint != 1 {
+		t.Fatalf("endpoint = %d, want the fallback (1)", sessions.endpoint)
+	}
+	if fallback.count("echo -n hello") != 1 {
+		t.Fatalf("fallback ran %v", fallback.ran())
+	}
+}
+
+func TestFailBackKeepsFallbackWhilePrimaryIsDown(t *testing.T) {
+	useConfig(t, nil)
+	primary, fallback := newFakeCloud(t), newFakeCloud(t)
+	primary.setDown(true)
+	sessions := newTestSessions(primary.URL, fallback.URL)
+	runEcho(t, sessions, "before")
+	in_use := sessions.api_client
+
+	sessions.primary_tried = time.Time{}
+	if !sessions.primaryDue() {
+		t.Fatal("primary retry not due")
+	}
+	sessions.failBack()
+
+	if sessions.endpoint != 1 || sessions.api_client != in_use {
+		t.Fatal("failing back to a down primary replaced the fallback client")
+	}
+	if sessions.primaryDue() {
+		t.Fatal("primary retried again right away")
+	}
+	runEcho(t, sessions, "after")
+}
+
+func TestFailBackSwitchesToPrimary(t *testing.T) {
+	useConfig(t, nil)
+	primary, fallback := newFakeCloud(t), newFakeCloud(t)
+	primary.setDown(true)
+	sessions := newTestSessions(primary.URL, fallback.URL)
+	runEcho(t, sessions, "before")
+
+	primary.setDown(false)
+	sessions.primary_tried = time.Time{}
+	sessions.failBack()
+
+	if sessions.endpoint != 0 {
+		t.Fatalf("endpoint = %d, want the primary (0)", sessions.endpoint)
+	}
+	runEcho(t, sessions, "after")
+	if primary.count("echo -n after") != 1 || fallback.count("echo -n after") != 0 {
+		t.Fatalf("command after failing back ran on primary %v, fallback %v", primary.ran(), fallback.ran())
+	}
+}
+
+func TestFailBackWaitsForRunningCommands(t *testing.T) {
+	useConfig(t, nil)
+	primary, fallback := newFakeCloud(t), newFakeCloud(t)
+	primary.setDown(true)
+	sessions := newTestSessions(primary.URL, fallback.URL)
+	runEcho(t, sessions, "before")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fallback.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command != "cat /home/slow/user.profile" {
+			return "", "", 0, false
+		}
+		close(started)
+		<-release
+		return "name: Slow", "", 0, true
+	})
+	api_client, _, _ := sessions.Client()
+	done := make(chan error)
+	go func() {
+		_, err := runCommand(context.Background(), api_client, "cat /home/slow/user.profile", io.Discard, io.Discard)
+		done <- err
+	}()
+	<-started
+
+	primary.setDown(false)
+	sessions.primary_tried = time.Time{}
+	sessions.failBack()
+	if sessions.endpoint != 1 {
+		t.Fatal("switched endpoints while a command was running")
+	}
+	if !sessions.primaryDue() {
+		t.Fatal("deferred fail-back isn't due again")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("running command failed: %v", err)
+	}
+	sessions.failBack()
+	if sessions.endpoint != 0 {
+		t.Fatal("didn't switch to the primary once idle")
+	}
+}
+
+func TestFailBackMidSync(t *testing.T) {
+	useConfig(t, nil)
+	primary, fallback := newFakeCloud(t), newFakeCloud(t)
+	primary.setDown(true)
+	fallback.addPilot("alice", "name: Alice", nil)
+	sessions := newTestSessions(primary.URL, fallback.URL)
+
+	// The sync thread takes the client once and runs one command after another on it
+	api_client, gen, err := sessions.Client()
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	if _, err := listPilots(context.Background(), api_client); err != nil {
+		t.Fatalf("listing pilots: %v", err)
+	}
+
+	// Between two of its commands, nothing is running, so failing back closes the fallback socket
+	primary.setDown(false)
+	sessions.primary_tried = time.Time{}
+	sessions.failBack()
+	if sessions.endpoint != 0 {
+		t.Fatal("didn't fail back between commands")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := GetPilotFromServer(ctx, api_client, "alice"); !errors.Is(err, ErrTransport) {
+		t.Fatalf("fetch on the closed fallback client = %v, want a transport failure", err)
+	}
+	// What the sync thread does with the failure mustn't cost the primary connection
+	sessions.Invalidate(gen)
+	if !sessions.connected() {
+		t.Fatal("invalidating the replaced fallback client dropped the primary")
+	}
+	runEcho(t, sessions, "after")
+	if primary.loginCount() != 1 || primary.count("echo -n after") != 1 {
+		t.Fatalf("primary had %d logins and ran %v, want the fail-back connection reused", primary.loginCount(), primary.ran())
+	}
+
+	// Invalidating the current client still drops it
+	_, gen, _ = sessions.Client()
+	sessions.Invalidate(gen)
+	if sessions.connected() {
+		t.Fatal("Invalidate kept the current client")
+	}
+}
+
+func TestConnectDoesNotHoldLock(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	validating := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command == "echo -n ok" {
+			once.Do(func() { close(validating) })
+			<-release
+		}
+		return "", "", 0, false
+	})
+	sessions := newTestSessions(cloud.URL)
+
+	type result struct {
+		gen uint64
+		err error
+	}
+	results := make(chan result, 2)
+	connect := func() {
+		_, gen, err := sessions.Client()
+		results <- result{gen, err}
+	}
+	go connect()
+	<-validating
+	go connect()
+
+	// A connect stuck validating doesn't hold up anything that only looks at the session
+	returned := make(chan struct{})
+	go func() {
+		sessions.connected()
+		sessions.Invalidate(sessions.generation())
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("connected and Invalidate blocked on a connect in progress")
+	}
+
+	close(release)
+	for range 2 {
+		if r := <-results; r.err != nil || r.gen != 1 {
+			t.Fatalf("Client = generation %d, %v; want both callers to share the first connection", r.gen, r.err)
+		}
+	}
+	if cloud.loginCount() != 1 {
+		t.Fatalf("%d logins, want one connect shared by both callers", cloud.loginCount())
+	}
+}
+
+// firstRequestCount is how many first requests were observed for a session state
+func firstRequestCount(session string) int64 {
+	metricFirstRequestSeconds.mu.Lock()
+	defer metricFirstRequestSeconds.mu.Unlock()
+	if series, ok := metricFirstRequestSeconds.series[session]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func TestFirstRequestLatency(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	request := map[string]string{"pilot_username": "alice"}
+
+	for _, tt := range []struct {
+		session string
+		prewarm bool
+	}{
+		{"cold", false},
+		{"warm", true},
+	} {
+		first_request = sync.Once{}
+		before := firstRequestCount(tt.session)
+		sessions := newTestSessions(cloud.URL)
+		if tt.prewarm {
+			sessions.Prewarm()
+		}
+
+		HandlePilotRequest(context.Background(), rdb, sessions, request)
+		HandlePilotRequest(context.Background(), rdb, sessions, request)
+		if got := firstRequestCount(tt.session) - before; got != 1 {
+			t.Errorf("%s first requests recorded: %d, want 1", tt.session, got)
+		}
+	}
+	out := &strings.Builder{}
+	metricFirstRequestSeconds.writeTo(out)
+	if !strings.Contains(out.String(), `cogniflight_first_request_seconds_count{session="warm"}`) {
+		t.Fatalf("metric output lacks the warm series:\n%s", out)
+	}
+}
+
+func TestKeepaliveInterval(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	sessions := newTestSessions(cloud.URL)
+
+	done := make(chan struct{})
+	go func() {
+		sessions.Keepalive(0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Keepalive(0) didn't return")
+	}
+
+	runEcho(t, sessions, "hello")
+	const interval = 20 * time.Millisecond
+	start := time.Now()
+	go sessions.Keepalive(interval)
+	// Keepalive never returns; without a client, its ticks are no-ops
+	t.Cleanup(func() { sessions.Invalidate(sessions.generation()) })
+	for cloud.count("echo -n keepalive") < 3 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%d keepalives in %v", cloud.count("echo -n keepalive"), time.Since(start))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if took := time.Since(start); took < 3*interval {
+		t.Fatalf("3 keepalives in %v, faster than every %v", took, interval)
+	}
+}
+
+func TestKeepaliveReconnects(t *testing.T) {
+	useConfig(t, nil)
+	previous := keepaliveTimeout
+	keepaliveTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { keepaliveTimeout = previous })
+	cloud := newFakeCloud(t)
+	sessions := newTestSessions(cloud.URL)
+
+	// Nothing to keep alive before the first connection
+	sessions.keepalive()
+	if cloud.loginCount() != 0 {
+		t.Fatal("keepalive connected an idle session")
+	}
+
+	runEcho(t, sessions, "before")
+	sessions.keepalive()
+	if cloud.count("echo -n keepalive") != 1 || cloud.loginCount() != 1 {
+		t.Fatalf("healthy keepalive ran %v with %d logins", cloud.ran(), cloud.loginCount())
+	}
+
+	// A dropped socket is noticed and replaced right away
+	cloud.closeSockets()
+	sessions.keepalive()
+	if cloud.loginCount() != 2 {
+		t.Fatalf("%d logins after a failed keepalive, want 2", cloud.loginCount())
+	}
+	if !sessions.connected() {
+		t.Fatal("no client after reconnecting")
+	}
+	runEcho(t, sessions, "after")
+}
+
+func TestConnectValidatesClient(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command == "echo -n ok" {
+			return "", "unknown client\n", 1, true
+		}
+		return "", "", 0, false
+	})
+	sessions := newTestSessions(cloud.URL)
+
+	_, _, err := sessions.Client()
+	if err == nil || !strings.Contains(err.Error(), `client "https-client" not available on server`) || !strings.Contains(err.Error(), "unknown client") {
+		t.Fatalf("Client = %v, want the client rejected", err)
+	}
+	if sessions.connected() {
+		t.Fatal("kept a client that failed validation")
+	}
+
+	cloud.setHandler(nil)
+	runEcho(t, sessions, "hello")
+	if cloud.count("echo -n ok") != 2 {
+		t.Fatalf("validation ran %d times, want once per connect", cloud.count("echo -n ok"))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	useConfig(t, map[string]string{"BREAKER_THRESHOLD": "3", "BREAKER_COOLDOWN": "1h"})
+	logs := captureLog(t)
+	cloud := newFakeCloud(t)
+	cloud.setDown(true)
+	sessions := newTestSessions(cloud.URL)
+	state := func() string { return breakerStateNames[breaker_state.Load()] }
+
+	for i := range 3 {
+		if _, _, err := sessions.Client(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("attempt %d = %v, want a connect failure", i+1, err)
+		}
+	}
+	if state() != "open" {
+		t.Fatalf("breaker %s after 3 failures, want open", state())
+	}
+	// Open: fails fast, even with the cloud back
+	cloud.setDown(false)
+	if _, _, err := sessions.Client(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Client with the breaker open = %v, want ErrCircuitOpen", err)
+	}
+	if cloud.loginCount() != 0 {
+		t.Fatal("logged in with the breaker open")
+	}
+
+	// Half-open after the cooldown: one failure opens it again right away
+	cloud.setDown(true)
+	sessions.open_until = time.Now()
+	if sessions.breakerState() != breakerHalfOpen {
+		t.Fatalf("breaker %s after the cooldown, want half-open", breakerStateNames[sessions.breakerState()])
+	}
+	if _, _, err := sessions.Client(); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("half-open attempt = %v, want a connect failure", err)
+	}
+	if state() != "open" {
+		t.Fatalf("breaker %s after a failed half-open attempt, want open", state())
+	}
+
+	// A successful half-open attempt closes it
+	cloud.setDown(false)
+	sessions.open_until = time.Now()
+	runEcho(t, sessions, "hello")
+	if state() != "closed" || sessions.failures != 0 {
+		t.Fatalf("breaker %s with %d failures after reconnecting, want closed", state(), sessions.failures)
+	}
+	if !strings.Contains(logs.String(), "Cloud circuit breaker open") || !strings.Contains(logs.String(), "Cloud circuit breaker closed") {
+		t.Errorf("transitions weren't logged:\n%s", logs)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	useConfig(t, map[string]string{"BREAKER_THRESHOLD": "0"})
+	cloud := newFakeCloud(t)
+	cloud.setDown(true)
+	sessions := newTestSessions(cloud.URL)
+	for range 10 {
+		if _, _, err := sessions.Client(); errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("breaker opened with BREAKER_THRESHOLD=0")
+		}
+	}
+	cloud.setDown(false)
+	runEcho(t, sessions, "hello")
+}
+
+func TestLoginRejectsUnexpectedResponses(t *testing.T) {
+	useConfig(t, nil)
+	for _, tt := range []struct {
+		name   string
+		handle http.HandlerFunc
+		want   error
+		err    string
+	}{
+		{"maintenance page", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<!DOCTYPE html><html><body>Down for maintenance</body></html>")
+		}, ErrUnexpectedResponse, "no session in login response"},
+		{"markup in the session", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Set-Cookie", "sessid=<html>")
+		}, ErrUnexpectedResponse, "malformed session ID"},
+		{"wrong credentials", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}, ErrInvalidCredentials, ""},
+		{"proxy error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "<html>Bad Gateway</html>", http.StatusBadGateway)
+		}, nil, "502"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handle)
+			defer server.Close()
+
+			_, _, err := connectEndpoint(APIConfig{Username: "device", Password: "secret", URLs: []string{server.URL}}, server.URL)
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("connectEndpoint = %v, want %v %q", err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestSocketURL(t *testing.T) {
+	for api_url, want := range map[string]string{
+		"http://cloud.example.com/api":  "ws://cloud.example.com/api",
+		"https://cloud.example.com/api": "wss://cloud.example.com/api",
+		// Only the scheme changes, wherever else "http" turns up
+		"https://http.example.com/https": "wss://http.example.com/https",
+	} {
+		if got := socketURL(api_url); got != want {
+			t.Errorf("socketURL(%q) = %q, want %q", api_url, got, want)
+		}
+	}
+}
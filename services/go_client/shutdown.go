@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// HandleShutdown waits for SIGINT/SIGTERM and exits, first finalizing the open flights of
+// authenticated pilots when FINALIZE_FLIGHTS_ON_SHUTDOWN is set
+func HandleShutdown(rdb *redis.Client, sessions *SessionManager) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %v, shutting down...", sig)
+
+	if cfg.FinalizeFlightsOnShutdown {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			finalizeActiveFlights(ctx, rdb, sessions)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Println("timed out finalizing flights, exiting anyway")
+		}
+		cancel()
+	}
+
+	os.Exit(0)
+}
+
+func finalizeActiveFlights(ctx context.Context, rdb *redis.Client, sessions *SessionManager) {
+	active, err := activePilots(ctx, rdb)
+	if err != nil {
+		log.Println("failed to find active pilots: ", err)
+		return
+	}
+	if len(active) == 0 {
+		return
+	}
+
+	api_client, gen, err := sessions.Client()
+	if err != nil {
+		log.Println("cloud unreachable, leaving flights open: ", err)
+		return
+	}
+
+	for username, flight_id := range active {
+		if flight_id == "" {
+			continue
+		}
+		if err := FinalizeFlight(ctx, api_client, flight_id, time.Now()); errors.Is(err, ErrTransport) {
+			// The rest would go through a client that may still be streaming this command
+			log.Printf("failed to finalize flight %s for %q, leaving the rest open: %v", flight_id, username, err)
+			sessions.Invalidate(gen)
+			return
+		} else if err != nil {
+			log.Printf("failed to finalize flight %s for %q: %v", flight_id, username, err)
+		} else {
+			log.Printf("Finalized flight %s for %q", flight_id, username)
+			clearFlight(ctx, rdb, username, flight_id)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFinalizeActiveFlights(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	ctx := context.Background()
+	for _, flight_id := range []string{"1700000000000000001", "1700000000000000002", "1700000000000000003"} {
+		cloud.setFile(flightFile(flight_id), "end_timestamp: 0\n")
+	}
+	rdb.HSet(ctx, pilotKey("alice"), "pilot_username", "alice", "authenticated", "true", "flight_id", "1700000000000000001")
+	rdb.HSet(ctx, pilotKey("bob"), "pilot_username", "bob", "authenticated", "true", "flight_id", "1700000000000000002")
+	rdb.HSet(ctx, pilotKey("carol"), "pilot_username", "carol", "authenticated", "false", "flight_id", "1700000000000000003")
+	rdb.HSet(ctx, pilotKey("dave"), "pilot_username", "dave", "authenticated", "true")
+
+	finalizeActiveFlights(ctx, rdb, newTestSessions(cloud.URL))
+
+	for username, flight_id := range map[string]string{"alice": "1700000000000000001", "bob": "1700000000000000002"} {
+		if _, ok := cloud.file(flightMarker(flight_id, "ended")); !ok {
+			t.Errorf("%s's flight %s not finalized", username, flight_id)
+		}
+		if data, _ := cloud.file(flightFile(flight_id)); strings.Contains(data, "end_timestamp: 0") {
+			t.Errorf("%s's flight file has no end:\n%s", username, data)
+		}
+		fields := fr.hash(0, pilotKey(username))
+		if fields["flight_id"] != "" {
+			t.Errorf("%s's finalized flight %q still on them", username, fields["flight_id"])
+		}
+		// Authentication is left to the pilots' TTLs and deauth requests
+		if fields["authenticated"] != "true" {
+			t.Errorf("%s's authenticated = %q", username, fields["authenticated"])
+		}
+	}
+	if _, ok := cloud.file(flightMarker("1700000000000000003", "ended")); ok {
+		t.Error("finalized the flight of a pilot who isn't authenticated")
+	}
+	if fr.hash(0, pilotKey("carol"))["flight_id"] == "" {
+		t.Error("cleared the flight of a pilot who isn't authenticated")
+	}
+}
+
+func TestFinalizeActiveFlightsWithoutPilots(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	cloud := newFakeCloud(t)
+	fr.client(0).HSet(context.Background(), pilotKey("alice"), "pilot_username", "alice", "authenticated", "false")
+
+	finalizeActiveFlights(context.Background(), fr.client(0), newTestSessions(cloud.URL))
+	if cloud.loginCount() != 0 {
+		t.Fatal("connected to the cloud with no flights to finalize")
+	}
+}
+
+func TestFinalizeActiveFlightsCloudDown(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.setDown(true)
+	const flight_id = "1700000000000000001"
+	rdb.HSet(context.Background(), pilotKey("alice"), "pilot_username", "alice", "authenticated", "true", "flight_id", flight_id)
+
+	finalizeActiveFlights(context.Background(), rdb, newTestSessions(cloud.URL))
+	if got := fr.hash(0, pilotKey("alice"))["flight_id"]; got != flight_id {
+		t.Fatalf("flight_id = %q, want the still open %s", got, flight_id)
+	}
+}
+
+func TestFinalizeActiveFlightsStopsOnTransportFailure(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_COMMAND_OUTPUT": "1024"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	ctx := context.Background()
+	for _, username := range []string{"alice", "bob"} {
+		flight_id := map[string]string{"alice": "1700000000000000001", "bob": "1700000000000000002"}[username]
+		cloud.setFile(flightFile(flight_id), "end_timestamp: 0\n")
+		rdb.HSet(ctx, pilotKey(username), "pilot_username", username, "authenticated", "true", "flight_id", flight_id)
+	}
+	// Whichever flight is read first overruns MAX_COMMAND_OUTPUT, abandoning the command
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if strings.HasPrefix(command, "cat ") {
+			return strings.Repeat("#", 4096), "", 0, true
+		}
+		return "", "", 0, false
+	})
+	sessions := newTestSessions(cloud.URL)
+
+	finalizeActiveFlights(ctx, rdb, sessions)
+	if n := cloud.count("cat "); n != 1 {
+		t.Fatalf("read %d flights, want to stop after the first failure", n)
+	}
+	if sessions.connected() {
+		t.Fatal("session kept after a transport failure")
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if fr.hash(0, pilotKey(username))["flight_id"] == "" {
+			t.Errorf("%s's flight cleared though it wasn't finalized", username)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With PILOT_SIGNING_KEY, every write to a pilot hash also stores signature: the hex
+// HMAC-SHA256, under that key, of
+//
+//	"cognicore-pilot-v1\n" + pilot_username + "\n" + authenticated + "\n" + flight_id
+//
+// (missing fields as empty strings). Consumers holding the key can then tell those fields were
+// written by this service, not flipped by another client of the shared Redis. The signature is
+// written in the same transaction as the fields, and expires with the authentication TTL (kept
+// when other fields are re-signed), so an unsigned pilot is never authenticated.
+//
+// That makes a pilot whose authentication expired one with neither authenticated nor signature,
+// and it verifies: there's no authentication left to vouch for, and nobody can add one without
+// the key. Its pilot_username and flight_id are then unsigned, so consumers must not rely on them.
+
+// signedPilotFields are covered by the signature, in signing order
+var signedPilotFields = []string{"pilot_username", "authenticated", "flight_id"}
+
+func pilotSignature(key []byte, username, authenticated, flight_id string) string {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, "cognicore-pilot-v1\n"+username+"\n"+authenticated+"\n"+flight_id)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyPilotSignature checks a pilot hash (as from HGETALL) against its signature field. An
+// unsigned hash verifies only when it isn't authenticated, as after its authentication expired.
+func VerifyPilotSignature(key []byte, fields map[string]string) bool {
+	if unsignedUnauthenticated(fields) {
+		return true
+	}
+	signature, err := hex.DecodeString(fields["signature"])
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	expected, _ := hex.DecodeString(pilotSignature(key, fields["pilot_username"], fields["authenticated"], fields["flight_id"]))
+	return hmac.Equal(signature, expected)
+}
+
+// unsignedUnauthenticated reports a pilot hash whose signature expired along with its
+// authentication, leaving nothing signed
+func unsignedUnauthenticated(fields map[string]string) bool {
+	_, signed := fields["signature"]
+	_, authenticated := fields["authenticated"]
+	return !signed && !authenticated
+}
+
+// fieldString renders a value the way go-redis writes it
+func fieldString(value any) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case encoding.BinaryMarshaler:
+		data, _ := value.MarshalBinary()
+		return string(data)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// updatePilot sets and deletes fields of a pilot hash (set holds field/value pairs, as HSET
+// takes them), re-signing it in the same transaction when signing is on
+func updatePilot(ctx context.Context, rdb *redis.Client, username string, set []any, del ...string) error {
+	key := pilotKey(username)
+	var auth_ttl time.Duration
+	for i := 0; i+1 < len(set); i += 2 {
+		if fieldString(set[i]) == "authenticated" && fieldString(set[i+1]) == "true" {
+			auth_ttl = authTTLOf(ctx)
+		}
+	}
+	var expire *redis.IntSliceCmd
+	if cfg.SigningKey == nil {
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(set) != 0 {
+				pipe.HSet(ctx, key, set...)
+			}
+			if len(del) != 0 {
+				pipe.HDel(ctx, key, del...)
+			}
+			if auth_ttl > 0 {
+				expire = expireAuthentication(ctx, pipe, key, auth_ttl)
+			}
+			return nil
+		})
+		return checkAuthExpiry(ctx, rdb, key, expire, err)
+	}
+
+	write := func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, key, signedPilotFields...).Result()
+		if err != nil {
+			return err
+		}
+		current := map[string]string{}
+		for i, value := range values {
+			current[signedPilotFields[i]], _ = value.(string)
+		}
+		sets_flag := slices.Contains(del, "authenticated")
+		for i := 0; i+1 < len(set); i += 2 {
+			current[fieldString(set[i])] = fieldString(set[i+1])
+			sets_flag = sets_flag || fieldString(set[i]) == "authenticated"
+		}
+		for _, field := range del {
+			current[field] = ""
+		}
+		// Rewriting the signature drops its TTL, which it has to keep as long as the flag keeps its own
+		var ttl time.Duration
+		if !sets_flag {
+			ttl = authenticationTTL(ctx, tx, key)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(set) != 0 {
+				pipe.HSet(ctx, key, set...)
+			}
+			if len(del) != 0 {
+				pipe.HDel(ctx, key, del...)
+			}
+			pipe.HSet(ctx, key, "signature", pilotSignature(cfg.SigningKey, current["pilot_username"], current["authenticated"], current["flight_id"]))
+			if ttl > 0 {
+				pipe.HPExpire(ctx, key, ttl, "signature")
+			}
+			if auth_ttl > 0 {
+				expire = expireAuthentication(ctx, pipe, key, auth_ttl)
+			}
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for range 3 {
+		if err = rdb.Watch(ctx, write, key); err != redis.TxFailedErr {
+			break
+		}
+	}
+	return checkAuthExpiry(ctx, rdb, key, expire, err)
+}
+
+// expireAuthentication queues the TTL of a pilot's freshly set authenticated flag, and of the
+// signature vouching for it (see withAuthTTL)
+func expireAuthentication(ctx context.Context, pipe redis.Pipeliner, key string, ttl time.Duration) *redis.IntSliceCmd {
+	return pipe.HPExpire(ctx, key, ttl, "authenticated", "signature")
+}
+
+// checkAuthExpiry passes on err from a write that queued expire, unless the TTL couldn't be set.
+// A flag left without its TTL would keep the pilot authenticated for good, so it's removed,
+// signature and all, and the write reported failed.
+func checkAuthExpiry(ctx context.Context, rdb *redis.Client, key string, expire *redis.IntSliceCmd, err error) error {
+	// A transaction that lost to a concurrent write never ran, so there's nothing to undo
+	if expire == nil || expire.Err() == nil || errors.Is(err, redis.TxFailedErr) {
+		return err
+	}
+	rdb.HDel(context.WithoutCancel(ctx), key, "authenticated", "signature")
+	return fmt.Errorf("failed to set authentication TTL: %w", expire.Err())
+}
+
+// authenticationTTL is how long the authenticated flag of a pilot hash has left (see authTTL), or
+// 0 if it doesn't expire. Redis before 7.4 has no field TTLs, so nothing to keep either.
+func authenticationTTL(ctx context.Context, tx *redis.Tx, key string) time.Duration {
+	ttls, err := tx.HPTTL(ctx, key, "authenticated").Result()
+	if err != nil || len(ttls) == 0 || ttls[0] <= 0 {
+		return 0
+	}
+	return time.Duration(ttls[0]) * time.Millisecond
+}
+
+// RunVerify checks the signature of the given pilots, or of every cached pilot. Usage: verify [username...]
+func RunVerify(ctx context.Context, rdb *redis.Client, args []string, out io.Writer) error {
+	if cfg.SigningKey == nil {
+		return fmt.Errorf("verify needs PILOT_SIGNING_KEY")
+	}
+
+	keys := make([]string, 0, len(args))
+	for _, username := range args {
+		keys = append(keys, pilotKey(username))
+	}
+	if len(args) == 0 {
+		iter := rdb.Scan(ctx, 0, pilotKey("*"), 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+
+	invalid := []string{}
+	for _, key := range keys {
+		fields, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		verdict := "ok"
+		switch {
+		case len(fields) == 0:
+			verdict = "MISSING"
+			invalid = append(invalid, key)
+		case !VerifyPilotSignature(cfg.SigningKey, fields):
+			verdict = "INVALID"
+			invalid = append(invalid, key)
+		case unsignedUnauthenticated(fields):
+			// Valid, but only in saying the pilot isn't authenticated
+			verdict = "unauthenticated"
+		}
+		fmt.Fprintf(out, "%s %s\n", verdict, key)
+	}
+	if len(invalid) != 0 {
+		return fmt.Errorf("%d pilot(s) failed verification: %s", len(invalid), strings.Join(invalid, ", "))
+	}
+	return nil
+}
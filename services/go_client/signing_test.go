@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useSigning(t *testing.T) {
+	t.Helper()
+	useConfig(t, map[string]string{"PILOT_SIGNING_KEY": base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))})
+}
+
+func TestPilotSignature(t *testing.T) {
+	useSigning(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	if err := writePilot(ctx, rdb, PilotInfo{Username: "alice", FlightID: "42", PersonalData: `{"name":"Alice"}`}); err != nil {
+		t.Fatalf("writePilot: %v", err)
+	}
+	if err := updatePilot(ctx, rdb, "alice", []any{"authenticated", AuthFlag(true)}); err != nil {
+		t.Fatalf("updatePilot: %v", err)
+	}
+	fields := fr.hash(0, pilotKey("alice"))
+	if !VerifyPilotSignature(cfg.SigningKey, fields) {
+		t.Fatalf("signature of %v doesn't verify", fields)
+	}
+	out := &strings.Builder{}
+	if err := RunVerify(ctx, rdb, nil, out); err != nil {
+		t.Fatalf("RunVerify: %v\n%s", err, out)
+	}
+
+	// Another client of the shared Redis moving the pilot to another flight
+	rdb.HSet(ctx, pilotKey("alice"), "flight_id", "43")
+	if VerifyPilotSignature(cfg.SigningKey, fr.hash(0, pilotKey("alice"))) {
+		t.Fatal("tampered pilot still verifies")
+	}
+	out.Reset()
+	if err := RunVerify(ctx, rdb, []string{"alice"}, out); err == nil || !strings.Contains(out.String(), "INVALID "+pilotKey("alice")) {
+		t.Fatalf("RunVerify = %v, printed %q; want alice reported invalid", err, out)
+	}
+	out.Reset()
+	if err := RunVerify(ctx, rdb, []string{"nobody"}, out); err == nil || !strings.Contains(out.String(), "MISSING "+pilotKey("nobody")) {
+		t.Fatalf("RunVerify = %v, printed %q; want nobody reported missing", err, out)
+	}
+	// Under a different key, nothing verifies
+	if VerifyPilotSignature([]byte("fedcba9876543210"), fields) {
+		t.Fatal("signature verifies under another key")
+	}
+}
+
+func TestSignatureKeepsAuthenticationTTL(t *testing.T) {
+	useSigning(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	pilot := PilotInfo{Username: "alice", FlightID: "42", PersonalData: `{"name":"Alice"}`, Authenticated: true}
+	if err := writePilot(ctx, rdb, pilot); err != nil {
+		t.Fatalf("writePilot: %v", err)
+	}
+	rdb.HExpire(ctx, pilotKey("alice"), time.Minute, "authenticated", "signature")
+
+	// A sync rewriting the profile, then a flight change, both re-sign the pilot
+	pilot.Authenticated = false
+	pilot.PersonalData = `{"name":"Alice B"}`
+	if err := writePilotParts(ctx, rdb, pilot, true, false); err != nil {
+		t.Fatalf("writePilotParts: %v", err)
+	}
+	if ttl := fr.fieldTTL(0, pilotKey("alice"), "signature"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("signature TTL after sync = %v, want the flag's", ttl)
+	}
+	if err := updatePilot(ctx, rdb, "alice", []any{"flight_id", "43"}); err != nil {
+		t.Fatalf("updatePilot: %v", err)
+	}
+	if ttl := fr.fieldTTL(0, pilotKey("alice"), "signature"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("signature TTL after update = %v, want the flag's", ttl)
+	}
+	if !VerifyPilotSignature(cfg.SigningKey, fr.hash(0, pilotKey("alice"))) {
+		t.Fatal("re-signed pilot doesn't verify")
+	}
+
+	fr.advance(time.Minute + time.Second)
+	fields := fr.hash(0, pilotKey("alice"))
+	if _, ok := fields["authenticated"]; ok {
+		t.Fatal("authenticated didn't expire")
+	}
+	if signature, ok := fields["signature"]; ok {
+		t.Fatalf("signature %q outlived the flag it vouched for", signature)
+	}
+
+	// Expired authentication leaves the pilot unsigned, which verifies as not authenticated
+	if !VerifyPilotSignature(cfg.SigningKey, fields) {
+		t.Fatal("pilot whose authentication expired doesn't verify")
+	}
+	out := &strings.Builder{}
+	if err := RunVerify(ctx, rdb, []string{"alice"}, out); err != nil || out.String() != "unauthenticated "+pilotKey("alice")+"\n" {
+		t.Fatalf("RunVerify = %v, printed %q; want alice reported unauthenticated", err, out)
+	}
+	// Adding the flag back without the key doesn't verify
+	rdb.HSet(ctx, pilotKey("alice"), "authenticated", "true")
+	if VerifyPilotSignature(cfg.SigningKey, fr.hash(0, pilotKey("alice"))) {
+		t.Fatal("unsigned authenticated pilot verifies")
+	}
+	rdb.HDel(ctx, pilotKey("alice"), "authenticated")
+
+	// Deauthenticating sets the flag for good, and the signature with it
+	if err := updatePilot(ctx, rdb, "alice", []any{"authenticated", AuthFlag(false)}); err != nil {
+		t.Fatalf("updatePilot: %v", err)
+	}
+	if ttl := fr.fieldTTL(0, pilotKey("alice"), "signature"); ttl != 0 {
+		t.Fatalf("signature of a deauthenticated pilot expires in %v", ttl)
+	}
+}
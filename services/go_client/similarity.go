@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A pilot_id_request may carry the live embedding the recognition service matched (live_embedding,
+// a JSON array of numbers like stored embeddings). The match quality against the stored embedding
+// is then kept on the pilot hash as match_cosine and match_l2, so consumers don't recompute it.
+// Requests without one clear the previous values, which belong to an earlier authentication.
+
+func embeddingSimilarity(a, b []float64) (cosine, l2 float64, err error) {
+	if len(a) == 0 || len(b) == 0 {
+		return 0, 0, errors.New("empty embedding")
+	}
+	if len(a) != len(b) {
+		return 0, 0, fmt.Errorf("dimension mismatch: %d against %d", len(a), len(b))
+	}
+
+	var dot, norm_a, norm_b, sum_sq float64
+	for i := range a {
+		dot += a[i] * b[i]
+		norm_a += a[i] * a[i]
+		norm_b += b[i] * b[i]
+		sum_sq += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	if norm_a == 0 || norm_b == 0 {
+		return 0, 0, errors.New("zero embedding has no direction")
+	}
+	return dot / (math.Sqrt(norm_a) * math.Sqrt(norm_b)), math.Sqrt(sum_sq), nil
+}
+
+// recordMatchQuality stores the similarity of a request's live embedding to stored, the pilot's
+// embedding (nil to load it from Redis)
+func recordMatchQuality(ctx context.Context, rdb *redis.Client, username, live_embedding string, stored []float64) {
+	if live_embedding == "" {
+		checkWrite(rdb.HDel(ctx, pilotKey(username), "match_cosine", "match_l2").Err(), "clear match quality of %q", username)
+		return
+	}
+
+	var live []float64
+	if err := json.Unmarshal([]byte(live_embedding), &live); err != nil {
+		logf(ctx, "warning: ignoring invalid live_embedding for %q: %v", username, err)
+		return
+	}
+
+	if stored == nil {
+		value, err := rdb.Get(ctx, embeddingKey(username)).Result()
+		if err == redis.Nil {
+			logf(ctx, "warning: %q has no stored embedding to compare the live one to", username)
+			return
+		} else if err != nil {
+			logf(ctx, "failed to read embedding of %q: %v", username, err)
+			return
+		}
+		if stored, err = decodeStoredEmbedding(value); err != nil {
+			logf(ctx, "failed to decode embedding of %q: %v", username, err)
+			return
+		}
+	}
+
+	cosine, l2, err := embeddingSimilarity(live, stored)
+	if err != nil {
+		logf(ctx, "warning: can't compare live embedding of %q: %v", username, err)
+		return
+	}
+	checkWrite(rdb.HSet(ctx, pilotKey(username),
+		"match_cosine", strconv.FormatFloat(cosine, 'g', -1, 64),
+		"match_l2", strconv.FormatFloat(l2, 'g', -1, 64),
+	).Err(), "store match quality of %q", username)
+	debugCtxf(ctx, "Match quality of %q: cosine %.4f, L2 %.4f", username, cosine, l2)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddingSimilarity(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		a, b       []float64
+		cosine, l2 float64
+		// Start of the expected error, "" for none
+		err string
+	}{
+		{"identical", []float64{1, 2, 3}, []float64{1, 2, 3}, 1, 0, ""},
+		{"scaled", []float64{1, 0}, []float64{3, 0}, 1, 2, ""},
+		{"orthogonal", []float64{1, 0}, []float64{0, 1}, 0, math.Sqrt2, ""},
+		{"opposite", []float64{1, 1}, []float64{-1, -1}, -1, 2 * math.Sqrt2, ""},
+		{"angled", []float64{3, 4}, []float64{4, 3}, 24.0 / 25, math.Sqrt2, ""},
+		{"empty", nil, []float64{1}, 0, 0, "empty embedding"},
+		{"mismatch", []float64{1, 2}, []float64{1, 2, 3}, 0, 0, "dimension mismatch: 2 against 3"},
+		{"zero", []float64{0, 0}, []float64{1, 0}, 0, 0, "zero embedding has no direction"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cosine, l2, err := embeddingSimilarity(tt.a, tt.b)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("embeddingSimilarity = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("embeddingSimilarity: %v", err)
+			}
+			if math.Abs(cosine-tt.cosine) > 1e-12 || math.Abs(l2-tt.l2) > 1e-12 {
+				t.Errorf("embeddingSimilarity = %v, %v, want %v, %v", cosine, l2, tt.cosine, tt.l2)
+			}
+		})
+	}
+}
+
+func TestRecordMatchQuality(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	stored, err := encodeStoredEmbedding([]float64{3, 4})
+	if err != nil {
+		t.Fatalf("encodeStoredEmbedding: %v", err)
+	}
+	rdb.Set(ctx, embeddingKey("alice"), stored, 0)
+	rdb.HSet(ctx, pilotKey("alice"), "username", "alice")
+
+	// Loaded from Redis when the caller doesn't have it
+	recordMatchQuality(ctx, rdb, "alice", "[4, 3]", nil)
+	hash := fr.hash(0, pilotKey("alice"))
+	if hash["match_cosine"] != strconv.FormatFloat(24.0/25, 'g', -1, 64) || hash["match_l2"] != strconv.FormatFloat(math.Sqrt2, 'g', -1, 64) {
+		t.Fatalf("match quality = %q, %q, want 0.96 and sqrt(2)", hash["match_cosine"], hash["match_l2"])
+	}
+
+	// The caller's copy wins over Redis
+	recordMatchQuality(ctx, rdb, "alice", "[1, 0]", []float64{1, 0})
+	if hash := fr.hash(0, pilotKey("alice")); hash["match_cosine"] != "1" || hash["match_l2"] != "0" {
+		t.Fatalf("match quality = %q, %q, want 1 and 0", hash["match_cosine"], hash["match_l2"])
+	}
+
+	// A request without a live embedding clears the previous authentication's values
+	recordMatchQuality(ctx, rdb, "alice", "", nil)
+	if hash := fr.hash(0, pilotKey("alice")); hash["match_cosine"] != "" || hash["match_l2"] != "" || hash["username"] != "alice" {
+		t.Fatalf("pilot hash = %v, want only the match quality cleared", hash)
+	}
+}
+
+func TestRecordMatchQualityIgnoresBadInput(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	rdb.HSet(ctx, pilotKey("alice"), "match_cosine", "0.5", "match_l2", "1")
+
+	for _, tt := range []struct {
+		name, live string
+		stored     []float64
+		log        string
+	}{
+		{"invalid JSON", "[1, 2", []float64{1, 2}, `warning: ignoring invalid live_embedding for "alice"`},
+		{"no stored embedding", "[1, 2]", nil, `warning: "alice" has no stored embedding to compare the live one to`},
+		{"dimension mismatch", "[1, 2]", []float64{1, 2, 3}, `warning: can't compare live embedding of "alice": dimension mismatch`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			recordMatchQuality(ctx, rdb, "alice", tt.live, tt.stored)
+			if !strings.Contains(logs.String(), tt.log) {
+				t.Errorf("log doesn't mention %q:\n%s", tt.log, logs)
+			}
+			// Left alone rather than cleared, as nothing says they're wrong
+			if hash := fr.hash(0, pilotKey("alice")); hash["match_cosine"] != "0.5" || hash["match_l2"] != "1" {
+				t.Errorf("match quality = %q, %q, want it untouched", hash["match_cosine"], hash["match_l2"])
+			}
+		})
+	}
+}
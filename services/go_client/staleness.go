@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With MAX_STALENESS, every pilot hash gets stale=true once no sync has succeeded for that long,
+// so consumers making trust decisions (authentication, say) can tell the cloud has been out of
+// reach. The next successful sync removes the flag again.
+
+// Only touched by the sync thread
+var (
+	last_sync_success = time.Now()
+	// Starts out set, so a flag left behind by an earlier run is cleared by the first sync
+	stale_flagged = true
+)
+
+// flagStalePilots marks every pilot stale once the last successful sync is over MAX_STALENESS old
+func flagStalePilots(ctx context.Context, rdb *redis.Client) {
+	if cfg.MaxStaleness <= 0 || time.Since(last_sync_success) < cfg.MaxStaleness {
+		return
+	}
+	if err := setStaleFlags(ctx, rdb, true); err != nil {
+		logf(ctx, "failed to flag stale pilots: %v", err)
+		return
+	}
+	if !stale_flagged {
+		logf(ctx, "No successful sync in %v, pilots flagged stale", time.Since(last_sync_success).Round(time.Second))
+	}
+	stale_flagged = true
+}
+
+// markSyncSuccess records a successful sync, clearing the stale flags if they were set
+func markSyncSuccess(ctx context.Context, rdb *redis.Client) {
+	last_sync_success = time.Now()
+	if !stale_flagged || cfg.MaxStaleness <= 0 {
+		return
+	}
+	if err := setStaleFlags(ctx, rdb, false); err != nil {
+		logf(ctx, "failed to clear stale flags: %v", err)
+		return
+	}
+	stale_flagged = false
+}
+
+// setStaleFlags sets or removes stale on every pilot hash. Pilots stored while offline are flagged
+// by the next pass, which runs every cycle.
+func setStaleFlags(ctx context.Context, rdb *redis.Client, stale bool) error {
+	iter := rdb.Scan(ctx, 0, pilotKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		var err error
+		if stale {
+			err = rdb.HSet(ctx, iter.Val(), "stale", "true").Err()
+		} else {
+			err = rdb.HDel(ctx, iter.Val(), "stale").Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useStaleness starts the test as a fresh process would: just synced, flags possibly left behind
+func useStaleness(t *testing.T) {
+	previous_success, previous_flagged := last_sync_success, stale_flagged
+	last_sync_success, stale_flagged = time.Now(), true
+	t.Cleanup(func() { last_sync_success, stale_flagged = previous_success, previous_flagged })
+}
+
+func TestStalePilotsFlagged(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_STALENESS": "1m"})
+	useStaleness(t)
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	rdb.HSet(ctx, pilotKey("alice"), "pilot_username", "alice")
+	rdb.HSet(ctx, pilotKey("bob"), "pilot_username", "bob", "stale", "true")
+	stale := func(username string) string { return fr.hash(0, pilotKey(username))["stale"] }
+
+	// A flag left behind by an earlier run goes with the first successful sync
+	markSyncSuccess(ctx, rdb)
+	if stale("bob") != "" || stale_flagged {
+		t.Fatal("leftover stale flag survived a successful sync")
+	}
+	// Within MAX_STALENESS nothing is flagged
+	flagStalePilots(ctx, rdb)
+	if stale("alice") != "" {
+		t.Fatal("flagged stale right after a sync")
+	}
+
+	last_sync_success = time.Now().Add(-2 * time.Minute)
+	flagStalePilots(ctx, rdb)
+	if stale("alice") != "true" || stale("bob") != "true" {
+		t.Fatalf("stale = %q, %q once MAX_STALENESS passed, want both flagged", stale("alice"), stale("bob"))
+	}
+	// Pilots stored while offline are flagged by the next pass, which doesn't log again
+	rdb.HSet(ctx, pilotKey("carol"), "pilot_username", "carol")
+	flagStalePilots(ctx, rdb)
+	if stale("carol") != "true" {
+		t.Error("pilot stored while offline wasn't flagged")
+	}
+	if n := strings.Count(logs.String(), "pilots flagged stale"); n != 1 {
+		t.Errorf("logged flagging %d times, want once:\n%s", n, logs)
+	}
+
+	markSyncSuccess(ctx, rdb)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if stale(username) != "" {
+			t.Errorf("%s still flagged after a successful sync", username)
+		}
+	}
+	// Nothing to clear, so no scan
+	scans := len(slices.DeleteFunc(fr.commands(), func(name string) bool { return name != "SCAN" }))
+	markSyncSuccess(ctx, rdb)
+	if n := len(slices.DeleteFunc(fr.commands(), func(name string) bool { return name != "SCAN" })); n != scans {
+		t.Errorf("scanned %d more times with no flags set", n-scans)
+	}
+}
+
+func TestStalenessDisabled(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_STALENESS": "0s"})
+	useStaleness(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	rdb.HSet(ctx, pilotKey("alice"), "pilot_username", "alice")
+
+	last_sync_success = time.Now().Add(-24 * time.Hour)
+	flagStalePilots(ctx, rdb)
+	if got := fr.hash(0, pilotKey("alice"))["stale"]; got != "" {
+		t.Fatalf("stale = %q without MAX_STALENESS", got)
+	}
+}
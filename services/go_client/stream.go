@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PILOT_OUTPUTS picks where sync puts pilots: "keys" (the pilot hashes and embedding keys), "json"
+// (one document per pilot, see pilotjson.go) and/or "stream", which XADDs every added, changed or deleted pilot to cognicore:stream:pilots for
+// consumers that want ordered, replayable changes they can acknowledge. Entries carry the event,
+// the username and, except for deletions, the pilot's hash fields and embedding. A change whose
+// key writes fail after being streamed is streamed again when it's retried, so consumers should
+// expect repeats.
+
+func outputEnabled(output string) bool {
+	return slices.Contains(cfg.PilotOutputs, output)
+}
+
+// streamPilotChange adds a change to the pilot stream; pilot is nil for deletions
+func streamPilotChange(ctx context.Context, rdb *redis.Client, event, username string, pilot *PilotInfo) error {
+	values := map[string]any{"event": event, "username": username}
+	if pilot != nil {
+		fields := map[string]string{
+			"flight_id":             pilot.FlightID,
+			"primary_embedding":     pilot.PrimaryEmbedding,
+			"status":                pilot.Status,
+			"embedding_fingerprint": pilot.EmbeddingFingerprint,
+			"recognizable":          pilot.Recognizable,
+			"pilot_id":              pilot.PilotID,
+			"embedding_stale":       pilot.EmbeddingStale,
+		}
+		for field, value := range fields {
+			if value != "" {
+				values[field] = value
+			}
+		}
+		for field, value := range pilot.ProfileFields {
+			values[field] = value
+		}
+		for field, value := range pilot.ExtraFiles {
+			values[field] = value
+		}
+		if pilot.PersonalData != "" {
+			values["personal_data"] = pilot.PersonalData
+		}
+		if pilot.Embedding != nil {
+			embedding, err := encodeStoredEmbedding(pilot.Embedding)
+			if err != nil {
+				return err
+			}
+			values["embedding"] = embedding
+		}
+	}
+
+	return rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: pilotStreamKey,
+		MaxLen: int64(cfg.PilotStreamMaxLen),
+		Approx: true,
+		Values: values,
+	}).Err()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestStreamOutput(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_OUTPUTS": "stream"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", FlightID: "1700000000000000000", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK, Embedding: []float64{1, 2}, ProfileFields: map[string]string{"rank": "captain"}}
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK}
+	pilot_hashes := map[string]pilotHash{}
+
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice, bob}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	alice.PersonalData = `{"name":"Alice Smith"}`
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	// Unchanged: nothing streamed
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("third cycle: %v", err)
+	}
+
+	entries := fr.stream(0, pilotStreamKey)
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry["event"]+" "+entry["username"])
+	}
+	// Deletions come first within a cycle; the order of the rest isn't fixed
+	if len(got) >= 2 {
+		slices.Sort(got[:2])
+	}
+	if want := []string{"added alice", "added bob", "deleted bob", "changed alice"}; !slices.Equal(got, want) {
+		t.Fatalf("streamed %v, want %v", got, want)
+	}
+
+	var added map[string]string
+	for _, entry := range entries {
+		if entry["event"] == "added" && entry["username"] == "alice" {
+			added = entry
+		}
+	}
+	embedding, err := decodeStoredEmbedding(added["embedding"])
+	if err != nil || !slices.Equal(embedding, alice.Embedding) {
+		t.Errorf("streamed embedding %q decodes to %v (%v), want %v", added["embedding"], embedding, err, alice.Embedding)
+	}
+	for field, want := range map[string]string{"flight_id": alice.FlightID, "personal_data": `{"name":"Alice"}`, "status": PilotStatusOK, "rank": "captain"} {
+		if added[field] != want {
+			t.Errorf("streamed %s = %q, want %q", field, added[field], want)
+		}
+	}
+	if _, ok := added["recognizable"]; ok {
+		t.Error("an empty field was streamed")
+	}
+	if deleted := entries[2]; len(deleted) != 2 {
+		t.Errorf("deletion streamed %v, want only the event and username", deleted)
+	}
+
+	// Only the stream was asked for
+	if fr.exists(0, pilotKey("alice")) || fr.exists(0, embeddingKey("alice")) {
+		t.Error("pilot keys were written without the keys output")
+	}
+}
+
+func TestStreamMaxLen(t *testing.T) {
+	useConfig(t, map[string]string{"PILOT_OUTPUTS": "keys,stream", "PILOT_STREAM_MAX_LEN": "2"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if err := streamPilotChange(ctx, rdb, "deleted", username, nil); err != nil {
+			t.Fatalf("streamPilotChange: %v", err)
+		}
+	}
+	entries := fr.stream(0, pilotStreamKey)
+	if len(entries) != 2 || entries[0]["username"] != "bob" || entries[1]["username"] != "carol" {
+		t.Fatalf("stream = %v, want the last 2 entries", entries)
+	}
+}
@@ -2,160 +2,447 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"maps"
 	"time"
 
-	"github.com/RoundRobinHood/cogniflight-cloud/backend/client"
 	"github.com/mitchellh/hashstructure/v2"
 	"github.com/redis/go-redis/v9"
 )
 
+// syncPeriod is how often SyncThread resyncs all pilots (where adaptive syncing starts from)
+const syncPeriod = 5 * time.Minute
+
 type APIConfig struct {
-	Username, Password, URL string
+	Username, Password string
+	// Endpoints in order of preference; the first is the primary
+	URLs []string
 }
 
-func SyncThread(rdb *redis.Client, api_cfg APIConfig, period time.Duration) {
-	sync_start:
-	sessID, err := client.Login(api_cfg.URL+"/login", api_cfg.Username, api_cfg.Password)
-	if err != nil {
-		if !strings.Contains(err.Error(), "401") {
-			log.Println("failed to connect to server: ", err)
-			goto sync_start
-		} else {
-			log.Fatal("invalid API credentials")
-		}
-	}
-
-	socket, err := client.ConnectSocket(strings.Replace(api_cfg.URL, "http", "ws", 1)+"/cmd-socket", sessID)
-	if err != nil {
-		log.Fatal("failed to connect socket: ", err)
+// SyncThread mirrors the cloud's pilots into Redis: once right away, then every period or when
+// forced by a write to the resync control key. Both go through syncPilots, so the first run and
+// steady state can't diverge. Syncs are at least MIN_SYNC_INTERVAL apart whatever the trigger.
+func SyncThread(rdb *redis.Client, sessions *SessionManager, period time.Duration) {
+	lock := newSyncLock(rdb, cfg.SyncLockTTL)
+	if lock != nil {
+		go lock.Run()
+		lock.wait()
+		finalizeOrphanedFlights(withTrace(context.Background(), "takeover"), rdb, sessions)
 	}
 
-	pilot_hashes := map[string]uint64{}
-	session := client.NewSocketSession(socket)
-	api_client, err := session.ConnectClient("https-client")
+	pilot_hashes := firstSync(rdb, sessions)
+	rotation := &pilotRotation{rdb: rdb, stored: pilot_hashes}
+	last_sync := time.Now()
 
-	if err != nil {
-		log.Fatal("failed to create client on socket: ", err)
-	}
+	resync := resyncRequests(rdb)
+	interval := newSyncInterval(period)
+	ticker := time.NewTicker(interval.current)
+	// A forced resync is a full one, pending until a cycle completes it
+	full := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-resync:
+			log.Println("Forced resync requested")
+			full = true
+		}
 
-	if pilots, err := GetPilots(context.Background(), api_client); err != nil {
-		log.Fatal(err)
-	} else {
-		for _, pilot := range pilots {
-			if hash, err := hashstructure.Hash(pilot, hashstructure.FormatV2, &hashstructure.HashOptions{}); err != nil {
-				log.Fatal(err)
-			} else {
-				pilot_hashes[pilot.Username] = hash
-			}
-	 	}
+		// Forced requests arriving meanwhile coalesce into the one pending in resync
+		waitMinSyncInterval(last_sync)
 
-		// Check now to delete non-existent pilots
-		deletes := make([]string, 0)
-		if redis_pilots, err := rdb.Keys(context.Background(), "cognicore:data:pilot:*").Result(); err != nil {
-			log.Fatal(err)
-		} else {
-			for _, pilot := range redis_pilots {
-				if _, ok := pilot_hashes[strings.TrimPrefix(pilot, "cognicore:data:pilot:")]; !ok {
-					deletes = append(deletes, pilot)
-				}
-			}
+		markSyncCycle()
+		if !lock.Held() {
+			lock.wait()
+			finalizeOrphanedFlights(withTrace(context.Background(), "takeover"), rdb, sessions)
+			// Another syncer wrote meanwhile, so what this one last stored says nothing anymore
+			clear(pilot_hashes)
+			maps.Copy(pilot_hashes, cachedPilotHashes(context.Background(), rdb))
+		}
+		if inMaintenance(context.Background(), rdb) {
+			continue
+		}
+		last_sync = time.Now()
+		ctx := withTrace(context.Background(), "sync")
+		flagStalePilots(ctx, rdb)
+		debugCtxf(ctx, "Syncing pilots...")
 
+		api_client, gen, err := sessions.Client()
+		if err != nil {
+			logf(ctx, "failed to connect to server: %v", err)
+			continue
 		}
 
-		if redis_embeddings, err := rdb.Keys(context.Background(), "cognicore:data:embedding:*").Result(); err != nil {
-			log.Fatal(err)
-		} else {
-			for _, pilot := range redis_embeddings {
-				if _, ok := pilot_hashes[strings.TrimPrefix(pilot, "cognicore:data:embedding:")]; !ok {
-					deletes = append(deletes, pilot)
-				}
+		// Syncing data this build might misparse would corrupt Redis, so mismatches skip the cycle
+		if err := checkSchemaVersion(ctx, api_client); err != nil {
+			logf(ctx, "ERROR: not syncing: %v", err)
+			if errors.Is(err, ErrTransport) {
+				sessions.Invalidate(gen)
 			}
+			continue
 		}
 
-		if len(deletes) != 0 {
-			if err := rdb.Del(context.Background(), deletes...).Err(); err != nil {
-				panic(err)
+		cycle_rotation := rotation
+		if full {
+			// Every pilot is fetched, however dormant
+			cycle_rotation = nil
+		}
+		list, err := GetPilots(withEmbeddingCache(ctx, rdb), api_client, cycle_rotation)
+		if err != nil {
+			logf(ctx, "failed to get pilots: %v", err)
+			if errors.Is(err, ErrTransport) {
+				sessions.Invalidate(gen)
 			}
+			continue
+		}
+		if err := revalidateFlights(ctx, api_client, list.Pilots); err != nil {
+			logf(ctx, "warning: failed to recheck flights: %v", err)
 		}
 
-		// Now sync all pilot info toward Redis
-		for _, pilot := range pilots {
-			rdb.HSet(context.Background(), fmt.Sprintf("cognicore:data:pilot:%s", pilot.Username), pilot)
+		if full {
+			resetPilotHashes(pilot_hashes)
+		}
+		result, err := syncPilots(ctx, rdb, list, pilot_hashes)
+		if full && err == nil {
+			logf(ctx, "Forced resync complete, %d pilot hash(es) rebuilt", len(pilot_hashes))
+			full = false
+		}
+		if next, changed := interval.adjust(result, err == nil); changed {
+			debugCtxf(ctx, "Next sync in %v", next)
+			ticker.Reset(next)
+		}
+	}
+}
 
-			if pilot.Embedding != nil {
-				data, err := json.Marshal(pilot.Embedding)
-				if err != nil {
-					log.Fatal(err)
-				}
+// firstSync runs the first cycle right away, through syncPilots like every later one, and
+// returns the pilot hashes it stored. Pilots cached by an earlier run are seeded with a zero
+// hash: the cycle rewrites them if the cloud still lists them, and deletes them otherwise.
+func firstSync(rdb *redis.Client, sessions *SessionManager) map[string]pilotHash {
+	pilot_hashes := cachedPilotHashes(context.Background(), rdb)
+	ctx := withTrace(context.Background(), "sync")
+	syncPilots(ctx, rdb, initialPilots(rdb, sessions), pilot_hashes)
+	return pilot_hashes
+}
 
-				rdb.Set(context.Background(), fmt.Sprintf("cognicore:data:embedding:%s", pilot.Username), string(data), 0)
+// resetPilotHashes zeroes every stored pilot hash. Zero hashes make the next cycle rewrite every
+// pilot and then store the hash of what it wrote, which leaves pilot_hashes rebuilt from that
+// cycle's data. Pilots whose write fails stay zero, and are rewritten by the cycle after.
+func resetPilotHashes(pilot_hashes map[string]pilotHash) {
+	for username := range pilot_hashes {
+		pilot_hashes[username] = pilotHash{}
+	}
+}
+
+// waitMinSyncInterval holds a sync back until MIN_SYNC_INTERVAL has passed since last_sync,
+// whatever triggered it
+func waitMinSyncInterval(last_sync time.Time) {
+	if wait := cfg.MinSyncInterval - time.Since(last_sync); wait > 0 {
+		log.Printf("Last sync was under MIN_SYNC_INTERVAL ago, delaying this one by %v", wait.Round(time.Second))
+		time.Sleep(wait)
+	}
+}
+
+// resyncRequests signals writes to the resync control key. Requests made while one is already
+// pending are merged into it.
+func resyncRequests(rdb *redis.Client) <-chan struct{} {
+	requests := make(chan struct{}, 1)
+	sub := rdb.Subscribe(context.Background(), keyspaceChannel(rdb.Options().DB, resyncKey))
+	go func() {
+		for range sub.Channel() {
+			select {
+			case requests <- struct{}{}:
+			default:
 			}
 		}
+	}()
+	return requests
+}
+
+// syncPilots runs a sync cycle and reports its result
+func syncPilots(ctx context.Context, rdb *redis.Client, list PilotList, pilot_hashes map[string]pilotHash) (SyncResult, error) {
+	result, err := runSyncCycle(ctx, rdb, list, pilot_hashes)
+	if err != nil {
+		logf(ctx, "sync failed: %v", err)
+		return result, err
 	}
 
-	ticker := time.NewTicker(period)
-	for range ticker.C {
-		log.Println("Syncing pilots...")
+	logSyncResult(ctx, result)
+	markSyncSuccess(ctx, rdb)
+	reassertTestPilot(ctx, rdb)
+	metricSyncCycles.Inc()
+	metricSyncAdded.Add(result.Added)
+	metricSyncChanged.Add(result.Changed)
+	metricSyncDeleted.Add(result.Deleted)
+	metricSyncErrors.Add(result.Errors)
+	if err := publishPilotEvent(ctx, rdb, PilotEvent{Event: "sync_complete", Summary: &result}); err != nil {
+		logf(ctx, "failed to publish sync event: %v", err)
+	}
+	runPostSyncHook(ctx, result)
+	return result, nil
+}
 
-		log.Println("Getting all pilots...")
+// sync_rollup accumulates the cycles since the last SYNC_LOG_SUMMARY rollup
+var sync_rollup struct {
+	since  time.Time
+	cycles int
+	total  SyncResult
+}
 
-		pilots, err := GetPilots(context.Background(), api_client)
-		if err != nil {
-			log.Println("failed to get pilots: ", err)
-			continue
-		}
+// logSyncResult logs a finished cycle. With SYNC_LOG_SUMMARY, quiet cycles are left to the rollup.
+func logSyncResult(ctx context.Context, result SyncResult) {
+	if cfg.SyncLogSummary <= 0 {
+		logf(ctx, "sync complete: %v", result)
+		return
+	}
+
+	if result == (SyncResult{}) {
+		debugCtxf(ctx, "sync complete: %v", result)
+	} else {
+		logf(ctx, "sync complete: %v", result)
+	}
 
-		log.Println("Hashing pilots from server...")
-		new_hashes := map[string]uint64{}
-		new_pilots := map[string]PilotInfo{}
+	if sync_rollup.since.IsZero() {
+		sync_rollup.since = time.Now()
+	}
+	sync_rollup.cycles++
+	sync_rollup.total.Added += result.Added
+	sync_rollup.total.Changed += result.Changed
+	sync_rollup.total.Deleted += result.Deleted
+	sync_rollup.total.Errors += result.Errors
+	if time.Since(sync_rollup.since) < cfg.SyncLogSummary {
+		return
+	}
+	log.Printf("Sync summary: %d cycle(s) in the last %v, %v", sync_rollup.cycles, time.Since(sync_rollup.since).Round(time.Second), sync_rollup.total)
+	sync_rollup.since = time.Now()
+	sync_rollup.cycles = 0
+	sync_rollup.total = SyncResult{}
+}
 
-		failed_hash := false
-		for _, pilot := range pilots {
-			new_pilots[pilot.Username] = pilot
-			if hash, err := hashstructure.Hash(pilot, hashstructure.FormatV2, &hashstructure.HashOptions{}); err != nil {
-				log.Println("failed to hash pilot: ", err)
-				failed_hash = true
-				break
-			} else {
-				new_hashes[pilot.Username] = hash
+// cachedPilotHashes lists the usernames already cached in Redis, from pilot hashes as well as
+// embeddings, each with a zero hash
+func cachedPilotHashes(ctx context.Context, rdb *redis.Client) map[string]pilotHash {
+	pilot_hashes := map[string]pilotHash{}
+	for _, key_func := range []func(string) string{pilotKey, embeddingKey, pilotJSONKey} {
+		iter := rdb.Scan(ctx, 0, key_func("*"), 100).Iterator()
+		for iter.Next(ctx) {
+			if username, ok := usernameFromKey(iter.Val(), key_func); ok {
+				pilot_hashes[username] = pilotHash{}
 			}
 		}
-		if failed_hash {
-			continue
+		if err := iter.Err(); err != nil {
+			log.Println("failed to list cached pilots: ", err)
 		}
+	}
+	return pilot_hashes
+}
 
-		log.Println("All pilots hashed")
+// Backoff between initial sync attempts (variables so tests don't have to wait that long)
+var (
+	initialRetryDelay    = time.Second
+	initialRetryMaxDelay = time.Minute
+)
 
-		log.Println("Checking for deleted pilots...")
-		for pilot_name := range pilot_hashes {
-			if _, ok := new_hashes[pilot_name]; !ok {
-				log.Println("Pilot deleted: ", pilot_name)
-				log.Println("Removing pilot from redis...")
+// initialPilots fetches every pilot for the initial population. Login, socket and client
+// setup and the listing itself can all fail transiently, so failures are retried with backoff;
+// only rejected credentials are fatal.
+func initialPilots(rdb *redis.Client, sessions *SessionManager) PilotList {
+	for delay := initialRetryDelay; ; delay = min(delay*2, initialRetryMaxDelay) {
+		for inMaintenance(context.Background(), rdb) {
+			markSyncCycle()
+			time.Sleep(maintenancePollInterval)
+		}
 
-				rdb.Del(context.Background(), fmt.Sprintf("cognicore:data:pilot:%s", pilot_name), fmt.Sprintf("cognicore:data:embedding:%s", pilot_name))
+		api_client, gen, err := sessions.Client()
+		if err == nil {
+			err = checkSchemaVersion(context.Background(), api_client)
+		}
+		if err == nil {
+			var list PilotList
+			if list, err = GetPilots(withEmbeddingCache(context.Background(), rdb), api_client, nil); err == nil {
+				if err := revalidateFlights(context.Background(), api_client, list.Pilots); err != nil {
+					log.Println("warning: failed to recheck flights: ", err)
+				}
+				return list
+			}
+			if errors.Is(err, ErrTransport) {
+				sessions.Invalidate(gen)
 			}
 		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			log.Fatal(err)
+		}
+		flagStalePilots(context.Background(), rdb)
+		if errors.Is(err, ErrPilotsUnavailable) {
+			// Pilot requests keep being served from the cache; permissions may be granted later
+			log.Printf("ERROR: %v; serving cached pilots, retrying in %v", err, delay)
+			markSyncCycle()
+			time.Sleep(delay)
+			continue
+		}
 
-		log.Println("Checking for changed/new pilot hashes...")
-		for pilot_name, new_hash := range new_hashes {
-			if old_hash := pilot_hashes[pilot_name]; new_hash != old_hash {
-				log.Printf("Hash for %q changed from %v to %v, updating redis data...", pilot_name, old_hash, new_hash)
+		log.Printf("initial sync failed, retrying in %v: %v", delay, err)
+		// Retrying isn't being wedged
+		markSyncCycle()
+		time.Sleep(delay)
+	}
+}
 
-				rdb.HSet(context.Background(), fmt.Sprintf("cognicore:data:pilot:%s", pilot_name), new_pilots[pilot_name])
+// SyncResult summarizes what a sync cycle changed in Redis
+type SyncResult struct {
+	Added   int `json:"added"`
+	Changed int `json:"changed"`
+	Deleted int `json:"deleted"`
+	Errors  int `json:"errors"`
+}
 
-				if new_pilots[pilot_name].Embedding != nil {
-					data, err := json.Marshal(new_pilots[pilot_name].Embedding)
-					if err != nil {
-						log.Println("failed to marshal new embedding: ", err)
-					} else {
-						rdb.Set(context.Background(), fmt.Sprintf("cognicore:data:embedding:%s", pilot_name), string(data), 0)
+func (r SyncResult) String() string {
+	return fmt.Sprintf("+%d ~%d -%d, %d error(s)", r.Added, r.Changed, r.Deleted, r.Errors)
+}
+
+// pilotHash identifies what sync last stored for a pilot. The pilot hash and the embedding are
+// separate keys, so each has its own hash and only the part that changed is rewritten.
+type pilotHash struct {
+	Profile, Embedding uint64
+}
+
+func hashPilot(pilot PilotInfo) (pilotHash, error) {
+	profile, err := hashstructure.Hash(pilot, hashstructure.FormatV2, &hashstructure.HashOptions{})
+	if err != nil {
+		return pilotHash{}, err
+	}
+	embedding, err := hashstructure.Hash(pilot.Embedding, hashstructure.FormatV2, &hashstructure.HashOptions{})
+	if err != nil {
+		return pilotHash{}, err
+	}
+	return pilotHash{Profile: profile, Embedding: embedding}, nil
+}
+
+// runSyncCycle diffs the pilots fetched from the server against pilot_hashes (keyed by canonical
+// username, like Redis keys), writes the differences to Redis and updates pilot_hashes to
+// reflect what was stored. Deferred and failed pilots, and any missing from an incomplete
+// listing, are kept rather than deleted.
+func runSyncCycle(ctx context.Context, rdb *redis.Client, list PilotList, pilot_hashes map[string]pilotHash) (SyncResult, error) {
+	var result SyncResult
+	changes := make([]PilotChange, 0)
+
+	new_hashes := map[string]pilotHash{}
+	new_pilots := map[string]PilotInfo{}
+	for _, pilot := range list.Pilots {
+		new_pilots[canonicalUsername(pilot.Username)] = pilot
+		hash, err := hashPilot(pilot)
+		if err != nil {
+			return result, fmt.Errorf("failed to hash pilot: %w", err)
+		}
+		new_hashes[canonicalUsername(pilot.Username)] = hash
+	}
+	deferred := map[string]bool{}
+	for _, username := range list.Deferred {
+		deferred[canonicalUsername(username)] = true
+	}
+	for _, username := range list.Failed {
+		deferred[canonicalUsername(username)] = true
+	}
+	result.Errors += len(list.Failed)
+
+	rename_targets := renameTargets(new_pilots, pilot_hashes)
+	for pilot_name := range pilot_hashes {
+		if _, ok := new_hashes[pilot_name]; !ok {
+			if !list.Complete || deferred[pilot_name] {
+				continue
+			}
+			if pilot_name == canonicalUsername(cfg.TestPilot) || isManualPilot(ctx, rdb, pilot_name) {
+				debugCtxf(ctx, "Pilot %q is gone from the cloud but pinned or marked manual, keeping it", pilot_name)
+				delete(pilot_hashes, pilot_name)
+				continue
+			}
+			if new_name, ok := renamedTo(ctx, rdb, pilot_name, rename_targets); ok {
+				if _, taken := pilot_hashes[new_name]; !taken {
+					logf(ctx, "Pilot %q was renamed to %q, migrating their state", pilot_name, new_name)
+					if outputEnabled("stream") && !checkWrite(streamPilotRename(ctx, rdb, pilot_name, new_name), "stream rename of %q", pilot_name) {
+						result.Errors++
+						continue
+					}
+					if !checkWrite(migratePilot(ctx, rdb, pilot_name, new_name), "migrate pilot %q to %q", pilot_name, new_name) {
+						result.Errors++
+						continue
 					}
+					delete(pilot_hashes, pilot_name)
+					// A zero hash never matches, so the new username is written below, as a change
+					pilot_hashes[new_name] = pilotHash{}
+					changes = append(changes, PilotChange{Event: "renamed", Username: new_name, From: pilot_name, At: time.Now()})
+					continue
 				}
 			}
+			if inActiveFlight(ctx, rdb, pilot_name) {
+				// Left in pilot_hashes, so the deletion is retried once the flight is finalized
+				logf(ctx, "Pilot %q is gone from the cloud but in an active flight, keeping them until it ends", pilot_name)
+				continue
+			}
+			debugCtxf(ctx, "Pilot deleted: %q", pilot_name)
+			if outputEnabled("stream") && !checkWrite(streamPilotChange(ctx, rdb, "deleted", pilot_name, nil), "stream deletion of %q", pilot_name) {
+				result.Errors++
+				continue
+			}
+			if !checkWrite(removePilot(ctx, rdb, pilot_name), "remove pilot %q", pilot_name) {
+				result.Errors++
+				continue
+			}
+			delete(pilot_hashes, pilot_name)
+			result.Deleted++
+			changes = append(changes, PilotChange{Event: "deleted", Username: pilot_name, At: time.Now()})
+		}
+	}
+
+	for pilot_name, new_hash := range new_hashes {
+		old_hash, existed := pilot_hashes[pilot_name]
+		if existed && new_hash == old_hash {
+			continue
+		}
+		debugCtxf(ctx, "Hash for %q changed from %v to %v, updating redis data...", pilot_name, old_hash, new_hash)
+		pilot := new_pilots[pilot_name]
+
+		if outputEnabled("stream") {
+			event := "added"
+			if existed {
+				event = "changed"
+			}
+			if !checkWrite(streamPilotChange(ctx, rdb, event, pilot.Username, &pilot), "stream %q", pilot_name) {
+				result.Errors++
+				continue
+			}
+		}
+
+		// Only the parts that changed are rewritten, together in one transaction
+		profile_changed := !existed || new_hash.Profile != old_hash.Profile
+		embedding_changed := !existed || new_hash.Embedding != old_hash.Embedding
+		if outputEnabled("keys") && !checkWrite(writePilotParts(ctx, rdb, pilot, profile_changed, embedding_changed), "write pilot %q", pilot_name) {
+			result.Errors++
+			continue
+		}
+		if outputEnabled("json") && !checkWrite(writePilotJSON(ctx, rdb, pilot), "write pilot document %q", pilot_name) {
+			result.Errors++
+			continue
+		}
+		if pilot.EmbeddingStale != "" {
+			// A zero embedding hash has the rotation fetch the pilot every cycle until the
+			// embedding comes through, and the embedding rewritten once it does
+			new_hash.Embedding = 0
 		}
+		pilot_hashes[pilot_name] = new_hash
+
+		if existed {
+			result.Changed++
+			changes = append(changes, PilotChange{Event: "changed", Username: pilot_name, At: time.Now()})
+		} else {
+			result.Added++
+			changes = append(changes, PilotChange{Event: "added", Username: pilot_name, At: time.Now()})
+			checkWrite(clearTombstone(ctx, rdb, pilot_name), "clear tombstone of %q", pilot_name)
+		}
+	}
+
+	if err := recordPilotChanges(ctx, rdb, changes); err != nil {
+		logf(ctx, "failed to record pilot changes: %v", err)
 	}
+	return result, nil
 }
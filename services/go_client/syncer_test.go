@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPilotsListsFailedFetches(t *testing.T) {
+	useConfig(t, nil)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	cloud.addPilot("bob", "name: Bob\n", []float64{3, 4})
+	// carol is listed, but has no profile at all
+	cloud.setPilots("alice", "bob", "carol")
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command == "cat "+homeFile("alice", "user.profile") {
+			return "", "cat: permission denied\n", 1, true
+		}
+		return "", "", 0, false
+	})
+
+	list, err := GetPilots(context.Background(), cloud.connect(), nil)
+	if err != nil {
+		t.Fatalf("GetPilots: %v", err)
+	}
+	if len(list.Pilots) != 1 || list.Pilots[0].Username != "bob" {
+		t.Errorf("got pilots %+v, want only bob", list.Pilots)
+	}
+	if !slices.Equal(list.Failed, []string{"alice", "carol"}) {
+		t.Errorf("failed = %v, want [alice carol]", list.Failed)
+	}
+}
+
+func TestSyncCountsFailedPilots(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK}
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice, bob}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+
+	// alice fails to fetch, carol is new, bob is gone
+	carol := PilotInfo{Username: "carol", PersonalData: `{"name":"Carol"}`, Status: PilotStatusOK}
+	result, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{carol}, Failed: []string{"alice"}, Complete: true}, pilot_hashes)
+	if err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if want := (SyncResult{Added: 1, Deleted: 1, Errors: 1}); result != want {
+		t.Errorf("result = %v, want %v", result, want)
+	}
+	if !fr.exists(0, pilotKey("alice")) {
+		t.Error("alice was deleted for failing to fetch")
+	}
+	if _, ok := pilot_hashes["alice"]; !ok {
+		t.Error("alice was dropped from the pilot hashes")
+	}
+	if fr.exists(0, pilotKey("bob")) {
+		t.Error("bob wasn't deleted")
+	}
+}
+
+func TestInitialPilotsBackoff(t *testing.T) {
+	useConfig(t, nil)
+	previous_delay, previous_max := initialRetryDelay, initialRetryMaxDelay
+	initialRetryDelay, initialRetryMaxDelay = 10*time.Millisecond, 40*time.Millisecond
+	t.Cleanup(func() { initialRetryDelay, initialRetryMaxDelay = previous_delay, previous_max })
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	failures := 0
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		if command == "pilots" && failures < 5 {
+			failures++
+			return "", "pilots: temporarily unavailable\n", 1, true
+		}
+		return "", "", 0, false
+	})
+
+	list := initialPilots(fr.client(0), newTestSessions(cloud.URL))
+	if len(list.Pilots) != 1 || list.Pilots[0].Username != "alice" {
+		t.Fatalf("initial pilots = %+v, want alice", list.Pilots)
+	}
+	var delays []string
+	for line := range strings.Lines(logs.String()) {
+		if _, rest, ok := strings.Cut(line, "initial sync failed, retrying in "); ok {
+			delay, _, _ := strings.Cut(rest, ":")
+			delays = append(delays, delay)
+		}
+	}
+	if want := []string{"10ms", "20ms", "40ms", "40ms", "40ms"}; !slices.Equal(delays, want) {
+		t.Fatalf("retried after %v, want %v:\n%s", delays, want, logs)
+	}
+}
+
+func TestFirstSyncRunsACycle(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	// bob was cached by an earlier run, and the cloud no longer lists him
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{bob}, Complete: true}, map[string]pilotHash{}); err != nil {
+		t.Fatalf("seeding bob: %v", err)
+	}
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+
+	pilot_hashes := firstSync(rdb, newTestSessions(cloud.URL))
+	if !fr.exists(0, pilotKey("alice")) {
+		t.Error("alice wasn't written by the first cycle")
+	}
+	if fr.exists(0, pilotKey("bob")) {
+		t.Error("bob's stale cache survived the first cycle")
+	}
+	if _, ok := pilot_hashes["alice"]; !ok || len(pilot_hashes) != 1 {
+		t.Errorf("pilot hashes = %v, want only alice", pilot_hashes)
+	}
+	if cloud.count("pilots") != 1 {
+		t.Errorf("listed pilots %d times, want once", cloud.count("pilots"))
+	}
+}
+
+func TestResetPilotHashesRebuilds(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK, Embedding: []float64{1, 2}}
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK, Embedding: []float64{3, 4}}
+	list := PilotList{Pilots: []PilotInfo{alice, bob}, Complete: true}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, list, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	// Changed behind the syncer's back, which the stored hashes can't see
+	rdb.HSet(ctx, pilotKey("alice"), "personal_data", `{"name":"Mallory"}`)
+	rdb.Del(ctx, embeddingKey("bob"))
+	if result, err := runSyncCycle(ctx, rdb, list, pilot_hashes); err != nil || result.Changed != 0 {
+		t.Fatalf("ordinary cycle = %v (%v), want nothing rewritten", result, err)
+	}
+
+	resetPilotHashes(pilot_hashes)
+	result, err := runSyncCycle(ctx, rdb, list, pilot_hashes)
+	if err != nil {
+		t.Fatalf("full cycle: %v", err)
+	}
+	if result.Changed != 2 {
+		t.Errorf("result = %v, want both pilots rewritten", result)
+	}
+	if got := fr.hash(0, pilotKey("alice"))["personal_data"]; got != string(alice.PersonalData) {
+		t.Errorf("alice's personal_data = %q, want it restored", got)
+	}
+	if !fr.exists(0, embeddingKey("bob")) {
+		t.Error("bob's embedding wasn't restored")
+	}
+	for _, pilot := range list.Pilots {
+		want, err := hashPilot(pilot)
+		if err != nil {
+			t.Fatalf("hashPilot: %v", err)
+		}
+		if got := pilot_hashes[pilot.Username]; got != want {
+			t.Errorf("%s's hash = %v, want it rebuilt as %v", pilot.Username, got, want)
+		}
+	}
+	// Rebuilt hashes take over again, so the next cycle rewrites nothing
+	if result, err := runSyncCycle(ctx, rdb, list, pilot_hashes); err != nil || result.Changed != 0 {
+		t.Errorf("cycle after the full one = %v (%v), want nothing rewritten", result, err)
+	}
+}
+
+func TestMinSyncInterval(t *testing.T) {
+	useConfig(t, map[string]string{"MIN_SYNC_INTERVAL": "200ms"})
+	logs := captureLog(t)
+
+	start := time.Now()
+	waitMinSyncInterval(start.Add(-50 * time.Millisecond))
+	if took := time.Since(start); took < 140*time.Millisecond {
+		t.Errorf("sync 50ms after the last one waited %v, want about 150ms", took)
+	}
+	if !strings.Contains(logs.String(), "Last sync was under MIN_SYNC_INTERVAL ago") {
+		t.Errorf("the delay wasn't logged:\n%s", logs)
+	}
+
+	start = time.Now()
+	waitMinSyncInterval(start.Add(-time.Second))
+	if took := time.Since(start); took > 50*time.Millisecond {
+		t.Errorf("sync long after the last one waited %v", took)
+	}
+}
+
+func TestForcedResyncsCoalesce(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	resync := resyncRequests(rdb)
+
+	// The subscription is set up in the background, so request until one is seen
+	deadline := time.After(5 * time.Second)
+	for received := false; !received; {
+		rdb.Set(ctx, resyncKey, "1", 0)
+		select {
+		case <-resync:
+			received = true
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("resync request wasn't signalled")
+		}
+	}
+
+	// A burst while a sync is busy leaves a single one pending
+	for range 5 {
+		rdb.Set(ctx, resyncKey, "1", 0)
+	}
+	time.Sleep(100 * time.Millisecond)
+	pending := 0
+	for drained := false; !drained; {
+		select {
+		case <-resync:
+			pending++
+		default:
+			drained = true
+		}
+	}
+	if pending != 1 {
+		t.Fatalf("%d resyncs pending after a burst of 5, want 1", pending)
+	}
+}
+
+func TestInitialPilotsWithoutPilotsPermission(t *testing.T) {
+	useConfig(t, nil)
+	previous_delay, previous_max := initialRetryDelay, initialRetryMaxDelay
+	initialRetryDelay, initialRetryMaxDelay = 10*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { initialRetryDelay, initialRetryMaxDelay = previous_delay, previous_max })
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK}
+	if _, err := runSyncCycle(context.Background(), rdb, PilotList{Pilots: []PilotInfo{bob}, Complete: true}, map[string]pilotHash{}); err != nil {
+		t.Fatalf("seeding bob: %v", err)
+	}
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	denied := 0
+	cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+		// Until the permission is granted
+		if command == "pilots" && denied < 2 {
+			denied++
+			return "", "pilots: permission denied\n", 1, true
+		}
+		return "", "", 0, false
+	})
+
+	list := initialPilots(rdb, newTestSessions(cloud.URL))
+	if len(list.Pilots) != 1 || list.Pilots[0].Username != "alice" {
+		t.Fatalf("initial pilots = %+v, want alice once permitted", list.Pilots)
+	}
+	if n := strings.Count(logs.String(), "ERROR: "+ErrPilotsUnavailable.Error()); n != 2 {
+		t.Errorf("reported the missing permission %d times, want 2:\n%s", n, logs)
+	}
+	if strings.Contains(logs.String(), "initial sync failed") {
+		t.Errorf("missing permission was reported as a transient failure:\n%s", logs)
+	}
+	// The cache kept serving meanwhile
+	if !fr.exists(0, pilotKey("bob")) {
+		t.Error("bob's cached entry was dropped while the cloud couldn't list pilots")
+	}
+}
+
+// useSyncRollup starts the test with an empty SYNC_LOG_SUMMARY rollup
+func useSyncRollup(t *testing.T) {
+	previous := sync_rollup
+	sync_rollup.since, sync_rollup.cycles, sync_rollup.total = time.Time{}, 0, SyncResult{}
+	t.Cleanup(func() { sync_rollup = previous })
+}
+
+func TestLogSyncResult(t *testing.T) {
+	useConfig(t, map[string]string{"SYNC_LOG_SUMMARY": "0s"})
+	useSyncRollup(t)
+	logs := captureLog(t)
+	ctx := context.Background()
+
+	logSyncResult(ctx, SyncResult{})
+	logSyncResult(ctx, SyncResult{Added: 1})
+	if want := "sync complete: +0 ~0 -0, 0 error(s)\nsync complete: +1 ~0 -0, 0 error(s)\n"; logs.String() != want {
+		t.Fatalf("logged %q, want every cycle", logs)
+	}
+	if sync_rollup.cycles != 0 {
+		t.Error("cycles were rolled up without SYNC_LOG_SUMMARY")
+	}
+}
+
+func TestLogSyncResultRollup(t *testing.T) {
+	useConfig(t, map[string]string{"SYNC_LOG_SUMMARY": "1h"})
+	useSyncRollup(t)
+	logs := captureLog(t)
+	ctx := context.Background()
+
+	logSyncResult(ctx, SyncResult{})
+	if logs.String() != "" {
+		t.Fatalf("quiet cycle logged %q, want it left to the rollup", logs)
+	}
+	logSyncResult(ctx, SyncResult{Added: 2, Errors: 1})
+	if !strings.Contains(logs.String(), "sync complete: +2 ~0 -0, 1 error(s)") {
+		t.Fatalf("busy cycle wasn't logged:\n%s", logs)
+	}
+	if strings.Contains(logs.String(), "Sync summary") {
+		t.Fatalf("summarized before SYNC_LOG_SUMMARY passed:\n%s", logs)
+	}
+
+	// An hour on
+	sync_rollup.since = time.Now().Add(-time.Hour)
+	logSyncResult(ctx, SyncResult{Changed: 3, Deleted: 1})
+	if !strings.Contains(logs.String(), "Sync summary: 3 cycle(s) in the last 1h0m0s, +2 ~3 -1, 1 error(s)\n") {
+		t.Fatalf("rollup wasn't logged with the totals:\n%s", logs)
+	}
+	if sync_rollup.cycles != 0 || sync_rollup.total != (SyncResult{}) || time.Since(sync_rollup.since) > time.Minute {
+		t.Errorf("rollup = %+v, want it started over", sync_rollup)
+	}
+}
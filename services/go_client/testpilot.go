@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TEST_PILOT pins a pilot as authenticated without face recognition, for bench testing. The pilot
+// is fetched and written at startup, kept authenticated after every sync and never deleted by
+// sync. Builds with the "production" tag refuse to start with it set.
+
+// Delay between attempts to pin the test pilot (a variable so tests don't have to wait that long)
+var pinRetryDelay = 5 * time.Second
+
+// pinTestPilot writes the test pilot as authenticated, retrying until it succeeds
+func pinTestPilot(rdb *redis.Client, sessions *SessionManager) {
+	for {
+		ctx := withTrace(context.Background(), "pin")
+		if err := writeTestPilot(ctx, rdb, sessions); err != nil {
+			logf(ctx, "failed to pin test pilot %q, retrying: %v", cfg.TestPilot, err)
+			time.Sleep(pinRetryDelay)
+			continue
+		}
+		logf(ctx, "TEST PILOT %q pinned as authenticated", cfg.TestPilot)
+		return
+	}
+}
+
+func writeTestPilot(ctx context.Context, rdb *redis.Client, sessions *SessionManager) error {
+	api_client, _, err := sessions.Client()
+	if err != nil {
+		return err
+	}
+	pilot, err := GetPilotFromServer(ctx, api_client, cfg.TestPilot)
+	if err != nil {
+		return err
+	}
+
+	pilot.Authenticated = true
+	return writePilot(ctx, rdb, *pilot)
+}
+
+// reassertTestPilot keeps the test pilot authenticated, e.g. after its flag expired
+func reassertTestPilot(ctx context.Context, rdb *redis.Client) {
+	if cfg.TestPilot == "" {
+		return
+	}
+	exists, err := rdb.Exists(ctx, pilotKey(cfg.TestPilot)).Result()
+	if err != nil || exists == 0 {
+		return
+	}
+	checkWrite(updatePilot(ctx, rdb, cfg.TestPilot, []any{"authenticated", AuthFlag(true)}), "pin test pilot %q", cfg.TestPilot)
+}
+
+func checkTestPilotAllowed() {
+	if cfg.TestPilot != "" && productionBuild {
+		log.Fatalf("TEST_PILOT is set (%q), which production builds refuse", cfg.TestPilot)
+	}
+}
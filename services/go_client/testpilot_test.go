@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPinTestPilot(t *testing.T) {
+	useConfig(t, map[string]string{"TEST_PILOT": "alice", "BREAKER_COOLDOWN": "20ms"})
+	previous := pinRetryDelay
+	pinRetryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { pinRetryDelay = previous })
+	logs := captureLog(t)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	cloud := newFakeCloud(t)
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	// The cloud is down for the first attempts
+	cloud.setDown(true)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cloud.setDown(false)
+	}()
+
+	pinTestPilot(rdb, newTestSessions(cloud.URL))
+	if got := fr.hash(0, pilotKey("alice"))["authenticated"]; got != "true" {
+		t.Fatalf("authenticated = %q, want \"true\"", got)
+	}
+	if !strings.Contains(logs.String(), `failed to pin test pilot "alice", retrying`) || !strings.Contains(logs.String(), `TEST PILOT "alice" pinned`) {
+		t.Errorf("log:\n%s", logs)
+	}
+}
+
+func TestTestPilotSurvivesSync(t *testing.T) {
+	useConfig(t, map[string]string{"TEST_PILOT": "alice"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK, Authenticated: true}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := syncPilots(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	// The authentication expired, or a consumer cleared it; the next sync pins it again
+	rdb.HSet(ctx, pilotKey("alice"), "authenticated", "false")
+	alice.Authenticated = false
+	alice.PersonalData = `{"name":"Alice Smith"}`
+	if _, err := syncPilots(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	if got := fr.hash(0, pilotKey("alice"))["authenticated"]; got != "true" {
+		t.Fatalf("authenticated = %q after a sync, want \"true\"", got)
+	}
+
+	// Gone from the cloud, but pinned
+	result, err := syncPilots(ctx, rdb, PilotList{Complete: true}, pilot_hashes)
+	if err != nil {
+		t.Fatalf("third sync: %v", err)
+	}
+	if result.Deleted != 0 || !fr.exists(0, pilotKey("alice")) {
+		t.Fatal("sync deleted the test pilot")
+	}
+}
+
+func TestReassertWithoutTestPilot(t *testing.T) {
+	useConfig(t, nil)
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	rdb.HSet(context.Background(), pilotKey("alice"), "pilot_username", "alice", "authenticated", "false")
+
+	reassertTestPilot(context.Background(), rdb)
+	if got := fr.hash(0, pilotKey("alice"))["authenticated"]; got != "false" {
+		t.Fatalf("authenticated = %q without TEST_PILOT, want it untouched", got)
+	}
+
+	// A test pilot that isn't cached yet isn't created from nothing
+	useConfig(t, map[string]string{"TEST_PILOT": "bob"})
+	reassertTestPilot(context.Background(), rdb)
+	if fr.exists(0, pilotKey("bob")) {
+		t.Fatal("reasserting created the test pilot")
+	}
+}
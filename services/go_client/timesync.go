@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CommandTimings accumulates how long cloud commands took, by kind (see commandKind)
+type CommandTimings struct {
+	mu     sync.Mutex
+	Totals map[string]time.Duration
+	Counts map[string]int
+}
+
+type commandTimingsKey struct{}
+
+// withCommandTimings makes every command run with the returned context count toward timings
+func withCommandTimings(ctx context.Context) (context.Context, *CommandTimings) {
+	timings := &CommandTimings{Totals: map[string]time.Duration{}, Counts: map[string]int{}}
+	return context.WithValue(ctx, commandTimingsKey{}, timings), timings
+}
+
+func recordCommand(ctx context.Context, command string, took time.Duration) {
+	timings, ok := ctx.Value(commandTimingsKey{}).(*CommandTimings)
+	if !ok {
+		return
+	}
+
+	kind := commandKind(command)
+	timings.mu.Lock()
+	timings.Totals[kind] += took
+	timings.Counts[kind]++
+	timings.mu.Unlock()
+}
+
+// commandKind groups command lines into profile, embedding, flights, list and other
+func commandKind(command string) string {
+	name, args, _ := strings.Cut(command, " ")
+	switch {
+	case name == "pilots":
+		return "list"
+	case strings.Contains(args, cfg.FlightsDir):
+		return "flights"
+	case name == "cat" && slices.Contains(cfg.ProfileFilenames, path.Base(args)):
+		return "profile"
+	case name == "cat" && slices.Contains(cfg.EmbeddingFilenames, path.Base(args)):
+		return "embedding"
+	}
+	return "other"
+}
+
+// RunTimeSync runs one full sync cycle and reports where the time went, to size the sync period
+// for a device and link. It writes exactly what a normal sync would. Usage: time-sync
+func RunTimeSync(ctx context.Context, rdb *redis.Client, out io.Writer) error {
+	sessions := NewSessionManager(cfg.APIConfig())
+	ctx, timings := withCommandTimings(withTrace(ctx, "sync"))
+
+	start := time.Now()
+	api_client, _, err := sessions.Client()
+	if err != nil {
+		return err
+	}
+	connected := time.Since(start)
+
+	usernames, err := listPilots(ctx, api_client)
+	if err != nil {
+		return err
+	}
+
+	pilots := make([]PilotInfo, 0, len(usernames))
+	var slowest string
+	var slowest_took time.Duration
+	for _, username := range usernames {
+		pilot_start := time.Now()
+		pilot, err := GetPilotFromServer(ctx, api_client, username)
+		if errors.Is(err, ErrPilotRejected) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get pilot (%q): %w", username, err)
+		}
+		if took := time.Since(pilot_start); took > slowest_took {
+			slowest, slowest_took = username, took
+		}
+		pilots = append(pilots, *pilot)
+	}
+	fetched := time.Since(start)
+
+	list := PilotList{Pilots: pilots, Complete: true}
+	if err := verifyPilotList(ctx, api_client, usernames); errors.Is(err, ErrPilotListMismatch) {
+		fmt.Fprintf(out, "warning: not deleting pilots: %v\n", err)
+		list.Complete = false
+	} else if err != nil {
+		return err
+	}
+	result, err := runSyncCycle(ctx, rdb, list, cachedPilotHashes(ctx, rdb))
+	if err != nil {
+		return err
+	}
+	total := time.Since(start)
+
+	fmt.Fprintf(out, "total:        %v\n", total.Round(time.Millisecond))
+	fmt.Fprintf(out, "connect:      %v\n", connected.Round(time.Millisecond))
+	fmt.Fprintf(out, "fetch:        %v\n", (fetched - connected).Round(time.Millisecond))
+	fmt.Fprintf(out, "redis writes: %v\n", (total - fetched).Round(time.Millisecond))
+	fmt.Fprintf(out, "pilots:       %d (%v)\n", len(pilots), result)
+	for _, kind := range []string{"list", "profile", "embedding", "flights", "other"} {
+		if count := timings.Counts[kind]; count != 0 {
+			fmt.Fprintf(out, "  %-10s %d command(s), %v\n", kind+":", count, timings.Totals[kind].Round(time.Millisecond))
+		}
+	}
+	if slowest != "" {
+		fmt.Fprintf(out, "slowest pilot: %q (%v)\n", slowest, slowest_took.Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCommandKind(t *testing.T) {
+	useConfig(t, map[string]string{"EMBEDDING_FILENAMES": "user.embedding,face.embedding"})
+	for command, want := range map[string]string{
+		"pilots":                                   "list",
+		"cat /home/alice/user.profile":             "profile",
+		"cat /home/alice/face.embedding":           "embedding",
+		"cat flights/ZS-ABC.flight":                "flights",
+		"ls -yl flights/":                          "flights",
+		"echo -n ok":                               "other",
+		"cat /home/alice/notes.txt":                "other",
+		"tee /home/alice/user.embedding.orig-copy": "other",
+	} {
+		if got := commandKind(command); got != want {
+			t.Errorf("commandKind(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestRunTimeSync(t *testing.T) {
+	cloud := newFakeCloud(t)
+	useConfig(t, map[string]string{"API_URL": cloud.URL})
+	cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+	cloud.addPilot("bob", "name: Bob\n", []float64{3, 4})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	carol := PilotInfo{Username: "carol", PersonalData: `{"name":"Carol"}`, Status: PilotStatusOK}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{carol}, Complete: true}, map[string]pilotHash{}); err != nil {
+		t.Fatalf("seeding carol: %v", err)
+	}
+
+	out := &strings.Builder{}
+	if err := RunTimeSync(ctx, rdb, out); err != nil {
+		t.Fatalf("RunTimeSync: %v", err)
+	}
+	for _, want := range []string{"total:", "connect:", "fetch:", "redis writes:", "pilots:       2 ", "list:", "profile:   2 command(s)", "embedding: 2 command(s)", "slowest pilot:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out)
+		}
+	}
+
+	// The cycle is a normal one: listed pilots written, stale ones deleted
+	if !fr.exists(0, pilotKey("alice")) || !fr.exists(0, pilotKey("bob")) {
+		t.Error("synced pilots weren't written")
+	}
+	if fr.exists(0, pilotKey("carol")) {
+		t.Error("carol's stale cache survived")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With TOMBSTONE_TTL, every pilot sync deletes (or renames away) is recorded in the sorted set
+// cognicore:data:deleted_pilots, the username scored by when it was deleted (unix milliseconds),
+// so consumers can clear their own caches of a pilot rather than only find their keys gone.
+// Tombstones older than TOMBSTONE_TTL are trimmed, and a pilot that comes back loses theirs.
+// PILOT_DELETE_KEYS=false leaves a deleted pilot's keys in place, the tombstone being the only
+// trace of the deletion.
+
+// removePilot deletes a pilot's keys and records their tombstone, as configured
+func removePilot(ctx context.Context, rdb *redis.Client, username string) error {
+	pipelined := rdb.TxPipelined
+	if cfg.KeyScheme == "cluster" {
+		// The tombstone set isn't in the pilot's slot, which MULTI can't span
+		pipelined = rdb.Pipelined
+	}
+	_, err := pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if cfg.DeletePilotKeys {
+			// Every output's keys go, so one left behind by a since-disabled output doesn't linger
+			pipe.Del(ctx, pilotKey(username), embeddingKey(username), pilotJSONKey(username))
+		}
+		addTombstone(ctx, pipe, username)
+		return nil
+	})
+	return err
+}
+
+func addTombstone(ctx context.Context, pipe redis.Pipeliner, username string) {
+	if cfg.TombstoneTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	pipe.ZAdd(ctx, deletedPilotsKey, redis.Z{Score: float64(now.UnixMilli()), Member: canonicalUsername(username)})
+	cutoff := now.Add(-cfg.TombstoneTTL).UnixMilli()
+	pipe.ZRemRangeByScore(ctx, deletedPilotsKey, "-inf", "("+strconv.FormatInt(cutoff, 10))
+}
+
+// clearTombstone drops the tombstone of a pilot sync stores again
+func clearTombstone(ctx context.Context, rdb *redis.Client, username string) error {
+	if cfg.TombstoneTTL <= 0 {
+		return nil
+	}
+	return rdb.ZRem(ctx, deletedPilotsKey, canonicalUsername(username)).Err()
+}
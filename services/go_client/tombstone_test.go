@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTombstones(t *testing.T) {
+	useConfig(t, map[string]string{"TOMBSTONE_TTL": "1h", "PILOT_OUTPUTS": "keys,json"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	alice := PilotInfo{Username: "alice", PersonalData: `{"name":"Alice"}`, Status: PilotStatusOK}
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK, Embedding: []float64{1, 2}}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice, bob}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	// Past TOMBSTONE_TTL, so trimmed by the next deletion
+	rdb.ZAdd(ctx, deletedPilotsKey, redis.Z{Score: float64(time.Now().Add(-2 * time.Hour).UnixMilli()), Member: "carol"})
+
+	before := time.Now().UnixMilli()
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	for _, key := range []string{pilotKey("bob"), embeddingKey("bob"), pilotJSONKey("bob")} {
+		if fr.exists(0, key) {
+			t.Errorf("%s kept after bob was deleted", key)
+		}
+	}
+	tombstones := fr.zset(0, deletedPilotsKey)
+	if at, ok := tombstones["bob"]; !ok || at < float64(before) || at > float64(time.Now().UnixMilli()) {
+		t.Errorf("tombstones = %v, want bob's scored with when he was deleted", tombstones)
+	}
+	if _, ok := tombstones["carol"]; ok {
+		t.Error("tombstone older than TOMBSTONE_TTL wasn't trimmed")
+	}
+
+	// A pilot that comes back loses their tombstone
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{alice, bob}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("third cycle: %v", err)
+	}
+	if _, ok := fr.zset(0, deletedPilotsKey)["bob"]; ok {
+		t.Error("bob's tombstone kept after he came back")
+	}
+}
+
+func TestTombstonesDisabled(t *testing.T) {
+	useConfig(t, map[string]string{"TOMBSTONE_TTL": "0s"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+
+	if err := removePilot(ctx, rdb, "bob"); err != nil {
+		t.Fatalf("removePilot: %v", err)
+	}
+	if err := clearTombstone(ctx, rdb, "bob"); err != nil {
+		t.Fatalf("clearTombstone: %v", err)
+	}
+	if fr.exists(0, deletedPilotsKey) {
+		t.Error("tombstone recorded without TOMBSTONE_TTL")
+	}
+}
+
+func TestTombstoneKeepsKeys(t *testing.T) {
+	useConfig(t, map[string]string{"TOMBSTONE_TTL": "1h", "PILOT_DELETE_KEYS": "false"})
+	fr := newFakeRedis(t)
+	rdb := fr.client(0)
+	ctx := context.Background()
+	bob := PilotInfo{Username: "bob", PersonalData: `{"name":"Bob"}`, Status: PilotStatusOK, Embedding: []float64{1, 2}}
+	pilot_hashes := map[string]pilotHash{}
+	if _, err := runSyncCycle(ctx, rdb, PilotList{Pilots: []PilotInfo{bob}, Complete: true}, pilot_hashes); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+
+	result, err := runSyncCycle(ctx, rdb, PilotList{Complete: true}, pilot_hashes)
+	if err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if result.Deleted != 1 {
+		t.Errorf("result = %v, want bob counted as deleted", result)
+	}
+	if !fr.exists(0, pilotKey("bob")) || !fr.exists(0, embeddingKey("bob")) {
+		t.Error("bob's keys were deleted under PILOT_DELETE_KEYS=false")
+	}
+	if _, ok := fr.zset(0, deletedPilotsKey)["bob"]; !ok {
+		t.Error("bob wasn't tombstoned")
+	}
+}
@@ -1,15 +1,93 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
+
 	"github.com/RoundRobinHood/cogniflight-cloud/backend/types"
 )
 
 type PilotInfo struct {
-	Username      string    `redis:"pilot_username,omitempty"`
-	FlightID      string    `redis:"flight_id,omitempty"`
-	Authenticated string    `redis:"authenticated,omitempty" hash:"ignore"`
-	PersonalData  string    `redis:"personal_data,omitempty"`
-	Embedding     []float64 `redis:"-"`
+	Username      string      `redis:"pilot_username,omitempty"`
+	FlightID      string      `redis:"flight_id,omitempty"`
+	Authenticated AuthFlag    `redis:"authenticated,omitempty" hash:"ignore"`
+	PersonalData  ProfileData `redis:"personal_data,omitempty"`
+	// Redis key of the embedding recognition should prefer for this pilot
+	PrimaryEmbedding string `redis:"primary_embedding,omitempty"`
+	// Stored under its own key, and hashed separately from the rest (see pilotHash)
+	Embedding []float64 `redis:"-" hash:"ignore"`
+	// One of the PilotStatus* values, so problems can be queried rather than found in logs
+	Status string `redis:"status,omitempty"`
+	// "false" for pilots without an embedding under NO_EMBEDDING_POLICY=mark, unset otherwise
+	Recognizable string `redis:"recognizable,omitempty"`
+	// "true" when the embedding couldn't be fetched and the previously stored one was kept
+	// (DEGRADED_EMBEDDINGS), unset otherwise
+	EmbeddingStale string `redis:"embedding_stale,omitempty"`
+	// Version of the embedding file the stored embedding came from (EMBEDDING_FINGERPRINTS)
+	EmbeddingFingerprint string `redis:"embedding_fingerprint,omitempty"`
+	// Stable ID from the profile (PILOT_ID_FIELD), which survives a change of username
+	PilotID string `redis:"pilot_id,omitempty"`
+	// Profile values promoted to hash fields of their own by PROFILE_FIELD_MAP
+	ProfileFields map[string]string `redis:"-"`
+	// Contents of the EXTRA_FILES found in the pilot's home, by hash field
+	ExtraFiles map[string]string `redis:"-"`
+}
+
+// reservedPilotFields can't be targets of PROFILE_FIELD_MAP
+var reservedPilotFields = []string{"pilot_username", "flight_id", "authenticated", "personal_data", "primary_embedding", "status", "embedding_fingerprint", "recognizable", "match_cosine", "match_l2", "manual", "pilot_id", "stale", "embedding_stale", "signature"}
+
+const (
+	PilotStatusOK = "ok"
+	// The pilot has no user.embedding, so can't be recognized
+	PilotStatusNoEmbedding = "no_embedding"
+	// user.embedding exists but couldn't be decoded; it is treated as missing
+	PilotStatusDecodeError = "decode_error"
+	// user.profile isn't valid YAML, or not a mapping; personal_data is left empty
+	PilotStatusProfileInvalid = "profile_invalid"
+	// user.profile has no content (empty, or only whitespace/comments); personal_data is left empty
+	PilotStatusProfileEmpty = "profile_empty"
+	// The profile was over PROFILE_MAX_BYTES and only a summary is stored
+	PilotStatusProfileTruncated = "profile_truncated"
+	// user.embedding had NaN or Inf values, stored zeroed under NON_FINITE_EMBEDDING_POLICY=flag
+	PilotStatusNonFinite = "non_finite"
+)
+
+// AuthFlag is stored as "true"/"false" whichever path writes it, which is also how CogniCore
+// JSON-encodes the flag (go-redis would otherwise write a plain bool as "1"/"0")
+type AuthFlag bool
+
+func (a AuthFlag) MarshalBinary() ([]byte, error) {
+	return strconv.AppendBool(nil, bool(a)), nil
+}
+
+func (a *AuthFlag) ScanRedis(value string) error {
+	switch value {
+	case "true", "1":
+		*a = true
+	case "false", "0", "":
+		*a = false
+	default:
+		return fmt.Errorf("invalid authenticated flag %q", value)
+	}
+	return nil
+}
+
+// ProfileData is the profile JSON, encrypted on its way into Redis with ENCRYPT_PROFILES. It's
+// hashed as plaintext, so the random nonce doesn't make every sync see a change.
+type ProfileData string
+
+func (p ProfileData) MarshalBinary() ([]byte, error) {
+	if !cfg.EncryptProfiles {
+		return []byte(p), nil
+	}
+	sealed, err := sealValue(string(p))
+	return []byte(sealed), err
+}
+
+func (p *ProfileData) ScanRedis(value string) error {
+	plain, err := openValue(value)
+	*p = ProfileData(plain)
+	return err
 }
 
 type FileInfo struct {
@@ -22,5 +100,6 @@ type FileInfo struct {
 }
 
 type FlightFile struct {
-	EndTimestamp uint64 `yaml:"end_timestamp"`
+	EndTimestamp uint64        `yaml:"end_timestamp"`
+	Events       []FlightEvent `yaml:"events,omitempty"`
 }
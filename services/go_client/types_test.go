@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAuthFlagEncoding(t *testing.T) {
+	for _, flag := range []AuthFlag{true, false} {
+		data, err := flag.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		if want := map[AuthFlag]string{true: "true", false: "false"}[flag]; string(data) != want {
+			t.Errorf("%v marshals to %q, want %q", flag, data, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		value string
+		want  AuthFlag
+		err   bool
+	}{
+		{"true", true, false},
+		{"false", false, false},
+		// Written by older versions as a plain bool
+		{"1", true, false},
+		{"0", false, false},
+		{"", false, false},
+		{"yes", false, true},
+		{"True", false, true},
+	} {
+		flag := !tt.want
+		err := flag.ScanRedis(tt.value)
+		if (err != nil) != tt.err || (err == nil && flag != tt.want) {
+			t.Errorf("ScanRedis(%q) = %v, %v; want %v (error: %v)", tt.value, flag, err, tt.want, tt.err)
+		}
+	}
+}
+
+// Every path that writes the authenticated flag stores it as "true"/"false", and the shutdown path
+// reads those back
+func TestAuthFlagStoredAsString(t *testing.T) {
+	const flight_id = "1700000000000000000"
+	setup := func(t *testing.T) (*fakeRedis, *fakeCloud) {
+		useConfig(t, map[string]string{"FINALIZE_FLIGHTS_ON_SHUTDOWN": "true"})
+		fr := newFakeRedis(t)
+		cloud := newFakeCloud(t)
+		cloud.addPilot("alice", "name: Alice\n", []float64{1, 2})
+		cloud.setFile(flightFile(flight_id), "end_timestamp: 0\n")
+		cloud.setFile(flightMarker(flight_id, "open"), "")
+		return fr, cloud
+	}
+	request := map[string]string{"pilot_username": "alice"}
+	authenticated := func(t *testing.T, fr *fakeRedis, want string) {
+		t.Helper()
+		if got := fr.hash(0, pilotKey("alice"))["authenticated"]; got != want {
+			t.Fatalf("authenticated = %q, want %q", got, want)
+		}
+	}
+
+	t.Run("request", func(t *testing.T) {
+		fr, cloud := setup(t)
+		rdb := fr.client(0)
+		sessions := newTestSessions(cloud.URL)
+		HandlePilotRequest(context.Background(), rdb, sessions, request)
+		authenticated(t, fr, "true")
+
+		HandleDeauthRequest(rdb, sessions, "alice")
+		authenticated(t, fr, "false")
+	})
+
+	t.Run("request without the cloud", func(t *testing.T) {
+		fr, cloud := setup(t)
+		cloud.setDown(true)
+		HandlePilotRequest(context.Background(), fr.client(0), newTestSessions(cloud.URL), request)
+		authenticated(t, fr, "true")
+	})
+
+	t.Run("request with a failed fetch", func(t *testing.T) {
+		fr, cloud := setup(t)
+		cloud.setHandler(func(command, stdin string) (string, string, int, bool) {
+			if strings.HasPrefix(command, "cat /home/alice/") {
+				return "", "cat: permission denied\n", 1, true
+			}
+			return "", "", 0, false
+		})
+		HandlePilotRequest(context.Background(), fr.client(0), newTestSessions(cloud.URL), request)
+		authenticated(t, fr, "true")
+		if got := fr.hash(0, pilotKey("alice"))["flight_id"]; got != flight_id {
+			t.Fatalf("flight_id = %q, want %s", got, flight_id)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		fr, cloud := setup(t)
+		rdb := fr.client(0)
+		sessions := newTestSessions(cloud.URL)
+		HandlePilotRequest(context.Background(), rdb, sessions, request)
+		authenticated(t, fr, "true")
+
+		finalizeActiveFlights(context.Background(), rdb, sessions)
+		if _, ok := cloud.file(flightMarker(flight_id, "ended")); !ok {
+			t.Fatal("shutdown didn't see the pilot as authenticated")
+		}
+		if got := fr.hash(0, pilotKey("alice"))["flight_id"]; got != "" {
+			t.Fatalf("finalized flight %q still on the pilot", got)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// A RunCommand or Redis call that never returns would stop SyncThread without killing the
+// process. SyncThread records when each tick starts (ticks don't queue up behind a stuck one),
+// and the watchdog complains once none has started within WATCHDOG_MULTIPLE sync periods.
+
+// last_sync_cycle is when SyncThread last started a tick, in unix nanoseconds (0 before the first)
+var last_sync_cycle atomic.Int64
+
+func markSyncCycle() {
+	last_sync_cycle.Store(time.Now().UnixNano())
+}
+
+// lastSyncCycleAge reports how long ago SyncThread last started a tick, if it has run at all
+func lastSyncCycleAge() (time.Duration, bool) {
+	last := last_sync_cycle.Load()
+	if last == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, last)), true
+}
+
+// syncStalled reports whether the watchdog would consider SyncThread wedged right now
+func syncStalled(period time.Duration) bool {
+	age, ok := lastSyncCycleAge()
+	return ok && cfg.WatchdogMultiple > 0 && age > time.Duration(cfg.WatchdogMultiple)*period
+}
+
+func SyncWatchdog(sessions *SessionManager, period time.Duration) {
+	if cfg.WatchdogMultiple <= 0 {
+		return
+	}
+
+	// Startup counts as a tick, so an initial sync that never finishes is caught too
+	last_sync_cycle.CompareAndSwap(0, time.Now().UnixNano())
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		if maintenance_active.Load() || !syncStalled(period) {
+			continue
+		}
+
+		age, _ := lastSyncCycleAge()
+		log.Printf("ERROR: no sync cycle started in %v, the sync thread looks wedged", age.Round(time.Second))
+		switch cfg.WatchdogAction {
+		case "reconnect":
+			// Closing the socket fails whatever command the sync thread is stuck on
+			sessions.Invalidate(sessions.generation())
+		case "exit":
+			log.Println("Exiting so the supervisor can restart the service")
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// useLastSyncCycle sets when the last sync cycle started (zero for never) for the rest of the test
+func useLastSyncCycle(t *testing.T, at time.Time) {
+	previous := last_sync_cycle.Load()
+	if at.IsZero() {
+		last_sync_cycle.Store(0)
+	} else {
+		last_sync_cycle.Store(at.UnixNano())
+	}
+	t.Cleanup(func() { last_sync_cycle.Store(previous) })
+}
+
+func TestSyncStalled(t *testing.T) {
+	const period = time.Minute
+	for _, tt := range []struct {
+		name     string
+		multiple string
+		ago      time.Duration
+		want     bool
+	}{
+		{"never ran", "3", 0, false},
+		{"just ran", "3", time.Second, false},
+		{"within the multiple", "3", 2 * period, false},
+		{"past the multiple", "3", 4 * period, true},
+		{"past a smaller multiple", "1", 2 * period, true},
+		{"disabled", "0", time.Hour, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, map[string]string{"WATCHDOG_MULTIPLE": tt.multiple})
+			if tt.ago == 0 {
+				useLastSyncCycle(t, time.Time{})
+			} else {
+				useLastSyncCycle(t, time.Now().Add(-tt.ago))
+			}
+			if got := syncStalled(period); got != tt.want {
+				t.Fatalf("syncStalled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthzSyncCycle(t *testing.T) {
+	useMaintenanceState(t)
+	for _, tt := range []struct {
+		name   string
+		ago    time.Duration
+		code   int
+		status string
+		age    string
+	}{
+		{"before the first cycle", 0, 200, "ok", ""},
+		{"recent cycle", 90 * time.Second, 200, "ok", "90s"},
+		{"stalled", 4 * longestSyncPeriod(), 503, "stalled", "1200s"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			if tt.ago == 0 {
+				useLastSyncCycle(t, time.Time{})
+			} else {
+				useLastSyncCycle(t, time.Now().Add(-tt.ago))
+			}
+
+			w := httptest.NewRecorder()
+			healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+			want := "^" + tt.status + "\ncloud_breaker [a-z-]+\n"
+			if tt.age != "" {
+				want += "last_sync_cycle_age " + tt.age + "\n"
+			}
+			if w.Code != tt.code || !regexp.MustCompile(want+"$").MatchString(w.Body.String()) {
+				t.Fatalf("/healthz = %d %q, want %d matching %q", w.Code, w.Body, tt.code, want)
+			}
+		})
+	}
+}
+
+func TestMarkSyncCycle(t *testing.T) {
+	useLastSyncCycle(t, time.Time{})
+	if _, ok := lastSyncCycleAge(); ok {
+		t.Fatal("cycle age reported before any cycle")
+	}
+	markSyncCycle()
+	if age, ok := lastSyncCycleAge(); !ok || age < 0 || age > time.Second {
+		t.Fatalf("cycle age right after a cycle = %v, %v", age, ok)
+	}
+}